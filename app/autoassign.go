@@ -0,0 +1,353 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+// Strategies available to auto-assignment rules (see the autoassign.*.strategy config item).
+const (
+	// autoAssignRoundRobin takes turns through the rule's reviewer list.
+	autoAssignRoundRobin = "round-robin"
+	// autoAssignLeastLoaded picks whoever on the rule's reviewer list has the fewest open
+	// review requests.
+	autoAssignLeastLoaded = "least-loaded"
+	// autoAssignOwners picks the owners of the change's modified files, according to the
+	// rule's OWNERS-style path patterns.
+	autoAssignOwners = "owners"
+)
+
+// autoAssignRule is the configuration of a named reviewer auto-assignment rule.
+type autoAssignRule struct {
+	Name      string
+	Projects  []string
+	Strategy  string
+	Reviewers []string
+	Owners    []ownersEntry
+	Count     int
+}
+
+// ownersEntry is one path pattern from an autoassign.*.owners config item, with the Gerrit
+// users who own matching files.
+type ownersEntry struct {
+	Pattern string
+	Users   []string
+}
+
+// reviewerChoice is a reviewer chosen by an auto-assignment rule, along with the reason they
+// were chosen.
+type reviewerChoice struct {
+	Username string
+	Reason   string
+}
+
+// autoAssignRules reads all configured auto-assignment rules, sorted by name. Rules with
+// invalid configuration are logged and skipped.
+func (a *App) autoAssignRules(ctx context.Context) ([]autoAssignRule, error) {
+	items, err := a.persistentDB.GetConfigWildcard(ctx, "autoassign.%.projects")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]autoAssignRule, 0, len(items))
+	for key, projects := range items {
+		if !strings.HasPrefix(key, "autoassign.") || !strings.HasSuffix(key, ".projects") {
+			// shouldn't be possible, but..
+			a.logger.Error("invalid auto-assignment config key", zap.String("config-key", key))
+			continue
+		}
+		name := key[len("autoassign.") : len(key)-len(".projects")]
+		prefix := "autoassign." + name + "."
+		rule := autoAssignRule{
+			Name:      name,
+			Projects:  splitList(projects, ","),
+			Strategy:  a.persistentDB.JustGetConfig(ctx, prefix+"strategy", autoAssignRoundRobin),
+			Reviewers: splitList(a.persistentDB.JustGetConfig(ctx, prefix+"reviewers", ""), ","),
+			Count:     a.persistentDB.JustGetConfigInt(ctx, prefix+"count", 1),
+		}
+		rule.Owners, err = parseOwners(a.persistentDB.JustGetConfig(ctx, prefix+"owners", ""))
+		if err != nil {
+			a.logger.Warn("invalid auto-assignment owners", zap.String("rule-name", name), zap.Error(err))
+			continue
+		}
+		if rule.Count < 1 {
+			rule.Count = 1
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, nil
+}
+
+// splitList splits a sep-separated list, trimming space around the elements and omitting
+// empty ones.
+func splitList(s, sep string) (list []string) {
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseOwners parses the value of an autoassign.*.owners config item, which looks like
+// "<pattern>=<user>[,<user>...] <pattern>=<user>...".
+func parseOwners(spec string) (entries []ownersEntry, err error) {
+	for _, field := range strings.Fields(spec) {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return nil, errs.New("expected <pattern>=<users>, got %q", field)
+		}
+		entry := ownersEntry{Pattern: field[:eq], Users: splitList(field[eq+1:], ",")}
+		if _, err := path.Match(entry.Pattern, ""); err != nil {
+			return nil, errs.New("bad pattern %q: %v", entry.Pattern, err)
+		}
+		if len(entry.Users) == 0 {
+			return nil, errs.New("no owners given for %q", entry.Pattern)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ownersPatternMatches determines whether an OWNERS-style path pattern applies to the given
+// file. A pattern with no slash is matched against the file's base name, so "*.proto"
+// matches proto files anywhere. Otherwise, the pattern is matched against the file's path
+// and each of its parent directories, so "storage/*" matches everything under storage/.
+func ownersPatternMatches(pattern, filePath string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(filePath))
+		if ok {
+			return true
+		}
+	}
+	for p := filePath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesProject determines whether the rule applies to changes in the given project.
+func (rule *autoAssignRule) matchesProject(project string) bool {
+	for _, pattern := range rule.Projects {
+		if globMatches(pattern, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseRoundRobin picks up to count candidates, starting at position start in the list
+// and wrapping around, skipping any in exclude. It also returns the position where the
+// next pick should start.
+func chooseRoundRobin(candidates []string, start int, exclude map[string]struct{}, count int) (choices []reviewerChoice, next int) {
+	start %= len(candidates)
+	next = start
+	for i := 0; i < len(candidates) && len(choices) < count; i++ {
+		next = (start + i + 1) % len(candidates)
+		username := candidates[(start+i)%len(candidates)]
+		if _, ok := exclude[username]; ok {
+			continue
+		}
+		choices = append(choices, reviewerChoice{Username: username, Reason: "next in rotation"})
+	}
+	return choices, next
+}
+
+// chooseLeastLoaded picks up to count candidates with the lowest load, skipping any in
+// exclude. Ties go to whoever comes first in the candidate list.
+func chooseLeastLoaded(candidates []string, load map[string]int, exclude map[string]struct{}, count int) (choices []reviewerChoice) {
+	eligible := make([]string, 0, len(candidates))
+	for _, username := range candidates {
+		if _, ok := exclude[username]; !ok {
+			eligible = append(eligible, username)
+		}
+	}
+	sort.SliceStable(eligible, func(i, j int) bool { return load[eligible[i]] < load[eligible[j]] })
+	for _, username := range eligible {
+		if len(choices) == count {
+			break
+		}
+		reason := fmt.Sprintf("%d open review requests", load[username])
+		if load[username] == 1 {
+			reason = "1 open review request"
+		}
+		choices = append(choices, reviewerChoice{Username: username, Reason: reason})
+	}
+	return choices
+}
+
+// chooseOwners picks up to count owners of the given files, skipping any in exclude. Owners
+// of more of the files are preferred; ties go to whoever is named first in the entries.
+func chooseOwners(entries []ownersEntry, files []string, exclude map[string]struct{}, count int) (choices []reviewerChoice) {
+	var order []string
+	covered := make(map[string]map[string]struct{})
+	patterns := make(map[string][]string)
+	for _, entry := range entries {
+		matched := false
+		for _, file := range files {
+			if !ownersPatternMatches(entry.Pattern, file) {
+				continue
+			}
+			matched = true
+			for _, username := range entry.Users {
+				if _, ok := exclude[username]; ok {
+					continue
+				}
+				if covered[username] == nil {
+					covered[username] = make(map[string]struct{})
+					order = append(order, username)
+				}
+				covered[username][file] = struct{}{}
+			}
+		}
+		if matched {
+			for _, username := range entry.Users {
+				if covered[username] != nil && !containsString(patterns[username], entry.Pattern) {
+					patterns[username] = append(patterns[username], entry.Pattern)
+				}
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return len(covered[order[i]]) > len(covered[order[j]]) })
+	for _, username := range order {
+		if len(choices) == count {
+			break
+		}
+		choices = append(choices, reviewerChoice{Username: username, Reason: "owns " + strings.Join(patterns[username], ", ")})
+	}
+	return choices
+}
+
+// autoAssignReviewers adds reviewers to a newly created change, according to the first
+// auto-assignment rule (by name) which applies to its project, and tells the owner who was
+// added and why. Nothing is done if the change already has reviewers other than its owner,
+// or if it is a work in progress. In dry-run mode the reviewers are chosen and the owner's
+// notification is recorded, but the change is left alone.
+func (a *App) autoAssignReviewers(ctx context.Context, change *events.Change, patchSet *events.PatchSet, changeInfo *gerrit.ChangeInfo) {
+	if change.WIP || change.Private {
+		return
+	}
+	exclude := map[string]struct{}{change.Owner.Username: {}}
+	for _, reviewer := range changeInfo.Reviewers["REVIEWER"] {
+		if reviewer.Username != change.Owner.Username {
+			return
+		}
+	}
+	for _, cc := range changeInfo.Reviewers["CC"] {
+		exclude[cc.Username] = struct{}{}
+	}
+
+	rules, err := a.autoAssignRules(ctx)
+	if err != nil {
+		a.logger.Error("failed to read auto-assignment rules", zap.Error(err))
+		return
+	}
+	var rule *autoAssignRule
+	for i := range rules {
+		if rules[i].matchesProject(change.Project) {
+			rule = &rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return
+	}
+	logger := a.logger.With(zap.String("rule-name", rule.Name), zap.String("change-id", change.BestID()))
+
+	choices, err := a.chooseReviewers(ctx, rule, change, patchSet, exclude)
+	if err != nil {
+		logger.Error("failed to choose reviewers", zap.Error(err))
+		return
+	}
+	if len(choices) == 0 {
+		logger.Info("auto-assignment rule found no eligible reviewers")
+		return
+	}
+
+	gerritClient := a.getGerritClient()
+	dryRun := a.isDryRun(ctx)
+	var added []string
+	for _, choice := range choices {
+		if dryRun {
+			logger.Info("dry run: not auto-assigning reviewer", zap.String("reviewer", choice.Username), zap.String("reason", choice.Reason))
+		} else if err := gerritClient.AddReviewer(ctx, change.BestID(), choice.Username); err != nil {
+			logger.Error("failed to add reviewer", zap.String("reviewer", choice.Username), zap.Error(err))
+			continue
+		} else {
+			logger.Info("auto-assigned reviewer", zap.String("reviewer", choice.Username), zap.String("reason", choice.Reason))
+		}
+		added = append(added, fmt.Sprintf("• %s (%s)", a.prepareUserLink(ctx, &events.Account{Username: choice.Username}), choice.Reason))
+	}
+	if len(added) == 0 {
+		return
+	}
+	a.notify(ctx, &change.Owner, change, notifyReviewerAdded, fmt.Sprintf(
+		"I added reviewers to your change %s, following the %s rule %s:\n%s",
+		a.formatChangeLink(change), rule.Strategy, a.fmt.FormatCode(rule.Name), strings.Join(added, "\n")))
+}
+
+// chooseReviewers applies the rule's strategy to pick reviewers for a change.
+func (a *App) chooseReviewers(ctx context.Context, rule *autoAssignRule, change *events.Change, patchSet *events.PatchSet, exclude map[string]struct{}) ([]reviewerChoice, error) {
+	gerritClient := a.getGerritClient()
+	switch rule.Strategy {
+	case autoAssignRoundRobin:
+		if len(rule.Reviewers) == 0 {
+			return nil, nil
+		}
+		start, err := a.persistentDB.GetRoundRobinPosition(ctx, rule.Name)
+		if err != nil {
+			return nil, err
+		}
+		choices, next := chooseRoundRobin(rule.Reviewers, start, exclude, rule.Count)
+		if a.isDryRun(ctx) {
+			// nobody was really assigned, so it is still the same reviewers' turn
+			return choices, nil
+		}
+		if err := a.persistentDB.SetRoundRobinPosition(ctx, rule.Name, next); err != nil {
+			return nil, err
+		}
+		return choices, nil
+	case autoAssignLeastLoaded:
+		load := make(map[string]int)
+		for _, username := range rule.Reviewers {
+			if _, ok := exclude[username]; ok {
+				continue
+			}
+			query := fmt.Sprintf("is:open reviewer:%q -owner:%q", username, username)
+			changes, _, err := gerritClient.QueryChangesEx(ctx, []string{query}, &gerrit.QueryChangesOpts{})
+			if err != nil {
+				return nil, errs.New("counting open reviews for %q: %w", username, err)
+			}
+			load[username] = len(changes)
+		}
+		return chooseLeastLoaded(rule.Reviewers, load, exclude, rule.Count), nil
+	case autoAssignOwners:
+		fileMap, err := gerritClient.ListRevisionFiles(ctx, change.BestID(), strconv.Itoa(patchSet.Number))
+		if err != nil {
+			return nil, errs.New("listing modified files: %w", err)
+		}
+		files := make([]string, 0, len(fileMap))
+		for file := range fileMap {
+			// skip magic entries like /COMMIT_MSG
+			if !strings.HasPrefix(file, "/") {
+				files = append(files, file)
+			}
+		}
+		sort.Strings(files)
+		return chooseOwners(rule.Owners, files, exclude, rule.Count), nil
+	}
+	return nil, errs.New("unknown strategy %q", rule.Strategy)
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOwners(t *testing.T) {
+	entries, err := parseOwners("satellite/=alice,bob  *.proto=carol storage/piece*=dave")
+	require.NoError(t, err)
+	assert.Equal(t, []ownersEntry{
+		{Pattern: "satellite/", Users: []string{"alice", "bob"}},
+		{Pattern: "*.proto", Users: []string{"carol"}},
+		{Pattern: "storage/piece*", Users: []string{"dave"}},
+	}, entries)
+
+	_, err = parseOwners("satellite")
+	require.Error(t, err)
+	_, err = parseOwners("satellite=")
+	require.Error(t, err)
+	_, err = parseOwners("[abc=alice")
+	require.Error(t, err)
+}
+
+func TestOwnersPatternMatches(t *testing.T) {
+	for i, test := range []struct {
+		pattern  string
+		filePath string
+		expected bool
+	}{
+		{"*.proto", "pb/metainfo.proto", true},
+		{"*.proto", "metainfo.proto", true},
+		{"*.proto", "pb/metainfo.go", false},
+		{"satellite/", "satellite/metainfo/endpoint.go", true},
+		{"satellite", "satellite/metainfo/endpoint.go", true},
+		{"satellite/metainfo", "satellite/metainfo/endpoint.go", true},
+		{"satellite/metainfo", "satellite/orders/endpoint.go", false},
+		{"storage/piece*", "storage/piecestore/store.go", true},
+		{"storage/piece*", "private/storage/piecestore/store.go", false},
+		{"Makefile", "Makefile", true},
+	} {
+		assert.Equalf(t, test.expected, ownersPatternMatches(test.pattern, test.filePath), "test case %d", i)
+	}
+}
+
+func TestChooseReviewers(t *testing.T) {
+	candidates := []string{"alice", "bob", "carol", "dave"}
+	exclude := map[string]struct{}{"bob": {}}
+
+	t.Run("round-robin", func(t *testing.T) {
+		choices, next := chooseRoundRobin(candidates, 0, exclude, 2)
+		assert.Equal(t, []string{"alice", "carol"}, usernamesOf(choices))
+		assert.Equal(t, 3, next)
+		choices, next = chooseRoundRobin(candidates, 7, exclude, 2)
+		assert.Equal(t, []string{"dave", "alice"}, usernamesOf(choices))
+		assert.Equal(t, 1, next)
+		choices, next = chooseRoundRobin(candidates, 0, exclude, 10)
+		assert.Equal(t, []string{"alice", "carol", "dave"}, usernamesOf(choices))
+		assert.Equal(t, 0, next)
+	})
+
+	t.Run("least-loaded", func(t *testing.T) {
+		load := map[string]int{"alice": 4, "bob": 0, "carol": 1, "dave": 1}
+		choices := chooseLeastLoaded(candidates, load, exclude, 2)
+		assert.Equal(t, []reviewerChoice{
+			{Username: "carol", Reason: "1 open review request"},
+			{Username: "dave", Reason: "1 open review request"},
+		}, choices)
+	})
+
+	t.Run("owners", func(t *testing.T) {
+		entries := []ownersEntry{
+			{Pattern: "satellite/", Users: []string{"alice", "bob"}},
+			{Pattern: "*.proto", Users: []string{"carol"}},
+			{Pattern: "satellite/metainfo", Users: []string{"carol", "dave"}},
+		}
+		files := []string{"satellite/metainfo/endpoint.go", "satellite/metainfo/metainfo.proto", "pb/piecestore.proto", "README.md"}
+		choices := chooseOwners(entries, files, exclude, 2)
+		assert.Equal(t, []reviewerChoice{
+			{Username: "carol", Reason: "owns *.proto, satellite/metainfo"},
+			{Username: "alice", Reason: "owns satellite/"},
+		}, choices)
+
+		assert.Empty(t, chooseOwners(entries, []string{"README.md"}, exclude, 2))
+	})
+}
+
+func usernamesOf(choices []reviewerChoice) (usernames []string) {
+	for _, choice := range choices {
+		usernames = append(usernames, choice.Username)
+	}
+	return usernames
+}
@@ -0,0 +1,331 @@
+package app
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+)
+
+// buildStatus is the kind of build progress reported in a comment from a CI robot user.
+type buildStatus string
+
+const (
+	buildStarted       = buildStatus("start")
+	buildSucceeded     = buildStatus("success")
+	buildFailed        = buildStatus("fail")
+	buildAborted       = buildStatus("abort")
+	buildTypeTriggered = buildStatus("type-triggered")
+	buildTypeStarted   = buildStatus("type-start")
+	buildTypeFailed    = buildStatus("type-fail")
+	buildTypeSucceeded = buildStatus("type-success")
+)
+
+// buildReport is the build progress found in a comment from a CI robot user.
+type buildReport struct {
+	Status buildStatus
+	// BuildType names the part of the build (such as a job or workflow) being reported on,
+	// for the type-* statuses.
+	BuildType string
+	// Link points to the build, if the comment gave one.
+	Link string
+}
+
+// ciParser recognizes the build progress comments which a CI system posts on changes.
+type ciParser interface {
+	// ParseComment interprets a comment from a CI robot user, from which the "Patch Set N:"
+	// line and any votes have already been removed. It returns false if the comment is not
+	// a build report.
+	ParseComment(comment string) (buildReport, bool)
+}
+
+// ciParserFunc lets an ordinary function be used as a ciParser.
+type ciParserFunc func(comment string) (buildReport, bool)
+
+// ParseComment calls f(comment).
+func (f ciParserFunc) ParseComment(comment string) (buildReport, bool) {
+	return f(comment)
+}
+
+// Built-in CI parsers, which can be named in the ci-robots.*.parser config item. A parser
+// defined with ci-parsers.* config items can not use one of these names.
+const (
+	ciParserJenkins       = "jenkins"
+	ciParserZuul          = "zuul"
+	ciParserBuildkite     = "buildkite"
+	ciParserGitHubActions = "github-actions"
+)
+
+var builtinCIParsers = map[string]ciParser{
+	ciParserJenkins:       ciParserFunc(parseJenkinsComment),
+	ciParserZuul:          ciParserFunc(parseZuulComment),
+	ciParserBuildkite:     ciParserFunc(parseBuildkiteComment),
+	ciParserGitHubActions: ciParserFunc(parseGitHubActionsComment),
+}
+
+// ciParserStatuses are the statuses which a parser defined with ci-parsers.* config items
+// can recognize, in the order they are tried, along with the status reported when the
+// pattern has a "type" group.
+var ciParserStatuses = []struct {
+	Key        string
+	Status     buildStatus
+	TypeStatus buildStatus
+}{
+	{"triggered", buildTypeTriggered, buildTypeTriggered},
+	{"started", buildStarted, buildTypeStarted},
+	{"succeeded", buildSucceeded, buildTypeSucceeded},
+	{"failed", buildFailed, buildTypeFailed},
+	{"aborted", buildAborted, buildTypeFailed},
+}
+
+var (
+	generalRobotCommentRegexp = regexp.MustCompile(`(?s)^Patch Set [1-9][0-9]*:(?: +(?:[_A-Za-z0-9][-_A-Za-z0-9 ]*[-+][0-9]+|[-+][_A-Za-z0-9][-_A-Za-z0-9 ]*))? *\n *\n(.*)$`)
+
+	// comments from the Jenkins Gerrit Trigger plugin
+	buildStartedRegexp    = regexp.MustCompile(`^ *Build Started +(https?:\S+)\s*$`)
+	buildSuccessfulRegexp = regexp.MustCompile(`^ *Build Successful *\n *\n(https?:\S+) : SUCCESS\s*$`)
+	buildFailedRegexp     = regexp.MustCompile(`^ *Build Failed *\n *\n(https?:\S+) : (FAILURE|ABORTED)\s*$`)
+
+	buildTypeTriggeredRegexp  = regexp.MustCompile(`^ *triggering build (.+)\.\.\.\s*$`)
+	buildTypeStartedRegexp    = regexp.MustCompile(`^ *build (.+) is started: +(https?:\S+)\s*$`)
+	buildTypeFailedRegexp     = regexp.MustCompile(`^ *build (.+) is failed: +(https?:\S+)\s*$`)
+	buildTypeSuccessfulRegexp = regexp.MustCompile(`^ *build (.+) is finished successfully: +(https?:\S+)\s*$`)
+
+	// comments from Zuul, with its default start, success and failure messages
+	zuulStartRegexp    = regexp.MustCompile(`^ *Starting [-_A-Za-z0-9]+ jobs\.`)
+	zuulResultRegexp   = regexp.MustCompile(`^ *Build (succeeded|failed|canceled)\b`)
+	zuulBuildsetRegexp = regexp.MustCompile(`(?m)^ *(https?:\S+/buildset/\S+)\s*$`)
+	zuulJobRegexp      = regexp.MustCompile(`(?m)^- +\S+ +(https?:\S+) +: +([A-Z_]+)\b`)
+
+	// comments like "Build #123 passed: https://buildkite.com/org/pipeline/builds/123"
+	buildkiteRegexp = regexp.MustCompile(`(?is)^ *(?:buildkite +)?build +#?[0-9]+ +(?:is +)?(scheduled|started|running|passed|failed|canceled|cancelled)\b.*?(https?:\S+)`)
+
+	// comments like "Workflow CI / test success: https://github.com/org/repo/actions/runs/1",
+	// using GitHub's check run statuses and conclusions
+	gitHubActionsRegexp = regexp.MustCompile(`(?i)^ *(?:workflow|job|check) +"?(.+?)"? +(queued|requested|in_progress|success|failure|timed_out|cancelled):? *(https?:\S+)?\s*$`)
+
+	anyLinkRegexp = regexp.MustCompile(`https?:[^\s<>|]+`)
+)
+
+// parseRobotComment removes the "Patch Set N:" line (and any votes) from a comment posted by
+// a CI robot user, and interprets the rest with the given parser.
+func parseRobotComment(parser ciParser, comment string) (buildReport, bool) {
+	subMatches := generalRobotCommentRegexp.FindStringSubmatch(comment)
+	if subMatches == nil {
+		return buildReport{}, false
+	}
+	return parser.ParseComment(subMatches[1])
+}
+
+// parseJenkinsComment recognizes comments from the Jenkins Gerrit Trigger plugin.
+func parseJenkinsComment(comment string) (buildReport, bool) {
+	if subMatches := buildStartedRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildStarted, Link: subMatches[1]}, true
+	} else if subMatches = buildSuccessfulRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildSucceeded, Link: subMatches[1]}, true
+	} else if subMatches = buildFailedRegexp.FindStringSubmatch(comment); subMatches != nil {
+		if subMatches[2] == "ABORTED" {
+			return buildReport{Status: buildAborted, Link: subMatches[1]}, true
+		}
+		return buildReport{Status: buildFailed, Link: subMatches[1]}, true
+	} else if subMatches = buildTypeTriggeredRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildTypeTriggered, BuildType: subMatches[1]}, true
+	} else if subMatches = buildTypeStartedRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildTypeStarted, BuildType: subMatches[1], Link: subMatches[2]}, true
+	} else if subMatches = buildTypeFailedRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildTypeFailed, BuildType: subMatches[1], Link: subMatches[2]}, true
+	} else if subMatches = buildTypeSuccessfulRegexp.FindStringSubmatch(comment); subMatches != nil {
+		return buildReport{Status: buildTypeSucceeded, BuildType: subMatches[1], Link: subMatches[2]}, true
+	}
+	return buildReport{}, false
+}
+
+// parseZuulComment recognizes the start and result comments from Zuul. The link given for a
+// result is the buildset page if Zuul included it, or else the first job which did not
+// succeed (for failures) or the first job.
+func parseZuulComment(comment string) (buildReport, bool) {
+	if zuulStartRegexp.MatchString(comment) {
+		return buildReport{Status: buildStarted, Link: anyLinkRegexp.FindString(comment)}, true
+	}
+	subMatches := zuulResultRegexp.FindStringSubmatch(comment)
+	if subMatches == nil {
+		return buildReport{}, false
+	}
+	report := buildReport{Status: buildSucceeded}
+	switch subMatches[1] {
+	case "failed":
+		report.Status = buildFailed
+	case "canceled":
+		report.Status = buildAborted
+	}
+	if buildset := zuulBuildsetRegexp.FindStringSubmatch(comment); buildset != nil {
+		report.Link = buildset[1]
+		return report, true
+	}
+	for _, job := range zuulJobRegexp.FindAllStringSubmatch(comment, -1) {
+		if report.Link == "" {
+			report.Link = job[1]
+		}
+		if report.Status == buildFailed && job[2] != "SUCCESS" {
+			report.Link = job[1]
+			break
+		}
+	}
+	return report, true
+}
+
+// parseBuildkiteComment recognizes comments like "Build #123 passed: <link>", as posted by
+// Buildkite notification hooks.
+func parseBuildkiteComment(comment string) (buildReport, bool) {
+	subMatches := buildkiteRegexp.FindStringSubmatch(comment)
+	if subMatches == nil {
+		return buildReport{}, false
+	}
+	report := buildReport{Link: subMatches[2]}
+	switch strings.ToLower(subMatches[1]) {
+	case "scheduled", "started", "running":
+		report.Status = buildStarted
+	case "passed":
+		report.Status = buildSucceeded
+	case "failed":
+		report.Status = buildFailed
+	default:
+		report.Status = buildAborted
+	}
+	return report, true
+}
+
+// parseGitHubActionsComment recognizes comments like "Workflow <name> <status>: <link>",
+// where the status is a GitHub check run status or conclusion. Each workflow is reported as
+// a build type; cancelled and timed-out workflows count as failures.
+func parseGitHubActionsComment(comment string) (buildReport, bool) {
+	subMatches := gitHubActionsRegexp.FindStringSubmatch(comment)
+	if subMatches == nil {
+		return buildReport{}, false
+	}
+	report := buildReport{BuildType: subMatches[1], Link: subMatches[3]}
+	switch strings.ToLower(subMatches[2]) {
+	case "queued", "requested":
+		report.Status = buildTypeTriggered
+	case "in_progress":
+		report.Status = buildTypeStarted
+	case "success":
+		report.Status = buildTypeSucceeded
+	default:
+		report.Status = buildTypeFailed
+	}
+	return report, true
+}
+
+// regexpCIParser is a CI parser defined with ci-parsers.* config items. Its patterns are tried
+// in the order of ciParserStatuses. A pattern's "link" group gives the link to the build (if
+// there is no such group, the first link in the match is used), and a "type" group gives the
+// build type, making the report one of the type-* statuses.
+type regexpCIParser []regexpCIParserRule
+
+// regexpCIParserRule is one pattern of a regexpCIParser, and the status it reports.
+type regexpCIParserRule struct {
+	Pattern    *regexp.Regexp
+	Status     buildStatus
+	TypeStatus buildStatus
+}
+
+// ParseComment implements ciParser.
+func (p regexpCIParser) ParseComment(comment string) (buildReport, bool) {
+	for _, rule := range p {
+		subMatches := rule.Pattern.FindStringSubmatch(comment)
+		if subMatches == nil {
+			continue
+		}
+		report := buildReport{Status: rule.Status}
+		if i := rule.Pattern.SubexpIndex("type"); i >= 0 && subMatches[i] != "" {
+			report.Status = rule.TypeStatus
+			report.BuildType = subMatches[i]
+		}
+		if i := rule.Pattern.SubexpIndex("link"); i >= 0 {
+			report.Link = subMatches[i]
+		} else {
+			report.Link = anyLinkRegexp.FindString(subMatches[0])
+		}
+		return report, true
+	}
+	return buildReport{}, false
+}
+
+// ciParser returns the built-in CI parser with the given name, or else the one defined by the
+// ci-parsers.<name>.* config items.
+func (a *App) ciParser(ctx context.Context, name string) (ciParser, error) {
+	if parser, ok := builtinCIParsers[name]; ok {
+		return parser, nil
+	}
+	var parser regexpCIParser
+	for _, status := range ciParserStatuses {
+		pattern := a.persistentDB.JustGetConfig(ctx, "ci-parsers."+name+"."+status.Key, "")
+		if pattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errs.New("bad ci-parsers.%s.%s pattern: %v", name, status.Key, err)
+		}
+		if status.Status == buildTypeTriggered && compiled.SubexpIndex("type") < 0 {
+			return nil, errs.New("ci-parsers.%s.%s pattern needs a (?P<type>...) group", name, status.Key)
+		}
+		parser = append(parser, regexpCIParserRule{Pattern: compiled, Status: status.Status, TypeStatus: status.TypeStatus})
+	}
+	if len(parser) == 0 {
+		return nil, errs.New("no CI parser named %q (built-in parsers are %s)", name, strings.Join(builtinCIParserNames(), ", "))
+	}
+	return parser, nil
+}
+
+func builtinCIParserNames() []string {
+	return []string{ciParserJenkins, ciParserZuul, ciParserBuildkite, ciParserGitHubActions}
+}
+
+// ciRobotParser determines whether the given Gerrit user is a CI robot, and if so, returns
+// the parser for its comments along with the string transformation to apply to its build
+// links. Robots are configured with ci-robots.<username>.parser; users listed in
+// jenkins-robot-user use the Jenkins parser unless configured otherwise.
+func (a *App) ciRobotParser(ctx context.Context, username string) (parser ciParser, linkTransformer string) {
+	if username == "" {
+		return nil, ""
+	}
+	parserName := a.persistentDB.JustGetConfig(ctx, "ci-robots."+username+".parser", "")
+	if commaSeparatedListContains(a.persistentDB.JustGetConfig(ctx, "jenkins-robot-user", ""), username) {
+		if parserName == "" {
+			parserName = ciParserJenkins
+		}
+		linkTransformer = a.persistentDB.JustGetConfig(ctx, "jenkins-link-transformer", "")
+	}
+	if parserName == "" {
+		return nil, ""
+	}
+	parser, err := a.ciParser(ctx, parserName)
+	if err != nil {
+		a.logger.Warn("CI robot user has a bad parser configured", zap.String("gerrit-username", username), zap.Error(err))
+		return nil, ""
+	}
+	return parser, a.persistentDB.JustGetConfig(ctx, "ci-robots."+username+".link-transformer", linkTransformer)
+}
+
+// ciRobotUsernames returns the Gerrit usernames of all configured CI robot users.
+func (a *App) ciRobotUsernames(ctx context.Context) []string {
+	usernames := splitList(a.persistentDB.JustGetConfig(ctx, "jenkins-robot-user", ""), ",")
+	items, err := a.persistentDB.GetConfigWildcard(ctx, "ci-robots.%.parser")
+	if err != nil {
+		a.logger.Error("failed to look up CI robot users", zap.Error(err))
+	}
+	for key := range items {
+		if !strings.HasPrefix(key, "ci-robots.") || !strings.HasSuffix(key, ".parser") {
+			continue
+		}
+		username := key[len("ci-robots.") : len(key)-len(".parser")]
+		if !containsString(usernames, username) {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+func TestBuiltinCIParsers(t *testing.T) {
+	for i, test := range []struct {
+		parser   string
+		comment  string
+		expected buildReport
+		ok       bool
+	}{
+		{ciParserJenkins, "Patch Set 2:\n\nBuild Started https://build.jorts.io/job/1", buildReport{Status: buildStarted, Link: "https://build.jorts.io/job/1"}, true},
+		{ciParserJenkins, "Patch Set 2: Verified-1\n\nBuild Failed \n\nhttps://build.jorts.io/job/1 : ABORTED", buildReport{Status: buildAborted, Link: "https://build.jorts.io/job/1"}, true},
+		{ciParserJenkins, "Patch Set 2:\n\nbuild lint is failed: https://build.jorts.io/job/2", buildReport{Status: buildTypeFailed, BuildType: "lint", Link: "https://build.jorts.io/job/2"}, true},
+		{ciParserJenkins, "Patch Set 2:\n\nBuild succeeded (check pipeline).", buildReport{}, false},
+
+		{ciParserZuul, "Patch Set 3:\n\nStarting check jobs.", buildReport{Status: buildStarted}, true},
+		{ciParserZuul, "Patch Set 3: Verified+1\n\nBuild succeeded (check pipeline).\n\nhttps://zuul.jorts.io/t/jorts/buildset/abc\n\n- tox-py38 https://zuul.jorts.io/t/jorts/build/1 : SUCCESS in 3m 02s",
+			buildReport{Status: buildSucceeded, Link: "https://zuul.jorts.io/t/jorts/buildset/abc"}, true},
+		{ciParserZuul, "Patch Set 3: Verified-1\n\nBuild failed (gate pipeline).\n\n- tox-py38 https://zuul.jorts.io/t/jorts/build/1 : SUCCESS in 3m 02s\n- tox-pep8 https://zuul.jorts.io/t/jorts/build/2 : FAILURE in 1m 10s",
+			buildReport{Status: buildFailed, Link: "https://zuul.jorts.io/t/jorts/build/2"}, true},
+		{ciParserZuul, "Patch Set 3:\n\nlooks good to me", buildReport{}, false},
+
+		{ciParserBuildkite, "Patch Set 1:\n\nBuild #123 started: https://buildkite.com/jorts/exandria/builds/123", buildReport{Status: buildStarted, Link: "https://buildkite.com/jorts/exandria/builds/123"}, true},
+		{ciParserBuildkite, "Patch Set 1: Verified+1\n\nBuild #123 passed\n\nhttps://buildkite.com/jorts/exandria/builds/123", buildReport{Status: buildSucceeded, Link: "https://buildkite.com/jorts/exandria/builds/123"}, true},
+		{ciParserBuildkite, "Patch Set 1:\n\nBuild #124 canceled: https://buildkite.com/jorts/exandria/builds/124", buildReport{Status: buildAborted, Link: "https://buildkite.com/jorts/exandria/builds/124"}, true},
+		{ciParserBuildkite, "Patch Set 1:\n\nBuild #124 passed", buildReport{}, false},
+
+		{ciParserGitHubActions, "Patch Set 1:\n\nWorkflow CI / test queued", buildReport{Status: buildTypeTriggered, BuildType: "CI / test"}, true},
+		{ciParserGitHubActions, "Patch Set 1:\n\nworkflow \"lint\" in_progress: https://github.com/jorts/exandria/actions/runs/7", buildReport{Status: buildTypeStarted, BuildType: "lint", Link: "https://github.com/jorts/exandria/actions/runs/7"}, true},
+		{ciParserGitHubActions, "Patch Set 1:\n\nJob build timed_out: https://github.com/jorts/exandria/actions/runs/8", buildReport{Status: buildTypeFailed, BuildType: "build", Link: "https://github.com/jorts/exandria/actions/runs/8"}, true},
+		{ciParserGitHubActions, "Patch Set 1:\n\nWorkflow CI exploded", buildReport{}, false},
+	} {
+		report, ok := parseRobotComment(builtinCIParsers[test.parser], test.comment)
+		assert.Equalf(t, test.ok, ok, "test case %d", i)
+		assert.Equalf(t, test.expected, report, "test case %d", i)
+	}
+}
+
+func TestCIRobotConfig(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		a := &App{logger: zaptest.NewLogger(t), fmt: &slack.Formatter{}, persistentDB: db, reconfigureChannel: make(chan struct{}, 1)}
+		require.NoError(t, db.SetConfig(ctx, "jenkins-robot-user", "doty2.0,doty3.0"))
+		require.NoError(t, db.SetConfig(ctx, "jenkins-link-transformer", "s,https://build.dev.jorts.io/(.*),https://changedhost/$1,"))
+
+		// a parser can't be used before it is defined
+		require.Error(t, a.setConfigItem(ctx, "ci-robots.pike.parser", "cleric"))
+		require.Error(t, a.setConfigItem(ctx, "ci-parsers.cleric.failed", "Heal(ing"))
+		require.Error(t, a.setConfigItem(ctx, "ci-parsers.cleric.triggered", "Praying"))
+		require.NoError(t, a.setConfigItem(ctx, "ci-parsers.cleric.started", `^Healing (?P<type>\w+) began.*`))
+		require.NoError(t, a.setConfigItem(ctx, "ci-parsers.cleric.failed", `^Healing failed \((?P<link>[^)]+)\)`))
+		require.NoError(t, a.setConfigItem(ctx, "ci-robots.pike.parser", "cleric"))
+		require.NoError(t, a.setConfigItem(ctx, "ci-robots.pike.link-transformer", "s,^,https://temple/,"))
+		require.NoError(t, a.setConfigItem(ctx, "ci-robots.doty3.0.parser", ciParserZuul))
+
+		parser, linkTransformer := a.ciRobotParser(ctx, "pike")
+		require.NotNil(t, parser)
+		assert.Equal(t, "s,^,https://temple/,", linkTransformer)
+		report, ok := parseRobotComment(parser, "Patch Set 1:\n\nHealing Grog began https://temple/1")
+		require.True(t, ok)
+		assert.Equal(t, buildReport{Status: buildTypeStarted, BuildType: "Grog", Link: "https://temple/1"}, report)
+		report, ok = parseRobotComment(parser, "Patch Set 1: Verified-1\n\nHealing failed (job/2)")
+		require.True(t, ok)
+		assert.Equal(t, buildReport{Status: buildFailed, Link: "job/2"}, report)
+		_, ok = parseRobotComment(parser, "Patch Set 1:\n\nBuild Started https://build.jorts.io/job/1")
+		assert.False(t, ok)
+
+		// jenkins-robot-user entries default to the Jenkins parser, but can be changed
+		parser, linkTransformer = a.ciRobotParser(ctx, "doty2.0")
+		require.NotNil(t, parser)
+		assert.Equal(t, "s,https://build.dev.jorts.io/(.*),https://changedhost/$1,", linkTransformer)
+		assert.Equal(t, "started https://build.jorts.io/job/1", describeBuildComment(parser, "Patch Set 1:\n\nBuild Started https://build.jorts.io/job/1"))
+		parser, _ = a.ciRobotParser(ctx, "doty3.0")
+		require.NotNil(t, parser)
+		assert.Equal(t, "failed https://zuul.jorts.io/t/jorts/build/2", describeBuildComment(parser, "Patch Set 1:\n\nBuild failed (check pipeline).\n\n- lint https://zuul.jorts.io/t/jorts/build/2 : FAILURE in 1s"))
+
+		parser, _ = a.ciRobotParser(ctx, "scanlan")
+		assert.Nil(t, parser)
+		assert.ElementsMatch(t, []string{"doty2.0", "doty3.0", "pike"}, a.ciRobotUsernames(ctx))
+	})
+}
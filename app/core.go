@@ -5,8 +5,8 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"flag"
 	"fmt"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -18,9 +18,12 @@ import (
 	"github.com/zeebo/errs"
 	"go.uber.org/zap"
 
+	"github.com/storj/changesetchihuahua/app/dbx"
+	"github.com/storj/changesetchihuahua/config"
 	"github.com/storj/changesetchihuahua/gerrit"
 	"github.com/storj/changesetchihuahua/gerrit/events"
 	"github.com/storj/changesetchihuahua/messages"
+	"github.com/storj/changesetchihuahua/metrics"
 	"github.com/storj/changesetchihuahua/slack"
 )
 
@@ -34,14 +37,17 @@ const (
 	// defaultPerUserReviewsNeededQuery is the Gerrit query to use for determining change sets
 	// with reviews needed for a particular user.
 	defaultPerUserReviewsNeededQuery = "reviewer:\"$username\" is:open -reviewedby:\"$username\" -owner:\"$username\" -is:wip -label:Verified=-1"
+	// channelNotificationKind is the kind under which channel notifications are counted in
+	// the notification metrics, alongside the notificationKinds of direct messages.
+	channelNotificationKind = "channel"
 )
 
 var (
-	minIntervalBetweenReports = flag.Duration("min-interval-between-reports", time.Hour*10, "Minimum amount of time that must elapse before more personalized Gerrit reports are sent to a given user")
+	minIntervalBetweenReports = config.DurationFlag("min-interval-between-reports", time.Hour*10, "Minimum amount of time that must elapse before more personalized Gerrit reports are sent to a given user")
 
-	inlineCommentMaxAge = flag.Duration("inline-comment-max-age", time.Hour, "Inline comments older than this will not be reported, even if not found in the cache")
+	inlineCommentMaxAge = config.DurationFlag("inline-comment-max-age", time.Hour, "Inline comments older than this will not be reported, even if not found in the cache")
 
-	logGerritUsage = flag.Bool("log-gerrit-usage", false, "If given, log all requests and responses to and from Gerrit")
+	logGerritUsage = config.BoolFlag("log-gerrit-usage", false, "If given, log all requests and responses to and from Gerrit")
 )
 
 const (
@@ -50,6 +56,10 @@ const (
 
 	workingDayStartHour = 9
 	workingDayEndHour   = 17
+
+	// configSyncInterval is how often PeriodicConfigSync looks for config changes made by
+	// other instances.
+	configSyncInterval = 30 * time.Second
 )
 
 type gerritConnector interface {
@@ -71,17 +81,29 @@ const (
 	ConfigItemLink
 	// ConfigItemBool indicates a config item that is expected to be a boolean.
 	ConfigItemBool
+	// ConfigItemSecret indicates a config item that is a string which should not be shown
+	// back to users.
+	ConfigItemSecret
+	// ConfigItemRegexp indicates a config item that is expected to be a regular expression.
+	ConfigItemRegexp
 )
 
+// secretConfigPlaceholder is displayed in place of the value of a ConfigItemSecret.
+const secretConfigPlaceholder = "********"
+
 type configItem struct {
 	Name        string
 	Description string
 	ItemType    configItemType
 	IsWildcard  bool
+	Choices     []string
 }
 
 var configItems = []configItem{
 	{Name: "gerrit-address", Description: "URL to your Gerrit server (e.g. `https://gerrit-review.googlesource.com/`)", ItemType: ConfigItemLink},
+	{Name: "gerrit-http-username", Description: "Gerrit username to authenticate as when making changes in Gerrit, such as adding reviewers", ItemType: ConfigItemString},
+	{Name: "gerrit-http-password", Description: "HTTP password (from the Gerrit user's settings page) for gerrit-http-username", ItemType: ConfigItemSecret},
+	{Name: "share-bot-gerrit-access", Description: "Whether everyone may use `!mine`, `!status` and `!stats` when gerrit-http-username is set. These commands then run as that user, so they can show private or restricted changes which the asker could not see in Gerrit; when this is off, only admins can use them", ItemType: ConfigItemBool},
 	{Name: "admin-ids", Description: "comma-separated list of chat IDs of admins", ItemType: ConfigItemUserList},
 	{Name: "blocklist-ids", Description: "comma-separated list of chat IDs of users to avoid messaging", ItemType: ConfigItemUserList},
 	{Name: "remove-project-prefix", Description: "a common prefix on project names which can be removed if present before displaying in links (e.g., `myCompany/`)", ItemType: ConfigItemString},
@@ -90,15 +112,37 @@ var configItems = []configItem{
 	{Name: "personal-reviews-needed-query", Description: "Gerrit query to use for determining change sets with reviews needed for a particular user", ItemType: ConfigItemString},
 	{Name: "jenkins-robot-user", Description: "Gerrit robot user that will post updates from Jenkins. If provided, these will be parsed and changed to display in a more helpful way", ItemType: ConfigItemString},
 	{Name: "jenkins-link-transformer", Description: "String transformation to apply to Jenkins links before passing them on. Looks like a sed subst command, but with $1 backreferences instead of \"\\1\"", ItemType: ConfigItemString},
+	{Name: "ci-robots.*.parser", Description: "How build reports posted by the named Gerrit robot user are recognized, so they can be displayed in a more helpful way: `jenkins`, `zuul`, `buildkite`, `github-actions`, or the name of a parser defined with `ci-parsers.*` items", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "ci-robots.*.link-transformer", Description: "String transformation to apply to build links from the named Gerrit robot user, like jenkins-link-transformer", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "ci-parsers.*.triggered", Description: "Regular expression matching comments which report that a build type has been triggered, for the named CI parser. A `(?P<type>...)` group gives the build type, and is required here", ItemType: ConfigItemRegexp, IsWildcard: true},
+	{Name: "ci-parsers.*.started", Description: "Regular expression matching comments which report that a build has started, for the named CI parser. A `(?P<link>...)` group gives the build link (otherwise the first link matched is used), and a `(?P<type>...)` group gives the build type, if the report is about one part of the build", ItemType: ConfigItemRegexp, IsWildcard: true},
+	{Name: "ci-parsers.*.succeeded", Description: "Regular expression matching comments which report that a build has succeeded, for the named CI parser, with groups as for ci-parsers.*.started", ItemType: ConfigItemRegexp, IsWildcard: true},
+	{Name: "ci-parsers.*.failed", Description: "Regular expression matching comments which report that a build has failed, for the named CI parser, with groups as for ci-parsers.*.started", ItemType: ConfigItemRegexp, IsWildcard: true},
+	{Name: "ci-parsers.*.aborted", Description: "Regular expression matching comments which report that a build was canceled, for the named CI parser, with groups as for ci-parsers.*.started", ItemType: ConfigItemRegexp, IsWildcard: true},
 	{Name: "reports.*.timeofday", Description: "The time of day (in 24-hour time HH:MM format, in UTC) when the named report should be sent each day", ItemType: ConfigItemString, IsWildcard: true},
 	{Name: "reports.*.weekends", Description: "Whether the named report should be sent on weekends", ItemType: ConfigItemBool, IsWildcard: true},
 	{Name: "reports.*.gerrit-query", Description: "Gerrit query to use for determining change sets with work needed for the named report", ItemType: ConfigItemString, IsWildcard: true},
 	{Name: "reports.*.channel", Description: "The channel to which the named report will be sent, noting which change sets have been waiting too long and who they're waiting for", ItemType: ConfigItemChannel, IsWildcard: true},
+	{Name: "autoassign.*.projects", Description: "Comma-separated list of project name patterns (shell-style globs) on which the named auto-assignment rule adds reviewers to new changes that have none", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "autoassign.*.strategy", Description: "How the named auto-assignment rule chooses reviewers", ItemType: ConfigItemString, IsWildcard: true, Choices: []string{autoAssignRoundRobin, autoAssignLeastLoaded, autoAssignOwners}},
+	{Name: "autoassign.*.reviewers", Description: "Comma-separated list of Gerrit usernames the named auto-assignment rule chooses from, for the round-robin and least-loaded strategies", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "autoassign.*.owners", Description: "Space-separated list of `<path-pattern>=<gerrit-user>[,<gerrit-user>...]` entries for the owners strategy of the named auto-assignment rule. A pattern containing no slash matches file names in any directory; otherwise it matches a file or any directory containing it, relative to the repository root", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "autoassign.*.count", Description: "How many reviewers the named auto-assignment rule should add (default 1)", ItemType: ConfigItemInt, IsWildcard: true},
+	{Name: "quiet-alert-hours", Description: "Working hours (in UTC) without any events from Gerrit after which admins are told that Gerrit may have stopped delivering events (0 or unset to disable)", ItemType: ConfigItemInt},
+	{Name: "gerrit-failure-alert-count", Description: "Number of consecutive failed Gerrit API calls after which admins are alerted (default 5; 0 to disable)", ItemType: ConfigItemInt},
+	{Name: "weekly-stats-channel", Description: "A channel to which a weekly report of review turnaround statistics should be sent", ItemType: ConfigItemChannel},
+	{Name: "sla.*.projects", Description: "Comma-separated list of project name patterns (shell-style globs) to which the named review SLA applies", ItemType: ConfigItemString, IsWildcard: true},
+	{Name: "sla.*.reminder-hours", Description: "Working hours (in the reviewer's timezone) a reviewer may leave a review request without a vote or comment before being reminded, under the named SLA", ItemType: ConfigItemInt, IsWildcard: true},
+	{Name: "sla.*.escalation-hours", Description: "Working hours (in the reviewer's timezone) a reviewer may leave a review request without a vote or comment before the change owner and the SLA channel are told, under the named SLA", ItemType: ConfigItemInt, IsWildcard: true},
+	{Name: "sla.*.channel", Description: "The channel to which escalations under the named review SLA are sent", ItemType: ConfigItemChannel, IsWildcard: true},
+	{Name: "dry-run", Description: "Whether messages and reactions should be recorded (see `!dry-run`) instead of sent, for trying out configuration changes safely", ItemType: ConfigItemBool},
+	{Name: "dry-run-channel", Description: "A channel to which messages should be sent in dry-run mode, instead of to their real recipients", ItemType: ConfigItemChannel},
 }
 
 // App represents the Changeset Chihuahua application for a particular team.
 type App struct {
 	logger       *zap.Logger
+	teamID       string
 	chat         slack.EventedChatSystem
 	fmt          messages.ChatSystemFormatter
 	persistentDB *PersistentDB
@@ -109,23 +153,41 @@ type App struct {
 
 	reporterLock sync.Mutex
 
+	statusLock       sync.Mutex
+	startTime        time.Time
+	lastReportSent   time.Time
+	eventCaptureFile string
+	// the team's health is kept in the persistent DB (see HealthState), so that the leader
+	// sees events and Gerrit failures from every instance. these track what this instance
+	// has written there, so that it need not write on every event and API call.
+	lastEventPersisted time.Time
+	gerritFailures     int
+	lastFailureReset   time.Time
+
 	// a send is done on this channel when PeriodicTeamReports may need to reread report intervals
 	reconfigureChannel chan struct{}
 
+	// configSnapshot is the team's config as of the last SyncConfig, against which the next
+	// call looks for changes.
+	configLock     sync.Mutex
+	configSnapshot map[string]string
 	// A common prefix on project names which can be removed if present before displaying in
-	// links; configure by way of remove-project-prefix config item
+	// links; configure by way of remove-project-prefix config item. Guarded by configLock,
+	// since config changes are handled while events are.
 	removeProjectPrefix string
 }
 
-// New creates a new App instance.
-func New(ctx context.Context, logger *zap.Logger, chat slack.EventedChatSystem, chatFormatter messages.ChatSystemFormatter, persistentDB *PersistentDB, gerritConnector gerritConnector) *App {
+// New creates a new App instance. The teamID is used to label the team's metrics.
+func New(ctx context.Context, logger *zap.Logger, teamID string, chat slack.EventedChatSystem, chatFormatter messages.ChatSystemFormatter, persistentDB *PersistentDB, gerritConnector gerritConnector) *App {
 	app := &App{
 		logger:             logger,
-		chat:               chat,
+		teamID:             teamID,
+		chat:               newDryRunChat(logger, chat, chatFormatter, persistentDB),
 		fmt:                chatFormatter,
 		persistentDB:       persistentDB,
 		gerritConnector:    gerritConnector,
 		reconfigureChannel: make(chan struct{}, 1),
+		startTime:          time.Now(),
 	}
 	logger.Info("team starting up")
 	chat.SetIncomingMessageCallback(app.IncomingChatCommand)
@@ -137,6 +199,7 @@ func New(ctx context.Context, logger *zap.Logger, chat slack.EventedChatSystem,
 		logger.Error("failed to initialize Gerrit configuration", zap.Error(err))
 	}
 	app.removeProjectPrefix = persistentDB.JustGetConfig(ctx, "remove-project-prefix", "")
+	app.SyncConfig(ctx)
 	return app
 }
 
@@ -187,6 +250,13 @@ func (w *waitGroup) Go(f func()) {
 	}()
 }
 
+// detach returns a context for a unit of periodic work, such as sending a report. It carries
+// ctx's values, but is not canceled along with ctx, so that when a team is shut down, work
+// which has already started is finished instead of being left half done.
+func detach(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
 const chatCommandHandlingTimeout = time.Minute * 10
 
 // Close closes an App, freeing its resources.
@@ -209,9 +279,11 @@ func (a *App) getGerritClient() gerrit.Client {
 
 // GerritEvent is called when a Gerrit event has been received related to this team.
 func (a *App) GerritEvent(ctx context.Context, event events.GerritEvent) {
+	a.noteEventReceived(ctx, time.Now())
 	if a.getGerritClient() == nil {
 		a.logger.Info("dropping event, no gerrit client", zap.String("event-type", event.GetType()))
 	}
+	a.recordEventHistory(ctx, event)
 	switch ev := event.(type) {
 	case *events.CommentAddedEvent:
 		a.CommentAdded(ctx, ev.Author, ev.Change, ev.PatchSet, ev.Comment, ev.EventCreatedAt())
@@ -249,11 +321,8 @@ func (a *App) ChatEvent(ctx context.Context, eventObj slack.ChatEvent) error {
 	err := a.chat.HandleEvent(ctx, eventObj)
 	if err != nil {
 		if errors.Is(err, slack.ErrStopTeam) {
-			a.logger.Info("uninstalled. shutting down app for team")
-			err = a.Close()
-			if err != nil {
-				a.logger.Error("failed to shut down app for team")
-			}
+			// the app is closed when the team is stopped, once other in-flight events are done
+			a.logger.Info("uninstalled. app for team will be shut down")
 			return slack.ErrStopTeam
 		}
 		a.logger.Error("failed to handle event from chat system", zap.Error(err))
@@ -271,17 +340,49 @@ func (a *App) IncomingChatCommand(userID, chanID string, isDM bool, text string)
 	if !strings.HasPrefix(text, "!") {
 		return "" // only pay attention to !-prefixed messages, for now
 	}
-	logger := a.logger.With(zap.String("user-id", userID), zap.String("chan-id", chanID), zap.String("text", text))
+	logger := a.logger.With(zap.String("user-id", userID), zap.String("chan-id", chanID), zap.String("text", redactChatCommand(text)))
 	logger.Debug("got chat command")
 	ctx, cancel := context.WithTimeout(context.Background(), chatCommandHandlingTimeout)
 	defer cancel()
 
+	parts := strings.Fields(text)
+	command := parts[0]
+
+	// commands available to all users
+	switch command {
+	case "!help":
+		return a.helpCommand(ctx, userID)
+	case "!prefs":
+		return a.userPrefsCommand(ctx, logger, userID, parts[1:])
+	case "!mine":
+		if reply := a.botAccessRefusal(ctx, userID); reply != "" {
+			return reply
+		}
+		return a.mineCommand(ctx, logger, userID)
+	case "!reviews":
+		return a.reviewsCommand(ctx, logger, userID)
+	case "!whois":
+		return a.whoisCommand(ctx, logger, parts[1:])
+	case "!link":
+		return a.linkCommand(ctx, logger, userID, parts[1:])
+	case "!unlink":
+		return a.unlinkCommand(ctx, logger, userID, parts[1:])
+	case "!status":
+		if reply := a.botAccessRefusal(ctx, userID); reply != "" {
+			return reply
+		}
+		return a.statusCommand(ctx, logger, parts[1:])
+	case "!stats":
+		if reply := a.botAccessRefusal(ctx, userID); reply != "" {
+			return reply
+		}
+		return a.statsCommand(ctx, logger, parts[1:], time.Now())
+	}
+
 	if !a.isAdminUser(ctx, userID) {
-		return "" // only pay attention to messages from admin, for now
+		return "" // only pay attention to other messages from admin, for now
 	}
 
-	parts := strings.Fields(text)
-	command := parts[0]
 	switch command {
 	case "!personal-reports":
 		logger.Info("admin requested unscheduled personal review reports")
@@ -292,12 +393,11 @@ func (a *App) IncomingChatCommand(userID, chanID string, isDM bool, text string)
 		}
 		reportName := parts[1]
 		logger.Info("admin requested unscheduled team report", zap.String("report-name", reportName))
-		report, err := a.getTeamReportConfig(ctx, reportName)
+		channelID, err := a.SendTeamReport(ctx, reportName, time.Now())
 		if err != nil {
-			return fmt.Sprintf("could not retrieve report config for %q: %v", reportName, err)
+			return err.Error()
 		}
-		a.TeamReport(ctx, time.Now(), report)
-		return fmt.Sprintf("Report sent to %s", a.fmt.FormatChannelLink(report.ChannelID))
+		return fmt.Sprintf("Report sent to %s", a.fmt.FormatChannelLink(channelID))
 	case "!assoc":
 		gerritUsername := ""
 		chatID := ""
@@ -316,6 +416,14 @@ func (a *App) IncomingChatCommand(userID, chanID string, isDM bool, text string)
 		}
 		logger.Info("admin created manual association")
 		return fmt.Sprintf("Ok, %s = %s", gerritUsername, a.fmt.FormatUserLink(chatID))
+	case "!routes":
+		return a.routesCommand(ctx, logger, parts[1:])
+	case "!identities":
+		return a.identitiesCommand(ctx, logger, text)
+	case "!dry-run":
+		return a.dryRunCommand(ctx, logger, parts[1:])
+	case "!replay-events":
+		return a.replayEventsCommand(ctx, logger, parts[1:])
 	case "!config":
 		if len(parts) < 2 {
 			return a.formatAllConfigItems(ctx)
@@ -360,11 +468,36 @@ func (a *App) formatAllConfigItems(ctx context.Context) string {
 
 	var s bytes.Buffer
 	for _, pair := range pairs {
-		s.WriteString(fmt.Sprintf("%s = %s\n", a.fmt.FormatCode(pair.key), a.fmt.FormatCode(pair.val)))
+		s.WriteString(fmt.Sprintf("%s = %s\n", a.fmt.FormatCode(pair.key), a.fmt.FormatCode(redactConfigValue(pair.key, pair.val))))
 	}
 	return s.String()
 }
 
+// isSecretConfigItem reports whether key names a ConfigItemSecret.
+func isSecretConfigItem(key string) bool {
+	configDef := findConfigItem(key)
+	return configDef != nil && configDef.ItemType == ConfigItemSecret
+}
+
+// redactConfigValue returns the value of a config item as it may be shown or logged: with
+// secretConfigPlaceholder in place of the value of a secret item.
+func redactConfigValue(key, value string) string {
+	if isSecretConfigItem(key) {
+		return secretConfigPlaceholder
+	}
+	return value
+}
+
+// redactChatCommand returns a chat command as it may be logged: with secretConfigPlaceholder
+// in place of any secret config value being set.
+func redactChatCommand(text string) string {
+	parts := strings.Fields(text)
+	if len(parts) > 2 && parts[0] == "!config" && isSecretConfigItem(parts[1]) {
+		return parts[0] + " " + parts[1] + " " + secretConfigPlaceholder
+	}
+	return text
+}
+
 func findConfigItem(key string) *configItem {
 	for _, configDef := range configItems {
 		if configDef.IsWildcard {
@@ -401,6 +534,10 @@ func (a *App) getConfigItem(ctx context.Context, key string) (string, error) {
 			userLinks = append(userLinks, a.formatUserLink(nil, userID))
 		}
 		curValue = strings.Join(userLinks, ",")
+	case ConfigItemSecret:
+		if curValue != "" {
+			curValue = secretConfigPlaceholder
+		}
 	}
 	return curValue, nil
 }
@@ -410,6 +547,9 @@ func (a *App) setConfigItem(ctx context.Context, key, value string) error {
 	if configDef == nil {
 		return errs.New("%q is not a known config item.", key)
 	}
+	if len(configDef.Choices) > 0 && !containsString(configDef.Choices, value) {
+		return errs.New("%q is not one of: %s", value, strings.Join(configDef.Choices, ", "))
+	}
 	switch configDef.ItemType {
 	case ConfigItemInt:
 		// just ensure it's valid; we'll still store it as a str
@@ -424,6 +564,10 @@ func (a *App) setConfigItem(ctx context.Context, key, value string) error {
 		}
 	case ConfigItemLink:
 		value = a.fmt.UnwrapLink(value)
+	case ConfigItemRegexp:
+		if _, err := regexp.Compile(value); err != nil {
+			return errs.New("%q is not a valid regular expression: %v", value, err)
+		}
 	case ConfigItemUserList:
 		action := "replace"
 		if strings.HasPrefix(value, "+") {
@@ -450,43 +594,138 @@ func (a *App) setConfigItem(ctx context.Context, key, value string) error {
 		oldValue := a.persistentDB.JustGetConfig(ctx, key, "")
 		value = marshalUserSet(transformUserSet(parseUserSet(oldValue), userIDs, action))
 	}
+	switch configDef.Name {
+	case "ci-robots.*.parser":
+		if _, err := a.ciParser(ctx, value); err != nil {
+			return err
+		}
+	case "ci-parsers.*.triggered":
+		if regexp.MustCompile(value).SubexpIndex("type") < 0 {
+			return errs.New("a (?P<type>...) group is needed, to give the build type")
+		}
+	}
 	err := a.persistentDB.SetConfig(ctx, key, value)
 	if err != nil {
-		a.logger.Error("failed to set config", zap.String("key", key), zap.String("value", value), zap.Error(err))
+		a.logger.Error("failed to set config", zap.String("key", key), zap.String("value", redactConfigValue(key, value)), zap.Error(err))
 		return errs.New("db error")
 	}
 
-	// a few special config items need particular handling
-	switch key {
-	case "remove-project-prefix":
-		a.removeProjectPrefix = value
-	case "gerrit-server":
-		if err := a.ConfigureGerritServer(ctx, value); err != nil {
-			a.logger.Error("failed to open new gerrit client", zap.Error(err))
-			// but don't pass this error back to caller, as the config setting was successful
+	a.configLock.Lock()
+	if a.configSnapshot != nil {
+		a.configSnapshot[key] = value
+	}
+	a.configLock.Unlock()
+	a.configChanged(ctx, []string{key})
+	return nil
+}
+
+// configChanged handles the config items which need more than rereading from the DB when
+// they change, and wakes up the report handler.
+func (a *App) configChanged(ctx context.Context, keys []string) {
+	reconnectGerrit := false
+	for _, key := range keys {
+		switch key {
+		case "remove-project-prefix":
+			prefix := a.persistentDB.JustGetConfig(ctx, key, "")
+			a.configLock.Lock()
+			a.removeProjectPrefix = prefix
+			a.configLock.Unlock()
+		case "gerrit-address", "gerrit-http-username", "gerrit-http-password":
+			reconnectGerrit = true
+		}
+	}
+	if reconnectGerrit {
+		if gerritAddress := a.persistentDB.JustGetConfig(ctx, "gerrit-address", ""); gerritAddress != "" {
+			if err := a.ConfigureGerritServer(ctx, gerritAddress); err != nil {
+				a.logger.Error("failed to open new gerrit client", zap.Error(err))
+				// but don't pass this error back to caller, as the config setting was successful
+			}
 		}
 	}
 	// Many changes in config might affect report timing, so wake up the report handler.
-	// It will reread relevant config.
-	a.reconfigureChannel <- struct{}{}
+	// It will reread relevant config. If a wakeup is already pending, that will do; and the
+	// report handler may not be running at all, when another instance is the leader.
+	select {
+	case a.reconfigureChannel <- struct{}{}:
+	default:
+	}
+}
 
-	return nil
+// PeriodicConfigSync calls SyncConfig every configSyncInterval, until ctx is canceled. Unlike
+// the other periodic work, this is needed on every instance serving the team.
+func (a *App) PeriodicConfigSync(ctx context.Context) error {
+	ticker := time.NewTicker(configSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.SyncConfig(detach(ctx))
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SyncConfig looks for changes to the team's config made since the last call, whether by
+// another instance serving the team or through the operator CLI, and handles them as though
+// they had been made here with !config.
+func (a *App) SyncConfig(ctx context.Context) {
+	items, err := a.persistentDB.GetAllConfigItems(ctx)
+	if err != nil {
+		a.logger.Error("failed to read config", zap.Error(err))
+		return
+	}
+	a.configLock.Lock()
+	previous := a.configSnapshot
+	a.configSnapshot = items
+	a.configLock.Unlock()
+	if previous == nil {
+		return
+	}
+
+	var changed []string
+	for key, value := range items {
+		if oldValue, ok := previous[key]; !ok || oldValue != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := items[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+	a.logger.Info("config changed elsewhere", zap.Strings("keys", changed))
+	a.configChanged(ctx, changed)
 }
 
 // ConfigureGerritServer updates the Gerrit server being used for this team, opening a new
-// Gerrit client. If there is already a Gerrit client handle open, it is closed first.
+// Gerrit client. If there is already a Gerrit client handle open, it is closed first. If
+// gerrit-http-username is configured, the client authenticates as that user.
 func (a *App) ConfigureGerritServer(ctx context.Context, gerritAddress string) error {
 	a.gerritLock.Lock()
 	defer a.gerritLock.Unlock()
 
 	a.logger.Info("updating gerrit-server", zap.String("new address", gerritAddress))
+	if username := a.persistentDB.JustGetConfig(ctx, "gerrit-http-username", ""); username != "" {
+		addressURL, err := url.Parse(gerritAddress)
+		if err != nil {
+			return err
+		}
+		addressURL.User = url.UserPassword(username, a.persistentDB.JustGetConfig(ctx, "gerrit-http-password", ""))
+		gerritAddress = addressURL.String()
+	}
 	if a.gerritHandle != nil {
 		if err := a.gerritHandle.Close(); err != nil {
 			a.logger.Error("failed to close old gerritHandle", zap.Error(err))
 		}
 	}
 	var gerritLog *zap.Logger
-	if *logGerritUsage {
+	if logGerritUsage.Get() {
 		gerritLog = a.logger.Named("gerrit")
 	} else {
 		gerritLog = zap.NewNop()
@@ -495,7 +734,7 @@ func (a *App) ConfigureGerritServer(ctx context.Context, gerritAddress string) e
 	if err != nil {
 		return err
 	}
-	a.gerritHandle = gerritClient
+	a.gerritHandle = newInstrumentedGerritClient(a.teamID, gerritClient, a.noteGerritResult)
 	return nil
 }
 
@@ -506,6 +745,28 @@ func (a *App) isAdminUser(ctx context.Context, chatID string) bool {
 	return ok
 }
 
+// robotUsernames returns the set of Gerrit usernames known to belong to robots rather than
+// people: the CI robot users and our own Gerrit user.
+func (a *App) robotUsernames(ctx context.Context) map[string]struct{} {
+	robots := map[string]struct{}{}
+	for _, username := range a.ciRobotUsernames(ctx) {
+		robots[username] = struct{}{}
+	}
+	if username := a.persistentDB.JustGetConfig(ctx, "gerrit-http-username", ""); username != "" {
+		robots[username] = struct{}{}
+	}
+	return robots
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *App) isBlocklisted(ctx context.Context, chatID string) bool {
 	blocklist := a.persistentDB.JustGetConfig(ctx, "blocklist-ids", "")
 	blockUsers := parseUserSet(blocklist)
@@ -663,11 +924,8 @@ var (
 //   - For all new inline comments, notify the change owner and all prior thread participants (except
 //     for the commenter).
 func (a *App) CommentAdded(ctx context.Context, author events.Account, change events.Change, patchSet events.PatchSet, comment string, eventTime time.Time) {
-	jenkinsRobots := a.persistentDB.JustGetConfig(ctx, "jenkins-robot-user", "")
-	if jenkinsRobots != "" && commaSeparatedListContains(jenkinsRobots, author.Username) {
-		if a.JenkinsRobotCommentAdded(ctx, change, patchSet, comment) {
-			return
-		}
+	if a.CIRobotCommentAdded(ctx, author, change, patchSet, comment) {
+		return
 	}
 
 	owner := &change.Owner
@@ -693,7 +951,7 @@ func (a *App) CommentAdded(ctx context.Context, author events.Account, change ev
 	}
 
 	// get all inline comments and identify which ones are new
-	allInline, newInline, err := a.getNewInlineComments(ctx, change.BestID(), strconv.Itoa(patchSet.Number), author.Username, eventTime.Add(-*inlineCommentMaxAge))
+	allInline, newInline, err := a.getNewInlineComments(ctx, change.BestID(), strconv.Itoa(patchSet.Number), author.Username, eventTime.Add(-inlineCommentMaxAge.Get()))
 	if err != nil {
 		a.logger.Error("could not query inline comments via API", zap.Error(err), zap.String("change-id", change.BestID()), zap.Int("patch-set", patchSet.Number))
 		// fallback: use empty maps; assume there just aren't any inline comments to deal with
@@ -760,15 +1018,15 @@ func (a *App) CommentAdded(ctx context.Context, author events.Account, change ev
 
 	if tellChangeOwner != "" {
 		wg.Go(func() {
-			a.notify(ctx, owner, tellChangeOwner)
+			a.notify(ctx, owner, &change, notifyComments, tellChangeOwner)
 		})
 	}
 	wg.Go(func() {
-		a.generalNotify(ctx, tellNotifyChannel)
+		a.generalNotify(ctx, "comment-added", &change, tellNotifyChannel)
 	})
 	wg.Go(func() {
 		if tellReviewers != "" {
-			a.notifyAllReviewers(ctx, change.BestID(), tellReviewers, []string{author.Username, change.Owner.Username})
+			a.notifyAllReviewers(ctx, &change, notifyComments, tellReviewers, []string{author.Username, change.Owner.Username})
 		}
 		// notify thread participants after reviewers; since thread participants are likely
 		// reviewers themselves, these thread updates will make most sense in the context
@@ -776,7 +1034,7 @@ func (a *App) CommentAdded(ctx context.Context, author events.Account, change ev
 		for destAccount, messageList := range threadParticipants {
 			combinedMsg := strings.Join(messageList, "\n")
 			wg.Go(func() {
-				a.notify(ctx, &destAccount, combinedMsg)
+				a.notify(ctx, &destAccount, &change, notifyInlineReplies, combinedMsg)
 			})
 		}
 	})
@@ -798,22 +1056,22 @@ func (a *App) VoteDeleted(ctx context.Context, reviewer events.Account, remover
 	defer wg.Wait()
 
 	wg.Go(func() {
-		a.generalNotify(ctx, fmt.Sprintf("%s removed %s vote from %s on %s patchset %d", remover.DisplayName(), voteDesc, reviewer.DisplayName(), changeLink, patchSet.Number))
+		a.generalNotify(ctx, "vote-deleted", &change, fmt.Sprintf("%s removed %s vote from %s on %s patchset %d", remover.DisplayName(), voteDesc, reviewer.DisplayName(), changeLink, patchSet.Number))
 	})
 
 	if owner.Username != remover.Username {
 		wg.Go(func() {
 			if owner.Username == reviewer.Username {
-				a.notify(ctx, owner, fmt.Sprintf("%s removed your %s vote on your change %s patchset %d", removerLink, voteDesc, changeLink, patchSet.Number))
+				a.notify(ctx, owner, &change, notifyVotesRemoved, fmt.Sprintf("%s removed your %s vote on your change %s patchset %d", removerLink, voteDesc, changeLink, patchSet.Number))
 			} else {
-				a.notify(ctx, owner, fmt.Sprintf("%s removed %s vote from %s on your change %s patchset %d", removerLink, voteDesc, reviewerLink, changeLink, patchSet.Number))
+				a.notify(ctx, owner, &change, notifyVotesRemoved, fmt.Sprintf("%s removed %s vote from %s on your change %s patchset %d", removerLink, voteDesc, reviewerLink, changeLink, patchSet.Number))
 			}
 		})
 	}
 
 	if reviewer.Username != remover.Username && reviewer.Username != owner.Username {
 		wg.Go(func() {
-			a.notify(ctx, &reviewer, fmt.Sprintf("%s removed your %s vote on %s patchset %d", removerLink, voteDesc, changeLink, patchSet.Number))
+			a.notify(ctx, &reviewer, &change, notifyVotesRemoved, fmt.Sprintf("%s removed your %s vote on %s patchset %d", removerLink, voteDesc, changeLink, patchSet.Number))
 		})
 	}
 }
@@ -857,70 +1115,23 @@ func (b byLastUpdateTime) Less(i, j int) bool {
 	return b[i].Updated < b[j].Updated
 }
 
-var (
-	generalRobotCommentRegexp = regexp.MustCompile(`(?s)^Patch Set [1-9][0-9]*:(?: +(?:[_A-Za-z0-9][-_A-Za-z0-9 ]*[-+][0-9]+|[-+][_A-Za-z0-9][-_A-Za-z0-9 ]*))? *\n *\n(.*)$`)
-
-	buildStartedRegexp    = regexp.MustCompile(`^ *Build Started +(https?:\S+)\s*$`)
-	buildSuccessfulRegexp = regexp.MustCompile(`^ *Build Successful *\n *\n(https?:\S+) : SUCCESS\s*$`)
-	buildFailedRegexp     = regexp.MustCompile(`^ *Build Failed *\n *\n(https?:\S+) : (FAILURE|ABORTED)\s*$`)
-
-	buildTypeTriggeredRegexp  = regexp.MustCompile(`^ *triggering build (.+)\.\.\.\s*$`)
-	buildTypeStartedRegexp    = regexp.MustCompile(`^ *build (.+) is started: +(https?:\S+)\s*$`)
-	buildTypeFailedRegexp     = regexp.MustCompile(`^ *build (.+) is failed: +(https?:\S+)\s*$`)
-	buildTypeSuccessfulRegexp = regexp.MustCompile(`^ *build (.+) is finished successfully: +(https?:\S+)\s*$`)
-)
-
-// JenkinsRobotCommentAdded is called when the Jenkins robot adds a comment to a Gerrit change.
-func (a *App) JenkinsRobotCommentAdded(ctx context.Context, change events.Change, patchSet events.PatchSet, comment string) bool {
-	var (
-		link      string
-		msgType   string
-		buildType string
-	)
-	if subMatches := generalRobotCommentRegexp.FindStringSubmatch(comment); subMatches != nil {
-		// we don't especially care about the "Patch Set" label or the optionally-included vote part; strip that off
-		comment = subMatches[1]
-	} else {
-		// no magic to do here; report as normal comment
-		a.logger.Debug("unexpected comment format from jenkins robot user", zap.String("content", comment), zap.String("change", change.URL), zap.Int("patchset", patchSet.Number))
+// CIRobotCommentAdded is called when a Gerrit user adds a comment to a change. If the user
+// is a configured CI robot, and its parser recognizes the comment as a build report, the
+// build status is shown on the patchset's announcements and true is returned.
+func (a *App) CIRobotCommentAdded(ctx context.Context, author events.Account, change events.Change, patchSet events.PatchSet, comment string) bool {
+	parser, linkTransformer := a.ciRobotParser(ctx, author.Username)
+	if parser == nil {
 		return false
 	}
-
-	if subMatches := buildStartedRegexp.FindStringSubmatch(comment); subMatches != nil {
-		link = subMatches[1]
-		msgType = "start"
-	} else if subMatches = buildSuccessfulRegexp.FindStringSubmatch(comment); subMatches != nil {
-		link = subMatches[1]
-		msgType = "success"
-	} else if subMatches = buildFailedRegexp.FindStringSubmatch(comment); subMatches != nil {
-		link = subMatches[1]
-		if subMatches[2] == "ABORTED" {
-			msgType = "abort"
-		} else {
-			msgType = "fail"
-		}
-	} else if subMatches = buildTypeTriggeredRegexp.FindStringSubmatch(comment); subMatches != nil {
-		msgType = "type-triggered"
-		buildType = subMatches[1]
-	} else if subMatches = buildTypeStartedRegexp.FindStringSubmatch(comment); subMatches != nil {
-		msgType = "type-start"
-		buildType = subMatches[1]
-		link = subMatches[2]
-	} else if subMatches = buildTypeFailedRegexp.FindStringSubmatch(comment); subMatches != nil {
-		msgType = "type-fail"
-		buildType = subMatches[1]
-		link = subMatches[2]
-	} else if subMatches = buildTypeSuccessfulRegexp.FindStringSubmatch(comment); subMatches != nil {
-		msgType = "type-success"
-		buildType = subMatches[1]
-		link = subMatches[2]
-	} else {
+	report, ok := parseRobotComment(parser, comment)
+	if !ok {
 		// no magic to do here; report as normal comment
-		a.logger.Debug("unexpected comment from jenkins robot user", zap.String("content", comment), zap.String("change", change.URL), zap.Int("patchset", patchSet.Number))
+		a.logger.Debug("unexpected comment from CI robot user", zap.String("gerrit-username", author.Username), zap.String("content", comment), zap.String("change", change.URL), zap.Int("patchset", patchSet.Number))
 		return false
 	}
+	msgType, buildType, link := report.Status, report.BuildType, report.Link
 
-	logger := a.logger.With(zap.String("project", change.Project), zap.Int("change-number", change.Number), zap.Int("patchset-number", patchSet.Number), zap.String("jenkins-robot-msgtype", msgType), zap.String("build-link", link))
+	logger := a.logger.With(zap.String("project", change.Project), zap.Int("change-number", change.Number), zap.Int("patchset-number", patchSet.Number), zap.String("build-status", string(msgType)), zap.String("build-type", buildType), zap.String("build-link", link))
 
 	patchSetAnnouncements, err := a.persistentDB.GetPatchSetAnnouncements(ctx, change.Project, change.Number, patchSet.Number)
 	if err != nil {
@@ -929,15 +1140,12 @@ func (a *App) JenkinsRobotCommentAdded(ctx context.Context, change events.Change
 		return false
 	}
 
-	if link != "" {
-		linkTransformer := a.persistentDB.JustGetConfig(ctx, "jenkins-link-transformer", "")
-		if linkTransformer != "" {
-			newLink, err := applyStringTransformer(link, linkTransformer)
-			if err != nil {
-				a.logger.Info("failed to apply jenkins link transformer", zap.Error(err))
-			} else {
-				link = newLink
-			}
+	if link != "" && linkTransformer != "" {
+		newLink, err := applyStringTransformer(link, linkTransformer)
+		if err != nil {
+			a.logger.Info("failed to apply CI link transformer", zap.Error(err))
+		} else {
+			link = newLink
 		}
 	}
 
@@ -950,37 +1158,37 @@ func (a *App) JenkinsRobotCommentAdded(ctx context.Context, change events.Change
 
 	var informFunc func(ctx context.Context, mh messages.MessageHandle, link string) error
 	switch msgType {
-	case "start":
+	case buildStarted:
 		informFunc = a.chat.InformBuildStarted
-	case "success":
+	case buildSucceeded:
 		notifyMsg = fmt.Sprintf("Build for %s succeeded", changeLink)
 		informFunc = a.chat.InformBuildSuccess
-	case "fail":
+	case buildFailed:
 		notifyMsg = fmt.Sprintf("Build for %s failed: %s", changeLink, link)
 		informFunc = a.chat.InformBuildFailure
-	case "abort":
+	case buildAborted:
 		notifyMsg = fmt.Sprintf("Build for %s was canceled", changeLink)
 		informFunc = a.chat.InformBuildAborted
-	case "type-triggered":
+	case buildTypeTriggered:
 		informFunc = func(ctx context.Context, announcement messages.MessageHandle, link string) error {
 			return a.chat.InformBuildTypeTriggered(ctx, announcement, buildType, link)
 		}
-	case "type-start":
+	case buildTypeStarted:
 		informFunc = func(ctx context.Context, announcement messages.MessageHandle, link string) error {
 			return a.chat.InformBuildTypeStarted(ctx, announcement, buildType, link)
 		}
-	case "type-fail":
+	case buildTypeFailed:
 		notifyMsg = fmt.Sprintf("%s build for %s failed: %s", buildType, changeLink, link)
 		informFunc = func(ctx context.Context, announcement messages.MessageHandle, link string) error {
 			return a.chat.InformBuildTypeFailure(ctx, announcement, buildType, link)
 		}
-	case "type-success":
+	case buildTypeSucceeded:
 		notifyMsg = fmt.Sprintf("%s build for %s succeeded: %s", buildType, changeLink, link)
 		informFunc = func(ctx context.Context, announcement messages.MessageHandle, link string) error {
 			return a.chat.InformBuildTypeSuccess(ctx, announcement, buildType, link)
 		}
 	default:
-		a.logger.Error("things are definitely broken. unrecognized msgType", zap.String("msgType", msgType))
+		a.logger.Error("things are definitely broken. unrecognized build status", zap.String("build-status", string(msgType)))
 		return false
 	}
 
@@ -993,7 +1201,7 @@ func (a *App) JenkinsRobotCommentAdded(ctx context.Context, change events.Change
 		}
 		wg.Go(func() {
 			if err := informFunc(ctx, announcement, link); err != nil {
-				a.logger.Error("failed to inform of build status", zap.String("status", msgType), zap.Error(err))
+				a.logger.Error("failed to inform of build status", zap.String("status", string(msgType)), zap.Error(err))
 			}
 		})
 	}
@@ -1001,7 +1209,7 @@ func (a *App) JenkinsRobotCommentAdded(ctx context.Context, change events.Change
 		for userToNotify := range toNotify {
 			userToNotify := userToNotify
 			wg.Go(func() {
-				a.notify(ctx, &userToNotify, notifyMsg)
+				a.notify(ctx, &userToNotify, &change, notifyBuildResults, notifyMsg)
 			})
 		}
 	}
@@ -1022,8 +1230,8 @@ func (a *App) ReviewerAdded(ctx context.Context, reviewer events.Account, change
 	if err != nil {
 		// the records in Gerrit are alarmingly different from what the event told us. oh well?
 		a.logger.Error("could not identify reviewer update entity via API", zap.Error(err), zap.String("change-id", change.BestID()), zap.String("reviewer", reviewer.Username), zap.Time("event-time", eventTime))
-		a.notify(ctx, &reviewer, fmt.Sprintf("You were added as a reviewer or CC for %s", changeLink))
-		a.generalNotify(ctx, fmt.Sprintf("%s was added as a reviewer or CC for %s", reviewer.DisplayName(), changeLink))
+		a.notify(ctx, &reviewer, &change, notifyReviewerAdded, fmt.Sprintf("You were added as a reviewer or CC for %s", changeLink))
+		a.generalNotify(ctx, "reviewer-added", &change, fmt.Sprintf("%s was added as a reviewer or CC for %s", reviewer.DisplayName(), changeLink))
 		return
 	}
 
@@ -1038,20 +1246,22 @@ func (a *App) ReviewerAdded(ctx context.Context, reviewer events.Account, change
 		// the reviewer added themself.
 		if reviewer.Username != change.Owner.Username {
 			// notify the owner
-			a.notify(ctx, &change.Owner, fmt.Sprintf("%s signed up %s on your change %s",
+			a.notify(ctx, &change.Owner, &change, notifyReviewerAdded, fmt.Sprintf("%s signed up %s on your change %s",
 				updaterLink, what, changeLink))
 		}
-		a.generalNotify(ctx, fmt.Sprintf("%s signed up %s on change %s", updater.DisplayName(), what, changeLink))
+		a.generalNotify(ctx, "reviewer-added", &change, fmt.Sprintf("%s signed up %s on change %s", updater.DisplayName(), what, changeLink))
 	} else {
 		// the updater added someone else as a reviewer
-		a.notify(ctx, &reviewer, fmt.Sprintf("%s added you %s on %s",
+		a.notify(ctx, &reviewer, &change, notifyReviewerAdded, fmt.Sprintf("%s added you %s on %s",
 			updaterLink, what, changeLink))
-		// if the owner is the same as the reviewer _or_ the updater, we don't need to notify them also
-		if change.Owner.Username != reviewer.Username && change.Owner.Username != updater.Username {
-			a.notify(ctx, &change.Owner, fmt.Sprintf("%s added %s %s on your change %s",
+		// if the owner is the same as the reviewer _or_ the updater, we don't need to notify them
+		// also. if the updater is us, the owner was already told about it by autoAssignReviewers.
+		if change.Owner.Username != reviewer.Username && change.Owner.Username != updater.Username &&
+			updater.Username != a.persistentDB.JustGetConfig(ctx, "gerrit-http-username", "") {
+			a.notify(ctx, &change.Owner, &change, notifyReviewerAdded, fmt.Sprintf("%s added %s %s on your change %s",
 				updaterLink, a.prepareUserLink(ctx, &reviewer), what, changeLink))
 		}
-		a.generalNotify(ctx, fmt.Sprintf("%s added %s %s on change %s", updater.DisplayName(), reviewer.DisplayName(), what, changeLink))
+		a.generalNotify(ctx, "reviewer-added", &change, fmt.Sprintf("%s added %s %s on change %s", updater.DisplayName(), reviewer.DisplayName(), what, changeLink))
 	}
 }
 
@@ -1072,15 +1282,17 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 	uploaderLink := a.prepareUserLink(ctx, &uploader)
 	changeLink := a.formatChangeLink(&change)
 
-	if uploader.Username != change.Owner.Username {
+	// chat users may have more than one linked Gerrit account, so the uploader and owner are
+	// recognized by chat ID as well as by Gerrit username
+	uploaderChatID := a.lookupGerritUser(ctx, &uploader)
+	ownerChatID := a.lookupGerritUser(ctx, &change.Owner)
+
+	if uploader.Username != change.Owner.Username && ownerChatID != "" && ownerChatID != uploaderChatID {
 		wg.Go(func() {
-			ownerChatID := a.lookupGerritUser(ctx, &change.Owner)
-			if ownerChatID != "" {
-				handle := a.notify(ctx, &change.Owner,
-					fmt.Sprintf("%s uploaded a new patchset #%d on your change %s",
-						uploaderLink, patchSet.Number, changeLink))
-				gotHandle(handle)
-			}
+			handle := a.notify(ctx, &change.Owner, &change, notifyNewPatchSet,
+				fmt.Sprintf("%s uploaded a new patchset #%d on your change %s",
+					uploaderLink, patchSet.Number, changeLink))
+			gotHandle(handle)
 		})
 	}
 
@@ -1094,8 +1306,14 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 		// using REWORK as a default change type and with an empty reviewers map. Continue
 		// for the sake of the general notification.
 	}
+	if patchSet.Number == 1 && err == nil {
+		wg.Go(func() {
+			a.autoAssignReviewers(ctx, &change, &patchSet, &changeInfo)
+		})
+	}
 
 	var reviewerMsg, ccMsg, generalMsg string
+	reviewerKind := notifyNewPatchSet
 	if patchSet.Number == 1 {
 		// this is a whole new changeset. notify accordingly.
 		reviewerMsg = fmt.Sprintf("%s pushed a new changeset %s, with you as a reviewer.",
@@ -1112,6 +1330,7 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 		}
 		switch changeType {
 		case "TRIVIAL_REBASE":
+			reviewerKind = notifyTrivialRebase
 			generalMsg = fmt.Sprintf("%s rebased change %s into patchset #%d",
 				uploader.DisplayName(), changeLink, patchSet.Number)
 			reviewerMsg = fmt.Sprintf("%s rebased change %s into patchset #%d",
@@ -1131,8 +1350,15 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 		ccMsg = reviewerMsg
 	}
 
-	// send the reviewerMsg or ccMsg, as appropriate, to all relevant users
+	// send the reviewerMsg or ccMsg, as appropriate, to all relevant users, notifying each
+	// chat user only once
 	haveNotified := map[string]struct{}{uploader.Username: {}, change.Owner.Username: {}}
+	haveNotifiedChatIDs := make(map[string]struct{})
+	for _, chatID := range []string{uploaderChatID, ownerChatID} {
+		if chatID != "" {
+			haveNotifiedChatIDs[chatID] = struct{}{}
+		}
+	}
 	notifyMessages := []string{reviewerMsg, ccMsg}
 	for i, reviewerGroup := range []string{"REVIEWER", "CC"} {
 		useMsg := notifyMessages[i]
@@ -1140,8 +1366,14 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 			if _, alreadyNotified := haveNotified[reviewer.Username]; !alreadyNotified {
 				haveNotified[reviewer.Username] = struct{}{}
 				reviewerInfo := accountFromAccountInfo(&reviewer)
+				if chatID := a.lookupGerritUser(ctx, reviewerInfo); chatID != "" {
+					if _, alreadyNotified := haveNotifiedChatIDs[chatID]; alreadyNotified {
+						continue
+					}
+					haveNotifiedChatIDs[chatID] = struct{}{}
+				}
 				wg.Go(func() {
-					handle := a.notify(ctx, reviewerInfo, useMsg)
+					handle := a.notify(ctx, reviewerInfo, &change, reviewerKind, useMsg)
 					gotHandle(handle)
 				})
 			}
@@ -1150,8 +1382,9 @@ func (a *App) PatchSetCreated(ctx context.Context, uploader events.Account, chan
 
 	// and, finally, send the general notification
 	wg.Go(func() {
-		handle := a.generalNotify(ctx, generalMsg)
-		gotHandle(handle)
+		for _, handle := range a.generalNotify(ctx, "patchset-created", &change, generalMsg) {
+			gotHandle(handle)
+		}
 	})
 	wg.Wait()
 
@@ -1183,16 +1416,17 @@ func (a *App) ChangeAbandoned(ctx context.Context, abandoner events.Account, cha
 	abandonerLink := a.prepareUserLink(ctx, &abandoner)
 	changeLink := a.formatChangeLink(&change)
 	if abandoner.Username != change.Owner.Username {
-		a.notify(ctx, &change.Owner, fmt.Sprintf(
+		a.notify(ctx, &change.Owner, &change, notifyStatusChanges, fmt.Sprintf(
 			"%s marked your change %s as abandoned with the message: %s",
 			abandonerLink, changeLink, reason))
 	}
 	reviewerMsg := fmt.Sprintf("%s marked change %s as abandoned with the message: %s",
 		abandonerLink, changeLink, reason)
-	a.notifyAllReviewers(ctx, change.BestID(), reviewerMsg, []string{abandoner.Username, change.Owner.Username})
+	a.notifyAllReviewers(ctx, &change, notifyStatusChanges, reviewerMsg, []string{abandoner.Username, change.Owner.Username})
 	generalMsg := fmt.Sprintf("%s marked change %s as abandoned with the message: %s",
 		abandoner.DisplayName(), changeLink, reason)
-	a.generalNotify(ctx, generalMsg)
+	a.generalNotify(ctx, "change-abandoned", &change, generalMsg)
+	a.forgetSLAReminders(ctx, &change)
 }
 
 // ChangeRestored is called when we receive a Gerrit change-restored event.
@@ -1200,16 +1434,16 @@ func (a *App) ChangeRestored(ctx context.Context, restorer events.Account, chang
 	restorerLink := a.prepareUserLink(ctx, &restorer)
 	changeLink := a.formatChangeLink(&change)
 	if restorer.Username != change.Owner.Username {
-		a.notify(ctx, &change.Owner, fmt.Sprintf(
+		a.notify(ctx, &change.Owner, &change, notifyStatusChanges, fmt.Sprintf(
 			"%s restored your change %s using patchset #%d with the message: %s",
 			restorerLink, changeLink, patchSet.Number, reason))
 	}
 	reviewerMsg := fmt.Sprintf("%s restored change %s using patchset #%d with the message: %s",
 		restorerLink, changeLink, patchSet.Number, reason)
-	a.notifyAllReviewers(ctx, change.BestID(), reviewerMsg, []string{restorer.Username, change.Owner.Username})
+	a.notifyAllReviewers(ctx, &change, notifyStatusChanges, reviewerMsg, []string{restorer.Username, change.Owner.Username})
 	generalMsg := fmt.Sprintf("%s restored change %s using patchset #%d with the message: %s",
 		restorer.DisplayName(), changeLink, patchSet.Number, reason)
-	a.generalNotify(ctx, generalMsg)
+	a.generalNotify(ctx, "change-restored", &change, generalMsg)
 }
 
 // ChangeMerged is called when we receive a Gerrit change-merged event.
@@ -1217,16 +1451,17 @@ func (a *App) ChangeMerged(ctx context.Context, submitter events.Account, change
 	submitterLink := a.prepareUserLink(ctx, &submitter)
 	changeLink := a.formatChangeLink(&change)
 	if submitter.Username != change.Owner.Username {
-		a.notify(ctx, &change.Owner, fmt.Sprintf(
+		a.notify(ctx, &change.Owner, &change, notifyStatusChanges, fmt.Sprintf(
 			"%s merged patchset #%d of your change %s.",
 			submitterLink, patchSet.Number, changeLink))
 	}
 	reviewerMsg := fmt.Sprintf("%s merged patchset #%d of change %s.",
 		submitterLink, patchSet.Number, changeLink)
-	a.notifyAllReviewers(ctx, change.BestID(), reviewerMsg, []string{submitter.Username, change.Owner.Username})
+	a.notifyAllReviewers(ctx, &change, notifyStatusChanges, reviewerMsg, []string{submitter.Username, change.Owner.Username})
 	generalMsg := fmt.Sprintf("%s merged patchset #%d of change %s.",
 		submitter.DisplayName(), patchSet.Number, changeLink)
-	a.generalNotify(ctx, generalMsg)
+	a.generalNotify(ctx, "change-merged", &change, generalMsg)
+	a.forgetSLAReminders(ctx, &change)
 }
 
 // TopicChanged is called when we receive a Gerrit topic-changed event.
@@ -1234,16 +1469,16 @@ func (a *App) TopicChanged(ctx context.Context, changer events.Account, change e
 	changerLink := a.prepareUserLink(ctx, &changer)
 	changeLink := a.formatChangeLink(&change)
 	if changer.Username != change.Owner.Username {
-		a.notify(ctx, &change.Owner, fmt.Sprintf(
+		a.notify(ctx, &change.Owner, &change, notifyStatusChanges, fmt.Sprintf(
 			"%s changed the topic of your change %s to %q.",
 			changerLink, changeLink, change.Topic))
 	}
 	reviewerMsg := fmt.Sprintf("%s changed the topic of changeset %s to %q.",
 		changerLink, changeLink, change.Topic)
-	a.notifyAllReviewers(ctx, change.BestID(), reviewerMsg, []string{changer.Username, change.Owner.Username})
+	a.notifyAllReviewers(ctx, &change, notifyStatusChanges, reviewerMsg, []string{changer.Username, change.Owner.Username})
 	generalMsg := fmt.Sprintf("%s changed the topic of changeset %s to %q.",
 		changer.DisplayName(), changeLink, change.Topic)
-	a.generalNotify(ctx, generalMsg)
+	a.generalNotify(ctx, "topic-changed", &change, generalMsg)
 }
 
 // WipStateChanged is called when we receive a Gerrit topic-changed event.
@@ -1255,12 +1490,12 @@ func (a *App) WipStateChanged(ctx context.Context, changer events.Account, chang
 		what = "as a Work In Progress"
 	}
 	if changer.Username != change.Owner.Username {
-		a.notify(ctx, &change.Owner, fmt.Sprintf("%s marked your change %s %s.", changerLink, changeLink, what))
+		a.notify(ctx, &change.Owner, &change, notifyStatusChanges, fmt.Sprintf("%s marked your change %s %s.", changerLink, changeLink, what))
 	}
 	reviewerMsg := fmt.Sprintf("%s marked change %s %s.", changerLink, changeLink, what)
-	a.notifyAllReviewers(ctx, change.BestID(), reviewerMsg, []string{changer.Username, change.Owner.Username})
+	a.notifyAllReviewers(ctx, &change, notifyStatusChanges, reviewerMsg, []string{changer.Username, change.Owner.Username})
 	generalMsg := fmt.Sprintf("%s marked change %s %s.", changer.DisplayName(), changeLink, what)
-	a.generalNotify(ctx, generalMsg)
+	a.generalNotify(ctx, "wip-state-changed", &change, generalMsg)
 }
 
 // AssigneeChanged is called when we receive a Gerrit assignee-changed event.
@@ -1268,16 +1503,21 @@ func (a *App) AssigneeChanged(_ context.Context, _ events.Account, _ events.Chan
 	// We don't use the Assignee field for anything right now, I think. Probably good to ignore this
 }
 
-func (a *App) notifyAllReviewers(ctx context.Context, changeID, msg string, except []string) {
-	reviewers, err := a.getGerritClient().GetChangeReviewers(ctx, changeID)
+func (a *App) notifyAllReviewers(ctx context.Context, change *events.Change, kind notificationKind, msg string, except []string) {
+	reviewers, err := a.getGerritClient().GetChangeReviewers(ctx, change.BestID())
 	if err != nil {
 		a.logger.Error("could not query reviewers for change, so can not notify reviewers",
-			zap.Error(err), zap.String("change-id", changeID))
+			zap.Error(err), zap.String("change-id", change.BestID()))
 		return
 	}
 	haveNotified := make(map[string]struct{})
+	// chat users may have more than one linked Gerrit account; only notify each once
+	haveNotifiedChatIDs := make(map[string]struct{})
 	for _, exception := range except {
 		haveNotified[exception] = struct{}{}
+		if chatID, err := a.persistentDB.LookupChatIDForGerritUser(ctx, exception); err == nil {
+			haveNotifiedChatIDs[chatID] = struct{}{}
+		}
 	}
 
 	var wg waitGroup
@@ -1285,13 +1525,19 @@ func (a *App) notifyAllReviewers(ctx context.Context, changeID, msg string, exce
 		if _, alreadyNotified := haveNotified[reviewer.Username]; !alreadyNotified {
 			haveNotified[reviewer.Username] = struct{}{}
 			reviewerInfo := accountFromAccountInfo(&reviewer.AccountInfo)
-			wg.Go(func() { a.notify(ctx, reviewerInfo, msg) })
+			if chatID := a.lookupGerritUser(ctx, reviewerInfo); chatID != "" {
+				if _, alreadyNotified := haveNotifiedChatIDs[chatID]; alreadyNotified {
+					continue
+				}
+				haveNotifiedChatIDs[chatID] = struct{}{}
+			}
+			wg.Go(func() { a.notify(ctx, reviewerInfo, change, kind, msg) })
 		}
 	}
 	wg.Wait()
 }
 
-func (a *App) notify(ctx context.Context, gerritUser *events.Account, message string) messages.MessageHandle {
+func (a *App) notify(ctx context.Context, gerritUser *events.Account, change *events.Change, kind notificationKind, message string) messages.MessageHandle {
 	chatID := a.lookupGerritUser(ctx, gerritUser)
 	if chatID == "" {
 		return nil
@@ -1302,32 +1548,71 @@ func (a *App) notify(ctx context.Context, gerritUser *events.Account, message st
 			zap.String("gerrit-username", gerritUser.Username))
 		return nil
 	}
+	if !a.wantsNotification(ctx, chatID, kind) {
+		a.logger.Debug("suppressing message due to user preferences",
+			zap.String("chat-id", chatID),
+			zap.String("gerrit-username", gerritUser.Username),
+			zap.String("kind", string(kind)))
+		return nil
+	}
+	// in dry-run mode, the notification is recorded right away instead of lingering in the
+	// digest queue, where it would be sent for real later on
+	if a.isDigestUser(ctx, chatID) && !shouldDeliverImmediately(gerritUser, kind, message) && !a.isDryRun(ctx) {
+		if err := a.queueDigestEntry(ctx, chatID, change, kind, message); err != nil {
+			a.logger.Error("failed to queue notification for digest; sending immediately",
+				zap.Error(err),
+				zap.String("chat-id", chatID),
+				zap.String("gerrit-username", gerritUser.Username))
+		} else {
+			return nil
+		}
+	}
 	msgHandle, err := a.chat.SendNotification(ctx, chatID, message)
 	if err != nil {
+		metrics.NotificationsFailed.WithLabelValues(a.teamID, string(kind)).Inc()
 		a.logger.Error("failed to send notification",
 			zap.Error(err),
 			zap.String("chat-id", chatID),
 			zap.String("gerrit-username", gerritUser.Username))
 		return nil
 	}
+	if !isDryRunHandle(msgHandle) {
+		metrics.NotificationsSent.WithLabelValues(a.teamID, string(kind)).Inc()
+	}
 	return msgHandle
 }
 
-func (a *App) generalNotify(ctx context.Context, message string) messages.MessageHandle {
-	chanID := a.persistentDB.JustGetConfig(ctx, "global-notify-channel", "")
-	if chanID == "" {
-		// no global notify channel configured.
-		return nil
+// generalNotify sends a channel notification about an event on the given change. The
+// notification goes to all channels named by matching routing rules, or to the
+// global-notify-channel if no rules match.
+func (a *App) generalNotify(ctx context.Context, eventType string, change *events.Change, message string) (handles []messages.MessageHandle) {
+	chanIDs := a.routeChannelsFor(ctx, eventType, change)
+	if len(chanIDs) == 0 {
+		chanID := a.persistentDB.JustGetConfig(ctx, "global-notify-channel", "")
+		if chanID == "" {
+			// no global notify channel configured.
+			return nil
+		}
+		chanIDs = []string{chanID}
 	}
-	handle, err := a.chat.SendChannelNotification(ctx, chanID, message)
-	if err != nil {
-		a.logger.Error("failed to send notification to channel",
-			zap.Error(err),
-			zap.String("channel-id", chanID),
-			zap.String("message", message))
-		return nil
+	for _, chanID := range chanIDs {
+		handle, err := a.chat.SendChannelNotification(ctx, chanID, message)
+		if err != nil {
+			metrics.NotificationsFailed.WithLabelValues(a.teamID, channelNotificationKind).Inc()
+			a.logger.Error("failed to send notification to channel",
+				zap.Error(err),
+				zap.String("channel-id", chanID),
+				zap.String("message", message))
+			continue
+		}
+		if !isDryRunHandle(handle) {
+			metrics.NotificationsSent.WithLabelValues(a.teamID, channelNotificationKind).Inc()
+		}
+		if handle != nil {
+			handles = append(handles, handle)
+		}
 	}
-	return handle
+	return handles
 }
 
 func (a *App) lookupGerritUser(ctx context.Context, user *events.Account) string {
@@ -1384,7 +1669,7 @@ func (a *App) PeriodicTeamReports(ctx context.Context, getTime func() time.Time)
 		select {
 		case t := <-timer.C:
 			for _, nextReport := range nextReports {
-				a.TeamReport(ctx, t, nextReport)
+				a.TeamReport(detach(ctx), t, nextReport)
 			}
 		case <-ctx.Done():
 			if !timer.Stop() {
@@ -1525,7 +1810,7 @@ func (a *App) PeriodicPersonalReports(ctx context.Context, getTime func() time.T
 	for {
 		select {
 		case t := <-timer.C:
-			a.PersonalReports(ctx, t)
+			a.PersonalReports(detach(ctx), t)
 		case <-ctx.Done():
 			if !timer.Stop() {
 				<-timer.C
@@ -1540,6 +1825,7 @@ func (a *App) PeriodicPersonalReports(ctx context.Context, getTime func() time.T
 
 // TeamReport builds and sends a team Gerrit report.
 func (a *App) TeamReport(ctx context.Context, t time.Time, config reportConfig) {
+	defer metrics.ObserveSince(metrics.ReportDuration.WithLabelValues(a.teamID, "team"), time.Now())
 	defer func() {
 		rec := recover()
 		if rec != nil {
@@ -1713,7 +1999,9 @@ changeLoop:
 	caption := fmt.Sprintf("%d changesets waiting for review (%d waiting for over a week, %d waiting for over a month)", len(lines), countOverWeek, countOverMonth)
 	if _, err := a.chat.SendChannelReport(ctx, config.ChannelID, caption, lines); err != nil {
 		logger.Error("failed to send global message report", zap.Error(err))
+		return
 	}
+	a.noteReportSent(time.Now())
 }
 
 // PersonalReports builds and issues personal Gerrit reports to all users who are due for reports.
@@ -1723,6 +2011,7 @@ func (a *App) PersonalReports(ctx context.Context, t time.Time) {
 	// debugging reasons.
 	a.reporterLock.Lock()
 	defer a.reporterLock.Unlock()
+	defer metrics.ObserveSince(metrics.ReportDuration.WithLabelValues(a.teamID, "personal"), time.Now())
 
 	logger := a.logger.With(zap.Time("personal-reports-start", t))
 	logger.Debug("initiating personal current changeset reports")
@@ -1742,57 +2031,79 @@ func (a *App) PersonalReports(ctx context.Context, t time.Time) {
 
 	// if a user already had a report shown to them since this time, we won't show another
 	// report even if it is their reporting time again (e.g. because of a time zone change).
-	cutOffTime := t.Add(-*minIntervalBetweenReports)
+	cutOffTime := t.Add(-minIntervalBetweenReports.Get())
 
+	// group accounts by the chat user they belong to, so that users with more than one
+	// linked Gerrit account get a single merged report.
+	var chatIDs []string
+	gerritUsersByChatID := make(map[string][]*dbx.GerritUser)
 	for _, acct := range accounts {
-		a.PersonalReportToUser(ctx, logger, t, cutOffTime, &acct)
+		gerritUser, err := a.persistentDB.LookupGerritUser(ctx, acct.Username)
+		if err != nil {
+			// we don't know who this is. can't send a report.
+			logger.Info("No association with user in chat. Skipping.",
+				zap.String("gerrit-username", acct.Username),
+				zap.String("gerrit-email", acct.Email),
+				zap.String("gerrit-name", acct.Name))
+			continue
+		}
+		if _, ok := gerritUsersByChatID[gerritUser.ChatId]; !ok {
+			chatIDs = append(chatIDs, gerritUser.ChatId)
+		}
+		gerritUsersByChatID[gerritUser.ChatId] = append(gerritUsersByChatID[gerritUser.ChatId], gerritUser)
+	}
+
+	for _, chatID := range chatIDs {
+		a.PersonalReportToUser(ctx, logger, t, cutOffTime, chatID, gerritUsersByChatID[chatID])
 	}
 }
 
-// PersonalReportToUser looks up information on the given user, and if it is an appropriate
-// time, sends them a report on the changesets currently waiting for their review.
+// PersonalReportToUser looks up information on the given chat user, and if it is an
+// appropriate time, sends them a report on the changesets currently waiting for their review
+// under any of their linked Gerrit accounts.
 //
 // Note this is pretty inefficient with respect to execution time and data transferred.
 // Since I don't expect this to be dealing with very large amounts of data, and performance
 // is very non-critical here, I would rather let it be a little slow as a simplistic way of
 // keeping down the load on the chat and Gerrit servers. If this needs to be snappier,
 // though, this is probably a good place to start parallelizing.
-func (a *App) PersonalReportToUser(ctx context.Context, logger *zap.Logger, now, cutOffTime time.Time, acct *gerrit.AccountInfo) {
+func (a *App) PersonalReportToUser(ctx context.Context, logger *zap.Logger, now, cutOffTime time.Time, chatID string, gerritUsers []*dbx.GerritUser) {
 	defer func() {
 		rec := recover()
 		if rec != nil {
-			a.logger.Error("panic creating personal report", zap.String("gerrit-username", acct.Username), zap.Any("panic-message", rec))
+			a.logger.Error("panic creating personal report", zap.String("chat-id", chatID), zap.Any("panic-message", rec))
 		}
 	}()
 
+	gerritUsernames := make([]string, 0, len(gerritUsers))
+	for _, gerritUser := range gerritUsers {
+		gerritUsernames = append(gerritUsernames, gerritUser.GerritUsername)
+	}
 	logger = logger.With(
-		zap.String("gerrit-username", acct.Username),
-		zap.String("gerrit-email", acct.Email),
-		zap.String("gerrit-name", acct.Name))
+		zap.String("chat-id", chatID),
+		zap.Strings("gerrit-usernames", gerritUsernames))
 
-	// see if we even know who this is in chat
-	chatUser, err := a.persistentDB.LookupGerritUser(ctx, acct.Username)
-	if err != nil {
-		// we don't know who this is. can't send a report.
-		logger.Info("No association with user in chat. Skipping.")
+	if a.isBlocklisted(ctx, chatID) {
+		logger.Debug("not sending personal report to blocklisted user")
 		return
 	}
-	logger = logger.With(zap.String("chat-id", chatUser.ChatId))
-
-	if a.isBlocklisted(ctx, chatUser.ChatId) {
-		logger.Debug("not sending personal report to blocklisted user")
+	if !a.persistentDB.JustGetUserPrefBool(ctx, chatID, personalReportPrefKey, true) {
+		logger.Debug("not sending personal report to user who opted out")
 		return
 	}
 
-	// check last report time
-	if chatUser.LastReport != nil && chatUser.LastReport.After(cutOffTime) {
-		logger.Info("Skipping report for user due to recent report",
-			zap.Time("last-report", *chatUser.LastReport))
-		return
+	// check last report time. reports are merged across all linked accounts, so a recent
+	// report for any of them counts.
+	for _, gerritUser := range gerritUsers {
+		if gerritUser.LastReport != nil && gerritUser.LastReport.After(cutOffTime) {
+			logger.Info("Skipping report for user due to recent report",
+				zap.Time("last-report", *gerritUser.LastReport))
+			return
+		}
 	}
 
 	// get updated user info from chat system
-	chatInfo, err := a.chat.GetUserInfoByID(ctx, chatUser.ChatId)
+	chatInfo, err := a.chat.GetUserInfoByID(ctx, chatID)
 	if err != nil {
 		logger.Error("Chat system failed to look up user! Possibly deleted?",
 			zap.Error(err))
@@ -1809,15 +2120,14 @@ func (a *App) PersonalReportToUser(ctx context.Context, logger *zap.Logger, now,
 		return
 	}
 	now = now.In(tz)
-	if !a.isGoodTimeForReport(ctx, acct, chatInfo, now) {
+	if !a.isGoodTimeForReport(ctx, chatInfo, now) {
 		logger.Info("Not a good time for a report. Skipping.",
 			zap.Time("user-localtime", now))
 		return
 	}
 
 	// actually get their reviews according to Gerrit
-	personalWorkNeededQuery := a.persistentDB.JustGetConfig(ctx, "personal-reviews-needed-query", defaultPerUserReviewsNeededQuery)
-	changes, err := a.allPendingReviewsFor(ctx, acct.Username, personalWorkNeededQuery)
+	reportItems, err := a.personalReportItems(ctx, gerritUsernames, now)
 	if err != nil {
 		logger.Error("failed to query Gerrit for pending reviews", zap.Error(err))
 		return
@@ -1825,17 +2135,59 @@ func (a *App) PersonalReportToUser(ctx context.Context, logger *zap.Logger, now,
 
 	// If we made it this far, record the report in the db. it might still fail,
 	// but it's not absolutely critical that all reports reach the user.
-	if err := a.persistentDB.UpdateLastReportTime(ctx, acct.Username, now); err != nil {
-		logger.Error("could not update last-report time in persistent db", zap.Error(err))
-		return
+	for _, gerritUsername := range gerritUsernames {
+		if err := a.persistentDB.UpdateLastReportTime(ctx, gerritUsername, now); err != nil {
+			logger.Error("could not update last-report time in persistent db", zap.Error(err))
+			return
+		}
 	}
 
-	if len(changes) == 0 {
+	if len(reportItems) == 0 {
 		logger.Info("No reviews assigned. No report needed.")
 		return
 	}
+	logger = logger.With(zap.Int("review-items-pending", len(reportItems)))
+
+	// and finally, send it out
+	_, err = a.chat.SendPersonalReport(ctx, chatID, "Reviews assigned to you", reportItems)
+	if err != nil {
+		logger.Error("failed to send report to chat")
+		return
+	}
+	a.noteReportSent(time.Now())
 
-	// build the report
+	logger.Info("successfully sent report")
+}
+
+// personalReportItems queries Gerrit for the changes currently waiting for review by any of
+// the given Gerrit users, and formats them as personal report items. The given users are
+// expected to be the linked accounts of a single person, so each change is listed only once,
+// and changes owned by any of the accounts are left out.
+func (a *App) personalReportItems(ctx context.Context, gerritUsernames []string, now time.Time) ([]string, error) {
+	personalWorkNeededQuery := a.persistentDB.JustGetConfig(ctx, "personal-reviews-needed-query", defaultPerUserReviewsNeededQuery)
+	isOwnAccount := make(map[string]struct{}, len(gerritUsernames))
+	for _, gerritUsername := range gerritUsernames {
+		isOwnAccount[gerritUsername] = struct{}{}
+	}
+	var changes []gerrit.ChangeInfo
+	seen := make(map[string]struct{})
+	for _, gerritUsername := range gerritUsernames {
+		userChanges, err := a.allPendingReviewsFor(ctx, gerritUsername, personalWorkNeededQuery)
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range userChanges {
+			if _, ok := isOwnAccount[ch.Owner.Username]; ok {
+				continue
+			}
+			changeKey := ch.Project + "~" + strconv.Itoa(ch.Number)
+			if _, ok := seen[changeKey]; ok {
+				continue
+			}
+			seen[changeKey] = struct{}{}
+			changes = append(changes, ch)
+		}
+	}
 	reportItems := make([]string, 0, len(changes))
 	for _, ch := range changes {
 		createdOn := gerrit.ParseTimestamp(ch.Created)
@@ -1846,16 +2198,7 @@ func (a *App) PersonalReportToUser(ctx context.Context, logger *zap.Logger, now,
 			prettyDate(now, lastUpdated))
 		reportItems = append(reportItems, reviewItem)
 	}
-	logger = logger.With(zap.Int("review-items-pending", len(changes)))
-
-	// and finally, send it out
-	_, err = a.chat.SendPersonalReport(ctx, chatUser.ChatId, "Reviews assigned to you", reportItems)
-	if err != nil {
-		logger.Error("failed to send report to chat")
-		return
-	}
-
-	logger.Info("successfully sent report")
+	return reportItems, nil
 }
 
 func (a *App) formatChangeLink(ch *events.Change) string {
@@ -1954,7 +2297,7 @@ func prettyTimeDelta(delta time.Duration) string {
 	return fmt.Sprintf("%d %s%s", count, timeUnits, plural)
 }
 
-func (a *App) isGoodTimeForReport(ctx context.Context, _ *gerrit.AccountInfo, _ messages.ChatUser, t time.Time) bool {
+func (a *App) isGoodTimeForReport(ctx context.Context, chatUser messages.ChatUser, t time.Time) bool {
 	hour := t.Hour()
 	day := t.Weekday()
 	if day == time.Saturday || day == time.Sunday {
@@ -1964,6 +2307,7 @@ func (a *App) isGoodTimeForReport(ctx context.Context, _ *gerrit.AccountInfo, _
 		return false
 	}
 	personalReportHour := a.persistentDB.JustGetConfigInt(ctx, "personal-report-hour", defaultPersonalReportHour)
+	personalReportHour = a.persistentDB.JustGetUserPrefInt(ctx, chatUser.ChatID(), personalReportHourPrefKey, personalReportHour)
 	return hour >= personalReportHour
 }
 
@@ -1996,8 +2340,11 @@ func (a *App) getAllChangesMatching(ctx context.Context, queryString string, opt
 }
 
 func (a *App) shortenProjectName(projectName string) string {
-	if a.removeProjectPrefix != "" && strings.HasPrefix(projectName, a.removeProjectPrefix) {
-		projectName = projectName[len(a.removeProjectPrefix):]
+	a.configLock.Lock()
+	prefix := a.removeProjectPrefix
+	a.configLock.Unlock()
+	if prefix != "" && strings.HasPrefix(projectName, prefix) {
+		projectName = projectName[len(prefix):]
 	}
 	return projectName
 }
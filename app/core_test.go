@@ -1,19 +1,26 @@
 package app_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -23,6 +30,7 @@ import (
 	"github.com/storj/changesetchihuahua/gerrit"
 	"github.com/storj/changesetchihuahua/gerrit/events"
 	"github.com/storj/changesetchihuahua/messages"
+	"github.com/storj/changesetchihuahua/metrics"
 	"github.com/storj/changesetchihuahua/slack"
 )
 
@@ -33,6 +41,7 @@ type testSystem struct {
 	T           *testing.T
 	Ctx         context.Context
 	DB          *app.PersistentDB
+	DBSource    string
 	Controller  *gomock.Controller
 	MockChat    *MockEventedChatSystem
 	App         *app.App
@@ -48,6 +57,30 @@ func (ts *testSystem) OpenGerrit(_ context.Context, log *zap.Logger, _ string) (
 	return ts.MockGerrit, nil
 }
 
+// AnotherInstance creates a second App serving the same team, with its own connection to the
+// same persistent DB, as another instance of the service would. The caller is responsible
+// for closing its App.
+func (ts *testSystem) AnotherInstance() *testSystem {
+	logger := zaptest.NewLogger(ts.T).Named("other")
+	db, err := app.NewPersistentDB(logger.Named("db"), ts.DBSource, newTestSealer(ts.T))
+	require.NoError(ts.T, err)
+	m := NewMockEventedChatSystem(ts.Controller)
+	m.EXPECT().
+		SetIncomingMessageCallback(gomock.Any()).
+		Times(1)
+	other := &testSystem{
+		T:           ts.T,
+		Ctx:         ts.Ctx,
+		DB:          db,
+		DBSource:    ts.DBSource,
+		Controller:  ts.Controller,
+		MockChat:    m,
+		MockClients: make(map[string]*MockClient),
+	}
+	other.App = app.New(ts.Ctx, logger.Named("app"), "T1", m, &slack.Formatter{}, db, other)
+	return other
+}
+
 func (ts *testSystem) InjectEvent(eventJSON string) {
 	ev, err := events.DecodeGerritEvent([]byte(eventJSON))
 	require.NoError(ts.T, err)
@@ -146,13 +179,22 @@ func (hu *hypotheticalUser) JSON() string {
 
 const adminUserID = "fred"
 
+// newTestSealer returns a Sealer with a fixed key, so that every instance in a test can open
+// what the others seal.
+func newTestSealer(t *testing.T) *app.Sealer {
+	sealer, err := app.NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	return sealer
+}
+
 func testWithMockChat(t *testing.T, config map[string]string, testFunc func(*testSystem)) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
 
 	logger := zaptest.NewLogger(t)
 
-	db, err := app.NewPersistentDB(logger.Named("db"), "sqlite3:"+filepath.Join(t.TempDir(), "sqlite.db"))
+	dbSource := "sqlite3:" + filepath.Join(t.TempDir(), "sqlite.db")
+	db, err := app.NewPersistentDB(logger.Named("db"), dbSource, newTestSealer(t))
 	require.NoError(t, err)
 
 	for key, value := range config {
@@ -174,11 +216,12 @@ func testWithMockChat(t *testing.T, config map[string]string, testFunc func(*tes
 		T:           t,
 		Ctx:         ctx,
 		DB:          db,
+		DBSource:    dbSource,
 		Controller:  ctrl,
 		MockChat:    m,
 		MockClients: make(map[string]*MockClient),
 	}
-	ts.App = app.New(ctx, logger.Named("app"), m, &slack.Formatter{}, db, ts)
+	ts.App = app.New(ctx, logger.Named("app"), "T1", m, &slack.Formatter{}, db, ts)
 	require.NotNil(t, ts.App)
 
 	if gerritAddr, ok := config["gerrit-address"]; ok {
@@ -775,6 +818,999 @@ func TestReviewerAdded(t *testing.T) {
 	})
 }
 
+func TestUserPrefsSuppressNotifications(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":        "https://gerrit.jorts.io",
+		"remove-project-prefix": "jorts/",
+		"global-notify-channel": "GLOBALNOTIFY",
+	}, func(ts *testSystem) {
+		owner := ts.makeUser("owner@jorts.io", "owner", "Oh Ner")
+		reviewer := ts.makeUser("reviewer@jorts.io", "reviewer", "Ree Viewer")
+		remover := ts.makeUser("remover@jorts.io", "remover", "Ree Mover")
+
+		// any user (not only admins) can change their own preferences
+		reply := ts.App.IncomingChatCommand(owner.chatID, "D1234", true, "!prefs notify.votes-removed off")
+		require.Equal(t, `Ok, "notify.votes-removed" => "false"`, reply)
+		reply = ts.App.IncomingChatCommand(owner.chatID, "D1234", true, "!prefs notify.votes-removed")
+		require.Equal(t, `"notify.votes-removed" => "false"`, reply)
+		reply = ts.App.IncomingChatCommand(owner.chatID, "D1234", true, "!prefs delivery sometimes")
+		require.Contains(t, reply, "is not one of")
+
+		// the reviewer still gets notified, and so does the channel, but not the owner
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), reviewer.chatID, "<@CHATID(remover)> removed your Code-Review+2 vote on [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> patchset 1").
+			Times(1).
+			Return(nil, nil)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "GLOBALNOTIFY", "Ree Mover removed Code-Review+2 vote from Ree Viewer on [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> patchset 1").
+			Times(1).
+			Return(nil, nil)
+
+		ts.InjectEvent(`{
+			"change": {
+				"project": "jorts/testiness",
+				"branch": "master",
+				"id": "Ide512e00237f102c771b7056d3e557586f82272a",
+				"number": 1,
+				"subject": "beans",
+				"owner": ` + owner.JSON() + `,
+				"url": "https://gerrit.jorts.io/c/jorts/testiness/+/1",
+				"status": "NEW"
+			},
+			"patchSet": {
+				"number": 1,
+				"revision": "beebeebeebeebeebeebeebeebeebeebeebeebeeb",
+				"uploader": ` + owner.JSON() + `,
+				"author": ` + owner.JSON() + `,
+				"kind": "REWORK"
+			},
+			"reviewer": ` + reviewer.JSON() + `,
+			"remover": ` + remover.JSON() + `,
+			"approvals": [{"type": "Code-Review", "description": "Code-Review", "value": "0", "oldValue": "2"}],
+			"type": "vote-deleted",
+			"eventCreatedOn": 1580355933
+		}`)
+	})
+}
+
+func TestDigestDelivery(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":        "https://gerrit.jorts.io",
+		"remove-project-prefix": "jorts/",
+	}, func(ts *testSystem) {
+		owner := ts.makeUser("owner@jorts.io", "owner", "Oh Ner")
+		reviewer := ts.makeUser("reviewer@jorts.io", "reviewer", "Ree Viewer")
+		remover := ts.makeUser("remover@jorts.io", "remover", "Ree Mover")
+
+		reply := ts.App.IncomingChatCommand(owner.chatID, "D1234", true, "!prefs delivery digest")
+		require.Equal(t, `Ok, "delivery" => "digest"`, reply)
+
+		// only the reviewer gets an immediate notification
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), reviewer.chatID, gomock.Any()).
+			Times(2).
+			Return(nil, nil)
+
+		for _, patchSetNum := range []string{"1", "2"} {
+			ts.InjectEvent(`{
+				"change": {
+					"project": "jorts/testiness",
+					"number": 1,
+					"subject": "beans",
+					"owner": ` + owner.JSON() + `,
+					"url": "https://gerrit.jorts.io/c/jorts/testiness/+/1"
+				},
+				"patchSet": {"number": ` + patchSetNum + `},
+				"reviewer": ` + reviewer.JSON() + `,
+				"remover": ` + remover.JSON() + `,
+				"approvals": [{"type": "Code-Review", "description": "Code-Review", "value": "0", "oldValue": "2"}],
+				"type": "vote-deleted",
+				"eventCreatedOn": 1580355933
+			}`)
+		}
+
+		// both events are collapsed into one digest entry for the change
+		ts.MockChat.EXPECT().
+			SendPersonalReport(gomock.Any(), owner.chatID, "Notification digest", []string{
+				"[testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans>\n" +
+					"• <@CHATID(remover)> removed Code-Review+2 vote from <@CHATID(reviewer)> on your change [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> patchset 1\n" +
+					"• <@CHATID(remover)> removed Code-Review+2 vote from <@CHATID(reviewer)> on your change [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> patchset 2",
+			}).
+			Times(1).
+			Return(nil, nil)
+		ts.App.SendDigests(ts.Ctx, time.Now())
+
+		// and the digest is not sent again
+		ts.App.SendDigests(ts.Ctx, time.Now())
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":        "https://gerrit.jorts.io",
+		"remove-project-prefix": "jorts/",
+		"global-notify-channel": "GLOBALNOTIFY",
+		"dry-run":               "true",
+	}, func(ts *testSystem) {
+		owner := ts.makeUser("owner@jorts.io", "owner", "Oh Ner")
+		reviewer := ts.makeUser("reviewer@jorts.io", "reviewer", "Ree Viewer")
+		remover := ts.makeUser("remover@jorts.io", "remover", "Ree Mover")
+		voteDeleted := `{
+			"change": {
+				"project": "jorts/testiness",
+				"number": 1,
+				"subject": "beans",
+				"owner": ` + owner.JSON() + `,
+				"url": "https://gerrit.jorts.io/c/jorts/testiness/+/1"
+			},
+			"patchSet": {"number": 1},
+			"reviewer": ` + reviewer.JSON() + `,
+			"remover": ` + remover.JSON() + `,
+			"approvals": [{"type": "Code-Review", "description": "Code-Review", "value": "0", "oldValue": "2"}],
+			"type": "vote-deleted",
+			"eventCreatedOn": 1580355933
+		}`
+
+		ts.MockGerrit.EXPECT().ServerVersion().AnyTimes().Return("3.9.1")
+		sentBefore := testutil.ToFloat64(metrics.NotificationsSent.WithLabelValues("T1", "votes-removed"))
+
+		// the owner's notification is recorded too, instead of being queued for a digest
+		reply := ts.App.IncomingChatCommand(owner.chatID, "D1234", true, "!prefs delivery digest")
+		require.Equal(t, `Ok, "delivery" => "digest"`, reply)
+
+		// nothing is sent; the mock fails on any call
+		ts.InjectEvent(voteDeleted)
+		ts.App.SendDigests(ts.Ctx, time.Now())
+		require.Equal(t, sentBefore, testutil.ToFloat64(metrics.NotificationsSent.WithLabelValues("T1", "votes-removed")))
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!dry-run")
+		require.Contains(t, reply, "Dry-run mode is on")
+		require.Contains(t, reply, "notification for <@"+reviewer.chatID+">")
+		require.Contains(t, reply, "channel-notification for <#GLOBALNOTIFY>")
+
+		status, err := ts.App.Status(ts.Ctx)
+		require.NoError(t, err)
+		require.True(t, status.DryRun)
+		require.Len(t, status.DryRunMessages, 3) // to the reviewer, the owner, and the channel
+		require.Contains(t, reply, "notification for <@"+owner.chatID+">")
+
+		// with a dry-run channel, everything goes there instead
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!config dry-run-channel <#TESTCHANNEL>")
+		require.Equal(t, "Ok", reply)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "TESTCHANNEL", "_Dry run (notification for <@"+reviewer.chatID+">):_\n<@CHATID(remover)> removed your Code-Review+2 vote on [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> patchset 1").
+			Times(1).
+			Return(nil, nil)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "TESTCHANNEL", gomock.Any()).
+			Times(2).
+			Return(nil, nil)
+		ts.InjectEvent(voteDeleted)
+
+		// and with dry-run mode off, messages are sent normally again
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!config dry-run false")
+		require.Equal(t, "Ok", reply)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), reviewer.chatID, gomock.Any()).
+			Times(1).
+			Return(nil, nil)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "GLOBALNOTIFY", gomock.Any()).
+			Times(1).
+			Return(nil, nil)
+		ts.InjectEvent(voteDeleted)
+		require.Equal(t, sentBefore+1, testutil.ToFloat64(metrics.NotificationsSent.WithLabelValues("T1", "votes-removed")))
+
+		// only the owner's last notification made it into the digest
+		ts.MockChat.EXPECT().
+			SendPersonalReport(gomock.Any(), owner.chatID, "Notification digest", gomock.Len(1)).
+			Times(1).
+			DoAndReturn(func(_ context.Context, _, _ string, items []string) (messages.MessageHandle, error) {
+				assert.Equal(t, 1, strings.Count(items[0], "\n•"))
+				return nil, nil
+			})
+		ts.App.SendDigests(ts.Ctx, time.Now())
+	})
+}
+
+func TestReplayEvents(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":        "https://gerrit.jorts.io",
+		"remove-project-prefix": "jorts/",
+		"global-notify-channel": "GLOBALNOTIFY",
+	}, func(ts *testSystem) {
+		owner := ts.makeUser("owner@jorts.io", "owner", "Oh Ner")
+		reviewer := ts.makeUser("reviewer@jorts.io", "reviewer", "Ree Viewer")
+		remover := ts.makeUser("remover@jorts.io", "remover", "Ree Mover")
+		voteDeleted := func(changeNum string) []byte {
+			return []byte(`{
+				"change": {
+					"project": "jorts/testiness",
+					"number": ` + changeNum + `,
+					"subject": "beans",
+					"owner": ` + owner.JSON() + `,
+					"url": "https://gerrit.jorts.io/c/jorts/testiness/+/` + changeNum + `"
+				},
+				"patchSet": {"number": 1},
+				"reviewer": ` + reviewer.JSON() + `,
+				"remover": ` + remover.JSON() + `,
+				"approvals": [{"type": "Code-Review", "description": "Code-Review", "value": "0", "oldValue": "2"}],
+				"type": "vote-deleted",
+				"eventCreatedOn": 1580355933
+			}`)
+		}
+		captureFile := filepath.Join(t.TempDir(), "T1.jsonl")
+		f, err := os.Create(captureFile)
+		require.NoError(t, err)
+		capture := events.NewCaptureWriter(f)
+		receivedAt := time.Now()
+		require.NoError(t, capture.Write(voteDeleted("1"), receivedAt))
+		require.NoError(t, capture.Write(voteDeleted("2"), receivedAt.Add(time.Second)))
+		require.NoError(t, f.Close())
+
+		// in dry-run mode, nothing is sent; the mock fails on any call
+		reply := ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!replay-events 5")
+		require.Equal(t, "Gerrit events are not being captured for this team.", reply)
+		ts.App.SetEventCaptureFile(captureFile)
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!replay-events 5 1000")
+		require.Equal(t, "Replayed 2 events in dry-run mode; see `!dry-run` for the results.", reply)
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!dry-run")
+		require.Contains(t, reply, "Dry-run mode is off")
+		require.Contains(t, reply, "testiness/+/1|beans")
+		require.Contains(t, reply, "testiness/+/2|beans")
+
+		// the rest of the team is not in dry-run mode, and a replay need not be either
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), gomock.Any(), gomock.Any()).
+			Times(2).
+			Return(nil, nil)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "GLOBALNOTIFY", gomock.Any()).
+			Times(1).
+			Return(nil, nil)
+		f, err = os.Open(captureFile)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, f.Close()) }()
+		count, err := ts.App.ReplayEvents(ts.Ctx, f, app.ReplayOptions{Last: 1})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestReplayEventsDryRunSideEffects(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":            "https://gerrit.jorts.io",
+		"remove-project-prefix":     "jorts/",
+		"autoassign.core.projects":  "jorts/*",
+		"autoassign.core.strategy":  "round-robin",
+		"autoassign.core.reviewers": "user_a,user_b,user_c",
+	}, func(ts *testSystem) {
+		userA := ts.makeUser("user-a@jorts.io", "user_a", "Yoozer Eyy")
+		newChange := func(changeNum int) []byte {
+			return []byte(`{
+				"uploader": ` + userA.JSON() + `,
+				"patchSet": {"number": 1, "uploader": ` + userA.JSON() + `, "kind": "REWORK"},
+				"change": {
+					"project": "jorts/testiness",
+					"number": ` + strconv.Itoa(changeNum) + `,
+					"subject": "beans",
+					"owner": ` + userA.JSON() + `,
+					"url": "https://gerrit.jorts.io/c/jorts/testiness/+/` + strconv.Itoa(changeNum) + `",
+					"status": "NEW"
+				},
+				"type": "patchset-created",
+				"eventCreatedOn": 1580356000
+			}`)
+		}
+		var capture bytes.Buffer
+		require.NoError(t, events.NewCaptureWriter(&capture).Write(newChange(1), time.Now()))
+
+		// reviewers are chosen, but not added; the mock fails on any AddReviewer call
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~1", "1").
+			Times(1).
+			Return(gerrit.ChangeInfo{}, nil)
+		count, err := ts.App.ReplayEvents(ts.Ctx, &capture, app.ReplayOptions{DryRun: true})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		reply := ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!dry-run")
+		require.Contains(t, reply, "I added reviewers to your change")
+
+		// the replayed event is not added to the history
+		history, err := ts.DB.GetEventHistory(ts.Ctx, time.Time{}, time.Now())
+		require.NoError(t, err)
+		require.Empty(t, history)
+
+		// and the rotation did not move on
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~2", "1").
+			Times(1).
+			Return(gerrit.ChangeInfo{}, nil)
+		ts.MockGerrit.EXPECT().
+			AddReviewer(gomock.Any(), "jorts/testiness~2", "user_b").
+			Times(1).
+			Return(nil)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), userA.chatID, gomock.Any()).
+			Times(1).
+			Return(nil, nil)
+		ts.InjectEvent(string(newChange(2)))
+		history, err = ts.DB.GetEventHistory(ts.Ctx, time.Time{}, time.Now())
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+	})
+}
+
+func TestAppStatus(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		ts.MockGerrit.EXPECT().ServerVersion().AnyTimes().Return("3.9.1")
+
+		status, err := ts.App.Status(ts.Ctx)
+		require.NoError(t, err)
+		require.Equal(t, app.Status{GerritConnected: true, GerritVersion: "3.9.1"}, status)
+
+		ts.InjectEvent(`{
+			"refUpdate": {"project": "jorts/testiness", "refName": "refs/heads/main"},
+			"type": "ref-updated",
+			"eventCreatedOn": 1580355933
+		}`)
+		require.NoError(t, ts.DB.AddDigestEntry(ts.Ctx, "CHATID(owner)", app.DigestEntry{ProjectName: "jorts/testiness", ChangeNum: 1, Kind: "comments", Message: "hi", CreatedAt: time.Now()}))
+
+		status, err = ts.App.Status(ts.Ctx)
+		require.NoError(t, err)
+		require.NotNil(t, status.LastEventReceived)
+		require.WithinDuration(t, time.Now(), *status.LastEventReceived, time.Minute)
+		require.Nil(t, status.LastReportSent)
+		require.Equal(t, 1, status.QueuedNotifications)
+	})
+}
+
+func TestHealthAlerts(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":             "https://gerrit.jorts.io",
+		"quiet-alert-hours":          "2",
+		"gerrit-failure-alert-count": "2",
+		"sla.core.projects":          "*",
+	}, func(ts *testSystem) {
+		// nothing to report yet
+		ts.App.CheckHealth(ts.Ctx, time.Now())
+
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, gomock.Any()).
+			Times(1).
+			DoAndReturn(func(_ context.Context, _, message string) (messages.MessageHandle, error) {
+				require.Contains(t, message, "No Gerrit events have been received in 7 days (2 working hours)")
+				return nil, nil
+			})
+		ts.App.CheckHealth(ts.Ctx, time.Now().AddDate(0, 0, 7))
+		// only alerted once
+		ts.App.CheckHealth(ts.Ctx, time.Now().AddDate(0, 0, 7))
+
+		ts.InjectEvent(`{
+			"refUpdate": {"project": "jorts/testiness", "refName": "refs/heads/main"},
+			"type": "ref-updated",
+			"eventCreatedOn": 1580355933
+		}`)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, gomock.Any()).
+			Times(1).
+			DoAndReturn(func(_ context.Context, _, message string) (messages.MessageHandle, error) {
+				require.Contains(t, message, "Gerrit events are arriving again")
+				return nil, nil
+			})
+		ts.App.CheckHealth(ts.Ctx, time.Now())
+
+		// Gerrit API failures; the SLA check is just a convenient way to make API calls
+		gomock.InOrder(
+			ts.MockGerrit.EXPECT().
+				QueryChangesEx(gomock.Any(), gomock.Any(), gomock.Any()).
+				Times(2).
+				Return(nil, false, errors.New("502 Bad Gateway")),
+			ts.MockGerrit.EXPECT().
+				QueryChangesEx(gomock.Any(), gomock.Any(), gomock.Any()).
+				Times(1).
+				Return(nil, false, nil),
+		)
+		ts.App.CheckSLAs(ts.Ctx, time.Now())
+		ts.App.CheckHealth(ts.Ctx, time.Now())
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, "The last 2 Gerrit API calls have failed. The most recent error was: 502 Bad Gateway").
+			Times(1).
+			Return(nil, nil)
+		ts.App.CheckSLAs(ts.Ctx, time.Now())
+		ts.App.CheckHealth(ts.Ctx, time.Now())
+
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, "Gerrit API calls are succeeding again.").
+			Times(1).
+			Return(nil, nil)
+		ts.App.CheckSLAs(ts.Ctx, time.Now())
+		ts.App.CheckHealth(ts.Ctx, time.Now())
+	})
+}
+
+func TestHealthAcrossInstances(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":             "https://gerrit.jorts.io",
+		"gerrit-failure-alert-count": "2",
+		"sla.core.projects":          "*",
+	}, func(leader *testSystem) {
+		other := leader.AnotherInstance()
+		defer func() { require.NoError(t, other.App.Close()) }()
+		leader.MockGerrit.EXPECT().ServerVersion().AnyTimes().Return("3.9.1")
+
+		// events arriving at the other instance are seen by the leader
+		other.InjectEvent(`{
+			"refUpdate": {"project": "jorts/testiness", "refName": "refs/heads/main"},
+			"type": "ref-updated",
+			"eventCreatedOn": 1580355933
+		}`)
+		status, err := leader.App.Status(leader.Ctx)
+		require.NoError(t, err)
+		require.NotNil(t, status.LastEventReceived)
+		require.WithinDuration(t, time.Now(), *status.LastEventReceived, time.Minute)
+
+		// and so are Gerrit failures there
+		gomock.InOrder(
+			other.MockGerrit.EXPECT().
+				QueryChangesEx(gomock.Any(), gomock.Any(), gomock.Any()).
+				Times(2).
+				Return(nil, false, errors.New("502 Bad Gateway")),
+			other.MockGerrit.EXPECT().
+				QueryChangesEx(gomock.Any(), gomock.Any(), gomock.Any()).
+				Times(1).
+				Return(nil, false, nil),
+		)
+		other.App.CheckSLAs(other.Ctx, time.Now())
+		other.App.CheckSLAs(other.Ctx, time.Now())
+		leader.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, "The last 2 Gerrit API calls have failed. The most recent error was: 502 Bad Gateway").
+			Times(1).
+			Return(nil, nil)
+		leader.App.CheckHealth(leader.Ctx, time.Now())
+
+		// the alert is not repeated if the other instance takes over as leader
+		other.App.CheckHealth(other.Ctx, time.Now())
+
+		other.App.CheckSLAs(other.Ctx, time.Now())
+		leader.MockChat.EXPECT().
+			SendNotification(gomock.Any(), adminUserID, "Gerrit API calls are succeeding again.").
+			Times(1).
+			Return(nil, nil)
+		leader.App.CheckHealth(leader.Ctx, time.Now())
+	})
+}
+
+func TestConfigAcrossInstances(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		other := ts.AnotherInstance()
+		defer func() { require.NoError(t, other.App.Close()) }()
+
+		// nothing has changed, so nothing is done
+		gerritClient := ts.MockGerrit
+		ts.App.SyncConfig(ts.Ctx)
+		require.Same(t, gerritClient, ts.MockGerrit)
+
+		// a change of Gerrit server through the other instance reaches this one too
+		reply := other.App.IncomingChatCommand(adminUserID, "D1234", true, "!config gerrit-address https://gerrit2.jorts.io")
+		require.Equal(t, "Ok", reply)
+		require.Same(t, gerritClient, ts.MockGerrit)
+		ts.App.SyncConfig(ts.Ctx)
+		require.NotSame(t, gerritClient, ts.MockGerrit)
+		gerritClient = ts.MockGerrit
+
+		// as do changes made directly in the DB, as with the operator CLI
+		require.NoError(t, ts.DB.SetConfig(ts.Ctx, "gerrit-http-username", "chihuahua"))
+		ts.App.SyncConfig(ts.Ctx)
+		require.NotSame(t, gerritClient, ts.MockGerrit)
+		gerritClient = ts.MockGerrit
+
+		// changes made here are not handled twice
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!config gerrit-http-password hunter2")
+		require.Equal(t, "Ok", reply)
+		require.NotSame(t, gerritClient, ts.MockGerrit)
+		gerritClient = ts.MockGerrit
+		ts.App.SyncConfig(ts.Ctx)
+		require.Same(t, gerritClient, ts.MockGerrit)
+	})
+}
+
+func TestUserCommands(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		reviewer := newHypotheticalUser("reviewer@jorts.io", "reviewer", "Ree Viewer", "", 0)
+		require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, reviewer.username, reviewer.chatID))
+
+		// non-admins get help, but don't see admin commands
+		reply := ts.App.IncomingChatCommand(reviewer.chatID, "D1234", true, "!help")
+		require.Contains(t, reply, "!reviews")
+		require.NotContains(t, reply, "!config")
+		reply = ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!help")
+		require.Contains(t, reply, "!config")
+
+		// ...and admin commands are still ignored
+		reply = ts.App.IncomingChatCommand(reviewer.chatID, "D1234", true, "!config")
+		require.Equal(t, "", reply)
+
+		reply = ts.App.IncomingChatCommand(reviewer.chatID, "D1234", true, "!whois reviewer")
+		require.Equal(t, "`reviewer` = <@CHATID(reviewer)>", reply)
+		reply = ts.App.IncomingChatCommand(reviewer.chatID, "D1234", true, "!whois <@CHATID(reviewer)>")
+		require.Equal(t, "<@CHATID(reviewer)> = `reviewer`", reply)
+
+		// unknown users don't get reports
+		reply = ts.App.IncomingChatCommand("stranger", "D5678", true, "!reviews")
+		require.Contains(t, reply, "I don't know which Gerrit account is yours")
+
+		// a recent scheduled report doesn't prevent an on-demand one
+		require.NoError(t, ts.DB.UpdateLastReportTime(ts.Ctx, reviewer.username, time.Now()))
+		ts.MockGerrit.EXPECT().
+			QueryChangesEx(gomock.Any(), gomock.Eq([]string{`reviewer:"reviewer" is:open -reviewedby:"reviewer" -owner:"reviewer" -is:wip -label:Verified=-1`}), gomock.Any()).
+			Times(1).
+			Return([]gerrit.ChangeInfo{{Project: "jorts/testiness", Number: 12, Subject: "beans", Created: "2020-01-30 03:45:33.000000000", Updated: "2020-01-30 03:45:33.000000000"}}, false, nil)
+		ts.MockGerrit.EXPECT().
+			URLForChange(gomock.Any()).
+			Return("https://gerrit.jorts.io/c/jorts/testiness/+/12")
+		ts.MockChat.EXPECT().
+			SendPersonalReport(gomock.Any(), reviewer.chatID, "Reviews assigned to you", gomock.Len(1)).
+			Times(1).
+			Return(nil, nil)
+		reply = ts.App.IncomingChatCommand(reviewer.chatID, "D1234", true, "!reviews")
+		require.Equal(t, "", reply)
+	})
+}
+
+func TestSelfServiceLinking(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		// the chat system knows this user by an email Gerrit only has as a secondary address
+		navi := newHypotheticalUser("navi@jorts.io", "navi", "Navi Xerdafies", "", 0)
+		ts.MockChat.EXPECT().LookupUserByEmail(gomock.Any(), "navi@old.jorts.io").AnyTimes().Return(nil, errors.New("no such user"))
+		ts.MockChat.EXPECT().LookupUserByEmail(gomock.Any(), "navi@jorts.io").AnyTimes().Return(navi, nil)
+		naviAccount := gerrit.AccountInfo{Username: "navi", Email: "navi@old.jorts.io", SecondaryEmails: []string{"navi@jorts.io"}}
+		ts.MockGerrit.EXPECT().
+			QueryAccountsEx(gomock.Any(), "username:navi", gomock.Any()).
+			Times(1).
+			Return([]gerrit.AccountInfo{naviAccount}, false, nil)
+
+		reply := ts.App.IncomingChatCommand(navi.chatID, "D1234", true, "!link navi")
+		require.Equal(t, "Ok, you are now linked to `navi`", reply)
+		reply = ts.App.IncomingChatCommand(navi.chatID, "D1234", true, "!link navi")
+		require.Equal(t, "You are already linked to `navi`", reply)
+		reply = ts.App.IncomingChatCommand("someone-else", "D5678", true, "!link navi")
+		require.Contains(t, reply, "already associated with another chat user")
+
+		reply = ts.App.IncomingChatCommand(navi.chatID, "D1234", true, "!unlink")
+		require.Contains(t, reply, "Ok, unlinked `navi`")
+		reply = ts.App.IncomingChatCommand(navi.chatID, "D1234", true, "!unlink")
+		require.Equal(t, "You are not linked to any Gerrit account.", reply)
+
+		// with no matching email and nowhere to send a code, the user has to ask an admin
+		ts.MockChat.EXPECT().LookupUserByEmail(gomock.Any(), "hilmac@jorts.io").AnyTimes().Return(nil, errors.New("no such user"))
+		hilmac := newHypotheticalUser("hilmac@jorts.io", "hilmac", "Hilmac Learnwiz", "", 0)
+		ts.MockGerrit.EXPECT().
+			QueryAccountsEx(gomock.Any(), "username:hilmac", gomock.Any()).
+			Times(2).
+			Return([]gerrit.AccountInfo{*hilmac.GerritAccount()}, false, nil)
+		reply = ts.App.IncomingChatCommand("CHATID(hilmac-on-chat)", "D1234", true, "!link hilmac")
+		require.Contains(t, reply, "Ask an admin to link you.")
+
+		// otherwise a one-time code is emailed to the Gerrit account
+		mail := startFakeSMTPServer(t)
+		reply = ts.App.IncomingChatCommand("CHATID(hilmac-on-chat)", "D1234", true, "!link hilmac")
+		require.Contains(t, reply, "I've emailed a one-time code")
+		sent := <-mail
+		require.Equal(t, []string{"hilmac@jorts.io"}, sent.To)
+		codeMatch := regexp.MustCompile(`!link confirm ([0-9a-f]+)`).FindStringSubmatch(sent.Data)
+		require.NotNil(t, codeMatch, sent.Data)
+
+		// the code only works for the chat user who asked for it
+		reply = ts.App.IncomingChatCommand("CHATID(someone-else)", "D5678", true, "!link confirm "+codeMatch[1])
+		require.Contains(t, reply, "That code is not right")
+		reply = ts.App.IncomingChatCommand("CHATID(hilmac-on-chat)", "D1234", true, "!link confirm 0123456789ab")
+		require.Contains(t, reply, "That code is not right")
+		reply = ts.App.IncomingChatCommand("CHATID(hilmac-on-chat)", "D1234", true, "!link confirm "+codeMatch[1])
+		require.Equal(t, "Ok, you are now linked to `hilmac`", reply)
+
+		chatID, err := ts.DB.LookupChatIDForGerritUser(ts.Ctx, "hilmac")
+		require.NoError(t, err)
+		require.Equal(t, "CHATID(hilmac-on-chat)", chatID)
+
+		// and codes only work once
+		reply = ts.App.IncomingChatCommand("CHATID(hilmac-on-chat)", "D1234", true, "!link confirm "+codeMatch[1])
+		require.Contains(t, reply, "That code is not right")
+	})
+}
+
+// fakeMail is an email received by a fake SMTP server.
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// startFakeSMTPServer starts an SMTP server which accepts any mail and passes it on through
+// the returned channel, and points -smtp-address at it for the rest of the test.
+func startFakeSMTPServer(t *testing.T) <-chan fakeMail {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mail := make(chan fakeMail, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, mail)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	setFlag(t, "smtp-address", listener.Addr().String())
+	setFlag(t, "smtp-from", "chihuahua@jorts.io")
+	return mail
+}
+
+func serveFakeSMTP(conn net.Conn, mail chan<- fakeMail) {
+	defer func() { _ = conn.Close() }()
+	text := textproto.NewConn(conn)
+	var current fakeMail
+	reply := func(line string) bool { return text.PrintfLine("%s", line) == nil }
+	if !reply("220 fake ESMTP") {
+		return
+	}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "MAIL":
+			current = fakeMail{From: strings.TrimSuffix(strings.TrimPrefix(line[len("MAIL FROM:"):], "<"), ">")}
+			reply("250 ok")
+		case "RCPT":
+			current.To = append(current.To, strings.TrimSuffix(strings.TrimPrefix(line[len("RCPT TO:"):], "<"), ">"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			mail <- current
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// setFlag sets a command-line flag for the rest of the test.
+func setFlag(t *testing.T, name, value string) {
+	old := flag.Lookup(name).Value.String()
+	require.NoError(t, flag.Set(name, value))
+	t.Cleanup(func() { _ = flag.Set(name, old) })
+}
+
+func TestMergedPersonalReports(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		navi := newHypotheticalUser("navi@jorts.io", "navi", "Navi Xerdafies", "", 0)
+		navi.isOnline = true
+		navi.tz = time.UTC
+		naviBot := newHypotheticalUser("navi-bot@jorts.io", "navi-bot", "Navi's Robot", navi.chatID, 0)
+		other := newHypotheticalUser("other@jorts.io", "other", "Oth Er", "", 0)
+		require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, navi.username, navi.chatID))
+		require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, naviBot.username, navi.chatID))
+
+		ts.MockGerrit.EXPECT().
+			QueryAccountsEx(gomock.Any(), "is:active", gomock.Any()).
+			Times(2).
+			Return([]gerrit.AccountInfo{*navi.GerritAccount(), *other.GerritAccount(), *naviBot.GerritAccount()}, false, nil)
+		ts.MockChat.EXPECT().
+			GetUserInfoByID(gomock.Any(), navi.chatID).
+			Times(1).
+			Return(navi, nil)
+
+		changeA := gerrit.ChangeInfo{Project: "jorts/jorts", Number: 1, Subject: "a", Owner: *other.GerritAccount()}
+		changeB := gerrit.ChangeInfo{Project: "jorts/jorts", Number: 2, Subject: "b", Owner: *other.GerritAccount()}
+		changeC := gerrit.ChangeInfo{Project: "jorts/jorts", Number: 3, Subject: "c", Owner: *navi.GerritAccount()}
+		ts.MockGerrit.EXPECT().
+			QueryChangesEx(gomock.Any(), gomock.Eq([]string{`reviewer:"navi" is:open -reviewedby:"navi" -owner:"navi" -is:wip -label:Verified=-1`}), gomock.Any()).
+			Times(1).
+			Return([]gerrit.ChangeInfo{changeA, changeB}, false, nil)
+		ts.MockGerrit.EXPECT().
+			QueryChangesEx(gomock.Any(), gomock.Eq([]string{`reviewer:"navi-bot" is:open -reviewedby:"navi-bot" -owner:"navi-bot" -is:wip -label:Verified=-1`}), gomock.Any()).
+			Times(1).
+			Return([]gerrit.ChangeInfo{changeB, changeC}, false, nil)
+		ts.MockGerrit.EXPECT().
+			URLForChange(gomock.Any()).
+			AnyTimes().
+			DoAndReturn(func(ch *gerrit.ChangeInfo) string {
+				return fmt.Sprintf("https://gerrit.jorts.io/c/%s/+/%d", ch.Project, ch.Number)
+			})
+
+		// one report, with each change once, and without changes owned by the other account
+		ts.MockChat.EXPECT().
+			SendPersonalReport(gomock.Any(), navi.chatID, "Reviews assigned to you", gomock.Len(2)).
+			Times(1).
+			DoAndReturn(func(_ context.Context, _, _ string, items []string) (messages.MessageHandle, error) {
+				assert.Contains(t, items[0], "jorts/jorts/+/1|a>")
+				assert.Contains(t, items[1], "jorts/jorts/+/2|b>")
+				return nil, nil
+			})
+
+		// a Wednesday, at a good time for reports
+		reportTime := time.Date(2026, time.October, 14, 15, 0, 0, 0, time.UTC)
+		ts.App.PersonalReports(ts.Ctx, reportTime)
+
+		// the report counts for both accounts
+		ts.App.PersonalReports(ts.Ctx, reportTime.Add(time.Hour))
+	})
+}
+
+func TestAutoAssignReviewers(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":             "https://gerrit.jorts.io",
+		"remove-project-prefix":      "jorts/",
+		"gerrit-http-username":       "chihuahua",
+		"autoassign.core.projects":   "jorts/*",
+		"autoassign.core.strategy":   "round-robin",
+		"autoassign.core.reviewers":  "user_a,user_b,user_c",
+		"autoassign.other.projects":  "elsewhere",
+		"autoassign.other.strategy":  "least-loaded",
+		"autoassign.other.reviewers": "user_c",
+	}, func(ts *testSystem) {
+		userA := ts.makeUser("user-a@jorts.io", "user_a", "Yoozer Eyy")
+		userB := ts.makeUser("user-b@jorts.io", "user_b", "Yoozer Bee")
+		userC := ts.makeUser("user-c@jorts.io", "user_c", "You Zersee")
+		require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, userB.username, userB.chatID))
+		require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, userC.username, userC.chatID))
+
+		newChange := func(changeNum int, owner *hypotheticalUser) {
+			ts.InjectEvent(`{
+				"uploader": ` + owner.JSON() + `,
+				"patchSet": {
+					"number": 1,
+					"revision": "d4c577711813d50b40525708b646f7b04cf910f6",
+					"uploader": ` + owner.JSON() + `,
+					"author": ` + owner.JSON() + `,
+					"kind": "REWORK"
+				},
+				"change": {
+					"project": "jorts/testiness",
+					"branch": "master",
+					"id": "Ide512e00237f102c771b7056d3e557586f82272a",
+					"number": ` + strconv.Itoa(changeNum) + `,
+					"subject": "beans",
+					"owner": ` + owner.JSON() + `,
+					"url": "https://gerrit.jorts.io/c/jorts/testiness/+/` + strconv.Itoa(changeNum) + `",
+					"status": "NEW"
+				},
+				"type": "patchset-created",
+				"eventCreatedOn": 1580356000
+			}`)
+		}
+
+		// the owner is skipped, so user_b is first in the rotation
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~1", "1").
+			Times(1).
+			Return(gerrit.ChangeInfo{}, nil)
+		ts.MockGerrit.EXPECT().
+			AddReviewer(gomock.Any(), "jorts/testiness~1", "user_b").
+			Times(1).
+			Return(nil)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), userA.chatID, "I added reviewers to your change [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans>, following the round-robin rule `core`:\n• <@CHATID(user_b)> (next in rotation)").
+			Times(1).
+			Return(nil, nil)
+		newChange(1, userA)
+
+		// the rotation continues where it left off
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~2", "1").
+			Times(1).
+			Return(gerrit.ChangeInfo{}, nil)
+		ts.MockGerrit.EXPECT().
+			AddReviewer(gomock.Any(), "jorts/testiness~2", "user_c").
+			Times(1).
+			Return(nil)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), userA.chatID, "I added reviewers to your change [testiness@2] <https://gerrit.jorts.io/c/jorts/testiness/+/2|beans>, following the round-robin rule `core`:\n• <@CHATID(user_c)> (next in rotation)").
+			Times(1).
+			Return(nil, nil)
+		newChange(2, userA)
+
+		// changes which already have reviewers are left alone
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~3", "1").
+			Times(1).
+			Return(gerrit.ChangeInfo{Reviewers: map[string][]gerrit.AccountInfo{"REVIEWER": {*userC.GerritAccount()}}}, nil)
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), userC.chatID, gomock.Any()).
+			Times(1).
+			Return(nil, nil)
+		newChange(3, userB)
+	})
+}
+
+func TestSLAReminders(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":            "https://gerrit.jorts.io",
+		"remove-project-prefix":     "jorts/",
+		"sla.core.projects":         "jorts/*",
+		"sla.core.reminder-hours":   "8",
+		"sla.core.escalation-hours": "24",
+		"sla.core.channel":          "SLACHANNEL",
+		"sla.other.projects":        "elsewhere",
+		"sla.other.reminder-hours":  "1",
+	}, func(ts *testSystem) {
+		owner := ts.makeUser("owner@jorts.io", "owner", "Oh Ner")
+		slowpoke := ts.makeUser("slowpoke@jorts.io", "slowpoke", "Slow Poke")
+		speedy := ts.makeUser("speedy@jorts.io", "speedy", "Speedy G")
+		slowpoke.tz = time.UTC
+		ts.MockChat.EXPECT().
+			GetUserInfoByID(gomock.Any(), slowpoke.chatID).
+			AnyTimes().
+			Return(slowpoke, nil)
+
+		// both reviewers were added on Monday morning, and only speedy has responded
+		change := gerrit.ChangeInfo{
+			Project: "jorts/testiness",
+			Number:  1,
+			Subject: "beans",
+			Created: "2026-10-12 08:00:00.000000000",
+			Owner:   *owner.GerritAccount(),
+			Reviewers: map[string][]gerrit.AccountInfo{
+				"REVIEWER": {*slowpoke.GerritAccount(), *speedy.GerritAccount()},
+			},
+			ReviewerUpdates: []gerrit.ReviewerUpdateInfo{
+				{Updated: "2026-10-12 09:00:00.000000000", Reviewer: slowpoke.GerritAccount(), State: "REVIEWER"},
+				{Updated: "2026-10-12 09:00:00.000000000", Reviewer: speedy.GerritAccount(), State: "REVIEWER"},
+			},
+			Messages: []gerrit.ChangeMessageInfo{
+				{Author: *speedy.GerritAccount(), Date: "2026-10-12 09:30:00.000000000", Message: "Patch Set 1: Code-Review+1"},
+			},
+		}
+		ts.MockGerrit.EXPECT().
+			QueryChangesEx(gomock.Any(), []string{"is:open -is:wip"}, gomock.Any()).
+			AnyTimes().
+			Return([]gerrit.ChangeInfo{change}, false, nil)
+		ts.MockGerrit.EXPECT().
+			URLForChange(gomock.Any()).
+			AnyTimes().
+			Return("https://gerrit.jorts.io/c/jorts/testiness/+/1")
+
+		// 7 working hours later, nothing happens yet
+		ts.App.CheckSLAs(ts.Ctx, time.Date(2026, 10, 12, 16, 0, 0, 0, time.UTC))
+
+		// 9 working hours later, the reviewer is reminded, once
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), slowpoke.chatID, "Reminder: <@CHATID(owner)> has been waiting 9 working hours for your review on [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans>").
+			Times(1).
+			Return(nil, nil)
+		ts.App.CheckSLAs(ts.Ctx, time.Date(2026, 10, 13, 10, 0, 0, 0, time.UTC))
+		ts.App.CheckSLAs(ts.Ctx, time.Date(2026, 10, 13, 11, 0, 0, 0, time.UTC))
+
+		// 25 working hours later, the owner and the channel are told, once
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), owner.chatID, "<@CHATID(slowpoke)> has not responded to the review request on your change [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> in 25 working hours").
+			Times(1).
+			Return(nil, nil)
+		ts.MockChat.EXPECT().
+			SendChannelNotification(gomock.Any(), "SLACHANNEL", "Slow Poke has not responded to the review request on [testiness@1] <https://gerrit.jorts.io/c/jorts/testiness/+/1|beans> in 25 working hours (SLA `core`)").
+			Times(1).
+			Return(nil, nil)
+		ts.App.CheckSLAs(ts.Ctx, time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC))
+		ts.App.CheckSLAs(ts.Ctx, time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC))
+	})
+}
+
+func TestBotGerritAccess(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address":       "https://gerrit.jorts.io",
+		"gerrit-http-username": "chihuahua",
+	}, func(ts *testSystem) {
+		const refusal = "This command would use my Gerrit account"
+
+		// with an authenticated Gerrit client, only admins can see changes through the bot
+		for _, command := range []string{"!mine", "!status 12", "!stats jorts/testiness"} {
+			require.Contains(t, ts.App.IncomingChatCommand("stranger", "D5678", true, command), refusal, command)
+			require.NotContains(t, ts.App.IncomingChatCommand(adminUserID, "D1234", true, command+" bad-usage"), refusal, command)
+		}
+
+		// unless that access is shared with everyone
+		require.Equal(t, "Ok", ts.App.IncomingChatCommand(adminUserID, "D1234", true, "!config share-bot-gerrit-access true"))
+		reply := ts.App.IncomingChatCommand("stranger", "D5678", true, "!mine")
+		require.Contains(t, reply, "I don't know which Gerrit account is yours")
+	})
+}
+
+func TestWhoisDoesNotGuess(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		// Gerrit may match another account than the one asked about, which must not be
+		// associated with anyone
+		other := newHypotheticalUser("other@jorts.io", "other", "Oth Er", "", 0)
+		ts.MockGerrit.EXPECT().
+			QueryAccountsEx(gomock.Any(), `username:"oth"`, gomock.Any()).
+			Times(1).
+			Return([]gerrit.AccountInfo{*other.GerritAccount()}, false, nil)
+		reply := ts.App.IncomingChatCommand("stranger", "D5678", true, "!whois oth")
+		require.Equal(t, "`oth` is not associated with any chat user", reply)
+		_, err := ts.DB.LookupGerritUser(ts.Ctx, "other")
+		require.Error(t, err)
+	})
+}
+
+func TestPatchSetCreatedLinkedAccounts(t *testing.T) {
+	testWithMockChat(t, map[string]string{
+		"gerrit-address": "https://gerrit.jorts.io",
+	}, func(ts *testSystem) {
+		navi := newHypotheticalUser("navi@jorts.io", "navi", "Navi Xerdafies", "", 0)
+		naviBot := newHypotheticalUser("navi-bot@jorts.io", "navi-bot", "Navi's Robot", navi.chatID, 0)
+		owner := newHypotheticalUser("owner@jorts.io", "owner", "Own Er", "", 0)
+		ownerAlt := newHypotheticalUser("owner-alt@jorts.io", "owner-alt", "Own Er (work)", owner.chatID, 0)
+		for _, hu := range []*hypotheticalUser{navi, naviBot, owner, ownerAlt} {
+			require.NoError(t, ts.DB.AssociateChatIDWithGerritUser(ts.Ctx, hu.username, hu.chatID))
+		}
+
+		ts.MockGerrit.EXPECT().
+			GetPatchSetInfo(gomock.Any(), "jorts/testiness~5", gomock.Any()).
+			Times(2).
+			Return(gerrit.ChangeInfo{
+				Reviewers: map[string][]gerrit.AccountInfo{
+					"REVIEWER": {*navi.GerritAccount(), *ownerAlt.GerritAccount()},
+					"CC":       {*naviBot.GerritAccount()},
+				},
+			}, nil)
+
+		// each patchset reaches navi once, in spite of the two accounts, and the owner is
+		// not told about their own patchsets as a reviewer, whichever account they use
+		ts.MockChat.EXPECT().
+			SendNotification(gomock.Any(), navi.chatID, gomock.Any()).
+			Times(2).
+			Return(nil, nil)
+
+		for patchSet, uploader := range map[int]*hypotheticalUser{2: owner, 3: ownerAlt} {
+			ts.InjectEvent(`{
+				"uploader": ` + uploader.JSON() + `,
+				"patchSet": {
+					"number": ` + strconv.Itoa(patchSet) + `,
+					"revision": "d4c577711813d50b40525708b646f7b04cf910f6",
+					"uploader": ` + uploader.JSON() + `,
+					"kind": "REWORK"
+				},
+				"change": {
+					"project": "jorts/testiness",
+					"branch": "main",
+					"id": "I6b9b3c4bba6f6a6ff5d5b4e3bd3c2c0c2dd6f9a1",
+					"number": 5,
+					"subject": "Test all the things",
+					"owner": ` + owner.JSON() + `,
+					"url": "https://gerrit.jorts.io/c/jorts/testiness/+/5",
+					"status": "NEW"
+				},
+				"type": "patchset-created",
+				"eventCreatedOn": 1580355933
+			}`)
+		}
+	})
+}
+
 func TestTeamReports(t *testing.T) {
 	testWithMockChat(t, map[string]string{
 		"gerrit-address":                       "https://gerrit.jorts.io",
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// dumpTables lists the tables of a team's persistent DB, in the order they are exported and
+// imported. New tables need to be added here.
+var dumpTables = []string{
+	"team_configs",
+	"gerrit_users",
+	"inline_comments",
+	"patchset_announcements",
+	"user_prefs",
+	"digest_entries",
+	"notify_routes",
+	"pending_links",
+	"autoassign_state",
+	"sla_reminders",
+	"event_history",
+	"dry_run_messages",
+	"health_state",
+}
+
+// dumpRecord is a single line of a DB dump: one row of one table.
+type dumpRecord struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+// Export writes the entire contents of the persistent DB to w, as JSON lines. The result can
+// be loaded into another persistent DB, of any type, with Import. The values of secret config
+// items are masked, and need to be set again after an import.
+func (ud *PersistentDB) Export(ctx context.Context, w io.Writer) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	encoder := json.NewEncoder(w)
+	for _, table := range dumpTables {
+		if err := ud.exportTable(ctx, encoder, table); err != nil {
+			return errs.New("exporting %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (ud *PersistentDB) exportTable(ctx context.Context, encoder *json.Encoder, table string) (err error) {
+	rows, err := ud.db.DB.QueryContext(ctx, "SELECT * FROM "+table)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		record := dumpRecord{Table: table, Row: make(map[string]interface{}, len(columns))}
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			record.Row[column] = values[i]
+		}
+		if key, ok := record.Row["config_key"].(string); ok && table == "team_configs" && isSecretConfigItem(key) {
+			record.Row["config_value"] = secretConfigPlaceholder
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import loads a dump made by Export. If replace is true, the existing contents of every
+// table are deleted first; otherwise, rows which conflict with existing rows cause the import
+// to fail. Either way, nothing is changed unless the whole import succeeds. Secret config
+// items masked by Export are skipped, and any which are not masked are sealed.
+func (ud *PersistentDB) Import(ctx context.Context, r io.Reader, replace bool) (count int, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	tx, err := ud.db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	knownTables := make(map[string]bool, len(dumpTables))
+	for _, table := range dumpTables {
+		knownTables[table] = true
+		if replace {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+				return 0, errs.New("clearing %s: %w", table, err)
+			}
+		}
+	}
+
+	columns := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record dumpRecord
+		decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			return count, errs.New("line %d: %w", lineNum, err)
+		}
+		if !knownTables[record.Table] {
+			return count, errs.New("line %d: unknown table %q", lineNum, record.Table)
+		}
+		if key, ok := record.Row["config_key"].(string); ok && record.Table == "team_configs" && isSecretConfigItem(key) {
+			value, _ := record.Row["config_value"].(string)
+			if value == secretConfigPlaceholder {
+				continue
+			}
+			if !strings.HasPrefix(value, sealedPrefix) {
+				if record.Row["config_value"], err = ud.sealConfigValue(key, value); err != nil {
+					return count, errs.New("line %d: %w", lineNum, err)
+				}
+			}
+		}
+		if _, ok := columns[record.Table]; !ok {
+			columns[record.Table], err = tableColumns(ctx, tx, record.Table)
+			if err != nil {
+				return count, errs.New("examining %s: %w", record.Table, err)
+			}
+		}
+		if err := ud.importRow(ctx, tx, record, columns[record.Table]); err != nil {
+			return count, errs.New("line %d: %w", lineNum, err)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// importRow inserts one row from a dump. tableColumns gives the table's columns, each mapped
+// to whether it is a timestamp column, and any other column names in the row are refused,
+// since they go into the SQL as is.
+func (ud *PersistentDB) importRow(ctx context.Context, tx *sql.Tx, record dumpRecord, tableColumns map[string]bool) error {
+	columns := make([]string, 0, len(record.Row))
+	placeholders := make([]string, 0, len(record.Row))
+	values := make([]interface{}, 0, len(record.Row))
+	for column, value := range record.Row {
+		isTimestamp, ok := tableColumns[column]
+		if !ok {
+			return errs.New("unknown column %q in %s", column, record.Table)
+		}
+		if s, ok := value.(string); ok && isTimestamp {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return errs.New("column %s: %w", column, err)
+			}
+			value = t
+		}
+		columns = append(columns, column)
+		placeholders = append(placeholders, "?")
+		values = append(values, value)
+	}
+	_, err := tx.ExecContext(ctx, ud.db.Rebind(
+		"INSERT INTO "+record.Table+" ("+strings.Join(columns, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+")"),
+		values...)
+	return err
+}
+
+// tableColumns returns the names of the columns in a table, each mapped to whether it is a
+// timestamp column, whose values are exported as strings and need to be converted back.
+func tableColumns(ctx context.Context, tx *sql.Tx, table string) (columns map[string]bool, err error) {
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+table+" WHERE 1=0")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns = make(map[string]bool)
+	for _, columnType := range columnTypes {
+		columns[columnType.Name()] = strings.Contains(strings.ToUpper(columnType.DatabaseTypeName()), "TIMESTAMP")
+	}
+	return columns, nil
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpTablesComplete(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		rows, err := db.db.DB.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'")
+		require.NoError(t, err)
+		var tables []string
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			tables = append(tables, name)
+		}
+		require.NoError(t, rows.Err())
+		require.NoError(t, rows.Close())
+
+		expected := append([]string(nil), dumpTables...)
+		sort.Strings(expected)
+		sort.Strings(tables)
+		assert.Equal(t, expected, tables, "every table must be listed in dumpTables")
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	lastReport := time.Date(2026, 10, 1, 9, 30, 0, 0, time.UTC)
+	var dump bytes.Buffer
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		require.NoError(t, db.SetConfig(ctx, "team-reports", "daily"))
+		require.NoError(t, db.SetConfig(ctx, "gerrit-http-password", "hunter2"))
+		require.NoError(t, db.AssociateChatIDWithGerritUser(ctx, "noodle", "U1E9A928BCD"))
+		require.NoError(t, db.UpdateLastReportTime(ctx, "noodle", lastReport))
+		require.NoError(t, db.SetUserPref(ctx, "U1E9A928BCD", "notify.comments", "false"))
+		require.NoError(t, db.SetRoundRobinPosition(ctx, "backend", 3))
+		require.NoError(t, db.Export(ctx, &dump))
+	})
+	// secrets are not exported, whether sealed or not
+	assert.NotContains(t, dump.String(), "hunter2")
+	assert.NotContains(t, dump.String(), sealedPrefix)
+
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		require.NoError(t, db.SetConfig(ctx, "team-reports", "weekly"))
+
+		// conflicting rows fail the whole import
+		_, err := db.Import(ctx, bytes.NewReader(dump.Bytes()), false)
+		require.Error(t, err)
+		_, err = db.LookupGerritUser(ctx, "noodle")
+		require.Error(t, err)
+
+		count, err := db.Import(ctx, bytes.NewReader(dump.Bytes()), true)
+		require.NoError(t, err)
+		assert.Equal(t, 4, count)
+
+		assert.Equal(t, "daily", db.JustGetConfig(ctx, "team-reports", ""))
+		assert.Equal(t, "", db.JustGetConfig(ctx, "gerrit-http-password", ""))
+		user, err := db.LookupGerritUser(ctx, "noodle")
+		require.NoError(t, err)
+		assert.Equal(t, "U1E9A928BCD", user.ChatId)
+		require.NotNil(t, user.LastReport)
+		assert.True(t, lastReport.Equal(*user.LastReport))
+		assert.Equal(t, "false", db.JustGetUserPref(ctx, "U1E9A928BCD", "notify.comments", "true"))
+		position, err := db.GetRoundRobinPosition(ctx, "backend")
+		require.NoError(t, err)
+		assert.Equal(t, 3, position)
+	})
+}
+
+func TestImportUnknownColumns(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		for _, line := range []string{
+			`{"table":"team_configs","row":{"config_key":"a","config_value":"b","nonexistent":"c"}}`,
+			`{"table":"team_configs","row":{"config_key":"a","config_value\t--":"b"}}`,
+			`{"table":"team_configs","row":{"config_key":"a","config_value) VALUES ('x', 'y'); DROP TABLE gerrit_users; --":"b"}}`,
+		} {
+			_, err := db.Import(ctx, bytes.NewReader([]byte(line)), false)
+			require.ErrorContains(t, err, "unknown column", line)
+		}
+		_, err := db.Import(ctx, bytes.NewReader([]byte(`{"table":"team_configs","row":{"config_key":"a","config_value":"b"}}`)), false)
+		require.NoError(t, err)
+		assert.Equal(t, "b", db.JustGetConfig(ctx, "a", ""))
+	})
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+	"github.com/storj/changesetchihuahua/metrics"
+)
+
+const (
+	digestIntervalPrefKey = "digest-interval"
+
+	digestHourly     = "hourly"
+	digestTwiceDaily = "twice-daily"
+
+	// digestMiddayHour is the hour (in each user's local time zone) when the second of the
+	// twice-daily digests is sent. The first is sent at workingDayStartHour.
+	digestMiddayHour = 13
+)
+
+// isDigestUser determines whether the given chat user has asked for their notifications to be
+// delivered in a digest rather than immediately.
+func (a *App) isDigestUser(ctx context.Context, chatID string) bool {
+	return a.persistentDB.JustGetUserPref(ctx, chatID, deliveryPrefKey, deliveryImmediate) == deliveryDigest
+}
+
+// shouldDeliverImmediately determines whether a notification of the given kind should skip
+// the digest and be sent right away even for users who have digest delivery enabled. Build
+// results and review reminders are time-sensitive, and a user being directly mentioned is
+// assumed to want to know about it as soon as possible.
+func shouldDeliverImmediately(gerritUser *events.Account, kind notificationKind, message string) bool {
+	if kind == notifyBuildResults || kind == notifyReviewReminders {
+		return true
+	}
+	return mentionsUser(message, gerritUser)
+}
+
+// mentionsUser determines whether a message contains a Gerrit-style @-mention of the given
+// user (by username or email address). This is called for every notification, so it scans
+// for mentions directly instead of compiling a regexp per handle.
+func mentionsUser(message string, gerritUser *events.Account) bool {
+	for _, handle := range []string{gerritUser.Username, gerritUser.Email} {
+		if handle == "" {
+			continue
+		}
+		mention := "@" + handle
+		for offset := 0; offset < len(message); {
+			i := strings.Index(message[offset:], mention)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			end := start + len(mention)
+			if mentionStartsAt(message, start) && mentionEndsAt(message, end) {
+				return true
+			}
+			offset = start + 1
+		}
+	}
+	return false
+}
+
+// mentionStartsAt reports whether an @-mention can begin at the given index of message: it
+// must not be part of a word or of a chat-style <@...> reference.
+func mentionStartsAt(message string, start int) bool {
+	if start == 0 {
+		return true
+	}
+	prev := message[start-1]
+	return prev != '<' && !isWordByte(prev)
+}
+
+// mentionEndsAt reports whether an @-mention can end at the given index of message: it must
+// not run on into a longer username or email address, though a sentence-ending period is ok.
+func mentionEndsAt(message string, end int) bool {
+	if end == len(message) {
+		return true
+	}
+	switch next := message[end]; {
+	case next == '.':
+		return end+1 == len(message) || isSpaceByte(message[end+1])
+	case next == '@' || next == '-':
+		return false
+	default:
+		return !isWordByte(next)
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+func (a *App) queueDigestEntry(ctx context.Context, chatID string, change *events.Change, kind notificationKind, message string) error {
+	return a.persistentDB.AddDigestEntry(ctx, chatID, DigestEntry{
+		ProjectName: change.Project,
+		ChangeNum:   change.Number,
+		ChangeLink:  a.formatChangeLink(change),
+		Kind:        string(kind),
+		Message:     message,
+		CreatedAt:   time.Now(),
+	})
+}
+
+// PeriodicDigests delivers notification digests to users who have asked for them. Like
+// PeriodicPersonalReports, this runs close to the top of every UTC hour, and each user's
+// digest-interval preference determines whether their digest is sent on that hour.
+func (a *App) PeriodicDigests(ctx context.Context, getTime func() time.Time) error {
+	now := getTime()
+	timer := time.NewTimer(now.UTC().Truncate(time.Hour).Add(time.Hour).Sub(now))
+
+	for {
+		select {
+		case t := <-timer.C:
+			a.SendDigests(detach(ctx), t)
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return ctx.Err()
+		}
+
+		now = getTime()
+		timer.Reset(now.UTC().Truncate(time.Hour).Add(time.Hour).Sub(now))
+	}
+}
+
+// SendDigests sends out the accumulated notification digests for all users who are due for
+// one at time t.
+func (a *App) SendDigests(ctx context.Context, t time.Time) {
+	defer metrics.ObserveSince(metrics.ReportDuration.WithLabelValues(a.teamID, "digest"), time.Now())
+	chatIDs, err := a.persistentDB.GetChatIDsWithDigestEntries(ctx)
+	if err != nil {
+		a.logger.Error("failed to look up users with pending digests", zap.Error(err))
+		return
+	}
+	for _, chatID := range chatIDs {
+		if !a.isDigestDue(ctx, chatID, t) {
+			continue
+		}
+		a.SendDigestToUser(ctx, chatID, t)
+	}
+}
+
+func (a *App) isDigestDue(ctx context.Context, chatID string, t time.Time) bool {
+	interval := a.persistentDB.JustGetUserPref(ctx, chatID, digestIntervalPrefKey, digestHourly)
+	if interval != digestTwiceDaily {
+		return true
+	}
+	hour := t.In(a.chatUserTimezone(ctx, chatID)).Hour()
+	return hour == workingDayStartHour || hour == digestMiddayHour
+}
+
+// SendDigestToUser sends a single digest message to the given chat user containing all of the
+// notifications held for them up to time t, grouped by change, and then discards those
+// notifications.
+func (a *App) SendDigestToUser(ctx context.Context, chatID string, t time.Time) {
+	logger := a.logger.With(zap.String("chat-id", chatID), zap.Time("digest-time", t))
+	entries, err := a.persistentDB.GetDigestEntries(ctx, chatID)
+	if err != nil {
+		logger.Error("failed to retrieve digest entries", zap.Error(err))
+		return
+	}
+	var included []DigestEntry
+	for _, entry := range entries {
+		if !entry.CreatedAt.After(t) {
+			included = append(included, entry)
+		}
+	}
+	if len(included) == 0 {
+		return
+	}
+	if _, err := a.chat.SendPersonalReport(ctx, chatID, "Notification digest", formatDigestItems(included)); err != nil {
+		logger.Error("failed to send digest", zap.Error(err))
+		return
+	}
+	if err := a.persistentDB.DeleteDigestEntries(ctx, chatID, included[len(included)-1].CreatedAt); err != nil {
+		logger.Error("failed to clear delivered digest entries", zap.Error(err))
+	}
+	logger.Info("sent digest", zap.Int("num-entries", len(included)))
+}
+
+// formatDigestItems collapses all digest entries for the same change into a single report
+// item, headed by the change link. Changes appear in the order of their earliest entry.
+func formatDigestItems(entries []DigestEntry) []string {
+	type changeKey struct {
+		project string
+		number  int
+	}
+	var order []changeKey
+	grouped := make(map[changeKey][]DigestEntry)
+	for _, entry := range entries {
+		key := changeKey{project: entry.ProjectName, number: entry.ChangeNum}
+		if _, ok := grouped[key]; !ok {
+			order = append(order, key)
+		}
+		grouped[key] = append(grouped[key], entry)
+	}
+	items := make([]string, 0, len(order))
+	for _, key := range order {
+		changeEntries := grouped[key]
+		lines := make([]string, 0, len(changeEntries)+1)
+		lines = append(lines, changeEntries[0].ChangeLink)
+		for _, entry := range changeEntries {
+			lines = append(lines, fmt.Sprintf("• %s", entry.Message))
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return items
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+func TestMentionsUser(t *testing.T) {
+	user := &events.Account{Username: "navi", Email: "navi@jorts.io"}
+	assert.True(t, mentionsUser("@navi what do you think?", user))
+	assert.True(t, mentionsUser("what do you think, @navi?", user))
+	assert.True(t, mentionsUser("ask @navi.", user))
+	assert.True(t, mentionsUser("cc @navi@jorts.io", user))
+	assert.True(t, mentionsUser("ask @navigator, or failing that @navi", user))
+	assert.True(t, mentionsUser("ask @navi.\nthanks", user))
+	assert.False(t, mentionsUser("ask @navigator", user))
+	assert.False(t, mentionsUser("ask @navi.x", user))
+	assert.False(t, mentionsUser("email navi@jorts.io", user))
+	assert.False(t, mentionsUser("<@navi> is a chat link", user))
+}
+
+func TestFormatDigestItems(t *testing.T) {
+	now := time.Now()
+	items := formatDigestItems([]DigestEntry{
+		{ProjectName: "jorts", ChangeNum: 2, ChangeLink: "[jorts@2]", Message: "first", CreatedAt: now},
+		{ProjectName: "jorts", ChangeNum: 1, ChangeLink: "[jorts@1]", Message: "second", CreatedAt: now.Add(time.Second)},
+		{ProjectName: "jorts", ChangeNum: 2, ChangeLink: "[jorts@2]", Message: "third", CreatedAt: now.Add(2 * time.Second)},
+		{ProjectName: "shorts", ChangeNum: 2, ChangeLink: "[shorts@2]", Message: "fourth", CreatedAt: now.Add(3 * time.Second)},
+	})
+	assert.Equal(t, []string{
+		"[jorts@2]\n• first\n• third",
+		"[jorts@1]\n• second",
+		"[shorts@2]\n• fourth",
+	}, items)
+}
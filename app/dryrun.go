@@ -0,0 +1,324 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/messages"
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+// dryRunChat wraps a team's chat system so that new behavior can be tried out on a live
+// workspace. While the dry-run config item is on, messages and reactions are logged and
+// recorded in the persistent DB instead of being sent. If dry-run-channel is also set, the
+// messages are sent to that channel instead of to their real recipients.
+//
+// Lookups, replies to chat commands, and chat events are not affected.
+type dryRunChat struct {
+	slack.EventedChatSystem
+
+	logger       *zap.Logger
+	fmt          messages.ChatSystemFormatter
+	persistentDB *PersistentDB
+	getTime      func() time.Time
+}
+
+func newDryRunChat(logger *zap.Logger, chat slack.EventedChatSystem, chatFormatter messages.ChatSystemFormatter, persistentDB *PersistentDB) *dryRunChat {
+	return &dryRunChat{
+		EventedChatSystem: chat,
+		logger:            logger.Named("dry-run"),
+		fmt:               chatFormatter,
+		persistentDB:      persistentDB,
+		getTime:           time.Now,
+	}
+}
+
+// dryRunHandle is the MessageHandle of a message which was recorded instead of sent.
+type dryRunHandle struct {
+	ID     string    `json:"dry_run_id"`
+	SentAt time.Time `json:"sent_at"`
+	// Redirected is the handle of the copy of the message sent to the dry-run channel, if
+	// there was one.
+	Redirected json.RawMessage `json:"redirected,omitempty"`
+}
+
+func (h *dryRunHandle) SentTime() time.Time {
+	return h.SentAt
+}
+
+func (h *dryRunHandle) MarshalJSON() ([]byte, error) {
+	type plain dryRunHandle
+	return json.Marshal((*plain)(h))
+}
+
+// forcedDryRunKey is the context key for withDryRun.
+type forcedDryRunKey struct{}
+
+// withDryRun returns a context in which messages are handled as in dry-run mode, whatever
+// the team's configuration, and redirected to channelID if it is not empty.
+func withDryRun(ctx context.Context, channelID string) context.Context {
+	return context.WithValue(ctx, forcedDryRunKey{}, channelID)
+}
+
+// mode reports whether messages sent with ctx should be handled in dry-run mode and, if so,
+// the channel to which they should be redirected, if any.
+func (d *dryRunChat) mode(ctx context.Context) (dryRun bool, channelID string) {
+	if channelID, ok := ctx.Value(forcedDryRunKey{}).(string); ok {
+		return true, channelID
+	}
+	return dryRunMode(ctx, d.persistentDB)
+}
+
+// isDryRun reports whether messages sent with ctx are handled in dry-run mode, either
+// because the team is configured that way or because ctx came from withDryRun.
+func (a *App) isDryRun(ctx context.Context) bool {
+	if isForcedDryRun(ctx) {
+		return true
+	}
+	dryRun, _ := dryRunMode(ctx, a.persistentDB)
+	return dryRun
+}
+
+// isForcedDryRun reports whether ctx came from withDryRun, as when captured events are
+// replayed with !replay-events.
+func isForcedDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(forcedDryRunKey{}).(string)
+	return ok
+}
+
+// isDryRunHandle reports whether handle belongs to a message which was recorded by
+// dryRunChat instead of being sent.
+func isDryRunHandle(handle messages.MessageHandle) bool {
+	_, ok := handle.(*dryRunHandle)
+	return ok
+}
+
+// dryRunMode reports whether the team is in dry-run mode and, if so, the channel to which
+// messages should be redirected, if any.
+func dryRunMode(ctx context.Context, persistentDB *PersistentDB) (dryRun bool, channelID string) {
+	if !persistentDB.JustGetConfigBool(ctx, "dry-run", false) {
+		return false, ""
+	}
+	return true, persistentDB.JustGetConfig(ctx, "dry-run-channel", "")
+}
+
+func (d *dryRunChat) SendNotification(ctx context.Context, chatID, message string) (messages.MessageHandle, error) {
+	return d.send(ctx, "notification", d.fmt.FormatUserLink(chatID), chatID, message,
+		func() (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendNotification(ctx, chatID, message)
+		},
+		func(channelID, note string) (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelNotification(ctx, channelID, note+"\n"+message)
+		})
+}
+
+func (d *dryRunChat) SendPersonalReport(ctx context.Context, chatID, title string, reportItems []string) (messages.MessageHandle, error) {
+	return d.send(ctx, "personal-report", d.fmt.FormatUserLink(chatID), chatID, reportText(title, reportItems),
+		func() (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendPersonalReport(ctx, chatID, title, reportItems)
+		},
+		func(channelID, note string) (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelReport(ctx, channelID, note+"\n"+title, reportItems)
+		})
+}
+
+func (d *dryRunChat) SendChannelNotification(ctx context.Context, chanID, message string) (messages.MessageHandle, error) {
+	return d.send(ctx, "channel-notification", d.fmt.FormatChannelLink(chanID), chanID, message,
+		func() (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelNotification(ctx, chanID, message)
+		},
+		func(channelID, note string) (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelNotification(ctx, channelID, note+"\n"+message)
+		})
+}
+
+func (d *dryRunChat) SendChannelReport(ctx context.Context, chanID, title string, reportItems []string) (messages.MessageHandle, error) {
+	return d.send(ctx, "channel-report", d.fmt.FormatChannelLink(chanID), chanID, reportText(title, reportItems),
+		func() (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelReport(ctx, chanID, title, reportItems)
+		},
+		func(channelID, note string) (messages.MessageHandle, error) {
+			return d.EventedChatSystem.SendChannelReport(ctx, channelID, note+"\n"+title, reportItems)
+		})
+}
+
+// send sends a message with sendFn, unless in dry-run mode. In dry-run mode, the message is
+// recorded instead, and sent with redirectFn to the dry-run channel if one is configured,
+// with a note saying whom it was meant for.
+func (d *dryRunChat) send(ctx context.Context, kind, targetLink, target, message string, sendFn func() (messages.MessageHandle, error), redirectFn func(channelID, note string) (messages.MessageHandle, error)) (messages.MessageHandle, error) {
+	dryRun, redirectChannel := d.mode(ctx)
+	if !dryRun {
+		return sendFn()
+	}
+	handle := &dryRunHandle{ID: newDryRunID(), SentAt: d.getTime()}
+	if redirectChannel != "" {
+		redirected, err := redirectFn(redirectChannel, d.fmt.FormatItalic(fmt.Sprintf("Dry run (%s for %s):", kind, targetLink)))
+		if err != nil {
+			return nil, err
+		}
+		if redirected != nil {
+			if handle.Redirected, err = redirected.MarshalJSON(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.record(ctx, DryRunMessage{ID: handle.ID, Kind: kind, Target: target, Message: message, CreatedAt: handle.SentAt})
+	return handle, nil
+}
+
+func (d *dryRunChat) InformBuildStarted(ctx context.Context, announcement messages.MessageHandle, link string) error {
+	return d.react(ctx, announcement, "build started: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildStarted(ctx, mh, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildSuccess(ctx context.Context, announcement messages.MessageHandle, link string) error {
+	return d.react(ctx, announcement, "build succeeded: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildSuccess(ctx, mh, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildFailure(ctx context.Context, announcement messages.MessageHandle, link string) error {
+	return d.react(ctx, announcement, "build failed: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildFailure(ctx, mh, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildAborted(ctx context.Context, announcement messages.MessageHandle, link string) error {
+	return d.react(ctx, announcement, "build aborted: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildAborted(ctx, mh, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildTypeTriggered(ctx context.Context, announcement messages.MessageHandle, buildType, link string) error {
+	return d.react(ctx, announcement, buildType+" build triggered: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildTypeTriggered(ctx, mh, buildType, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildTypeStarted(ctx context.Context, announcement messages.MessageHandle, buildType, link string) error {
+	return d.react(ctx, announcement, buildType+" build started: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildTypeStarted(ctx, mh, buildType, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildTypeFailure(ctx context.Context, announcement messages.MessageHandle, buildType, link string) error {
+	return d.react(ctx, announcement, buildType+" build failed: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildTypeFailure(ctx, mh, buildType, link)
+	})
+}
+
+func (d *dryRunChat) InformBuildTypeSuccess(ctx context.Context, announcement messages.MessageHandle, buildType, link string) error {
+	return d.react(ctx, announcement, buildType+" build succeeded: "+link, func(mh messages.MessageHandle) error {
+		return d.EventedChatSystem.InformBuildTypeSuccess(ctx, mh, buildType, link)
+	})
+}
+
+// react adds a reaction to a message with reactFn, unless in dry-run mode, in which case the
+// reaction is recorded instead. Messages which were themselves never sent can not be reacted
+// to, but their copies in the dry-run channel can.
+func (d *dryRunChat) react(ctx context.Context, announcement messages.MessageHandle, description string, reactFn func(messages.MessageHandle) error) error {
+	dryRun, _ := d.mode(ctx)
+	handle, wasDryRun := announcement.(*dryRunHandle)
+	if !dryRun && !wasDryRun {
+		return reactFn(announcement)
+	}
+	if dryRun {
+		target := "dry-run message " + handle.ID
+		if !wasDryRun {
+			handleJSON, err := announcement.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			target = string(handleJSON)
+		}
+		d.record(ctx, DryRunMessage{ID: newDryRunID(), Kind: "reaction", Target: target, Message: description, CreatedAt: d.getTime()})
+	}
+	if wasDryRun && len(handle.Redirected) > 0 {
+		redirected, err := d.EventedChatSystem.UnmarshalMessageHandle(string(handle.Redirected))
+		if err != nil {
+			return err
+		}
+		return reactFn(redirected)
+	}
+	return nil
+}
+
+func (d *dryRunChat) UnmarshalMessageHandle(handleData string) (messages.MessageHandle, error) {
+	var handle dryRunHandle
+	if err := json.Unmarshal([]byte(handleData), &handle); err == nil && handle.ID != "" {
+		return &handle, nil
+	}
+	return d.EventedChatSystem.UnmarshalMessageHandle(handleData)
+}
+
+// record logs a message which was not sent and stores it in the persistent DB.
+func (d *dryRunChat) record(ctx context.Context, msg DryRunMessage) {
+	d.logger.Info("not sending message in dry-run mode",
+		zap.String("dry-run-id", msg.ID), zap.String("kind", msg.Kind), zap.String("target", msg.Target), zap.String("message", msg.Message))
+	if err := d.persistentDB.RecordDryRunMessage(ctx, msg); err != nil {
+		d.logger.Error("failed to record dry-run message", zap.String("dry-run-id", msg.ID), zap.Error(err))
+	}
+}
+
+func newDryRunID() string {
+	var buf [8]byte
+	// crypto/rand does not fail on any supported platform.
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// reportText renders a report as a single piece of text, for recording.
+func reportText(title string, reportItems []string) string {
+	return title + "\n" + strings.Join(reportItems, "\n")
+}
+
+// dryRunCommand handles the !dry-run admin chat command, which shows whether the team is in
+// dry-run mode and lists the most recent messages which were recorded instead of sent.
+func (a *App) dryRunCommand(ctx context.Context, logger *zap.Logger, args []string) string {
+	limit := 10
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return "bad !dry-run usage (`!dry-run [<count>]`)"
+		}
+		limit = n
+	}
+	msgs, err := a.persistentDB.GetDryRunMessages(ctx, limit)
+	if err != nil {
+		logger.Error("failed to look up dry-run messages", zap.Error(err))
+		return "failed to look up dry-run messages"
+	}
+
+	var lines []string
+	switch dryRun, channelID := dryRunMode(ctx, a.persistentDB); {
+	case dryRun && channelID != "":
+		lines = append(lines, "Dry-run mode is on; messages are being sent to "+a.fmt.FormatChannelLink(channelID)+" instead.")
+	case dryRun:
+		lines = append(lines, "Dry-run mode is on; messages are being recorded instead of sent.")
+	default:
+		lines = append(lines, "Dry-run mode is off. Turn it on with `!config dry-run true`.")
+	}
+	if len(msgs) == 0 {
+		lines = append(lines, "No messages have been recorded.")
+	}
+	for _, msg := range msgs {
+		target := msg.Target
+		switch msg.Kind {
+		case "notification", "personal-report":
+			target = a.fmt.FormatUserLink(target)
+		case "channel-notification", "channel-report":
+			target = a.fmt.FormatChannelLink(target)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s for %s:\n%s", msg.CreatedAt.UTC().Format(time.RFC3339), msg.Kind, target, a.fmt.FormatBlockQuote(msg.Message)))
+	}
+	return strings.Join(lines, "\n")
+}
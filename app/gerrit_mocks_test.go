@@ -34,6 +34,20 @@ func (m *MockClient) EXPECT() *MockClientMockRecorder {
 	return m.recorder
 }
 
+// AddReviewer mocks base method
+func (m *MockClient) AddReviewer(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddReviewer", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddReviewer indicates an expected call of AddReviewer
+func (mr *MockClientMockRecorder) AddReviewer(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddReviewer", reflect.TypeOf((*MockClient)(nil).AddReviewer), arg0, arg1, arg2)
+}
+
 // Close mocks base method
 func (m *MockClient) Close() error {
 	m.ctrl.T.Helper()
@@ -108,6 +122,21 @@ func (mr *MockClientMockRecorder) ListRevisionComments(arg0, arg1, arg2 interfac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRevisionComments", reflect.TypeOf((*MockClient)(nil).ListRevisionComments), arg0, arg1, arg2)
 }
 
+// ListRevisionFiles mocks base method
+func (m *MockClient) ListRevisionFiles(arg0 context.Context, arg1, arg2 string) (map[string]gerrit.FileInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRevisionFiles", arg0, arg1, arg2)
+	ret0, _ := ret[0].(map[string]gerrit.FileInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRevisionFiles indicates an expected call of ListRevisionFiles
+func (mr *MockClientMockRecorder) ListRevisionFiles(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRevisionFiles", reflect.TypeOf((*MockClient)(nil).ListRevisionFiles), arg0, arg1, arg2)
+}
+
 // QueryAccountsEx mocks base method
 func (m *MockClient) QueryAccountsEx(arg0 context.Context, arg1 string, arg2 *gerrit.QueryAccountsOpts) ([]gerrit.AccountInfo, bool, error) {
 	m.ctrl.T.Helper()
@@ -140,6 +169,20 @@ func (mr *MockClientMockRecorder) QueryChangesEx(arg0, arg1, arg2 interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryChangesEx", reflect.TypeOf((*MockClient)(nil).QueryChangesEx), arg0, arg1, arg2)
 }
 
+// ServerVersion mocks base method
+func (m *MockClient) ServerVersion() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ServerVersion")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// ServerVersion indicates an expected call of ServerVersion
+func (mr *MockClientMockRecorder) ServerVersion() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ServerVersion", reflect.TypeOf((*MockClient)(nil).ServerVersion))
+}
+
 // URLForChange mocks base method
 func (m *MockClient) URLForChange(arg0 *gerrit.ChangeInfo) string {
 	m.ctrl.T.Helper()
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/metrics"
+)
+
+// instrumentedGerritClient wraps a gerrit.Client, recording the latency and error rate of each
+// API call for the team's metrics, and passing the outcome of each call to noteResult.
+type instrumentedGerritClient struct {
+	gerrit.Client
+	teamID     string
+	noteResult func(error)
+}
+
+func newInstrumentedGerritClient(teamID string, client gerrit.Client, noteResult func(error)) *instrumentedGerritClient {
+	return &instrumentedGerritClient{Client: client, teamID: teamID, noteResult: noteResult}
+}
+
+// observe records the outcome of a call to the named endpoint which began at start.
+func (c *instrumentedGerritClient) observe(endpoint string, start time.Time, err error) {
+	metrics.GerritRequestDuration.WithLabelValues(c.teamID, endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.GerritRequestErrors.WithLabelValues(c.teamID, endpoint).Inc()
+	}
+	c.noteResult(err)
+}
+
+func (c *instrumentedGerritClient) QueryChangesEx(ctx context.Context, queries []string, opts *gerrit.QueryChangesOpts) (changes []gerrit.ChangeInfo, more bool, err error) {
+	defer func(start time.Time) { c.observe("QueryChanges", start, err) }(time.Now())
+	return c.Client.QueryChangesEx(ctx, queries, opts)
+}
+
+func (c *instrumentedGerritClient) GetChangeEx(ctx context.Context, changeID string, opts *gerrit.QueryChangesOpts) (changeInfo gerrit.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("GetChange", start, err) }(time.Now())
+	return c.Client.GetChangeEx(ctx, changeID, opts)
+}
+
+func (c *instrumentedGerritClient) ListRevisionComments(ctx context.Context, changeID, revisionID string) (comments map[string][]gerrit.CommentInfo, err error) {
+	defer func(start time.Time) { c.observe("ListRevisionComments", start, err) }(time.Now())
+	return c.Client.ListRevisionComments(ctx, changeID, revisionID)
+}
+
+func (c *instrumentedGerritClient) GetPatchSetInfo(ctx context.Context, changeID, patchSetID string) (changeInfo gerrit.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("GetPatchSetInfo", start, err) }(time.Now())
+	return c.Client.GetPatchSetInfo(ctx, changeID, patchSetID)
+}
+
+func (c *instrumentedGerritClient) GetChangeReviewers(ctx context.Context, changeID string) (reviewers []gerrit.ReviewerInfo, err error) {
+	defer func(start time.Time) { c.observe("GetChangeReviewers", start, err) }(time.Now())
+	return c.Client.GetChangeReviewers(ctx, changeID)
+}
+
+func (c *instrumentedGerritClient) ListRevisionFiles(ctx context.Context, changeID, revisionID string) (files map[string]gerrit.FileInfo, err error) {
+	defer func(start time.Time) { c.observe("ListRevisionFiles", start, err) }(time.Now())
+	return c.Client.ListRevisionFiles(ctx, changeID, revisionID)
+}
+
+func (c *instrumentedGerritClient) AddReviewer(ctx context.Context, changeID, reviewer string) (err error) {
+	defer func(start time.Time) { c.observe("AddReviewer", start, err) }(time.Now())
+	return c.Client.AddReviewer(ctx, changeID, reviewer)
+}
+
+func (c *instrumentedGerritClient) QueryAccountsEx(ctx context.Context, query string, opts *gerrit.QueryAccountsOpts) (accounts []gerrit.AccountInfo, more bool, err error) {
+	defer func(start time.Time) { c.observe("QueryAccounts", start, err) }(time.Now())
+	return c.Client.QueryAccountsEx(ctx, query, opts)
+}
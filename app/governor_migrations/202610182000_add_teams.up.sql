@@ -0,0 +1,9 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE teams (
+       team_id TEXT NOT NULL,
+       setup_data TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL,
+       updated_at TIMESTAMP NOT NULL,
+       PRIMARY KEY ( team_id )
+);
@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP TABLE leases;
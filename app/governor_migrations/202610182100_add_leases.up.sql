@@ -0,0 +1,9 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- expires_at is in Unix milliseconds, so that it compares the same way in every database.
+CREATE TABLE leases (
+       name TEXT NOT NULL,
+       holder TEXT NOT NULL,
+       expires_at BIGINT NOT NULL,
+       PRIMARY KEY ( name )
+);
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"embed"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/app/dbx"
+)
+
+//go:embed governor_migrations/*.sql
+var governorMigrationsFS embed.FS
+
+// sealedPrefix marks a value sealed by a Sealer, and identifies the scheme used.
+const sealedPrefix = "aes-gcm:"
+
+// Sealer encrypts and decrypts secrets stored at rest, using AES-256-GCM.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer creates a Sealer using the given 32-byte key.
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != 32 {
+		return nil, errs.New("encryption key must be 32 bytes long, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal encrypts plaintext. The associated data is not encrypted, but the same value must be
+// given to Open, which keeps a sealed value from being moved to a different record.
+func (s *Sealer) Seal(plaintext, associatedData string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(plaintext), []byte(associatedData))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal.
+func (s *Sealer) Open(sealed, associatedData string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", errs.New("value is not sealed")
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed[len(sealedPrefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return "", errs.New("sealed value is too short")
+	}
+	plaintext, err := s.aead.Open(nil, data[:s.aead.NonceSize()], data[s.aead.NonceSize():], []byte(associatedData))
+	if err != nil {
+		return "", errs.New("could not decrypt sealed value (wrong key?): %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// TeamRecord is the registration of a chat team with Changeset Chihuahua.
+type TeamRecord struct {
+	TeamID string
+	// SetupData is the chat system's response to the team's installation, including its
+	// access token.
+	SetupData string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GovernorDB represents the persistent database shared by all teams, which holds team
+// registrations. Setup data is encrypted at rest.
+type GovernorDB struct {
+	logger *zap.Logger
+	db     *dbx.DB
+	dbLock sync.Mutex
+	sealer *Sealer
+}
+
+// NewGovernorDB opens a GovernorDB, sealing and opening team setup data with the given
+// Sealer.
+func NewGovernorDB(logger *zap.Logger, dbSource string, sealer *Sealer) (*GovernorDB, error) {
+	db, err := initializePersistentDB(logger, dbSource, governorMigrationsFS, "governor_migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &GovernorDB{logger: logger, db: db, sealer: sealer}, nil
+}
+
+// Sealer returns the Sealer used for team records, which is also used for the secrets of
+// each team.
+func (gd *GovernorDB) Sealer() *Sealer {
+	return gd.sealer
+}
+
+// Close closes a GovernorDB.
+func (gd *GovernorDB) Close() error {
+	return gd.db.Close()
+}
+
+// GetTeams returns all registered teams, ordered by team ID.
+func (gd *GovernorDB) GetTeams(ctx context.Context) (teams []TeamRecord, err error) {
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	rows, err := gd.db.DB.QueryContext(ctx, `
+		SELECT team_id, setup_data, created_at, updated_at FROM teams ORDER BY team_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var team TeamRecord
+		var sealed string
+		if err := rows.Scan(&team.TeamID, &sealed, &team.CreatedAt, &team.UpdatedAt); err != nil {
+			return nil, err
+		}
+		team.SetupData, err = gd.sealer.Open(sealed, team.TeamID)
+		if err != nil {
+			return nil, errs.New("team %s: %w", team.TeamID, err)
+		}
+		teams = append(teams, team)
+	}
+	return teams, nil
+}
+
+// GetTeam returns the registration of a single team. If the team is not registered,
+// sql.ErrNoRows is returned.
+func (gd *GovernorDB) GetTeam(ctx context.Context, teamID string) (team TeamRecord, err error) {
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	var sealed string
+	err = gd.db.DB.QueryRowContext(ctx, gd.db.Rebind(`
+		SELECT team_id, setup_data, created_at, updated_at FROM teams WHERE team_id = ?
+	`), teamID).Scan(&team.TeamID, &sealed, &team.CreatedAt, &team.UpdatedAt)
+	if err != nil {
+		return team, err
+	}
+	team.SetupData, err = gd.sealer.Open(sealed, team.TeamID)
+	return team, err
+}
+
+// PutTeam registers a team, or replaces the setup data of a team which is already
+// registered.
+func (gd *GovernorDB) PutTeam(ctx context.Context, teamID, setupData string, now time.Time) error {
+	sealed, err := gd.sealer.Seal(setupData, teamID)
+	if err != nil {
+		return err
+	}
+
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	_, err = gd.db.DB.ExecContext(ctx, gd.db.Rebind(`
+		INSERT INTO teams (team_id, setup_data, created_at, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (team_id) DO UPDATE SET setup_data = EXCLUDED.setup_data, updated_at = EXCLUDED.updated_at
+	`), teamID, sealed, now.UTC(), now.UTC())
+	return err
+}
+
+// DeleteTeam removes a team's registration. If the team is not registered, sql.ErrNoRows
+// is returned.
+func (gd *GovernorDB) DeleteTeam(ctx context.Context, teamID string) error {
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	result, err := gd.db.DB.ExecContext(ctx, gd.db.Rebind(`DELETE FROM teams WHERE team_id = ?`), teamID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AcquireLease takes the named lease for holder until now+ttl, if it is free, has expired, or
+// is already held by holder (in which case it is renewed). It returns whether holder has the
+// lease. Leases let several instances sharing a database agree on which of them does a job.
+func (gd *GovernorDB) AcquireLease(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	result, err := gd.db.DB.ExecContext(ctx, gd.db.Rebind(`
+		INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE leases.holder = EXCLUDED.holder OR leases.expires_at < ?
+	`), name, holder, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ReleaseLease gives up the named lease, if it is held by holder.
+func (gd *GovernorDB) ReleaseLease(ctx context.Context, name, holder string) error {
+	gd.dbLock.Lock()
+	defer gd.dbLock.Unlock()
+
+	_, err := gd.db.DB.ExecContext(ctx, gd.db.Rebind(`DELETE FROM leases WHERE name = ? AND holder = ?`), name, holder)
+	return err
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSealer(t *testing.T) {
+	key := make([]byte, 32)
+	key[0] = 1
+	sealer, err := NewSealer(key)
+	require.NoError(t, err)
+
+	sealed, err := sealer.Seal("xoxb-secret", "T1")
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, "xoxb-secret")
+	opened, err := sealer.Open(sealed, "T1")
+	require.NoError(t, err)
+	assert.Equal(t, "xoxb-secret", opened)
+
+	// the associated data must match
+	_, err = sealer.Open(sealed, "T2")
+	assert.Error(t, err)
+
+	// and so must the key
+	otherSealer, err := NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	_, err = otherSealer.Open(sealed, "T1")
+	assert.Error(t, err)
+
+	_, err = NewSealer(make([]byte, 16))
+	assert.Error(t, err)
+}
+
+func TestGovernorDB(t *testing.T) {
+	ctx := context.Background()
+	sealer, err := NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	db, err := NewGovernorDB(zaptest.NewLogger(t), "sqlite:"+filepath.Join(t.TempDir(), "governor.db"), sealer)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	_, err = db.GetTeam(ctx, "T1")
+	require.Equal(t, sql.ErrNoRows, err)
+
+	installed := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, db.PutTeam(ctx, "T1", `{"access_token":"xoxb-1"}`, installed))
+	require.NoError(t, db.PutTeam(ctx, "T0", `{"access_token":"xoxb-0"}`, installed))
+
+	// reinstalling replaces the setup data
+	require.NoError(t, db.PutTeam(ctx, "T1", `{"access_token":"xoxb-2"}`, installed.Add(time.Hour)))
+	team, err := db.GetTeam(ctx, "T1")
+	require.NoError(t, err)
+	assert.Equal(t, `{"access_token":"xoxb-2"}`, team.SetupData)
+	assert.True(t, team.CreatedAt.Equal(installed))
+	assert.True(t, team.UpdatedAt.Equal(installed.Add(time.Hour)))
+
+	// tokens are not stored in the clear
+	var stored string
+	require.NoError(t, db.db.DB.QueryRowContext(ctx, `SELECT setup_data FROM teams WHERE team_id = 'T1'`).Scan(&stored))
+	assert.NotContains(t, stored, "xoxb")
+
+	teams, err := db.GetTeams(ctx)
+	require.NoError(t, err)
+	require.Len(t, teams, 2)
+	assert.Equal(t, "T0", teams[0].TeamID)
+	assert.Equal(t, "T1", teams[1].TeamID)
+
+	require.NoError(t, db.DeleteTeam(ctx, "T1"))
+	require.Equal(t, sql.ErrNoRows, db.DeleteTeam(ctx, "T1"))
+	teams, err = db.GetTeams(ctx)
+	require.NoError(t, err)
+	require.Len(t, teams, 1)
+}
+
+func TestGovernorDBLeases(t *testing.T) {
+	ctx := context.Background()
+	sealer, err := NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	db, err := NewGovernorDB(zaptest.NewLogger(t), "sqlite:"+filepath.Join(t.TempDir(), "governor.db"), sealer)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	const ttl = 30 * time.Second
+
+	acquired, err := db.AcquireLease(ctx, "scheduler", "a", now, ttl)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// another holder can't take it while it is live, but the holder can renew it
+	acquired, err = db.AcquireLease(ctx, "scheduler", "b", now.Add(10*time.Second), ttl)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	acquired, err = db.AcquireLease(ctx, "scheduler", "a", now.Add(20*time.Second), ttl)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = db.AcquireLease(ctx, "scheduler", "b", now.Add(40*time.Second), ttl)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// once it expires, it can be taken over
+	acquired, err = db.AcquireLease(ctx, "scheduler", "b", now.Add(51*time.Second), ttl)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = db.AcquireLease(ctx, "scheduler", "a", now.Add(52*time.Second), ttl)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// releasing only works for the holder
+	require.NoError(t, db.ReleaseLease(ctx, "scheduler", "a"))
+	acquired, err = db.AcquireLease(ctx, "scheduler", "a", now.Add(53*time.Second), ttl)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	require.NoError(t, db.ReleaseLease(ctx, "scheduler", "b"))
+	acquired, err = db.AcquireLease(ctx, "scheduler", "a", now.Add(54*time.Second), ttl)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// healthCheckInterval is how often PeriodicHealthChecks looks for trouble.
+	healthCheckInterval = 5 * time.Minute
+	// healthWriteInterval is how often, at most, an instance records in the persistent DB
+	// that events are arriving or that Gerrit API calls are succeeding.
+	healthWriteInterval = time.Minute
+	// defaultGerritFailureAlertCount is the number of consecutive failed Gerrit API calls
+	// after which admins are alerted, unless gerrit-failure-alert-count says otherwise.
+	defaultGerritFailureAlertCount = 5
+)
+
+// noteGerritResult keeps track of the current streak of failed Gerrit API calls in the
+// team's HealthState. Every failure is recorded, but a success resets the streak only if
+// this instance has seen failures, or has not reset it in the last healthWriteInterval.
+// Calls abandoned because their context was canceled are not counted either way.
+func (a *App) noteGerritResult(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	ctx := context.Background()
+	a.statusLock.Lock()
+	if err != nil {
+		a.gerritFailures++
+		a.statusLock.Unlock()
+		if dbErr := a.persistentDB.NoteGerritFailure(ctx, err.Error()); dbErr != nil {
+			a.logger.Error("failed to record gerrit failure", zap.Error(dbErr))
+		}
+		return
+	}
+	now := time.Now()
+	reset := a.gerritFailures > 0 || now.Sub(a.lastFailureReset) >= healthWriteInterval
+	a.gerritFailures = 0
+	if reset {
+		a.lastFailureReset = now
+	}
+	a.statusLock.Unlock()
+	if reset {
+		if dbErr := a.persistentDB.ResetGerritFailures(ctx); dbErr != nil {
+			a.logger.Error("failed to reset gerrit failure count", zap.Error(dbErr))
+		}
+	}
+}
+
+// PeriodicHealthChecks checks every healthCheckInterval whether Gerrit has gone quiet or its
+// API is failing, alerting the team admins when either starts or stops being the case.
+func (a *App) PeriodicHealthChecks(ctx context.Context, getTime func() time.Time) error {
+	timer := time.NewTimer(healthCheckInterval)
+
+	for {
+		select {
+		case <-timer.C:
+			a.CheckHealth(detach(ctx), getTime())
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return ctx.Err()
+		}
+		timer.Reset(healthCheckInterval)
+	}
+}
+
+// CheckHealth alerts the team admins if no Gerrit events have arrived for longer than
+// quiet-alert-hours working hours (in UTC), or if the last gerrit-failure-alert-count Gerrit
+// API calls have all failed. Each alert is sent once, and is followed by a recovery message
+// when things return to normal. Events and failures seen by every instance serving the team
+// are taken into account.
+func (a *App) CheckHealth(ctx context.Context, now time.Time) {
+	quietHours := a.persistentDB.JustGetConfigInt(ctx, "quiet-alert-hours", 0)
+	failureAlertCount := a.persistentDB.JustGetConfigInt(ctx, "gerrit-failure-alert-count", defaultGerritFailureAlertCount)
+	gerritConnected := a.getGerritClient() != nil
+	health, err := a.persistentDB.GetHealthState(ctx)
+	if err != nil {
+		a.logger.Error("failed to read health state", zap.Error(err))
+		return
+	}
+
+	var alerts []string
+	quietAlerted, gerritAlerted := health.QuietAlerted, health.GerritAlerted
+	lastEvent := health.LastEventReceived
+	if lastEvent.IsZero() {
+		a.statusLock.Lock()
+		lastEvent = a.startTime
+		a.statusLock.Unlock()
+	}
+	switch {
+	case quietHours <= 0 || !gerritConnected:
+		quietAlerted = false
+	case workingTimeBetween(lastEvent, now, time.UTC) >= time.Duration(quietHours)*time.Hour:
+		if !quietAlerted {
+			quietAlerted = true
+			alerts = append(alerts, fmt.Sprintf(
+				"No Gerrit events have been received in %s (%d working hours). Check that the Gerrit webhooks plugin is still delivering events.",
+				prettyTimeDelta(now.Sub(lastEvent)), quietHours))
+		}
+	case quietAlerted:
+		quietAlerted = false
+		alerts = append(alerts, fmt.Sprintf("Gerrit events are arriving again (the latest %s ago).", prettyTimeDelta(now.Sub(lastEvent))))
+	}
+	switch {
+	case failureAlertCount <= 0:
+		gerritAlerted = false
+	case health.GerritFailures >= failureAlertCount:
+		if !gerritAlerted {
+			gerritAlerted = true
+			alerts = append(alerts, fmt.Sprintf("The last %d Gerrit API calls have failed. The most recent error was: %s", health.GerritFailures, health.LastGerritError))
+		}
+	case health.GerritFailures == 0 && gerritAlerted:
+		gerritAlerted = false
+		alerts = append(alerts, "Gerrit API calls are succeeding again.")
+	}
+	if quietAlerted != health.QuietAlerted || gerritAlerted != health.GerritAlerted {
+		if err := a.persistentDB.SetHealthAlerts(ctx, quietAlerted, gerritAlerted); err != nil {
+			a.logger.Error("failed to record health alerts", zap.Error(err))
+		}
+	}
+
+	for _, alert := range alerts {
+		a.alertAdmins(ctx, alert)
+	}
+}
+
+// alertAdmins sends a direct message to each of the team admins.
+func (a *App) alertAdmins(ctx context.Context, message string) {
+	a.logger.Warn("alerting admins", zap.String("message", message))
+	for adminID := range parseUserSet(a.persistentDB.JustGetConfig(ctx, "admin-ids", "")) {
+		if adminID == "" {
+			continue
+		}
+		if _, err := a.chat.SendNotification(ctx, adminID, message); err != nil {
+			a.logger.Error("failed to send alert to admin", zap.String("chat-id", adminID), zap.Error(err))
+		}
+	}
+}
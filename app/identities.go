@@ -0,0 +1,498 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+)
+
+// IdentityRecord is one line of an identity import or export file, describing the mapping
+// between a Gerrit user and a chat user. When ChatID is not given, the chat user is looked up
+// by ChatEmail, or by GerritEmail if that is also missing.
+type IdentityRecord struct {
+	GerritUsername string
+	GerritEmail    string
+	ChatID         string
+	ChatEmail      string
+}
+
+// Supported identity file formats.
+const (
+	IdentityFormatCSV  = "csv"
+	IdentityFormatLDIF = "ldif"
+)
+
+var identityCSVColumns = []string{"gerrit_username", "gerrit_email", "chat_id", "chat_email"}
+
+// ReadIdentities parses identity records in the given format (IdentityFormatCSV or
+// IdentityFormatLDIF).
+//
+// CSV input must have a header row naming its columns, which may be any of gerrit_username,
+// gerrit_email, chat_id and chat_email, in any order. Other columns are ignored.
+//
+// LDIF input uses the uid attribute as the Gerrit username and mail as the Gerrit email
+// address. The non-standard chatId and chatMail attributes, if present, give the chat ID and
+// chat email address. Entries with neither uid nor mail (such as organizational units) are
+// skipped.
+func ReadIdentities(r io.Reader, format string) ([]IdentityRecord, error) {
+	switch format {
+	case IdentityFormatCSV:
+		return readIdentitiesCSV(r)
+	case IdentityFormatLDIF:
+		return readIdentitiesLDIF(r)
+	}
+	return nil, errs.New("unknown identity format %q", format)
+}
+
+// WriteIdentities writes identity records in the given format, such that ReadIdentities can
+// read them back.
+func WriteIdentities(w io.Writer, format string, records []IdentityRecord) error {
+	switch format {
+	case IdentityFormatCSV:
+		return writeIdentitiesCSV(w, records)
+	case IdentityFormatLDIF:
+		return writeIdentitiesLDIF(w, records)
+	}
+	return errs.New("unknown identity format %q", format)
+}
+
+func readIdentitiesCSV(r io.Reader) ([]IdentityRecord, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.TrimLeadingSpace = true
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, errs.New("reading CSV header: %w", err)
+	}
+	columnIndex := make(map[string]int)
+	for i, name := range header {
+		columnIndex[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columnIndex["gerrit_username"]; !ok {
+		return nil, errs.New("CSV header must include a gerrit_username column")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columnIndex[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var records []IdentityRecord
+	for {
+		row, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errs.New("reading CSV: %w", err)
+		}
+		records = append(records, IdentityRecord{
+			GerritUsername: field(row, "gerrit_username"),
+			GerritEmail:    field(row, "gerrit_email"),
+			ChatID:         field(row, "chat_id"),
+			ChatEmail:      field(row, "chat_email"),
+		})
+	}
+	return records, nil
+}
+
+func writeIdentitiesCSV(w io.Writer, records []IdentityRecord) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(identityCSVColumns); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := csvWriter.Write([]string{record.GerritUsername, record.GerritEmail, record.ChatID, record.ChatEmail}); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func readIdentitiesLDIF(r io.Reader) (records []IdentityRecord, err error) {
+	var entry map[string]string
+	finishEntry := func() {
+		if entry != nil && (entry["uid"] != "" || entry["mail"] != "") {
+			records = append(records, IdentityRecord{
+				GerritUsername: entry["uid"],
+				GerritEmail:    entry["mail"],
+				ChatID:         entry["chatid"],
+				ChatEmail:      entry["chatmail"],
+			})
+		}
+		entry = nil
+	}
+
+	// unfold continuation lines first; a line starting with a single space continues the
+	// previous line.
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && len(lines) > 0 && lines[len(lines)-1] != "" {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs.New("reading LDIF: %w", err)
+	}
+
+	for lineNum, line := range lines {
+		if line == "" {
+			finishEntry()
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, errs.New("LDIF line %d: expected attribute: value", lineNum+1)
+		}
+		attr := strings.ToLower(line[:colon])
+		value := line[colon+1:]
+		if strings.HasPrefix(value, ":") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, errs.New("LDIF line %d: bad base64 value: %w", lineNum+1, err)
+			}
+			value = string(decoded)
+		}
+		value = strings.TrimSpace(value)
+		if attr == "version" && entry == nil {
+			continue
+		}
+		if entry == nil {
+			entry = make(map[string]string)
+		}
+		// only the first value of multi-valued attributes is used
+		if _, ok := entry[attr]; !ok {
+			entry[attr] = value
+		}
+	}
+	finishEntry()
+	return records, nil
+}
+
+func writeIdentitiesLDIF(w io.Writer, records []IdentityRecord) error {
+	var buf bytes.Buffer
+	buf.WriteString("version: 1\n")
+	for _, record := range records {
+		buf.WriteString("\n")
+		writeLDIFAttr(&buf, "dn", "uid="+record.GerritUsername)
+		writeLDIFAttr(&buf, "uid", record.GerritUsername)
+		writeLDIFAttr(&buf, "mail", record.GerritEmail)
+		writeLDIFAttr(&buf, "chatId", record.ChatID)
+		writeLDIFAttr(&buf, "chatMail", record.ChatEmail)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeLDIFAttr(buf *bytes.Buffer, attr, value string) {
+	if value == "" {
+		return
+	}
+	if ldifNeedsBase64(value) {
+		fmt.Fprintf(buf, "%s:: %s\n", attr, base64.StdEncoding.EncodeToString([]byte(value)))
+		return
+	}
+	fmt.Fprintf(buf, "%s: %s\n", attr, value)
+}
+
+func ldifNeedsBase64(value string) bool {
+	if strings.HasPrefix(value, " ") || strings.HasPrefix(value, ":") || strings.HasPrefix(value, "<") || strings.HasSuffix(value, " ") {
+		return true
+	}
+	for _, r := range value {
+		if r < 0x20 || r > 0x7e {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityAction is what an identity import will do for a single Gerrit user.
+type IdentityAction string
+
+// Identity import actions.
+const (
+	IdentityCreate    = IdentityAction("create")
+	IdentityUpdate    = IdentityAction("update")
+	IdentityUnchanged = IdentityAction("unchanged")
+	IdentityConflict  = IdentityAction("conflict")
+)
+
+// IdentityChange describes the effect an identity import will have on a single Gerrit user.
+type IdentityChange struct {
+	Action         IdentityAction
+	GerritUsername string
+	OldChatID      string
+	NewChatID      string
+	// Reason explains a conflict.
+	Reason string
+}
+
+// IdentityImportPlan is the set of changes an identity import would make.
+type IdentityImportPlan struct {
+	Changes []IdentityChange
+}
+
+// Count returns the number of planned changes with the given action.
+func (p *IdentityImportPlan) Count(action IdentityAction) int {
+	n := 0
+	for _, change := range p.Changes {
+		if change.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the plan as a diff: one line per create, update, or conflict, followed by a
+// summary line. Unchanged associations are only counted.
+func (p *IdentityImportPlan) String() string {
+	var s bytes.Buffer
+	for _, change := range p.Changes {
+		switch change.Action {
+		case IdentityCreate:
+			fmt.Fprintf(&s, "+ %s => %s\n", change.GerritUsername, change.NewChatID)
+		case IdentityUpdate:
+			fmt.Fprintf(&s, "~ %s => %s (was %s)\n", change.GerritUsername, change.NewChatID, change.OldChatID)
+		case IdentityConflict:
+			fmt.Fprintf(&s, "! %s: %s\n", change.GerritUsername, change.Reason)
+		}
+	}
+	fmt.Fprintf(&s, "%d to create, %d to update, %d unchanged, %d conflicts\n",
+		p.Count(IdentityCreate), p.Count(IdentityUpdate), p.Count(IdentityUnchanged), p.Count(IdentityConflict))
+	return s.String()
+}
+
+// PlanIdentityImport compares identity records against the associations already stored in db
+// and determines what importing them would change. lookupChatIDByEmail is used to find the
+// chat ID for records which only give an email address; it may be nil, in which case such
+// records are reported as conflicts.
+func PlanIdentityImport(ctx context.Context, db *PersistentDB, lookupChatIDByEmail func(ctx context.Context, email string) (string, error), records []IdentityRecord) (*IdentityImportPlan, error) {
+	existing, err := db.GetAllChatAssociations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &IdentityImportPlan{}
+	planned := make(map[string]string)
+	for _, record := range records {
+		change := IdentityChange{GerritUsername: record.GerritUsername}
+		if record.GerritUsername == "" {
+			change.Action = IdentityConflict
+			change.GerritUsername = "(no username)"
+			change.Reason = fmt.Sprintf("record for %q has no Gerrit username", record.GerritEmail)
+			plan.Changes = append(plan.Changes, change)
+			continue
+		}
+
+		chatID, err := resolveIdentityChatID(ctx, lookupChatIDByEmail, record)
+		if err != nil {
+			change.Action = IdentityConflict
+			change.Reason = err.Error()
+			plan.Changes = append(plan.Changes, change)
+			continue
+		}
+		if previous, ok := planned[record.GerritUsername]; ok {
+			if previous != chatID {
+				change.Action = IdentityConflict
+				change.Reason = fmt.Sprintf("listed more than once, with different chat users (%s and %s)", previous, chatID)
+				plan.Changes = append(plan.Changes, change)
+			}
+			continue
+		}
+		planned[record.GerritUsername] = chatID
+
+		change.NewChatID = chatID
+		change.OldChatID = existing[record.GerritUsername]
+		switch change.OldChatID {
+		case "":
+			change.Action = IdentityCreate
+		case chatID:
+			change.Action = IdentityUnchanged
+		default:
+			change.Action = IdentityUpdate
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+
+	// a conflicting duplicate invalidates the earlier entry for the same user, too
+	conflicted := make(map[string]struct{})
+	for _, change := range plan.Changes {
+		if change.Action == IdentityConflict {
+			conflicted[change.GerritUsername] = struct{}{}
+		}
+	}
+	filtered := plan.Changes[:0]
+	for _, change := range plan.Changes {
+		if _, ok := conflicted[change.GerritUsername]; ok && change.Action != IdentityConflict {
+			continue
+		}
+		filtered = append(filtered, change)
+	}
+	plan.Changes = filtered
+	return plan, nil
+}
+
+func resolveIdentityChatID(ctx context.Context, lookupChatIDByEmail func(ctx context.Context, email string) (string, error), record IdentityRecord) (string, error) {
+	if record.ChatID != "" {
+		return record.ChatID, nil
+	}
+	email := record.ChatEmail
+	if email == "" {
+		email = record.GerritEmail
+	}
+	if email == "" {
+		return "", errs.New("no chat ID or email address given")
+	}
+	if lookupChatIDByEmail == nil {
+		return "", errs.New("no chat ID given, and chat users can not be looked up by email here")
+	}
+	chatID, err := lookupChatIDByEmail(ctx, email)
+	if err != nil {
+		return "", errs.New("could not find chat user with email %q: %v", email, err)
+	}
+	return chatID, nil
+}
+
+// ApplyIdentityImport makes the creates and updates described by plan. Conflicts and
+// unchanged associations are left alone.
+func ApplyIdentityImport(ctx context.Context, db *PersistentDB, plan *IdentityImportPlan) error {
+	for _, change := range plan.Changes {
+		switch change.Action {
+		case IdentityUpdate:
+			if err := db.DisassociateGerritUser(ctx, change.GerritUsername); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return errs.New("removing old association for %q: %w", change.GerritUsername, err)
+			}
+			fallthrough
+		case IdentityCreate:
+			if err := db.AssociateChatIDWithGerritUser(ctx, change.GerritUsername, change.NewChatID); err != nil {
+				return errs.New("associating %q with %q: %w", change.GerritUsername, change.NewChatID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ExportIdentities returns all stored associations as identity records, sorted by Gerrit
+// username. Email addresses are not stored, so they are left empty.
+func ExportIdentities(ctx context.Context, db *PersistentDB) ([]IdentityRecord, error) {
+	associations, err := db.GetAllChatAssociations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]IdentityRecord, 0, len(associations))
+	for gerritUsername, chatID := range associations {
+		records = append(records, IdentityRecord{GerritUsername: gerritUsername, ChatID: chatID})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].GerritUsername < records[j].GerritUsername
+	})
+	return records, nil
+}
+
+const identitiesUsage = "usage: `!identities export [csv|ldif]`, or `!identities import <csv|ldif> [apply]` followed by the file contents on the next lines (without `apply`, only shows what would change)"
+
+var chatMarkupRegexp = regexp.MustCompile(`<[^<>\s]+>`)
+
+// identitiesCommand handles the admin !identities chat command, which imports or exports
+// Gerrit-to-chat user associations in bulk. Unlike other commands, it needs the full message
+// text, since imported data follows the command on subsequent lines.
+func (a *App) identitiesCommand(ctx context.Context, logger *zap.Logger, text string) string {
+	lines := strings.SplitN(text, "\n", 2)
+	args := strings.Fields(lines[0])[1:]
+	if len(args) == 0 {
+		return identitiesUsage
+	}
+	switch args[0] {
+	case "export":
+		format := IdentityFormatCSV
+		if len(args) > 1 {
+			format = args[1]
+		}
+		records, err := ExportIdentities(ctx, a.persistentDB)
+		if err != nil {
+			logger.Error("failed to export identities", zap.Error(err))
+			return "failed to export identities"
+		}
+		var buf bytes.Buffer
+		if err := WriteIdentities(&buf, format, records); err != nil {
+			return fmt.Sprintf("failed to export identities: %v", err)
+		}
+		return "```\n" + buf.String() + "```"
+	case "import":
+		if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "apply") || len(lines) < 2 {
+			return identitiesUsage
+		}
+		apply := len(args) == 3
+		records, err := ReadIdentities(strings.NewReader(a.unwrapChatMarkup(lines[1])), args[1])
+		if err != nil {
+			return fmt.Sprintf("failed to read identities: %v", err)
+		}
+		plan, err := PlanIdentityImport(ctx, a.persistentDB, a.lookupChatIDByEmail, records)
+		if err != nil {
+			logger.Error("failed to plan identity import", zap.Error(err))
+			return "failed to plan identity import"
+		}
+		if !apply {
+			return "```\n" + plan.String() + "```\nDry run only; add `apply` after the format to make these changes."
+		}
+		if err := ApplyIdentityImport(ctx, a.persistentDB, plan); err != nil {
+			logger.Error("failed to apply identity import", zap.Error(err))
+			return fmt.Sprintf("failed to apply identity import: %v", err)
+		}
+		logger.Info("admin imported identities",
+			zap.Int("created", plan.Count(IdentityCreate)),
+			zap.Int("updated", plan.Count(IdentityUpdate)),
+			zap.Int("conflicts", plan.Count(IdentityConflict)))
+		return "```\n" + plan.String() + "```\nApplied. Conflicts were skipped."
+	}
+	return identitiesUsage
+}
+
+func (a *App) lookupChatIDByEmail(ctx context.Context, email string) (string, error) {
+	chatUser, err := a.chat.LookupUserByEmail(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	return chatUser.ChatID(), nil
+}
+
+// unwrapChatMarkup undoes the formatting the chat system applies to pasted text: code block
+// fences, user mentions, and automatically linked email addresses.
+func (a *App) unwrapChatMarkup(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+	text = chatMarkupRegexp.ReplaceAllStringFunc(text, func(markup string) string {
+		if chatID := a.fmt.UnwrapUserLink(markup); chatID != "" {
+			return chatID
+		}
+		if link := a.fmt.UnwrapLink(markup); strings.HasPrefix(link, "mailto:") {
+			return strings.TrimPrefix(link, "mailto:")
+		}
+		return markup
+	})
+	return html.UnescapeString(text)
+}
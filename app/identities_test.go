@@ -0,0 +1,128 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+func TestIdentitiesRoundTrip(t *testing.T) {
+	records := []IdentityRecord{
+		{GerritUsername: "navi", GerritEmail: "navi@jorts.io", ChatID: "U1"},
+		{GerritUsername: "hilmac", ChatEmail: "hilmac@jorts.io"},
+		{GerritUsername: "bdugnutt", GerritEmail: "bobson, \"dugnutt\"@jorts.io", ChatID: "U3"},
+	}
+	for _, format := range []string{IdentityFormatCSV, IdentityFormatLDIF} {
+		var buf bytes.Buffer
+		require.NoError(t, WriteIdentities(&buf, format, records))
+		got, err := ReadIdentities(&buf, format)
+		require.NoError(t, err)
+		assert.Equal(t, records, got, format)
+	}
+}
+
+func TestReadIdentitiesLDIF(t *testing.T) {
+	ldif := `version: 1
+
+# the people OU has no uid or mail, so it is skipped
+dn: ou=people,dc=jorts,dc=io
+objectClass: organizationalUnit
+
+dn: uid=navi,ou=people,dc=jorts,dc=io
+uid: navi
+cn: Navi Xerdafies
+mail: navi@jorts.io
+mail: navi@old.jorts.io
+
+dn: uid=hilmac,ou=people,dc=jorts,dc=io
+UID: hilmac
+mail: hilmac@jo
+ rts.io
+chatId:: VTEyMzQ=
+`
+	records, err := ReadIdentities(strings.NewReader(ldif), IdentityFormatLDIF)
+	require.NoError(t, err)
+	assert.Equal(t, []IdentityRecord{
+		{GerritUsername: "navi", GerritEmail: "navi@jorts.io"},
+		{GerritUsername: "hilmac", GerritEmail: "hilmac@jorts.io", ChatID: "U1234"},
+	}, records)
+}
+
+func TestReadIdentitiesCSV(t *testing.T) {
+	csvData := "Chat_Email, gerrit_username, department\nnavi@jorts.io, navi, eng\nhilmac@jorts.io,hilmac\n"
+	records, err := ReadIdentities(strings.NewReader(csvData), IdentityFormatCSV)
+	require.NoError(t, err)
+	assert.Equal(t, []IdentityRecord{
+		{GerritUsername: "navi", ChatEmail: "navi@jorts.io"},
+		{GerritUsername: "hilmac", ChatEmail: "hilmac@jorts.io"},
+	}, records)
+
+	_, err = ReadIdentities(strings.NewReader("username,email\nnavi,navi@jorts.io\n"), IdentityFormatCSV)
+	require.Error(t, err)
+}
+
+func TestIdentityImport(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		require.NoError(t, db.AssociateChatIDWithGerritUser(ctx, "navi", "U1"))
+		require.NoError(t, db.AssociateChatIDWithGerritUser(ctx, "hilmac", "U2"))
+
+		lookup := func(ctx context.Context, email string) (string, error) {
+			if email == "bobson@jorts.io" {
+				return "U3", nil
+			}
+			return "", errors.New("user not found")
+		}
+		records := []IdentityRecord{
+			{GerritUsername: "navi", ChatID: "U1"},
+			{GerritUsername: "hilmac", ChatID: "U22"},
+			{GerritUsername: "bdugnutt", GerritEmail: "bobson@jorts.io"},
+			{GerritUsername: "nobody", GerritEmail: "nobody@jorts.io"},
+			{GerritUsername: "twice", ChatID: "U5"},
+			{GerritUsername: "twice", ChatID: "U6"},
+			{GerritEmail: "anonymous@jorts.io"},
+		}
+		plan, err := PlanIdentityImport(ctx, db, lookup, records)
+		require.NoError(t, err)
+		assert.Equal(t, 1, plan.Count(IdentityCreate))
+		assert.Equal(t, 1, plan.Count(IdentityUpdate))
+		assert.Equal(t, 1, plan.Count(IdentityUnchanged))
+		assert.Equal(t, 3, plan.Count(IdentityConflict))
+		assert.Equal(t, `~ hilmac => U22 (was U2)
++ bdugnutt => U3
+! nobody: could not find chat user with email "nobody@jorts.io": user not found
+! twice: listed more than once, with different chat users (U5 and U6)
+! (no username): record for "anonymous@jorts.io" has no Gerrit username
+1 to create, 1 to update, 1 unchanged, 3 conflicts
+`, plan.String())
+
+		// planning doesn't change anything
+		associations, err := db.GetAllChatAssociations(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"navi": "U1", "hilmac": "U2"}, associations)
+
+		require.NoError(t, ApplyIdentityImport(ctx, db, plan))
+		exported, err := ExportIdentities(ctx, db)
+		require.NoError(t, err)
+		assert.Equal(t, []IdentityRecord{
+			{GerritUsername: "bdugnutt", ChatID: "U3"},
+			{GerritUsername: "hilmac", ChatID: "U22"},
+			{GerritUsername: "navi", ChatID: "U1"},
+		}, exported)
+		chatID, err := db.LookupChatIDForGerritUser(ctx, "hilmac")
+		require.NoError(t, err)
+		assert.Equal(t, "U22", chatID)
+	})
+}
+
+func TestUnwrapChatMarkup(t *testing.T) {
+	a := &App{fmt: &slack.Formatter{}}
+	got := a.unwrapChatMarkup("```gerrit_username,chat_id,chat_email\nnavi,<@U1234>,<mailto:navi@jorts.io|navi@jorts.io>\nx&amp;y,,\n```")
+	assert.Equal(t, "gerrit_username,chat_id,chat_email\nnavi,U1234,navi@jorts.io\nx&y,,\n", got)
+}
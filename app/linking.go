@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+)
+
+var (
+	smtpAddress  = flag.String("smtp-address", "", "host:port of the SMTP server through which one-time codes are emailed to users linking Gerrit accounts with !link. If not given, users whose chat and Gerrit email addresses don't match must be linked by an admin.")
+	smtpFrom     = flag.String("smtp-from", "", "Sender address for email sent through -smtp-address")
+	smtpUsername = flag.String("smtp-username", "", "Username for authenticating to -smtp-address, if it requires it. The password is read from the "+smtpPasswordEnvVar+" environment variable.")
+)
+
+const (
+	// smtpPasswordEnvVar is the environment variable holding the password for -smtp-username.
+	smtpPasswordEnvVar = "CHIHUAHUA_SMTP_PASSWORD"
+	// linkCodeLifetime is how long a user has to confirm their one-time link code.
+	linkCodeLifetime = time.Hour
+	// maxLinkCodeAttempts is how many wrong codes a user may give before their pending link
+	// is discarded.
+	maxLinkCodeAttempts = 5
+)
+
+// errLinkAttemptsExhausted is returned by ConsumePendingLink when a pending link is discarded
+// because too many wrong codes were given for it.
+var errLinkAttemptsExhausted = errors.New("too many wrong link codes")
+
+func newLinkCode() (string, error) {
+	var buf [6]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// linkCommand handles the !link chat command, which lets a user associate their chat account
+// with a Gerrit account without involving an admin.
+//
+// If any of the Gerrit account's email addresses (including secondary addresses, when the
+// Gerrit server lets us see them) belong to the requesting chat user, the association is made
+// right away. Otherwise a one-time code is emailed to the Gerrit account's preferred address,
+// and the association is made when the user gives it back with `!link confirm <code>`. Only
+// the owner of the Gerrit account gets the code, and only the requesting chat user can use
+// it, so this proves control of both accounts. After maxLinkCodeAttempts wrong codes, the
+// pending link is discarded.
+//
+// Codes are only delivered by email. Posting them as a Gerrit review message would show them
+// to everyone who can see the change, not just the account's owner.
+func (a *App) linkCommand(ctx context.Context, logger *zap.Logger, userID string, args []string) string {
+	if len(args) == 2 && args[0] == "confirm" {
+		return a.confirmLinkCode(ctx, logger, userID, args[1])
+	}
+	if len(args) != 1 {
+		return "bad !link usage (`!link <gerrit-username>` or `!link confirm <code>`)"
+	}
+	gerritUsername := args[0]
+	logger = logger.With(zap.String("gerrit-username", gerritUsername))
+
+	existing, err := a.persistentDB.LookupChatIDForGerritUser(ctx, gerritUsername)
+	if err == nil {
+		if existing == userID {
+			return fmt.Sprintf("You are already linked to %s", a.fmt.FormatCode(gerritUsername))
+		}
+		return fmt.Sprintf("%s is already associated with another chat user. Ask an admin if this is wrong.", a.fmt.FormatCode(gerritUsername))
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("failed to look up existing association", zap.Error(err))
+		return "failed to look up existing associations"
+	}
+
+	gerritClient := a.getGerritClient()
+	if gerritClient == nil {
+		return "Gerrit is not configured yet."
+	}
+	accounts, _, err := gerritClient.QueryAccountsEx(ctx, "username:"+gerritUsername, &gerrit.QueryAccountsOpts{
+		DescribeDetails:   true,
+		DescribeAllEmails: true,
+	})
+	if err != nil {
+		logger.Info("failed to query Gerrit for account", zap.Error(err))
+		return fmt.Sprintf("could not look up Gerrit user %s", a.fmt.FormatCode(gerritUsername))
+	}
+	if len(accounts) == 0 || accounts[0].Username != gerritUsername {
+		return fmt.Sprintf("there is no Gerrit user %s", a.fmt.FormatCode(gerritUsername))
+	}
+
+	emails := append([]string{accounts[0].Email}, accounts[0].SecondaryEmails...)
+	for _, email := range emails {
+		if email == "" {
+			continue
+		}
+		chatUser, err := a.chat.LookupUserByEmail(ctx, email)
+		if err != nil || chatUser.ChatID() != userID {
+			continue
+		}
+		if err := a.persistentDB.AssociateChatIDWithGerritUser(ctx, gerritUsername, userID); err != nil {
+			logger.Error("failed to create association", zap.Error(err))
+			return "failed to link accounts"
+		}
+		logger.Info("user linked gerrit account by email", zap.String("gerrit-email", email))
+		return fmt.Sprintf("Ok, you are now linked to %s", a.fmt.FormatCode(gerritUsername))
+	}
+
+	if *smtpAddress == "" || accounts[0].Email == "" {
+		return fmt.Sprintf("I couldn't match your email address to %s, and I have no way to email that account a code to prove it's yours. Ask an admin to link you.",
+			a.fmt.FormatCode(gerritUsername))
+	}
+	code, err := newLinkCode()
+	if err != nil {
+		logger.Error("failed to generate link code", zap.Error(err))
+		return "failed to generate a link code"
+	}
+	if err := a.persistentDB.SetPendingLink(ctx, userID, gerritUsername, code, time.Now().Add(linkCodeLifetime)); err != nil {
+		logger.Error("failed to store pending link", zap.Error(err))
+		return "failed to store a link code"
+	}
+	if err := sendLinkCodeEmail(accounts[0].Email, gerritUsername, code); err != nil {
+		logger.Error("failed to email link code", zap.Error(err))
+		return "failed to email a link code"
+	}
+	logger.Info("user requested gerrit account link by code")
+	return fmt.Sprintf("I couldn't match your email address to %s, so I've emailed a one-time code to the address Gerrit has for it. To prove it's yours, send me %s within the next %s.",
+		a.fmt.FormatCode(gerritUsername),
+		a.fmt.FormatCode("!link confirm <code>"),
+		prettyTimeDelta(linkCodeLifetime))
+}
+
+// sendLinkCodeEmail emails a one-time link code for the given Gerrit user through the
+// -smtp-address server.
+func sendLinkCodeEmail(to, gerritUsername, code string) error {
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		host, _, err := net.SplitHostPort(*smtpAddress)
+		if err != nil {
+			return errs.New("invalid smtp address %q: %v", *smtpAddress, err)
+		}
+		auth = smtp.PlainAuth("", *smtpUsername, os.Getenv(smtpPasswordEnvVar), host)
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Code for linking your Gerrit account\r\nDate: %s\r\n\r\n"+
+		"Someone asked to link the Gerrit account %q to their chat account. If it was you, send\r\n\r\n"+
+		"    !link confirm %s\r\n\r\n"+
+		"to the bot within the next %s. If not, you can ignore this email.\r\n",
+		*smtpFrom, to, time.Now().Format(time.RFC1123Z), gerritUsername, code, prettyTimeDelta(linkCodeLifetime))
+	return smtp.SendMail(*smtpAddress, auth, *smtpFrom, []string{to}, []byte(message))
+}
+
+// confirmLinkCode handles `!link confirm <code>`. If the code matches the chat user's pending
+// link, their chat account is linked to the Gerrit account to which the code was sent.
+func (a *App) confirmLinkCode(ctx context.Context, logger *zap.Logger, userID, code string) string {
+	gerritUsername, err := a.persistentDB.ConsumePendingLink(ctx, userID, code, time.Now(), maxLinkCodeAttempts)
+	if err != nil {
+		if errors.Is(err, errLinkAttemptsExhausted) {
+			logger.Warn("discarded pending link after too many wrong codes")
+			return "That code is not right either, and there have been too many wrong codes, so I've forgotten about this link. Start again with `!link <gerrit-username>`."
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Error("failed to look up pending link", zap.Error(err))
+			return "failed to look up your link code"
+		}
+		logger.Info("user gave an unknown or expired link code")
+		return "That code is not right, or has expired. Start again with `!link <gerrit-username>`."
+	}
+	logger = logger.With(zap.String("gerrit-username", gerritUsername))
+
+	// the code proves control of both accounts, so it overrides any existing association
+	if err := a.persistentDB.DisassociateGerritUser(ctx, gerritUsername); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("failed to remove previous association", zap.Error(err))
+		return "failed to link accounts"
+	}
+	if err := a.persistentDB.AssociateChatIDWithGerritUser(ctx, gerritUsername, userID); err != nil {
+		logger.Error("failed to create association", zap.Error(err))
+		return "failed to link accounts"
+	}
+	logger.Info("user linked gerrit account by code")
+	return fmt.Sprintf("Ok, you are now linked to %s", a.fmt.FormatCode(gerritUsername))
+}
+
+// unlinkCommand handles the !unlink chat command, which removes associations between the
+// requesting chat user and their Gerrit account(s).
+func (a *App) unlinkCommand(ctx context.Context, logger *zap.Logger, userID string, args []string) string {
+	if len(args) > 1 {
+		return "bad !unlink usage (`!unlink [<gerrit-username>]`)"
+	}
+	usernames, err := a.persistentDB.GetGerritUsernamesForChatID(ctx, userID)
+	if err != nil {
+		logger.Error("failed to look up gerrit usernames for chat user", zap.Error(err))
+		return "failed to look up your Gerrit account"
+	}
+	if len(args) == 1 {
+		found := false
+		for _, username := range usernames {
+			if username == args[0] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("You are not linked to %s", a.fmt.FormatCode(args[0]))
+		}
+		usernames = args
+	}
+	if len(usernames) == 0 {
+		return "You are not linked to any Gerrit account."
+	}
+	formatted := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		if err := a.persistentDB.DisassociateGerritUser(ctx, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logger.Error("failed to remove association", zap.String("gerrit-username", username), zap.Error(err))
+			return fmt.Sprintf("failed to unlink %s", a.fmt.FormatCode(username))
+		}
+		logger.Info("user unlinked gerrit account", zap.String("gerrit-username", username))
+		formatted = append(formatted, a.fmt.FormatCode(username))
+	}
+	return fmt.Sprintf("Ok, unlinked %s. If your Gerrit and chat email addresses match, the link will be rediscovered automatically.", strings.Join(formatted, ", "))
+}
@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP TABLE user_prefs;
@@ -0,0 +1,8 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE user_prefs (
+       chat_id TEXT NOT NULL,
+       pref_key TEXT NOT NULL,
+       pref_value TEXT NOT NULL,
+       PRIMARY KEY ( chat_id, pref_key )
+);
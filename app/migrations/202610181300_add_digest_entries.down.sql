@@ -0,0 +1,4 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP INDEX digest_entries_chat_id_created_at_idx;
+DROP TABLE digest_entries;
@@ -0,0 +1,13 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE digest_entries (
+       chat_id TEXT NOT NULL,
+       project_name TEXT NOT NULL,
+       change_num INTEGER NOT NULL,
+       change_link TEXT NOT NULL,
+       kind TEXT NOT NULL,
+       message TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX digest_entries_chat_id_created_at_idx ON digest_entries ( chat_id, created_at );
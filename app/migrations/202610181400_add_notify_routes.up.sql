@@ -0,0 +1,12 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE notify_routes (
+       name TEXT NOT NULL,
+       project TEXT NOT NULL,
+       branch TEXT NOT NULL,
+       topic TEXT NOT NULL,
+       hashtag TEXT NOT NULL,
+       event_type TEXT NOT NULL,
+       channels TEXT NOT NULL,
+       PRIMARY KEY ( name )
+);
@@ -0,0 +1,9 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE pending_links (
+       chat_id TEXT NOT NULL,
+       gerrit_username TEXT NOT NULL,
+       code TEXT NOT NULL,
+       expires_at TIMESTAMP NOT NULL,
+       PRIMARY KEY ( chat_id )
+);
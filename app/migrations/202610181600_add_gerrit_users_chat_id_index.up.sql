@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE INDEX gerrit_users_chat_id_idx ON gerrit_users ( chat_id );
@@ -0,0 +1,7 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE autoassign_state (
+       rule_name TEXT NOT NULL,
+       next_index INTEGER NOT NULL,
+       PRIMARY KEY ( rule_name )
+);
@@ -0,0 +1,10 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE sla_reminders (
+       project_name TEXT NOT NULL,
+       change_num INTEGER NOT NULL,
+       reviewer TEXT NOT NULL,
+       requested_at TIMESTAMP NOT NULL,
+       level INTEGER NOT NULL,
+       PRIMARY KEY ( project_name, change_num, reviewer )
+);
@@ -0,0 +1,15 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE event_history (
+       event_type TEXT NOT NULL,
+       project_name TEXT NOT NULL,
+       change_num INTEGER NOT NULL,
+       owner TEXT NOT NULL,
+       actor TEXT NOT NULL,
+       patchset_num INTEGER NOT NULL,
+       approved BOOLEAN NOT NULL,
+       event_time TIMESTAMP NOT NULL
+);
+
+CREATE INDEX event_history_change_idx ON event_history ( project_name, change_num );
+CREATE INDEX event_history_event_time_idx ON event_history ( event_time );
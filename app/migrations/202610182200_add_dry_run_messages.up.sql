@@ -0,0 +1,12 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE dry_run_messages (
+       id TEXT NOT NULL,
+       kind TEXT NOT NULL,
+       target TEXT NOT NULL,
+       message TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL,
+       PRIMARY KEY ( id )
+);
+
+CREATE INDEX dry_run_messages_created_at_idx ON dry_run_messages ( created_at );
@@ -0,0 +1,11 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE health_state (
+       id INTEGER NOT NULL,
+       last_event_received TIMESTAMP,
+       gerrit_failures INTEGER NOT NULL DEFAULT 0,
+       last_gerrit_error TEXT NOT NULL DEFAULT '',
+       quiet_alerted INTEGER NOT NULL DEFAULT 0,
+       gerrit_alerted INTEGER NOT NULL DEFAULT 0,
+       PRIMARY KEY ( id )
+);
@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pending_links DROP COLUMN failed_attempts;
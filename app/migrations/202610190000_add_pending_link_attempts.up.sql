@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pending_links ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/messages"
+)
+
+// Operator carries out administrative tasks on a team's persistent DB for the command line
+// tools. It goes through the same code paths as the chat commands, but without connecting
+// to the chat system or to Gerrit, so it can be used while the team is not running.
+type Operator struct {
+	app *App
+}
+
+// NewOperator creates an Operator for the team whose persistent DB is given. Channels and
+// users can be given to it either as plain IDs or as links in the chat system's format.
+func NewOperator(logger *zap.Logger, persistentDB *PersistentDB, chatFormatter messages.ChatSystemFormatter) *Operator {
+	return &Operator{
+		app: &App{
+			logger:             logger,
+			fmt:                plainIDFormatter{chatFormatter},
+			persistentDB:       persistentDB,
+			gerritConnector:    offlineGerritConnector{},
+			reconfigureChannel: make(chan struct{}, 1),
+		},
+	}
+}
+
+// ConfigItem is a team config item and its value, as shown to operators.
+type ConfigItem struct {
+	Key   string
+	Value string
+}
+
+// ConfigItems returns all of the team's config items, sorted by key. The values of secret
+// items are hidden.
+func (o *Operator) ConfigItems(ctx context.Context) ([]ConfigItem, error) {
+	allConfig, err := o.app.persistentDB.GetAllConfigItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ConfigItem, 0, len(allConfig))
+	for key, value := range allConfig {
+		items = append(items, ConfigItem{Key: key, Value: redactConfigValue(key, value)})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, nil
+}
+
+// GetConfig returns the value of a team config item. The values of secret items are hidden.
+func (o *Operator) GetConfig(ctx context.Context, key string) (string, error) {
+	configDef := findConfigItem(key)
+	if configDef == nil {
+		return "", errs.New("%q is not a known config item", key)
+	}
+	value, err := o.app.persistentDB.GetConfig(ctx, key, "")
+	if err != nil {
+		return "", err
+	}
+	if configDef.ItemType == ConfigItemSecret && value != "" {
+		value = secretConfigPlaceholder
+	}
+	return value, nil
+}
+
+// SetConfig sets a team config item, checking the key and value just as the !config chat
+// command does. A running team sees the change the next time it reads the item, but changes
+// to report schedules may not take effect until the team is restarted.
+func (o *Operator) SetConfig(ctx context.Context, key, value string) error {
+	return o.app.setConfigItem(ctx, key, value)
+}
+
+// SendTeamReport builds and sends the named team report now, outside of its schedule. It
+// returns the ID of the channel the report was sent to.
+func (a *App) SendTeamReport(ctx context.Context, reportName string, now time.Time) (string, error) {
+	report, err := a.getTeamReportConfig(ctx, reportName)
+	if err != nil {
+		return "", errs.New("could not retrieve report config for %q: %w", reportName, err)
+	}
+	a.TeamReport(ctx, now, report)
+	return report.ChannelID, nil
+}
+
+// plainIDFormatter lets channels and users be given as plain IDs, as well as in the chat
+// system's link format, where the underlying formatter would only accept links.
+type plainIDFormatter struct {
+	messages.ChatSystemFormatter
+}
+
+func (f plainIDFormatter) UnwrapChannelLink(channelLink string) string {
+	if id := f.ChatSystemFormatter.UnwrapChannelLink(channelLink); id != "" {
+		return id
+	}
+	return plainID(channelLink)
+}
+
+func (f plainIDFormatter) UnwrapUserLink(userLink string) string {
+	if id := f.ChatSystemFormatter.UnwrapUserLink(userLink); id != "" {
+		return id
+	}
+	return plainID(userLink)
+}
+
+// plainID returns s if it looks like a bare chat system ID, or "" otherwise.
+func plainID(s string) string {
+	if s == "" || strings.ContainsAny(s, " <>|#@") {
+		return ""
+	}
+	return s
+}
+
+// offlineGerritConnector refuses to connect to Gerrit, for an Operator.
+type offlineGerritConnector struct{}
+
+func (offlineGerritConnector) OpenGerrit(context.Context, *zap.Logger, string) (gerrit.Client, error) {
+	return nil, errs.New("not connecting to Gerrit while offline")
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+func TestOperatorConfig(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		operator := NewOperator(zaptest.NewLogger(t), db, &slack.Formatter{})
+
+		require.Error(t, operator.SetConfig(ctx, "no-such-item", "x"))
+		require.Error(t, operator.SetConfig(ctx, "global-notify-channel", "#general"))
+
+		// channels can be given as plain IDs or as links, as many times as needed
+		require.NoError(t, operator.SetConfig(ctx, "global-notify-channel", "C0123456789"))
+		require.NoError(t, operator.SetConfig(ctx, "global-notify-channel", "<#C9876543210|general>"))
+		value, err := operator.GetConfig(ctx, "global-notify-channel")
+		require.NoError(t, err)
+		assert.Equal(t, "C9876543210", value)
+
+		// secrets are not shown
+		require.NoError(t, operator.SetConfig(ctx, "gerrit-http-password", "hunter2"))
+		value, err = operator.GetConfig(ctx, "gerrit-http-password")
+		require.NoError(t, err)
+		assert.NotContains(t, value, "hunter2")
+
+		items, err := operator.ConfigItems(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []ConfigItem{
+			{Key: "gerrit-http-password", Value: secretConfigPlaceholder},
+			{Key: "global-notify-channel", Value: "C9876543210"},
+		}, items)
+	})
+}
+
+func TestRedactSecrets(t *testing.T) {
+	assert.Equal(t, "!config gerrit-http-password "+secretConfigPlaceholder, redactChatCommand("!config gerrit-http-password hunter2 hunter3"))
+	assert.Equal(t, "!config gerrit-http-password", redactChatCommand("!config gerrit-http-password"))
+	assert.Equal(t, "!config gerrit-http-username noodle", redactChatCommand("!config gerrit-http-username noodle"))
+	assert.Equal(t, secretConfigPlaceholder, redactConfigValue("gerrit-http-password", "hunter2"))
+	assert.Equal(t, "noodle", redactConfigValue("gerrit-http-username", "noodle"))
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"embed"
 	"errors"
@@ -23,6 +24,7 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/storj/changesetchihuahua/app/dbx"
+	"github.com/storj/changesetchihuahua/config"
 )
 
 //go:embed migrations/*.sql
@@ -30,8 +32,11 @@ var migrationsFS embed.FS
 
 var (
 	prunePeriod       = flag.Duration("db-prune-period", time.Hour, "Time between persistent db prune jobs")
-	pruneTimeout      = flag.Duration("db-prune-timeout", 10*time.Minute, "Cancel any prune jobs that run longer than this amount of time")
+	pruneTimeout      = config.DurationFlag("db-prune-timeout", 10*time.Minute, "Cancel any prune jobs that run longer than this amount of time")
 	buildLifetimeDays = flag.Int("build-lifetime-days", 7, "Builds on patchsets older than this many days will not have their announcements inline-annotated with new build statuses")
+	eventHistoryDays  = flag.Int("event-history-days", 400, "Gerrit event history older than this many days is discarded, limiting how far back review statistics can look")
+	dryRunDays        = flag.Int("dry-run-days", 30, "Messages recorded in dry-run mode older than this many days are discarded")
+	identityCacheTTL  = flag.Duration("identity-cache-ttl", time.Minute, "How long a Gerrit user's chat ID is cached before being reread, so that links and unlinks made by other instances are seen")
 )
 
 // PersistentDB represents a persistent database attached to a specific team.
@@ -41,14 +46,19 @@ type PersistentDB struct {
 	dbLock sync.Mutex // is this still necessary with sqlite?
 
 	cacheLock sync.RWMutex
-	cache     map[string]string
+	cache     map[string]cachedChatID
+	cacheTTL  time.Duration
+
+	// sealer encrypts the values of secret config items at rest
+	sealer *Sealer
 
 	pruneCancel context.CancelFunc
 }
 
-// NewPersistentDB creates a new PersistentDB instance.
-func NewPersistentDB(logger *zap.Logger, dbSource string) (*PersistentDB, error) {
-	db, err := initializePersistentDB(logger, dbSource)
+// NewPersistentDB creates a new PersistentDB instance, sealing and opening the values of
+// secret config items with the given Sealer.
+func NewPersistentDB(logger *zap.Logger, dbSource string, sealer *Sealer) (*PersistentDB, error) {
+	db, err := initializePersistentDB(logger, dbSource, migrationsFS, "migrations")
 	if err != nil {
 		return nil, err
 	}
@@ -56,13 +66,53 @@ func NewPersistentDB(logger *zap.Logger, dbSource string) (*PersistentDB, error)
 	pdb := &PersistentDB{
 		logger:      logger,
 		db:          db,
-		cache:       make(map[string]string),
+		cache:       make(map[string]cachedChatID),
+		cacheTTL:    *identityCacheTTL,
+		sealer:      sealer,
 		pruneCancel: cancel,
 	}
+	if err := pdb.sealLegacySecrets(ctx); err != nil {
+		cancel()
+		return nil, errs.Combine(errs.New("could not seal secret config items: %w", err), db.Close())
+	}
 	go pdb.pruneJob(ctx)
 	return pdb, nil
 }
 
+// sealLegacySecrets seals the values of any secret config items which were stored before
+// they were sealed.
+func (ud *PersistentDB) sealLegacySecrets(ctx context.Context) error {
+	items, err := ud.db.All_TeamConfig(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if isSecretConfigItem(item.ConfigKey) && !strings.HasPrefix(item.ConfigValue, sealedPrefix) {
+			if err := ud.SetConfig(ctx, item.ConfigKey, item.ConfigValue); err != nil {
+				return err
+			}
+			ud.logger.Info("sealed secret config item", zap.String("key", item.ConfigKey))
+		}
+	}
+	return nil
+}
+
+// sealConfigValue seals the value of a config item for storage, if it is a secret item.
+func (ud *PersistentDB) sealConfigValue(key, value string) (string, error) {
+	if !isSecretConfigItem(key) || value == "" {
+		return value, nil
+	}
+	return ud.sealer.Seal(value, key)
+}
+
+// openConfigValue opens the stored value of a config item, if it is a secret item.
+func (ud *PersistentDB) openConfigValue(key, stored string) (string, error) {
+	if !isSecretConfigItem(key) || stored == "" {
+		return stored, nil
+	}
+	return ud.sealer.Open(stored, key)
+}
+
 func openPersistentDB(dbSource string) (*dbx.DB, string, error) {
 	sourceSplit := strings.SplitN(dbSource, ":", 2)
 	if len(sourceSplit) == 1 {
@@ -83,14 +133,16 @@ func openPersistentDB(dbSource string) (*dbx.DB, string, error) {
 	return dbxDB, driverName, err
 }
 
-func initializePersistentDB(logger *zap.Logger, dbSource string) (*dbx.DB, error) {
+// initializePersistentDB opens a database and brings it up to date by applying the
+// migrations found in the given directory of migrationFS.
+func initializePersistentDB(logger *zap.Logger, dbSource string, migrationFS embed.FS, migrationDir string) (*dbx.DB, error) {
 	logger.Info("Opening persistent DB", zap.String("db-source", dbSource))
 	db, driverName, err := openPersistentDB(dbSource)
 	if err != nil {
 		return nil, err
 	}
 
-	migrationSource, err := iofs.New(migrationsFS, "migrations")
+	migrationSource, err := iofs.New(migrationFS, migrationDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -136,7 +188,7 @@ func (ud *PersistentDB) pruneJob(ctx context.Context) {
 			return
 		case t := <-ticker.C:
 			go func() {
-				jobCtx, cancel := context.WithTimeout(ctx, *pruneTimeout)
+				jobCtx, cancel := context.WithTimeout(ctx, pruneTimeout.Get())
 				defer cancel()
 				if err := ud.Prune(jobCtx, t); err != nil {
 					ud.logger.Error("Prune job failed", zap.Error(err))
@@ -155,29 +207,49 @@ func (ud *PersistentDB) LookupGerritUser(ctx context.Context, gerritUsername str
 	return ud.db.Get_GerritUser_By_GerritUsername(ctx, dbx.GerritUser_GerritUsername(gerritUsername))
 }
 
+// cachedChatID is an entry in the PersistentDB cache of chat IDs by Gerrit username. Other
+// instances sharing the DB may change the association, so entries are only trusted until
+// their expiry time.
+type cachedChatID struct {
+	chatID  string
+	expires time.Time
+}
+
 // LookupChatIDForGerritUser tries to determine the corresponding chat ID for a given Gerrit
 // username. A cache is checked first, then the persistent DB is checked if necessary.
 func (ud *PersistentDB) LookupChatIDForGerritUser(ctx context.Context, gerritUsername string) (string, error) {
 	// check cache
 	ud.cacheLock.RLock()
-	chatID, found := ud.cache[gerritUsername]
+	entry, found := ud.cache[gerritUsername]
 	ud.cacheLock.RUnlock()
-	if found {
-		return chatID, nil
+	if found && time.Now().Before(entry.expires) {
+		return entry.chatID, nil
 	}
 	// consult db if necessary
 	usermapRecord, err := ud.LookupGerritUser(ctx, gerritUsername)
 	if err != nil {
+		if found {
+			ud.uncacheChatID(gerritUsername)
+		}
 		return "", err
 	}
-	chatID = usermapRecord.ChatId
+	chatID := usermapRecord.ChatId
 
 	// update cache if successful
+	ud.cacheChatID(gerritUsername, chatID)
+	return chatID, nil
+}
+
+func (ud *PersistentDB) cacheChatID(gerritUsername, chatID string) {
 	ud.cacheLock.Lock()
-	ud.cache[gerritUsername] = chatID
+	ud.cache[gerritUsername] = cachedChatID{chatID: chatID, expires: time.Now().Add(ud.cacheTTL)}
 	ud.cacheLock.Unlock()
+}
 
-	return chatID, nil
+func (ud *PersistentDB) uncacheChatID(gerritUsername string) {
+	ud.cacheLock.Lock()
+	delete(ud.cache, gerritUsername)
+	ud.cacheLock.Unlock()
 }
 
 // AssociateChatIDWithGerritUser associates a chat ID with a Gerrit username, storing that
@@ -193,9 +265,7 @@ func (ud *PersistentDB) AssociateChatIDWithGerritUser(ctx context.Context, gerri
 		return err
 	}
 	// if update was successful, this call is responsible for adding to cache
-	ud.cacheLock.Lock()
-	ud.cache[gerritUsername] = chatID
-	ud.cacheLock.Unlock()
+	ud.cacheChatID(gerritUsername, chatID)
 
 	ud.logger.Debug("associated gerrit user to chat ID",
 		zap.String("gerrit-username", gerritUsername),
@@ -203,6 +273,176 @@ func (ud *PersistentDB) AssociateChatIDWithGerritUser(ctx context.Context, gerri
 	return nil
 }
 
+// GetAllChatAssociations returns all known associations from Gerrit usernames to chat IDs.
+func (ud *PersistentDB) GetAllChatAssociations(ctx context.Context) (associations map[string]string, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, `
+		SELECT gerrit_username, chat_id FROM gerrit_users
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	associations = make(map[string]string)
+	for rows.Next() {
+		var gerritUsername, chatID string
+		if err := rows.Scan(&gerritUsername, &chatID); err != nil {
+			return nil, err
+		}
+		associations[gerritUsername] = chatID
+	}
+	return associations, nil
+}
+
+// DisassociateGerritUser removes any association between the given Gerrit username and a
+// chat ID. It returns sql.ErrNoRows if there was no association.
+func (ud *PersistentDB) DisassociateGerritUser(ctx context.Context, gerritUsername string) error {
+	err := func() error {
+		ud.dbLock.Lock()
+		defer ud.dbLock.Unlock()
+
+		result, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+			DELETE FROM gerrit_users WHERE gerrit_username = ?
+		`), gerritUsername)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	ud.uncacheChatID(gerritUsername)
+
+	ud.logger.Debug("disassociated gerrit user from chat ID",
+		zap.String("gerrit-username", gerritUsername))
+	return nil
+}
+
+// SetPendingLink records a one-time code which, when given by the chat user before the expiry
+// time, will associate that chat ID with the given Gerrit user. Any previous pending link for
+// the same chat ID is replaced.
+func (ud *PersistentDB) SetPendingLink(ctx context.Context, chatID, gerritUsername, code string, expiresAt time.Time) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO pending_links (chat_id, gerrit_username, code, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			gerrit_username = EXCLUDED.gerrit_username,
+			code = EXCLUDED.code,
+			expires_at = EXCLUDED.expires_at,
+			failed_attempts = 0
+	`), chatID, gerritUsername, code, expiresAt.UTC())
+	return err
+}
+
+// ConsumePendingLink looks for an unexpired pending link for the given chat ID with the given
+// code. If one is found, it is removed and the Gerrit username it was for is returned.
+// Otherwise, sql.ErrNoRows is returned. A wrong code counts as a failed attempt against the
+// chat ID's pending link, and once there have been maxAttempts of them, the pending link is
+// removed and errLinkAttemptsExhausted is returned.
+func (ud *PersistentDB) ConsumePendingLink(ctx context.Context, chatID, code string, now time.Time, maxAttempts int) (string, error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	var gerritUsername, pendingCode string
+	err := ud.db.DB.QueryRowContext(ctx, ud.db.Rebind(`
+		SELECT gerrit_username, code FROM pending_links WHERE chat_id = ? AND expires_at > ?
+	`), chatID, now.UTC()).Scan(&gerritUsername, &pendingCode)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(pendingCode)) == 1 {
+		_, err = ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+			DELETE FROM pending_links WHERE chat_id = ?
+		`), chatID)
+		return gerritUsername, err
+	}
+
+	_, err = ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		UPDATE pending_links SET failed_attempts = failed_attempts + 1 WHERE chat_id = ?
+	`), chatID)
+	if err != nil {
+		return "", err
+	}
+	result, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		DELETE FROM pending_links WHERE chat_id = ? AND failed_attempts >= ?
+	`), chatID, maxAttempts)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if n > 0 {
+		return "", errLinkAttemptsExhausted
+	}
+	return "", sql.ErrNoRows
+}
+
+// GetGerritUsernamesForChatID returns all Gerrit usernames which are associated with the
+// given chat ID, in sorted order.
+func (ud *PersistentDB) GetGerritUsernamesForChatID(ctx context.Context, chatID string) (usernames []string, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, ud.db.Rebind(`
+		SELECT gerrit_username FROM gerrit_users WHERE chat_id = ? ORDER BY gerrit_username
+	`), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
+
+// GetRoundRobinPosition returns the position at which the named round-robin rotation should
+// next pick. A rotation which has never been used starts at 0.
+func (ud *PersistentDB) GetRoundRobinPosition(ctx context.Context, ruleName string) (int, error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	var position int
+	err := ud.db.DB.QueryRowContext(ctx, ud.db.Rebind(`
+		SELECT next_index FROM autoassign_state WHERE rule_name = ?
+	`), ruleName).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return position, err
+}
+
+// SetRoundRobinPosition records the position at which the named round-robin rotation should
+// next pick.
+func (ud *PersistentDB) SetRoundRobinPosition(ctx context.Context, ruleName string, position int) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO autoassign_state (rule_name, next_index) VALUES (?, ?)
+		ON CONFLICT (rule_name) DO UPDATE SET next_index = EXCLUDED.next_index
+	`), ruleName, position)
+	return err
+}
+
 // GetAllUsersWhoseLastReportWasBefore gets all users whose last report was before the
 // specified time.
 func (ud *PersistentDB) GetAllUsersWhoseLastReportWasBefore(ctx context.Context, t time.Time) ([]*dbx.GerritUser, error) {
@@ -314,7 +554,10 @@ func (ud *PersistentDB) GetAllConfigItems(ctx context.Context) (map[string]strin
 	}
 	itemsMap := make(map[string]string)
 	for _, item := range items {
-		itemsMap[item.ConfigKey] = item.ConfigValue
+		itemsMap[item.ConfigKey], err = ud.openConfigValue(item.ConfigKey, item.ConfigValue)
+		if err != nil {
+			return nil, errs.New("config item %s: %w", item.ConfigKey, err)
+		}
 	}
 	return itemsMap, nil
 }
@@ -333,7 +576,11 @@ func (ud *PersistentDB) GetConfig(ctx context.Context, key, defaultValue string)
 		}
 		return defaultValue, err
 	}
-	return value.ConfigValue, nil
+	opened, err := ud.openConfigValue(key, value.ConfigValue)
+	if err != nil {
+		return defaultValue, err
+	}
+	return opened, nil
 }
 
 // JustGetConfig gets the value of a config item for this team and returns it as a string. If the
@@ -382,6 +629,14 @@ func (ud *PersistentDB) GetConfigBool(ctx context.Context, key string, defaultVa
 	if err != nil || val == "" {
 		return defaultValue, err
 	}
+	boolVal, err := parseBoolValue(val)
+	if err != nil {
+		return defaultValue, err
+	}
+	return boolVal, nil
+}
+
+func parseBoolValue(val string) (bool, error) {
 	val = strings.ToLower(val)
 	switch val {
 	case "yes", "y", "1", "on", "true", "t":
@@ -389,7 +644,7 @@ func (ud *PersistentDB) GetConfigBool(ctx context.Context, key string, defaultVa
 	case "no", "n", "0", "off", "false", "f":
 		return false, nil
 	}
-	return defaultValue, fmt.Errorf("invalid boolean value %q", val)
+	return false, fmt.Errorf("invalid boolean value %q", val)
 }
 
 // JustGetConfigBool gets the value of a config item for this team, parses it as a boolean, and
@@ -437,7 +692,10 @@ func (ud *PersistentDB) GetConfigWildcard(ctx context.Context, pattern string) (
 		if err != nil {
 			return nil, err
 		}
-		items[key] = val
+		items[key], err = ud.openConfigValue(key, val)
+		if err != nil {
+			return nil, errs.New("config item %s: %w", key, err)
+		}
 	}
 	return items, nil
 }
@@ -456,12 +714,18 @@ func (ud *PersistentDB) JustGetConfigWildcard(ctx context.Context, pattern strin
 	return items
 }
 
-// SetConfig stores a config item with the specified value.
+// SetConfig stores a config item with the specified value. The values of secret items are
+// sealed.
 func (ud *PersistentDB) SetConfig(ctx context.Context, key, value string) error {
+	value, err := ud.sealConfigValue(key, value)
+	if err != nil {
+		return err
+	}
+
 	ud.dbLock.Lock()
 	defer ud.dbLock.Unlock()
 
-	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+	_, err = ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
 		INSERT INTO team_configs (config_key, config_value) VALUES (?, ?)
 		ON CONFLICT (config_key) DO UPDATE SET config_value = EXCLUDED.config_value
 	`), key, value)
@@ -473,16 +737,568 @@ func (ud *PersistentDB) SetConfigInt(ctx context.Context, key string, value int)
 	return ud.SetConfig(ctx, key, strconv.FormatInt(int64(value), 32))
 }
 
-// Prune removes all records of old patchset announcements and inline comments, so the db does
-// not grow indefinitely.
+// GetUserPref gets the value of a preference item for the given chat user. If the user has not
+// set the preference, defaultValue is returned instead.
+func (ud *PersistentDB) GetUserPref(ctx context.Context, chatID, key, defaultValue string) (string, error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	var value string
+	err := ud.db.DB.QueryRowContext(ctx, ud.db.Rebind(`
+		SELECT pref_value FROM user_prefs WHERE chat_id = ? AND pref_key = ?
+	`), chatID, key).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return defaultValue, err
+	}
+	return value, nil
+}
+
+// JustGetUserPref gets the value of a preference item for the given chat user. If the user has
+// not set the preference, defaultValue is returned instead. If the preference can not be read,
+// the error is logged, and defaultValue is returned.
+func (ud *PersistentDB) JustGetUserPref(ctx context.Context, chatID, key, defaultValue string) string {
+	val, err := ud.GetUserPref(ctx, chatID, key, defaultValue)
+	if err != nil {
+		ud.logger.Error("failed to retrieve user pref", zap.String("chat-id", chatID), zap.String("key", key), zap.Error(err))
+	}
+	return val
+}
+
+// JustGetUserPrefBool gets the value of a preference item for the given chat user and parses
+// it as a boolean. If the preference is not set, or can not be read or parsed, defaultValue is
+// returned (and any error is logged).
+func (ud *PersistentDB) JustGetUserPrefBool(ctx context.Context, chatID, key string, defaultValue bool) bool {
+	val := ud.JustGetUserPref(ctx, chatID, key, "")
+	if val == "" {
+		return defaultValue
+	}
+	boolVal, err := parseBoolValue(val)
+	if err != nil {
+		ud.logger.Info("invalid bool value for user pref", zap.String("chat-id", chatID), zap.String("key", key), zap.Error(err))
+		return defaultValue
+	}
+	return boolVal
+}
+
+// JustGetUserPrefInt gets the value of a preference item for the given chat user and parses
+// it as an integer. If the preference is not set, or can not be read or parsed, defaultValue
+// is returned (and any error is logged).
+func (ud *PersistentDB) JustGetUserPrefInt(ctx context.Context, chatID, key string, defaultValue int) int {
+	val := ud.JustGetUserPref(ctx, chatID, key, "")
+	if val == "" {
+		return defaultValue
+	}
+	numVal, err := strconv.ParseInt(val, 0, 32)
+	if err != nil {
+		ud.logger.Info("invalid int value for user pref", zap.String("chat-id", chatID), zap.String("key", key), zap.Error(err))
+		return defaultValue
+	}
+	return int(numVal)
+}
+
+// GetAllUserPrefs gets all preference items set by the given chat user and returns them as a
+// map of preference key to value.
+func (ud *PersistentDB) GetAllUserPrefs(ctx context.Context, chatID string) (prefs map[string]string, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, ud.db.Rebind(`
+		SELECT pref_key, pref_value FROM user_prefs WHERE chat_id = ?
+	`), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	prefs = make(map[string]string)
+	for rows.Next() {
+		var key, val string
+		if err := rows.Scan(&key, &val); err != nil {
+			return nil, err
+		}
+		prefs[key] = val
+	}
+	return prefs, nil
+}
+
+// SetUserPref stores a preference item with the specified value for the given chat user.
+func (ud *PersistentDB) SetUserPref(ctx context.Context, chatID, key, value string) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO user_prefs (chat_id, pref_key, pref_value) VALUES (?, ?, ?)
+		ON CONFLICT (chat_id, pref_key) DO UPDATE SET pref_value = EXCLUDED.pref_value
+	`), chatID, key, value)
+	return err
+}
+
+// DeleteUserPref removes a preference item for the given chat user, so that the default
+// value will be used again.
+func (ud *PersistentDB) DeleteUserPref(ctx context.Context, chatID, key string) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		DELETE FROM user_prefs WHERE chat_id = ? AND pref_key = ?
+	`), chatID, key)
+	return err
+}
+
+// DigestEntry is a notification which has been held back for delivery in a user's digest.
+type DigestEntry struct {
+	ProjectName string
+	ChangeNum   int
+	ChangeLink  string
+	Kind        string
+	Message     string
+	CreatedAt   time.Time
+}
+
+// AddDigestEntry stores a notification to be delivered later in the given chat user's digest.
+func (ud *PersistentDB) AddDigestEntry(ctx context.Context, chatID string, entry DigestEntry) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO digest_entries (chat_id, project_name, change_num, change_link, kind, message, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`), chatID, entry.ProjectName, entry.ChangeNum, entry.ChangeLink, entry.Kind, entry.Message, entry.CreatedAt.UTC())
+	return err
+}
+
+// GetDigestEntries gets all notifications waiting to be delivered in the given chat user's
+// digest, in the order they were added.
+func (ud *PersistentDB) GetDigestEntries(ctx context.Context, chatID string) (entries []DigestEntry, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, ud.db.Rebind(`
+		SELECT project_name, change_num, change_link, kind, message, created_at FROM digest_entries
+		WHERE chat_id = ?
+		ORDER BY created_at
+	`), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var entry DigestEntry
+		if err := rows.Scan(&entry.ProjectName, &entry.ChangeNum, &entry.ChangeLink, &entry.Kind, &entry.Message, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// GetChatIDsWithDigestEntries gets the chat IDs of all users who have notifications waiting
+// to be delivered in a digest.
+func (ud *PersistentDB) GetChatIDsWithDigestEntries(ctx context.Context) (chatIDs []string, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, `SELECT DISTINCT chat_id FROM digest_entries`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var chatID string
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, nil
+}
+
+// CountDigestEntries counts the notifications waiting to be delivered in digests, across
+// all users.
+func (ud *PersistentDB) CountDigestEntries(ctx context.Context) (count int, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	err = ud.db.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM digest_entries`).Scan(&count)
+	return count, err
+}
+
+// DeleteDigestEntries removes all of the given chat user's digest notifications which were
+// added at or before the specified time.
+func (ud *PersistentDB) DeleteDigestEntries(ctx context.Context, chatID string, upTo time.Time) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		DELETE FROM digest_entries WHERE chat_id = ? AND created_at <= ?
+	`), chatID, upTo.UTC())
+	return err
+}
+
+// NotifyRoute is a rule directing channel notifications about matching events to one or
+// more channels. Empty match fields match anything.
+type NotifyRoute struct {
+	Name      string
+	Project   string
+	Branch    string
+	Topic     string
+	Hashtag   string
+	EventType string
+	Channels  []string
+}
+
+// GetAllNotifyRoutes returns all configured notification routing rules, ordered by name.
+func (ud *PersistentDB) GetAllNotifyRoutes(ctx context.Context) (routes []NotifyRoute, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, `
+		SELECT name, project, branch, topic, hashtag, event_type, channels
+		FROM notify_routes ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var route NotifyRoute
+		var channels string
+		if err := rows.Scan(&route.Name, &route.Project, &route.Branch, &route.Topic, &route.Hashtag, &route.EventType, &channels); err != nil {
+			return nil, err
+		}
+		route.Channels = strings.Split(channels, ",")
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// SetNotifyRoute stores a notification routing rule, replacing any existing rule with the
+// same name.
+func (ud *PersistentDB) SetNotifyRoute(ctx context.Context, route NotifyRoute) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO notify_routes (name, project, branch, topic, hashtag, event_type, channels)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			project = EXCLUDED.project,
+			branch = EXCLUDED.branch,
+			topic = EXCLUDED.topic,
+			hashtag = EXCLUDED.hashtag,
+			event_type = EXCLUDED.event_type,
+			channels = EXCLUDED.channels
+	`), route.Name, route.Project, route.Branch, route.Topic, route.Hashtag, route.EventType, strings.Join(route.Channels, ","))
+	return err
+}
+
+// DeleteNotifyRoute removes the named notification routing rule. It returns sql.ErrNoRows if
+// no such rule exists.
+func (ud *PersistentDB) DeleteNotifyRoute(ctx context.Context, name string) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	result, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		DELETE FROM notify_routes WHERE name = ?
+	`), name)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSLAReminderLevel returns the level of stalled-review reminder which has already been
+// sent about the given reviewer on the given change, for the review request made at
+// requestedAt. If nothing has been sent for that request, the level is 0.
+func (ud *PersistentDB) GetSLAReminderLevel(ctx context.Context, projectName string, changeNum int, reviewer string, requestedAt time.Time) (int, error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	var storedRequestedAt time.Time
+	var level int
+	err := ud.db.DB.QueryRowContext(ctx, ud.db.Rebind(`
+		SELECT requested_at, level FROM sla_reminders
+		WHERE project_name = ? AND change_num = ? AND reviewer = ?
+	`), projectName, changeNum, reviewer).Scan(&storedRequestedAt, &level)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !storedRequestedAt.Equal(requestedAt.UTC()) {
+		// the reviewer was asked again since; start over
+		return 0, nil
+	}
+	return level, nil
+}
+
+// SetSLAReminderLevel records the level of stalled-review reminder which has been sent about
+// the given reviewer on the given change, for the review request made at requestedAt.
+func (ud *PersistentDB) SetSLAReminderLevel(ctx context.Context, projectName string, changeNum int, reviewer string, requestedAt time.Time, level int) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO sla_reminders (project_name, change_num, reviewer, requested_at, level) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (project_name, change_num, reviewer) DO UPDATE SET
+			requested_at = EXCLUDED.requested_at,
+			level = EXCLUDED.level
+	`), projectName, changeNum, reviewer, requestedAt.UTC(), level)
+	return err
+}
+
+// DeleteSLAReminders removes all records of stalled-review reminders about the given change.
+func (ud *PersistentDB) DeleteSLAReminders(ctx context.Context, projectName string, changeNum int) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		DELETE FROM sla_reminders WHERE project_name = ? AND change_num = ?
+	`), projectName, changeNum)
+	return err
+}
+
+// HistoryEvent is a record of a Gerrit event, kept for computing review statistics.
+type HistoryEvent struct {
+	EventType   string
+	ProjectName string
+	ChangeNum   int
+	// Owner is the Gerrit username of the change owner.
+	Owner string
+	// Actor is the Gerrit username of the user who caused the event, or, for reviewer-added
+	// events, the user who was added.
+	Actor       string
+	PatchSetNum int
+	// Approved indicates a comment-added event which carried an approving Code-Review vote.
+	Approved  bool
+	EventTime time.Time
+}
+
+// RecordHistoryEvent stores a record of a Gerrit event.
+func (ud *PersistentDB) RecordHistoryEvent(ctx context.Context, ev HistoryEvent) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO event_history (event_type, project_name, change_num, owner, actor, patchset_num, approved, event_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`), ev.EventType, ev.ProjectName, ev.ChangeNum, ev.Owner, ev.Actor, ev.PatchSetNum, ev.Approved, ev.EventTime.UTC())
+	return err
+}
+
+// GetEventHistory returns the full recorded history, ordered by time, of every change which
+// had any event at or after since and before until.
+func (ud *PersistentDB) GetEventHistory(ctx context.Context, since, until time.Time) (history []HistoryEvent, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, ud.db.Rebind(`
+		SELECT h.event_type, h.project_name, h.change_num, h.owner, h.actor, h.patchset_num, h.approved, h.event_time
+		FROM event_history h
+		WHERE EXISTS (
+			SELECT 1 FROM event_history r
+			WHERE r.project_name = h.project_name AND r.change_num = h.change_num
+				AND r.event_time >= ? AND r.event_time < ?
+		)
+		ORDER BY h.event_time
+	`), since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var ev HistoryEvent
+		if err := rows.Scan(&ev.EventType, &ev.ProjectName, &ev.ChangeNum, &ev.Owner, &ev.Actor, &ev.PatchSetNum, &ev.Approved, &ev.EventTime); err != nil {
+			return nil, err
+		}
+		history = append(history, ev)
+	}
+	return history, nil
+}
+
+// DryRunMessage is a record of a message or reaction which was not sent because the team
+// was in dry-run mode.
+type DryRunMessage struct {
+	ID string `json:"id"`
+	// Kind is the chat system call which was intercepted, such as "notification" or
+	// "channel-report".
+	Kind string `json:"kind"`
+	// Target is the chat ID of the user or channel the message was meant for, or a
+	// description of the message to which a reaction was meant to be added.
+	Target    string    `json:"target"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecordDryRunMessage stores a record of a message which was not sent.
+func (ud *PersistentDB) RecordDryRunMessage(ctx context.Context, msg DryRunMessage) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO dry_run_messages (id, kind, target, message, created_at) VALUES (?, ?, ?, ?, ?)
+	`), msg.ID, msg.Kind, msg.Target, msg.Message, msg.CreatedAt.UTC())
+	return err
+}
+
+// GetDryRunMessages returns up to limit of the most recently recorded dry-run messages,
+// newest first.
+func (ud *PersistentDB) GetDryRunMessages(ctx context.Context, limit int) (msgs []DryRunMessage, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	rows, err := ud.db.DB.QueryContext(ctx, ud.db.Rebind(`
+		SELECT id, kind, target, message, created_at FROM dry_run_messages
+		ORDER BY created_at DESC, id
+		LIMIT ?
+	`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, rows.Err(), rows.Close()) }()
+
+	for rows.Next() {
+		var msg DryRunMessage
+		if err := rows.Scan(&msg.ID, &msg.Kind, &msg.Target, &msg.Message, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// HealthState is the team's health as seen by every instance sharing the persistent DB.
+type HealthState struct {
+	// LastEventReceived is when the most recent Gerrit event arrived, or the zero time if
+	// none has.
+	LastEventReceived time.Time
+	// GerritFailures is the number of Gerrit API calls which have failed since the failure
+	// count was last reset.
+	GerritFailures int
+	// LastGerritError is the error from the most recent failed Gerrit API call.
+	LastGerritError string
+	// QuietAlerted and GerritAlerted record whether admins have been alerted that Gerrit
+	// has gone quiet or that its API calls are failing, respectively.
+	QuietAlerted  bool
+	GerritAlerted bool
+}
+
+// GetHealthState returns the team's current HealthState.
+func (ud *PersistentDB) GetHealthState(ctx context.Context) (state HealthState, err error) {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	var lastEventReceived sql.NullTime
+	var quietAlerted, gerritAlerted int
+	err = ud.db.DB.QueryRowContext(ctx, `
+		SELECT last_event_received, gerrit_failures, last_gerrit_error, quiet_alerted, gerrit_alerted FROM health_state WHERE id = 1
+	`).Scan(&lastEventReceived, &state.GerritFailures, &state.LastGerritError, &quietAlerted, &gerritAlerted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return HealthState{}, nil
+	}
+	if lastEventReceived.Valid {
+		state.LastEventReceived = lastEventReceived.Time
+	}
+	state.QuietAlerted, state.GerritAlerted = quietAlerted != 0, gerritAlerted != 0
+	return state, err
+}
+
+// NoteHealthEventReceived records that a Gerrit event arrived at the given time, unless a
+// later one has already been recorded.
+func (ud *PersistentDB) NoteHealthEventReceived(ctx context.Context, t time.Time) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO health_state (id, last_event_received) VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET last_event_received = EXCLUDED.last_event_received
+		WHERE health_state.last_event_received IS NULL OR health_state.last_event_received < EXCLUDED.last_event_received
+	`), t.UTC())
+	return err
+}
+
+// NoteGerritFailure adds one to the count of failed Gerrit API calls, and records the error.
+func (ud *PersistentDB) NoteGerritFailure(ctx context.Context, errMsg string) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO health_state (id, gerrit_failures, last_gerrit_error) VALUES (1, 1, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			gerrit_failures = health_state.gerrit_failures + 1,
+			last_gerrit_error = EXCLUDED.last_gerrit_error
+	`), errMsg)
+	return err
+}
+
+// ResetGerritFailures sets the count of failed Gerrit API calls back to zero, after a call
+// has succeeded.
+func (ud *PersistentDB) ResetGerritFailures(ctx context.Context) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	_, err := ud.db.DB.ExecContext(ctx, `
+		UPDATE health_state SET gerrit_failures = 0 WHERE id = 1 AND gerrit_failures > 0
+	`)
+	return err
+}
+
+// SetHealthAlerts records whether admins have been alerted about Gerrit going quiet and
+// about Gerrit API calls failing.
+func (ud *PersistentDB) SetHealthAlerts(ctx context.Context, quietAlerted, gerritAlerted bool) error {
+	ud.dbLock.Lock()
+	defer ud.dbLock.Unlock()
+
+	toInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	_, err := ud.db.DB.ExecContext(ctx, ud.db.Rebind(`
+		INSERT INTO health_state (id, quiet_alerted, gerrit_alerted) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			quiet_alerted = EXCLUDED.quiet_alerted,
+			gerrit_alerted = EXCLUDED.gerrit_alerted
+	`), toInt(quietAlerted), toInt(gerritAlerted))
+	return err
+}
+
+// Prune removes all records of old patchset announcements, inline comments, Gerrit events,
+// and dry-run messages, so the db does not grow indefinitely.
 func (ud *PersistentDB) Prune(ctx context.Context, now time.Time) error {
-	deleteInlineCommentsBefore := now.Add(-2 * *inlineCommentMaxAge)
+	deleteInlineCommentsBefore := now.Add(-2 * inlineCommentMaxAge.Get())
 	_, err := ud.db.Delete_InlineComment_By_UpdatedAt_Less(ctx, dbx.InlineComment_UpdatedAt(deleteInlineCommentsBefore))
 	if err != nil {
 		return err
 	}
 	deletePatchsetAnnouncementsBefore := now.AddDate(0, 0, -*buildLifetimeDays)
 	_, err = ud.db.Delete_PatchsetAnnouncement_By_Ts_Less(ctx, dbx.PatchsetAnnouncement_Ts(deletePatchsetAnnouncementsBefore))
+	if err != nil {
+		return err
+	}
+	deleteEventHistoryBefore := now.AddDate(0, 0, -*eventHistoryDays)
+	_, err = ud.db.DB.ExecContext(ctx, ud.db.Rebind(`DELETE FROM event_history WHERE event_time < ?`), deleteEventHistoryBefore.UTC())
+	if err != nil {
+		return err
+	}
+	deleteDryRunMessagesBefore := now.AddDate(0, 0, -*dryRunDays)
+	_, err = ud.db.DB.ExecContext(ctx, ud.db.Rebind(`DELETE FROM dry_run_messages WHERE created_at < ?`), deleteDryRunMessagesBefore.UTC())
 	return err
 }
 
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
@@ -12,7 +13,7 @@ import (
 
 func doPersistentDBTest(t *testing.T, f func(ctx context.Context, d *PersistentDB)) {
 	dbFile := path.Join(t.TempDir(), "persistent.db")
-	db, err := NewPersistentDB(zaptest.NewLogger(t), "sqlite:"+dbFile)
+	db, err := NewPersistentDB(zaptest.NewLogger(t), "sqlite:"+dbFile, newTestSealer(t))
 	require.NoError(t, err)
 	require.NotNil(t, db)
 	defer func() { require.NoError(t, db.Close()) }()
@@ -20,6 +21,14 @@ func doPersistentDBTest(t *testing.T, f func(ctx context.Context, d *PersistentD
 	f(context.Background(), db)
 }
 
+// newTestSealer returns a Sealer with a fixed key, so that every PersistentDB in a test can
+// open what the others seal.
+func newTestSealer(t *testing.T) *Sealer {
+	sealer, err := NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	return sealer
+}
+
 func TestPersistentDBBasics(t *testing.T) {
 	const gerritUsername = "noodle"
 	const chatID = "U1E9A928BCD"
@@ -44,3 +53,274 @@ func TestPersistentDBBasics(t *testing.T) {
 		require.Equal(t, chatID, got)
 	})
 }
+
+func TestPersistentDBUserPrefs(t *testing.T) {
+	const chatID = "U1E9A928BCD"
+
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		// unset prefs give the default value
+		got, err := db.GetUserPref(ctx, chatID, "notify.comments", "true")
+		require.NoError(t, err)
+		require.Equal(t, "true", got)
+		require.True(t, db.JustGetUserPrefBool(ctx, chatID, "notify.comments", true))
+
+		// set and overwrite
+		require.NoError(t, db.SetUserPref(ctx, chatID, "notify.comments", "false"))
+		require.False(t, db.JustGetUserPrefBool(ctx, chatID, "notify.comments", true))
+		require.NoError(t, db.SetUserPref(ctx, chatID, "personal-report-hour", "14"))
+		require.NoError(t, db.SetUserPref(ctx, chatID, "personal-report-hour", "15"))
+		require.Equal(t, 15, db.JustGetUserPrefInt(ctx, chatID, "personal-report-hour", 11))
+
+		// prefs are per-user
+		require.Equal(t, 11, db.JustGetUserPrefInt(ctx, "someone-else", "personal-report-hour", 11))
+
+		all, err := db.GetAllUserPrefs(ctx, chatID)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"notify.comments": "false", "personal-report-hour": "15"}, all)
+
+		// deleting restores the default
+		require.NoError(t, db.DeleteUserPref(ctx, chatID, "notify.comments"))
+		require.True(t, db.JustGetUserPrefBool(ctx, chatID, "notify.comments", true))
+	})
+}
+
+func TestPersistentDBNotifyRoutes(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		routes, err := db.GetAllNotifyRoutes(ctx)
+		require.NoError(t, err)
+		require.Empty(t, routes)
+
+		route := NotifyRoute{Name: "storj", Project: "storj/*", Channels: []string{"C1", "C2"}}
+		require.NoError(t, db.SetNotifyRoute(ctx, route))
+		require.NoError(t, db.SetNotifyRoute(ctx, NotifyRoute{Name: "a-merges", EventType: "change-merged", Channels: []string{"C3"}}))
+
+		// setting an existing name replaces the rule
+		route.Branch = "main"
+		require.NoError(t, db.SetNotifyRoute(ctx, route))
+
+		routes, err = db.GetAllNotifyRoutes(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []NotifyRoute{
+			{Name: "a-merges", EventType: "change-merged", Channels: []string{"C3"}},
+			route,
+		}, routes)
+
+		require.NoError(t, db.DeleteNotifyRoute(ctx, "a-merges"))
+		require.Equal(t, sql.ErrNoRows, db.DeleteNotifyRoute(ctx, "a-merges"))
+		routes, err = db.GetAllNotifyRoutes(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []NotifyRoute{route}, routes)
+	})
+}
+
+func TestPersistentDBLinking(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		now := time.Now()
+		require.NoError(t, db.SetPendingLink(ctx, "U1", "noodle", "abc123", now.Add(time.Hour)))
+
+		// wrong user, wrong code, or expired code are all rejected
+		_, err := db.ConsumePendingLink(ctx, "U2", "abc123", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		_, err = db.ConsumePendingLink(ctx, "U1", "abc124", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		_, err = db.ConsumePendingLink(ctx, "U1", "abc123", now.Add(2*time.Hour), 3)
+		require.Equal(t, sql.ErrNoRows, err)
+
+		// a new request replaces the old one
+		require.NoError(t, db.SetPendingLink(ctx, "U1", "noodle", "def456", now.Add(time.Hour)))
+		_, err = db.ConsumePendingLink(ctx, "U1", "abc123", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		gerritUsername, err := db.ConsumePendingLink(ctx, "U1", "def456", now, 3)
+		require.NoError(t, err)
+		require.Equal(t, "noodle", gerritUsername)
+
+		// codes can only be used once
+		_, err = db.ConsumePendingLink(ctx, "U1", "def456", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+
+		// too many wrong codes discard the pending link, and a new request resets the count
+		require.NoError(t, db.SetPendingLink(ctx, "U1", "noodle", "ghi789", now.Add(time.Hour)))
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi780", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi781", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		require.NoError(t, db.SetPendingLink(ctx, "U1", "noodle", "ghi789", now.Add(time.Hour)))
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi782", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi783", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi784", now, 3)
+		require.ErrorIs(t, err, errLinkAttemptsExhausted)
+		_, err = db.ConsumePendingLink(ctx, "U1", "ghi789", now, 3)
+		require.Equal(t, sql.ErrNoRows, err)
+
+		// disassociating removes the association and its cache entry
+		require.NoError(t, db.AssociateChatIDWithGerritUser(ctx, "noodle", "U1"))
+		usernames, err := db.GetGerritUsernamesForChatID(ctx, "U1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"noodle"}, usernames)
+		require.NoError(t, db.DisassociateGerritUser(ctx, "noodle"))
+		require.Equal(t, sql.ErrNoRows, db.DisassociateGerritUser(ctx, "noodle"))
+		_, err = db.LookupChatIDForGerritUser(ctx, "noodle")
+		require.Equal(t, sql.ErrNoRows, err)
+	})
+}
+
+func TestPersistentDBIdentityCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	dbSource := "sqlite:" + path.Join(t.TempDir(), "persistent.db")
+	db, err := NewPersistentDB(zaptest.NewLogger(t), dbSource, newTestSealer(t))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	// another instance shares the DB, but not the cache
+	other, err := NewPersistentDB(zaptest.NewLogger(t), dbSource, newTestSealer(t))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, other.Close()) }()
+
+	require.NoError(t, other.AssociateChatIDWithGerritUser(ctx, "noodle", "U1"))
+	got, err := db.LookupChatIDForGerritUser(ctx, "noodle")
+	require.NoError(t, err)
+	require.Equal(t, "U1", got)
+
+	// an unlink elsewhere is not seen while the entry is fresh
+	require.NoError(t, other.DisassociateGerritUser(ctx, "noodle"))
+	got, err = db.LookupChatIDForGerritUser(ctx, "noodle")
+	require.NoError(t, err)
+	require.Equal(t, "U1", got)
+
+	// but is once it has expired
+	db.cacheLock.Lock()
+	entry := db.cache["noodle"]
+	entry.expires = time.Now().Add(-time.Second)
+	db.cache["noodle"] = entry
+	db.cacheLock.Unlock()
+	_, err = db.LookupChatIDForGerritUser(ctx, "noodle")
+	require.Equal(t, sql.ErrNoRows, err)
+
+	// and so is a relink elsewhere
+	require.NoError(t, other.AssociateChatIDWithGerritUser(ctx, "noodle", "U2"))
+	got, err = db.LookupChatIDForGerritUser(ctx, "noodle")
+	require.NoError(t, err)
+	require.Equal(t, "U2", got)
+}
+
+func TestPersistentDBSecretConfig(t *testing.T) {
+	ctx := context.Background()
+	dbSource := "sqlite:" + path.Join(t.TempDir(), "persistent.db")
+	db, err := NewPersistentDB(zaptest.NewLogger(t), dbSource, newTestSealer(t))
+	require.NoError(t, err)
+
+	storedValue := func(key string) string {
+		var value string
+		require.NoError(t, db.db.DB.QueryRowContext(ctx, `SELECT config_value FROM team_configs WHERE config_key = ?`, key).Scan(&value))
+		return value
+	}
+
+	// secret items are sealed at rest, and other items are not
+	require.NoError(t, db.SetConfig(ctx, "gerrit-http-password", "hunter2"))
+	require.NoError(t, db.SetConfig(ctx, "gerrit-http-username", "noodle"))
+	require.NotContains(t, storedValue("gerrit-http-password"), "hunter2")
+	require.Equal(t, "noodle", storedValue("gerrit-http-username"))
+	require.Equal(t, "hunter2", db.JustGetConfig(ctx, "gerrit-http-password", ""))
+	items, err := db.GetAllConfigItems(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"gerrit-http-password": "hunter2", "gerrit-http-username": "noodle"}, items)
+
+	// a value stored before sealing was introduced is sealed when the DB is next opened
+	_, err = db.db.DB.ExecContext(ctx, `UPDATE team_configs SET config_value = 'hunter3' WHERE config_key = 'gerrit-http-password'`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	db, err = NewPersistentDB(zaptest.NewLogger(t), dbSource, newTestSealer(t))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NotContains(t, storedValue("gerrit-http-password"), "hunter3")
+	require.Equal(t, "hunter3", db.JustGetConfig(ctx, "gerrit-http-password", ""))
+
+	// a different key can't open it
+	otherSealer, err := NewSealer([]byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	db.sealer = otherSealer
+	_, err = db.GetConfig(ctx, "gerrit-http-password", "")
+	require.Error(t, err)
+}
+
+func TestPersistentDBSLAReminders(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		requestedAt := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+		level, err := db.GetSLAReminderLevel(ctx, "jorts", 1, "noodle", requestedAt)
+		require.NoError(t, err)
+		require.Equal(t, 0, level)
+
+		require.NoError(t, db.SetSLAReminderLevel(ctx, "jorts", 1, "noodle", requestedAt, slaLevelReminded))
+		level, err = db.GetSLAReminderLevel(ctx, "jorts", 1, "noodle", requestedAt)
+		require.NoError(t, err)
+		require.Equal(t, slaLevelReminded, level)
+
+		// a new review request starts over
+		level, err = db.GetSLAReminderLevel(ctx, "jorts", 1, "noodle", requestedAt.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 0, level)
+
+		require.NoError(t, db.DeleteSLAReminders(ctx, "jorts", 1))
+		level, err = db.GetSLAReminderLevel(ctx, "jorts", 1, "noodle", requestedAt)
+		require.NoError(t, err)
+		require.Equal(t, 0, level)
+	})
+}
+
+func TestPersistentDBEventHistory(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		start := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+		for _, ev := range []HistoryEvent{
+			{EventType: "patchset-created", ProjectName: "jorts", ChangeNum: 1, Owner: "noodle", Actor: "noodle", PatchSetNum: 1, EventTime: start},
+			{EventType: "comment-added", ProjectName: "jorts", ChangeNum: 1, Owner: "noodle", Actor: "dolly", PatchSetNum: 1, Approved: true, EventTime: start.Add(48 * time.Hour)},
+			{EventType: "patchset-created", ProjectName: "jorts", ChangeNum: 2, Owner: "dolly", Actor: "dolly", PatchSetNum: 1, EventTime: start.Add(time.Hour)},
+		} {
+			require.NoError(t, db.RecordHistoryEvent(ctx, ev))
+		}
+
+		// all events for change 1 are included, though only one falls within the window
+		history, err := db.GetEventHistory(ctx, start.Add(24*time.Hour), start.Add(72*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+		require.Equal(t, "patchset-created", history[0].EventType)
+		require.True(t, history[0].EventTime.Equal(start))
+		require.Equal(t, "dolly", history[1].Actor)
+		require.True(t, history[1].Approved)
+
+		require.NoError(t, db.Prune(ctx, start.AddDate(0, 0, *eventHistoryDays).Add(2*time.Hour)))
+		history, err = db.GetEventHistory(ctx, start, start.Add(72*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		require.Equal(t, 1, history[0].ChangeNum)
+	})
+}
+
+func TestPersistentDBHealthState(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		state, err := db.GetHealthState(ctx)
+		require.NoError(t, err)
+		require.Equal(t, HealthState{}, state)
+
+		// an event which arrived earlier than the recorded one does not replace it
+		received := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+		require.NoError(t, db.NoteHealthEventReceived(ctx, received))
+		require.NoError(t, db.NoteHealthEventReceived(ctx, received.Add(-time.Minute)))
+		require.NoError(t, db.NoteGerritFailure(ctx, "502 Bad Gateway"))
+		require.NoError(t, db.NoteGerritFailure(ctx, "504 Gateway Timeout"))
+		require.NoError(t, db.SetHealthAlerts(ctx, false, true))
+		state, err = db.GetHealthState(ctx)
+		require.NoError(t, err)
+		require.True(t, state.LastEventReceived.Equal(received))
+		require.Equal(t, 2, state.GerritFailures)
+		require.Equal(t, "504 Gateway Timeout", state.LastGerritError)
+		require.False(t, state.QuietAlerted)
+		require.True(t, state.GerritAlerted)
+
+		require.NoError(t, db.ResetGerritFailures(ctx))
+		state, err = db.GetHealthState(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, state.GerritFailures)
+		require.True(t, state.GerritAlerted)
+	})
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// notificationKind identifies a class of direct message that a user may choose to receive or
+// not receive.
+type notificationKind string
+
+const (
+	notifyNewPatchSet     = notificationKind("new-patchset")
+	notifyTrivialRebase   = notificationKind("trivial-rebase")
+	notifyComments        = notificationKind("comments")
+	notifyInlineReplies   = notificationKind("inline-replies")
+	notifyVotesRemoved    = notificationKind("votes-removed")
+	notifyBuildResults    = notificationKind("build-results")
+	notifyReviewerAdded   = notificationKind("reviewer-added")
+	notifyStatusChanges   = notificationKind("status-changes")
+	notifyReviewReminders = notificationKind("review-reminders")
+)
+
+const (
+	notifyPrefKeyPrefix       = "notify."
+	personalReportPrefKey     = "personal-report"
+	personalReportHourPrefKey = "personal-report-hour"
+	deliveryPrefKey           = "delivery"
+
+	deliveryImmediate = "immediate"
+	deliveryDigest    = "digest"
+)
+
+var userPrefItems = []configItem{
+	{Name: notifyPrefKeyPrefix + string(notifyNewPatchSet), Description: "Tell me when new patchsets are uploaded to changes I own or review", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyTrivialRebase), Description: "Tell me when changes I review are trivially rebased", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyComments), Description: "Tell me about new comments on changes I own or review", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyInlineReplies), Description: "Tell me about replies to inline comment threads I have participated in", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyVotesRemoved), Description: "Tell me when votes are removed from my changes, or my votes are removed", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyBuildResults), Description: "Tell me about build results on my changes", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyReviewerAdded), Description: "Tell me when I am added as a reviewer, or reviewers are added to my changes", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyStatusChanges), Description: "Tell me when changes I own or review are merged, abandoned, restored, or have their topic or WIP state changed", ItemType: ConfigItemBool},
+	{Name: notifyPrefKeyPrefix + string(notifyReviewReminders), Description: "Remind me about review requests I have left waiting too long, and tell me when reviewers leave my changes waiting", ItemType: ConfigItemBool},
+	{Name: personalReportPrefKey, Description: "Send me a daily report of the changes waiting for my review", ItemType: ConfigItemBool},
+	{Name: personalReportHourPrefKey, Description: "Hour (in 24-hour time, in my local timezone) when my daily review report should be sent, between 9 and 16. Defaults to the team setting.", ItemType: ConfigItemInt},
+	{Name: deliveryPrefKey, Description: "How notifications should be delivered to me. With digest delivery, build results, review reminders, and direct @-mentions are still sent immediately.", ItemType: ConfigItemString, Choices: []string{deliveryImmediate, deliveryDigest}},
+	{Name: digestIntervalPrefKey, Description: "How often my digest should be sent, if I use digest delivery", ItemType: ConfigItemString, Choices: []string{digestHourly, digestTwiceDaily}},
+}
+
+func findUserPrefItem(key string) *configItem {
+	for _, prefDef := range userPrefItems {
+		if prefDef.Name == key {
+			return &prefDef
+		}
+	}
+	return nil
+}
+
+// wantsNotification determines whether the given chat user has opted in to (or, more
+// precisely, has not opted out of) the given kind of notification.
+func (a *App) wantsNotification(ctx context.Context, chatID string, kind notificationKind) bool {
+	return a.persistentDB.JustGetUserPrefBool(ctx, chatID, notifyPrefKeyPrefix+string(kind), true)
+}
+
+// userPrefsCommand handles the !prefs chat command, which lets any user inspect and change
+// their own notification preferences.
+func (a *App) userPrefsCommand(ctx context.Context, logger *zap.Logger, userID string, args []string) string {
+	if len(args) == 0 {
+		return a.formatAllUserPrefs(ctx, userID)
+	}
+	key := args[0]
+	prefDef := findUserPrefItem(key)
+	if prefDef == nil {
+		return fmt.Sprintf("%q is not a known preference. Send `!prefs` to see them all.", key)
+	}
+	if len(args) == 1 {
+		value, err := a.persistentDB.GetUserPref(ctx, userID, key, "")
+		if err != nil {
+			logger.Error("failed to look up user pref", zap.String("key", key), zap.Error(err))
+			return fmt.Sprintf("failed to look up preference %q", key)
+		}
+		if value == "" {
+			value = a.defaultUserPref(ctx, key)
+		}
+		return fmt.Sprintf("%q => %q", key, value)
+	}
+	value := strings.Join(args[1:], " ")
+	if value == "default" {
+		if err := a.persistentDB.DeleteUserPref(ctx, userID, key); err != nil {
+			logger.Error("failed to delete user pref", zap.String("key", key), zap.Error(err))
+			return fmt.Sprintf("failed to reset %q", key)
+		}
+		return fmt.Sprintf("Ok, %q reset to default", key)
+	}
+	value, err := validateUserPref(prefDef, value)
+	if err != nil {
+		return fmt.Sprintf("failed to set %q: %v", key, err)
+	}
+	if err := a.persistentDB.SetUserPref(ctx, userID, key, value); err != nil {
+		logger.Error("failed to set user pref", zap.String("key", key), zap.String("value", value), zap.Error(err))
+		return fmt.Sprintf("failed to set %q", key)
+	}
+	logger.Info("user changed preference", zap.String("key", key), zap.String("value", value))
+	return fmt.Sprintf("Ok, %q => %q", key, value)
+}
+
+func validateUserPref(prefDef *configItem, value string) (string, error) {
+	switch prefDef.ItemType {
+	case ConfigItemBool:
+		boolVal, err := parseBoolValue(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(boolVal), nil
+	case ConfigItemInt:
+		numVal, err := strconv.ParseInt(value, 0, 32)
+		if err != nil {
+			return "", fmt.Errorf("%q is an invalid numeric value", value)
+		}
+		// reports are only ever sent during working hours, so a later hour would never be used
+		if prefDef.Name == personalReportHourPrefKey && (numVal < workingDayStartHour || numVal >= workingDayEndHour) {
+			return "", fmt.Errorf("%d is not a working hour (%d-%d)", numVal, workingDayStartHour, workingDayEndHour-1)
+		}
+		return strconv.FormatInt(numVal, 10), nil
+	}
+	if len(prefDef.Choices) > 0 {
+		for _, choice := range prefDef.Choices {
+			if value == choice {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of: %s", value, strings.Join(prefDef.Choices, ", "))
+	}
+	return value, nil
+}
+
+func (a *App) defaultUserPref(ctx context.Context, key string) string {
+	switch key {
+	case personalReportHourPrefKey:
+		return strconv.Itoa(a.persistentDB.JustGetConfigInt(ctx, "personal-report-hour", defaultPersonalReportHour))
+	case deliveryPrefKey:
+		return deliveryImmediate
+	case digestIntervalPrefKey:
+		return digestHourly
+	}
+	return "true"
+}
+
+func (a *App) formatAllUserPrefs(ctx context.Context, userID string) string {
+	prefs, err := a.persistentDB.GetAllUserPrefs(ctx, userID)
+	if err != nil {
+		a.logger.Error("failed to enumerate user prefs", zap.String("chat-id", userID), zap.Error(err))
+	}
+	keys := make([]string, 0, len(userPrefItems))
+	for _, prefDef := range userPrefItems {
+		keys = append(keys, prefDef.Name)
+	}
+	sort.Strings(keys)
+
+	var s bytes.Buffer
+	for _, key := range keys {
+		val, ok := prefs[key]
+		if !ok {
+			val = a.defaultUserPref(ctx, key)
+		}
+		prefDef := findUserPrefItem(key)
+		s.WriteString(fmt.Sprintf("%s = %s (%s)\n", a.fmt.FormatCode(key), a.fmt.FormatCode(val), prefDef.Description))
+	}
+	s.WriteString("Change a preference with `!prefs <name> <value>`, or `!prefs <name> default` to go back to the default.\n")
+	return s.String()
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+// ReplayOptions control how captured Gerrit events are replayed.
+type ReplayOptions struct {
+	// Speed scales the time between events: at 1, they are replayed as far apart as they were
+	// received, and at 10, ten times as fast. At 0, there is no delay between them.
+	Speed float64
+	// DryRun causes the messages sent because of the replayed events to be recorded (see
+	// !dry-run) instead of sent, whether or not the team is in dry-run mode. If DryRunChannel
+	// is not empty, they are sent to that channel instead.
+	DryRun        bool
+	DryRunChannel string
+	// Last, if positive, limits the replay to that many of the most recent events in the
+	// capture.
+	Last int
+}
+
+// ReplayEvents handles the events in a Gerrit event capture (see events.ReadCapture) as
+// though they were being received again, returning the number of events replayed. Without
+// opts.DryRun, replayed events have all the effects of new ones: they are added to the event
+// history, reviewers are auto-assigned, and notifications which users get in digests are
+// queued for the next digest. With it, none of that happens, and all messages, including
+// those which would have gone into digests, are recorded instead of sent.
+func (a *App) ReplayEvents(ctx context.Context, r io.Reader, opts ReplayOptions) (count int, err error) {
+	if opts.DryRun {
+		ctx = withDryRun(ctx, opts.DryRunChannel)
+	}
+
+	var lastReceived time.Time
+	replay := func(captured events.CapturedEvent) error {
+		event, err := captured.Decode()
+		if err != nil {
+			return err
+		}
+		receivedAt := captured.ReceivedAt
+		if receivedAt.IsZero() {
+			receivedAt = event.EventCreatedAt()
+		}
+		if opts.Speed > 0 && !lastReceived.IsZero() && receivedAt.After(lastReceived) {
+			timer := time.NewTimer(time.Duration(float64(receivedAt.Sub(lastReceived)) / opts.Speed))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		lastReceived = receivedAt
+		a.GerritEvent(ctx, event)
+		count++
+		return nil
+	}
+
+	if opts.Last <= 0 {
+		err = events.ReadCapture(r, replay)
+		return count, err
+	}
+	var recent []events.CapturedEvent
+	err = events.ReadCapture(r, func(captured events.CapturedEvent) error {
+		recent = append(recent, captured)
+		if len(recent) > opts.Last {
+			recent = recent[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, captured := range recent {
+		if err := replay(captured); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// SetEventCaptureFile tells the App where the team's incoming Gerrit events are being
+// captured, so that admins can replay them with !replay-events.
+func (a *App) SetEventCaptureFile(fileName string) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	a.eventCaptureFile = fileName
+}
+
+// replayEventsCommand handles the !replay-events admin chat command, which replays the most
+// recent captured Gerrit events for the team in dry-run mode, so that their effects can be
+// examined with !dry-run.
+func (a *App) replayEventsCommand(ctx context.Context, logger *zap.Logger, args []string) string {
+	const usage = "bad !replay-events usage (`!replay-events <count> [<speed>]`)"
+	if len(args) < 1 || len(args) > 2 {
+		return usage
+	}
+	opts := ReplayOptions{DryRun: true}
+	var err error
+	if opts.Last, err = strconv.Atoi(args[0]); err != nil || opts.Last < 1 {
+		return usage
+	}
+	if len(args) == 2 {
+		if opts.Speed, err = strconv.ParseFloat(args[1], 64); err != nil || opts.Speed < 0 {
+			return usage
+		}
+	}
+	opts.DryRunChannel = a.persistentDB.JustGetConfig(ctx, "dry-run-channel", "")
+
+	a.statusLock.Lock()
+	captureFile := a.eventCaptureFile
+	a.statusLock.Unlock()
+	if captureFile == "" {
+		return "Gerrit events are not being captured for this team."
+	}
+	f, err := os.Open(captureFile)
+	if err != nil {
+		logger.Error("failed to open event capture", zap.String("capture-file", captureFile), zap.Error(err))
+		return "failed to open the event capture"
+	}
+	defer func() { _ = f.Close() }()
+
+	logger.Info("admin requested event replay", zap.Int("count", opts.Last), zap.Float64("speed", opts.Speed))
+	count, err := a.ReplayEvents(ctx, f, opts)
+	if err != nil {
+		logger.Error("event replay failed", zap.Int("replayed", count), zap.Error(err))
+		return fmt.Sprintf("Replay failed after %d events: %v", count, err)
+	}
+	return fmt.Sprintf("Replayed %d events in dry-run mode; see `!dry-run` for the results.", count)
+}
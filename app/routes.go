@@ -0,0 +1,249 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+// routeEventTypes lists the event types which can be named in a routing rule. These
+// correspond to the Gerrit stream-events types which result in channel notifications.
+var routeEventTypes = []string{
+	"comment-added",
+	"vote-deleted",
+	"reviewer-added",
+	"patchset-created",
+	"change-abandoned",
+	"change-restored",
+	"change-merged",
+	"topic-changed",
+	"wip-state-changed",
+}
+
+const routesUsage = "usage: `!routes [list]`, `!routes add <name> <#channel>[,<#channel>...] [project=<glob>] [branch=<glob>] [topic=<glob>] [hashtag=<glob>] [event=<type>]`, `!routes remove <name>`, or `!routes test [project=<name>] [branch=<name>] [topic=<name>] [hashtag=<name>] [event=<type>]`"
+
+// matches determines whether the given event on the given change satisfies all of this
+// route's criteria. Criteria are shell-style glob patterns (see filepath.Match), and empty
+// criteria match anything. The hashtag criterion matches if any of the change's hashtags
+// match.
+func (route *NotifyRoute) matches(eventType string, change *events.Change) bool {
+	if !globMatches(route.EventType, eventType) ||
+		!globMatches(route.Project, change.Project) ||
+		!globMatches(route.Branch, change.Branch) ||
+		!globMatches(route.Topic, change.Topic) {
+		return false
+	}
+	if route.Hashtag == "" {
+		return true
+	}
+	for _, hashtag := range change.Hashtags {
+		if globMatches(route.Hashtag, hashtag) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatches(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, value)
+	return ok
+}
+
+// matchingChannels returns the union of the channels named by all routes which match the
+// given event, in the order they are first named.
+func matchingChannels(routes []NotifyRoute, eventType string, change *events.Change) (chanIDs []string) {
+	seen := make(map[string]struct{})
+	for _, route := range routes {
+		if !route.matches(eventType, change) {
+			continue
+		}
+		for _, chanID := range route.Channels {
+			if _, ok := seen[chanID]; ok {
+				continue
+			}
+			seen[chanID] = struct{}{}
+			chanIDs = append(chanIDs, chanID)
+		}
+	}
+	return chanIDs
+}
+
+// routeChannelsFor returns the channels to which a notification about the given event should
+// be sent, according to the configured routing rules. If no rules match, the result is empty.
+func (a *App) routeChannelsFor(ctx context.Context, eventType string, change *events.Change) []string {
+	routes, err := a.persistentDB.GetAllNotifyRoutes(ctx)
+	if err != nil {
+		a.logger.Error("failed to look up notification routes", zap.Error(err))
+		return nil
+	}
+	return matchingChannels(routes, eventType, change)
+}
+
+// routesCommand handles the admin !routes chat command.
+func (a *App) routesCommand(ctx context.Context, logger *zap.Logger, args []string) string {
+	if len(args) == 0 {
+		return a.formatAllRoutes(ctx)
+	}
+	switch args[0] {
+	case "list":
+		return a.formatAllRoutes(ctx)
+	case "add":
+		if len(args) < 3 {
+			return routesUsage
+		}
+		route := NotifyRoute{Name: args[1]}
+		for _, chanLink := range strings.Split(args[2], ",") {
+			chanID := a.fmt.UnwrapChannelLink(chanLink)
+			if chanID == "" {
+				return fmt.Sprintf("%q is not a valid channel reference", chanLink)
+			}
+			route.Channels = append(route.Channels, chanID)
+		}
+		if err := parseRouteCriteria(args[3:], &route); err != nil {
+			return fmt.Sprintf("bad !routes add usage: %v", err)
+		}
+		if err := a.persistentDB.SetNotifyRoute(ctx, route); err != nil {
+			logger.Error("failed to store notify route", zap.String("route-name", route.Name), zap.Error(err))
+			return fmt.Sprintf("failed to store route %q", route.Name)
+		}
+		logger.Info("admin added notify route", zap.String("route-name", route.Name))
+		return fmt.Sprintf("Ok, %s", a.formatRoute(route))
+	case "remove":
+		if len(args) != 2 {
+			return routesUsage
+		}
+		err := a.persistentDB.DeleteNotifyRoute(ctx, args[1])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Sprintf("no route named %q", args[1])
+		}
+		if err != nil {
+			logger.Error("failed to delete notify route", zap.String("route-name", args[1]), zap.Error(err))
+			return fmt.Sprintf("failed to remove route %q", args[1])
+		}
+		logger.Info("admin removed notify route", zap.String("route-name", args[1]))
+		return fmt.Sprintf("Ok, route %q removed", args[1])
+	case "test":
+		var criteria NotifyRoute
+		if err := parseRouteCriteria(args[1:], &criteria); err != nil {
+			return fmt.Sprintf("bad !routes test usage: %v", err)
+		}
+		change := &events.Change{
+			Project: criteria.Project,
+			Branch:  criteria.Branch,
+			Topic:   criteria.Topic,
+		}
+		if criteria.Hashtag != "" {
+			change.Hashtags = []string{criteria.Hashtag}
+		}
+		return a.describeRouting(ctx, criteria.EventType, change)
+	}
+	return routesUsage
+}
+
+// parseRouteCriteria fills in the match fields of route from a list of key=value arguments.
+func parseRouteCriteria(args []string, route *NotifyRoute) error {
+	for _, arg := range args {
+		eq := strings.IndexByte(arg, '=')
+		if eq < 0 {
+			return fmt.Errorf("expected key=value, got %q", arg)
+		}
+		key, value := arg[:eq], arg[eq+1:]
+		if _, err := filepath.Match(value, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %v", value, err)
+		}
+		switch key {
+		case "project":
+			route.Project = value
+		case "branch":
+			route.Branch = value
+		case "topic":
+			route.Topic = value
+		case "hashtag":
+			route.Hashtag = value
+		case "event":
+			if !isRouteEventType(value) {
+				return fmt.Errorf("%q is not one of: %s", value, strings.Join(routeEventTypes, ", "))
+			}
+			route.EventType = value
+		default:
+			return fmt.Errorf("unknown criterion %q", key)
+		}
+	}
+	return nil
+}
+
+func isRouteEventType(eventType string) bool {
+	for _, known := range routeEventTypes {
+		if ok, _ := filepath.Match(eventType, known); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) describeRouting(ctx context.Context, eventType string, change *events.Change) string {
+	chanIDs := a.routeChannelsFor(ctx, eventType, change)
+	if len(chanIDs) == 0 {
+		chanID := a.persistentDB.JustGetConfig(ctx, "global-notify-channel", "")
+		if chanID == "" {
+			return "No routes match, and no global-notify-channel is configured; nothing would be sent."
+		}
+		return fmt.Sprintf("No routes match; would be sent to the global-notify-channel, %s", a.fmt.FormatChannelLink(chanID))
+	}
+	links := make([]string, 0, len(chanIDs))
+	for _, chanID := range chanIDs {
+		links = append(links, a.fmt.FormatChannelLink(chanID))
+	}
+	return fmt.Sprintf("Would be sent to %s", strings.Join(links, ", "))
+}
+
+func (a *App) formatAllRoutes(ctx context.Context) string {
+	routes, err := a.persistentDB.GetAllNotifyRoutes(ctx)
+	if err != nil {
+		a.logger.Error("failed to enumerate notify routes", zap.Error(err))
+		return "failed to look up routes"
+	}
+	if len(routes) == 0 {
+		return "No routes are configured; all channel notifications go to the global-notify-channel.\n" + routesUsage
+	}
+	var s bytes.Buffer
+	for _, route := range routes {
+		s.WriteString(a.formatRoute(route))
+		s.WriteString("\n")
+	}
+	return s.String()
+}
+
+func (a *App) formatRoute(route NotifyRoute) string {
+	var criteria []string
+	for _, c := range []struct{ key, value string }{
+		{"project", route.Project},
+		{"branch", route.Branch},
+		{"topic", route.Topic},
+		{"hashtag", route.Hashtag},
+		{"event", route.EventType},
+	} {
+		if c.value != "" {
+			criteria = append(criteria, a.fmt.FormatCode(c.key+"="+c.value))
+		}
+	}
+	if len(criteria) == 0 {
+		criteria = append(criteria, "everything")
+	}
+	links := make([]string, 0, len(route.Channels))
+	for _, chanID := range route.Channels {
+		links = append(links, a.fmt.FormatChannelLink(chanID))
+	}
+	return fmt.Sprintf("%s: %s => %s", a.fmt.FormatCode(route.Name), strings.Join(criteria, " "), strings.Join(links, ", "))
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+func TestNotifyRouteMatching(t *testing.T) {
+	routes := []NotifyRoute{
+		{Name: "storj", Project: "storj/*", Channels: []string{"C-storj"}},
+		{Name: "releases", Branch: "release-*", Channels: []string{"C-releases", "C-storj"}},
+		{Name: "security", Hashtag: "security", Channels: []string{"C-security"}},
+		{Name: "merges", Project: "storj/uplink", EventType: "change-merged", Channels: []string{"C-merges"}},
+		{Name: "topic", Topic: "metainfo-*", Channels: []string{"C-metainfo"}},
+	}
+
+	for i, test := range []struct {
+		eventType string
+		change    events.Change
+		expected  []string
+	}{
+		{"comment-added", events.Change{Project: "other/thing", Branch: "main"}, nil},
+		{"comment-added", events.Change{Project: "storj/storj", Branch: "main"}, []string{"C-storj"}},
+		{"comment-added", events.Change{Project: "storj/storj", Branch: "release-v1.2"}, []string{"C-storj", "C-releases"}},
+		{"comment-added", events.Change{Project: "other/thing", Branch: "release-v1.2"}, []string{"C-releases", "C-storj"}},
+		{"patchset-created", events.Change{Project: "other/thing", Hashtags: []string{"cleanup", "security"}}, []string{"C-security"}},
+		{"patchset-created", events.Change{Project: "storj/uplink"}, []string{"C-storj"}},
+		{"change-merged", events.Change{Project: "storj/uplink"}, []string{"C-storj", "C-merges"}},
+		{"change-merged", events.Change{Project: "other/thing", Topic: "metainfo-loop"}, []string{"C-metainfo"}},
+	} {
+		got := matchingChannels(routes, test.eventType, &test.change)
+		assert.Equalf(t, test.expected, got, "test case %d", i)
+	}
+}
+
+func TestParseRouteCriteria(t *testing.T) {
+	var route NotifyRoute
+	require.NoError(t, parseRouteCriteria([]string{"project=storj/*", "branch=main", "hashtag=sec*", "event=change-*"}, &route))
+	assert.Equal(t, NotifyRoute{Project: "storj/*", Branch: "main", Hashtag: "sec*", EventType: "change-*"}, route)
+
+	require.Error(t, parseRouteCriteria([]string{"project"}, &route))
+	require.Error(t, parseRouteCriteria([]string{"color=blue"}, &route))
+	require.Error(t, parseRouteCriteria([]string{"event=ref-updated"}, &route))
+	require.Error(t, parseRouteCriteria([]string{"project=[abc"}, &route))
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+// Levels of stalled-review notifications, as recorded in the sla_reminders table.
+const (
+	// slaLevelReminded means the reviewer has been reminded.
+	slaLevelReminded = 1
+	// slaLevelEscalated means the change owner and the SLA channel have been told.
+	slaLevelEscalated = 2
+)
+
+// slaRule is the configuration of a named review SLA (see the sla.* config items).
+type slaRule struct {
+	Name            string
+	Projects        []string
+	ReminderHours   int
+	EscalationHours int
+	Channel         string
+}
+
+// slaRules reads all configured review SLAs, sorted by name.
+func (a *App) slaRules(ctx context.Context) ([]slaRule, error) {
+	items, err := a.persistentDB.GetConfigWildcard(ctx, "sla.%.projects")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]slaRule, 0, len(items))
+	for key, projects := range items {
+		if !strings.HasPrefix(key, "sla.") || !strings.HasSuffix(key, ".projects") {
+			// shouldn't be possible, but..
+			a.logger.Error("invalid SLA config key", zap.String("config-key", key))
+			continue
+		}
+		name := key[len("sla.") : len(key)-len(".projects")]
+		prefix := "sla." + name + "."
+		rules = append(rules, slaRule{
+			Name:            name,
+			Projects:        splitList(projects, ","),
+			ReminderHours:   a.persistentDB.JustGetConfigInt(ctx, prefix+"reminder-hours", 0),
+			EscalationHours: a.persistentDB.JustGetConfigInt(ctx, prefix+"escalation-hours", 0),
+			Channel:         a.persistentDB.JustGetConfig(ctx, prefix+"channel", ""),
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, nil
+}
+
+// matchesProject determines whether the SLA applies to changes in the given project.
+func (rule *slaRule) matchesProject(project string) bool {
+	for _, pattern := range rule.Projects {
+		if globMatches(pattern, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// workingTimeBetween measures how much of the time between start and end falls within
+// working hours (workingDayStartHour to workingDayEndHour on weekdays) in the given
+// timezone.
+func workingTimeBetween(start, end time.Time, tz *time.Location) (total time.Duration) {
+	if !end.After(start) {
+		return 0
+	}
+	start = start.In(tz)
+	end = end.In(tz)
+	year, month, day := start.Date()
+	for midnight := time.Date(year, month, day, 0, 0, 0, 0, tz); midnight.Before(end); midnight = midnight.AddDate(0, 0, 1) {
+		if midnight.Weekday() == time.Saturday || midnight.Weekday() == time.Sunday {
+			continue
+		}
+		dayStart := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), workingDayStartHour, 0, 0, 0, tz)
+		dayEnd := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), workingDayEndHour, 0, 0, 0, tz)
+		if dayStart.Before(start) {
+			dayStart = start
+		}
+		if dayEnd.After(end) {
+			dayEnd = end
+		}
+		if dayEnd.After(dayStart) {
+			total += dayEnd.Sub(dayStart)
+		}
+	}
+	return total
+}
+
+// reviewRequestTime determines when the given user was most recently made a reviewer on the
+// change. If the change's reviewer updates don't say, the change creation time is used.
+func reviewRequestTime(change *gerrit.ChangeInfo, username string) time.Time {
+	var requestedAt time.Time
+	for _, update := range change.ReviewerUpdates {
+		if update.Reviewer == nil || update.Reviewer.Username != username || update.State != "REVIEWER" {
+			continue
+		}
+		if updated := gerrit.ParseTimestamp(update.Updated); updated.After(requestedAt) {
+			requestedAt = updated
+		}
+	}
+	if requestedAt.IsZero() {
+		requestedAt = gerrit.ParseTimestamp(change.Created)
+	}
+	return requestedAt
+}
+
+// hasRespondedSince determines whether the given user has voted or commented on the change at
+// or after time t. Votes are included because Gerrit records each vote as a change message.
+func hasRespondedSince(change *gerrit.ChangeInfo, username string, t time.Time) bool {
+	for _, message := range change.Messages {
+		if message.Author.Username == username && !gerrit.ParseTimestamp(message.Date).Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatUserTimezone looks up the timezone of the given chat user, falling back to UTC.
+func (a *App) chatUserTimezone(ctx context.Context, chatID string) *time.Location {
+	if chatID == "" {
+		return time.UTC
+	}
+	chatInfo, err := a.chat.GetUserInfoByID(ctx, chatID)
+	if err != nil {
+		a.logger.Info("could not look up user timezone; assuming UTC", zap.String("chat-id", chatID), zap.Error(err))
+		return time.UTC
+	}
+	if chatInfo.Timezone() == nil {
+		return time.UTC
+	}
+	return chatInfo.Timezone()
+}
+
+// PeriodicSLAReminders checks for stalled review requests close to the top of every UTC
+// hour, reminding reviewers and escalating according to the configured review SLAs.
+func (a *App) PeriodicSLAReminders(ctx context.Context, getTime func() time.Time) error {
+	now := getTime()
+	timer := time.NewTimer(now.UTC().Truncate(time.Hour).Add(time.Hour).Sub(now))
+
+	for {
+		select {
+		case t := <-timer.C:
+			a.CheckSLAs(detach(ctx), t)
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return ctx.Err()
+		}
+
+		now = getTime()
+		timer.Reset(now.UTC().Truncate(time.Hour).Add(time.Hour).Sub(now))
+	}
+}
+
+// CheckSLAs looks for review requests on open changes which have gone without a vote or
+// comment from the reviewer for longer than the applicable review SLA allows, measured in
+// the reviewer's local working hours. Once the reminder threshold passes, the reviewer is
+// reminded; once the escalation threshold passes, the change owner and the SLA's channel are
+// told. Each happens at most once per review request.
+func (a *App) CheckSLAs(ctx context.Context, now time.Time) {
+	rules, err := a.slaRules(ctx)
+	if err != nil {
+		a.logger.Error("failed to read SLA config", zap.Error(err))
+		return
+	}
+	if len(rules) == 0 || a.getGerritClient() == nil {
+		return
+	}
+	changes, err := a.getAllChangesMatching(ctx, "is:open -is:wip", &gerrit.QueryChangesOpts{
+		Limit:                    gerritQueryPageSize,
+		DescribeDetailedAccounts: true,
+		DescribeDetailedLabels:   true,
+		DescribeReviewerUpdates:  true,
+		DescribeMessages:         true,
+	})
+	if err != nil {
+		a.logger.Error("failed to query open changes for SLA check", zap.Error(err))
+		return
+	}
+
+	robots := a.robotUsernames(ctx)
+	for i := range changes {
+		change := &changes[i]
+		for j := range rules {
+			if rules[j].matchesProject(change.Project) {
+				a.checkChangeSLA(ctx, &rules[j], change, robots, now)
+				break
+			}
+		}
+	}
+}
+
+func (a *App) checkChangeSLA(ctx context.Context, rule *slaRule, changeInfo *gerrit.ChangeInfo, robots map[string]struct{}, now time.Time) {
+	change := &events.Change{
+		Project: changeInfo.Project,
+		Branch:  changeInfo.Branch,
+		Number:  changeInfo.Number,
+		Subject: changeInfo.Subject,
+		URL:     a.getGerritClient().URLForChange(changeInfo),
+		Owner:   *accountFromAccountInfo(&changeInfo.Owner),
+	}
+	for _, reviewerInfo := range changeInfo.Reviewers["REVIEWER"] {
+		if _, ok := robots[reviewerInfo.Username]; ok || reviewerInfo.Username == changeInfo.Owner.Username {
+			continue
+		}
+		requestedAt := reviewRequestTime(changeInfo, reviewerInfo.Username)
+		if hasRespondedSince(changeInfo, reviewerInfo.Username, requestedAt) {
+			continue
+		}
+		logger := a.logger.With(zap.String("sla-name", rule.Name), zap.String("change-id", change.BestID()), zap.String("reviewer", reviewerInfo.Username))
+		level, err := a.persistentDB.GetSLAReminderLevel(ctx, change.Project, change.Number, reviewerInfo.Username, requestedAt)
+		if err != nil {
+			logger.Error("failed to look up SLA reminder state", zap.Error(err))
+			continue
+		}
+		if level >= slaLevelEscalated {
+			continue
+		}
+		reviewer := accountFromAccountInfo(&reviewerInfo)
+		chatID := a.lookupGerritUser(ctx, reviewer)
+		waited := workingTimeBetween(requestedAt, now, a.chatUserTimezone(ctx, chatID))
+		waitedHours := int(waited / time.Hour)
+
+		var newLevel int
+		switch {
+		case rule.EscalationHours > 0 && waited >= time.Duration(rule.EscalationHours)*time.Hour:
+			newLevel = slaLevelEscalated
+			reviewerLink := a.formatUserLink(reviewer, chatID)
+			a.notify(ctx, &change.Owner, change, notifyReviewReminders, fmt.Sprintf(
+				"%s has not responded to the review request on your change %s in %d working hours",
+				reviewerLink, a.formatChangeLink(change), waitedHours))
+			if rule.Channel != "" {
+				if _, err := a.chat.SendChannelNotification(ctx, rule.Channel, fmt.Sprintf(
+					"%s has not responded to the review request on %s in %d working hours (SLA %s)",
+					reviewer.DisplayName(), a.formatChangeLink(change), waitedHours, a.fmt.FormatCode(rule.Name))); err != nil {
+					logger.Error("failed to send SLA escalation to channel", zap.String("channel-id", rule.Channel), zap.Error(err))
+				}
+			}
+		case level < slaLevelReminded && rule.ReminderHours > 0 && waited >= time.Duration(rule.ReminderHours)*time.Hour:
+			newLevel = slaLevelReminded
+			a.notify(ctx, reviewer, change, notifyReviewReminders, fmt.Sprintf(
+				"Reminder: %s has been waiting %d working hours for your review on %s",
+				a.prepareUserLink(ctx, &change.Owner), waitedHours, a.formatChangeLink(change)))
+		default:
+			continue
+		}
+		logger.Info("stalled review request", zap.Int("level", newLevel), zap.Duration("working-time-waited", waited))
+		if err := a.persistentDB.SetSLAReminderLevel(ctx, change.Project, change.Number, reviewerInfo.Username, requestedAt, newLevel); err != nil {
+			logger.Error("failed to record SLA reminder state", zap.Error(err))
+		}
+	}
+}
+
+// forgetSLAReminders discards the record of stalled-review reminders sent about a change
+// which has been closed.
+func (a *App) forgetSLAReminders(ctx context.Context, change *events.Change) {
+	if err := a.persistentDB.DeleteSLAReminders(ctx, change.Project, change.Number); err != nil {
+		a.logger.Error("failed to delete SLA reminder state", zap.String("change-id", change.BestID()), zap.Error(err))
+	}
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+)
+
+func TestWorkingTimeBetween(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+	// 2026-10-16 is a Friday
+	friday := func(hour, min int, tz *time.Location) time.Time {
+		return time.Date(2026, 10, 16, hour, min, 0, 0, tz)
+	}
+
+	for i, test := range []struct {
+		start, end time.Time
+		tz         *time.Location
+		expected   time.Duration
+	}{
+		{friday(10, 0, time.UTC), friday(12, 30, time.UTC), time.UTC, 150 * time.Minute},
+		{friday(7, 0, time.UTC), friday(20, 0, time.UTC), time.UTC, 8 * time.Hour},
+		{friday(12, 0, time.UTC), friday(11, 0, time.UTC), time.UTC, 0},
+		// over the weekend, into Monday
+		{friday(16, 0, time.UTC), friday(16, 0, time.UTC).AddDate(0, 0, 3).Add(-5 * time.Hour), time.UTC, 3 * time.Hour},
+		// a full week
+		{friday(9, 0, time.UTC), friday(9, 0, time.UTC).AddDate(0, 0, 7), time.UTC, 40 * time.Hour},
+		// 14:00 UTC is 10:00 in New York, and 22:00 UTC is 18:00
+		{friday(14, 0, time.UTC), friday(22, 0, time.UTC), newYork, 7 * time.Hour},
+		{friday(9, 0, newYork), friday(17, 0, newYork), newYork, 8 * time.Hour},
+	} {
+		assert.Equalf(t, test.expected, workingTimeBetween(test.start, test.end, test.tz), "test case %d", i)
+	}
+}
+
+func TestReviewRequestResponses(t *testing.T) {
+	alice := &gerrit.AccountInfo{Username: "alice"}
+	change := &gerrit.ChangeInfo{
+		Created: "2026-10-12 09:00:00.000000000",
+		ReviewerUpdates: []gerrit.ReviewerUpdateInfo{
+			{Updated: "2026-10-12 10:00:00.000000000", Reviewer: alice, State: "REVIEWER"},
+			{Updated: "2026-10-13 10:00:00.000000000", Reviewer: alice, State: "REMOVED"},
+			{Updated: "2026-10-14 10:00:00.000000000", Reviewer: alice, State: "REVIEWER"},
+		},
+		Messages: []gerrit.ChangeMessageInfo{
+			{Author: *alice, Date: "2026-10-12 11:00:00.000000000", Message: "Patch Set 1: Code-Review-1"},
+			{Author: gerrit.AccountInfo{Username: "bob"}, Date: "2026-10-15 11:00:00.000000000", Message: "Patch Set 2: Code-Review+1"},
+		},
+	}
+
+	requestedAt := reviewRequestTime(change, "alice")
+	assert.Equal(t, time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC), requestedAt)
+	assert.False(t, hasRespondedSince(change, "alice", requestedAt))
+	assert.True(t, hasRespondedSince(change, "alice", time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)))
+
+	// with no reviewer updates, the change creation time is used
+	assert.Equal(t, time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC), reviewRequestTime(change, "bob"))
+	assert.True(t, hasRespondedSince(change, "bob", reviewRequestTime(change, "bob")))
+}
@@ -0,0 +1,436 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+	"github.com/storj/changesetchihuahua/metrics"
+)
+
+const (
+	// defaultStatsPeriod is the period covered by !stats when none is given.
+	defaultStatsPeriod = 7 * 24 * time.Hour
+	// weeklyStatsWeekday is the day on which the weekly analytics report is sent, at
+	// workingDayStartHour UTC.
+	weeklyStatsWeekday = time.Monday
+	// weeklyStatsTopReviewers is how many reviewers are listed by load in the weekly report.
+	weeklyStatsTopReviewers = 5
+)
+
+// recordEventHistory stores the parts of a Gerrit event which are needed for review
+// statistics. Events which don't bear on review turnaround are ignored, and so are events
+// replayed in dry-run mode, which were already recorded when they first arrived.
+func (a *App) recordEventHistory(ctx context.Context, event events.GerritEvent) {
+	if isForcedDryRun(ctx) {
+		return
+	}
+	var ev HistoryEvent
+	var change *events.Change
+	switch e := event.(type) {
+	case *events.PatchSetCreatedEvent:
+		change, ev.Actor, ev.PatchSetNum = &e.Change, e.Uploader.Username, e.PatchSet.Number
+	case *events.ReviewerAddedEvent:
+		change, ev.Actor, ev.PatchSetNum = &e.Change, e.Reviewer.Username, e.PatchSet.Number
+	case *events.CommentAddedEvent:
+		change, ev.Actor, ev.PatchSetNum = &e.Change, e.Author.Username, e.PatchSet.Number
+		for _, approval := range e.Approvals {
+			if value, err := strconv.Atoi(approval.Value); err == nil && approval.Type == "Code-Review" && value >= 2 {
+				ev.Approved = true
+			}
+		}
+	case *events.ChangeMergedEvent:
+		change, ev.Actor, ev.PatchSetNum = &e.Change, e.Submitter.Username, e.PatchSet.Number
+	case *events.ChangeAbandonedEvent:
+		change, ev.Actor, ev.PatchSetNum = &e.Change, e.Abandoner.Username, e.PatchSet.Number
+	default:
+		return
+	}
+	ev.EventType = event.GetType()
+	ev.ProjectName = change.Project
+	ev.ChangeNum = change.Number
+	ev.Owner = change.Owner.Username
+	ev.EventTime = event.EventCreatedAt()
+	if ev.EventTime.Unix() <= 0 {
+		ev.EventTime = time.Now()
+	}
+	if err := a.persistentDB.RecordHistoryEvent(ctx, ev); err != nil {
+		a.logger.Error("failed to record event history", zap.String("event-type", ev.EventType), zap.Error(err))
+	}
+}
+
+// changeHistory is the review timeline of a single change, reconstructed from event history.
+type changeHistory struct {
+	Project     string
+	Number      int
+	Owner       string
+	Created     time.Time
+	FirstReview time.Time
+	Approved    time.Time
+	Merged      time.Time
+	Iterations  int
+	// Requested maps reviewers to when they were first asked to review.
+	Requested map[string]time.Time
+	// Responded maps reviewers to when they first voted or commented.
+	Responded map[string]time.Time
+}
+
+// buildChangeHistories reconstructs change timelines from event history, which must be
+// ordered by time. Comments by robots and by change owners do not count as reviews.
+func buildChangeHistories(history []HistoryEvent, robots map[string]struct{}) []*changeHistory {
+	byChange := make(map[string]*changeHistory)
+	var changes []*changeHistory
+	for _, ev := range history {
+		key := ev.ProjectName + "~" + strconv.Itoa(ev.ChangeNum)
+		ch, ok := byChange[key]
+		if !ok {
+			ch = &changeHistory{
+				Project:   ev.ProjectName,
+				Number:    ev.ChangeNum,
+				Owner:     ev.Owner,
+				Requested: make(map[string]time.Time),
+				Responded: make(map[string]time.Time),
+			}
+			byChange[key] = ch
+			changes = append(changes, ch)
+		}
+		if ev.PatchSetNum > ch.Iterations {
+			ch.Iterations = ev.PatchSetNum
+		}
+		_, isRobot := robots[ev.Actor]
+		switch ev.EventType {
+		case "patchset-created":
+			if ev.PatchSetNum == 1 && ch.Created.IsZero() {
+				ch.Created = ev.EventTime
+			}
+		case "reviewer-added":
+			if _, ok := ch.Requested[ev.Actor]; !ok && ev.Actor != ch.Owner && !isRobot {
+				ch.Requested[ev.Actor] = ev.EventTime
+			}
+		case "comment-added":
+			if ev.Actor == ch.Owner || isRobot {
+				continue
+			}
+			if ch.FirstReview.IsZero() {
+				ch.FirstReview = ev.EventTime
+			}
+			if _, ok := ch.Responded[ev.Actor]; !ok {
+				ch.Responded[ev.Actor] = ev.EventTime
+			}
+			if ev.Approved && ch.Approved.IsZero() {
+				ch.Approved = ev.EventTime
+			}
+		case "change-merged":
+			ch.Merged = ev.EventTime
+		}
+	}
+	for _, ch := range changes {
+		if ch.Created.IsZero() {
+			// created before our history begins; the earliest event we know of is the
+			// best approximation available
+			for _, t := range []time.Time{ch.FirstReview, ch.Approved, ch.Merged} {
+				if !t.IsZero() && (ch.Created.IsZero() || t.Before(ch.Created)) {
+					ch.Created = t
+				}
+			}
+			for _, t := range ch.Requested {
+				if ch.Created.IsZero() || t.Before(ch.Created) {
+					ch.Created = t
+				}
+			}
+		}
+	}
+	return changes
+}
+
+// reviewStats holds review turnaround statistics over some period.
+type reviewStats struct {
+	Opened            int
+	Merged            int
+	TimeToFirstReview []time.Duration
+	TimeToApproval    []time.Duration
+	TimeToMerge       []time.Duration
+	// Iterations holds the number of patchsets of each change merged in the period.
+	Iterations []int
+	// ReviewRequests counts the review requests each reviewer received in the period.
+	ReviewRequests map[string]int
+	// ReviewsGiven counts the changes each reviewer first responded to in the period.
+	ReviewsGiven map[string]int
+	// ResponseTimes holds, for each reviewer, how long they took to respond to the review
+	// requests they responded to in the period.
+	ResponseTimes map[string][]time.Duration
+}
+
+// computeReviewStats computes statistics over the period [start, end) for the changes for
+// which include returns true.
+func computeReviewStats(changes []*changeHistory, start, end time.Time, include func(*changeHistory) bool) *reviewStats {
+	stats := &reviewStats{
+		ReviewRequests: make(map[string]int),
+		ReviewsGiven:   make(map[string]int),
+		ResponseTimes:  make(map[string][]time.Duration),
+	}
+	inPeriod := func(t time.Time) bool {
+		return !t.IsZero() && !t.Before(start) && t.Before(end)
+	}
+	for _, ch := range changes {
+		if !include(ch) {
+			continue
+		}
+		if inPeriod(ch.Created) {
+			stats.Opened++
+		}
+		if inPeriod(ch.FirstReview) {
+			stats.TimeToFirstReview = append(stats.TimeToFirstReview, ch.FirstReview.Sub(ch.Created))
+		}
+		if inPeriod(ch.Approved) {
+			stats.TimeToApproval = append(stats.TimeToApproval, ch.Approved.Sub(ch.Created))
+		}
+		if inPeriod(ch.Merged) {
+			stats.Merged++
+			stats.TimeToMerge = append(stats.TimeToMerge, ch.Merged.Sub(ch.Created))
+			stats.Iterations = append(stats.Iterations, ch.Iterations)
+		}
+		for reviewer, requested := range ch.Requested {
+			if inPeriod(requested) {
+				stats.ReviewRequests[reviewer]++
+			}
+		}
+		for reviewer, responded := range ch.Responded {
+			if !inPeriod(responded) {
+				continue
+			}
+			stats.ReviewsGiven[reviewer]++
+			if requested, ok := ch.Requested[reviewer]; ok && !responded.Before(requested) {
+				stats.ResponseTimes[reviewer] = append(stats.ResponseTimes[reviewer], responded.Sub(requested))
+			}
+		}
+	}
+	return stats
+}
+
+// medianDuration returns the median of the given durations, which need not be sorted.
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func formatDurationStat(durations []time.Duration, what string) string {
+	if len(durations) == 0 {
+		return "n/a"
+	}
+	plural := "s"
+	if len(durations) == 1 {
+		plural = ""
+	}
+	return fmt.Sprintf("median %s (%d %s%s)", prettyTimeDelta(medianDuration(durations)), len(durations), what, plural)
+}
+
+// formatReviewLoad lists reviewers by the number of review requests they received, busiest
+// first, up to limit reviewers (or all of them, if limit is 0).
+func formatReviewLoad(load map[string]int, limit int) string {
+	reviewers := make([]string, 0, len(load))
+	for reviewer := range load {
+		reviewers = append(reviewers, reviewer)
+	}
+	sort.Slice(reviewers, func(i, j int) bool {
+		if load[reviewers[i]] != load[reviewers[j]] {
+			return load[reviewers[i]] > load[reviewers[j]]
+		}
+		return reviewers[i] < reviewers[j]
+	})
+	if limit > 0 && len(reviewers) > limit {
+		reviewers = reviewers[:limit]
+	}
+	parts := make([]string, 0, len(reviewers))
+	for _, reviewer := range reviewers {
+		parts = append(parts, fmt.Sprintf("%s %d", reviewer, load[reviewer]))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (a *App) formatReviewStats(stats *reviewStats, topReviewers int) string {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "Changes opened: %d, merged: %d\n", stats.Opened, stats.Merged)
+	fmt.Fprintf(&s, "Time to first review: %s\n", formatDurationStat(stats.TimeToFirstReview, "change"))
+	fmt.Fprintf(&s, "Time to approval: %s\n", formatDurationStat(stats.TimeToApproval, "change"))
+	fmt.Fprintf(&s, "Time to merge: %s\n", formatDurationStat(stats.TimeToMerge, "change"))
+	if len(stats.Iterations) > 0 {
+		total := 0
+		for _, n := range stats.Iterations {
+			total += n
+		}
+		fmt.Fprintf(&s, "Patchsets per merged change: %.1f on average\n", float64(total)/float64(len(stats.Iterations)))
+	}
+	fmt.Fprintf(&s, "Review load (requests received): %s\n", formatReviewLoad(stats.ReviewRequests, topReviewers))
+	return s.String()
+}
+
+func (a *App) formatUserStats(username string, stats, authored *reviewStats) string {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "Review requests received: %d\n", stats.ReviewRequests[username])
+	fmt.Fprintf(&s, "Changes reviewed: %d\n", stats.ReviewsGiven[username])
+	fmt.Fprintf(&s, "Time to respond to review requests: %s\n", formatDurationStat(stats.ResponseTimes[username], "request"))
+	fmt.Fprintf(&s, "Own changes opened: %d, merged: %d\n", authored.Opened, authored.Merged)
+	fmt.Fprintf(&s, "Time to first review on own changes: %s\n", formatDurationStat(authored.TimeToFirstReview, "change"))
+	fmt.Fprintf(&s, "Time to merge own changes: %s\n", formatDurationStat(authored.TimeToMerge, "change"))
+	return s.String()
+}
+
+// parseStatsPeriod parses a period like "12h", "7d" or "4w".
+func parseStatsPeriod(period string) (time.Duration, error) {
+	if len(period) < 2 {
+		return 0, fmt.Errorf("bad period %q", period)
+	}
+	n, err := strconv.Atoi(period[:len(period)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad period %q", period)
+	}
+	switch period[len(period)-1] {
+	case 'h':
+		return time.Duration(n) * time.Hour, nil
+	case 'd':
+		return time.Duration(n) * 24 * time.Hour, nil
+	case 'w':
+		return time.Duration(n) * 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("bad period %q (use a number followed by h, d, or w)", period)
+}
+
+// statsCommand handles the !stats chat command, which shows review statistics for a project
+// or a user over a recent period.
+func (a *App) statsCommand(ctx context.Context, logger *zap.Logger, args []string, now time.Time) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "bad !stats usage (`!stats <project>|<gerrit-username>|<@chat-user> [<period>]`, where period is like `7d` or `4w`)"
+	}
+	period := defaultStatsPeriod
+	if len(args) == 2 {
+		var err error
+		period, err = parseStatsPeriod(args[1])
+		if err != nil {
+			return err.Error()
+		}
+	}
+	start := now.Add(-period)
+	history, err := a.persistentDB.GetEventHistory(ctx, start, now)
+	if err != nil {
+		logger.Error("failed to read event history", zap.Error(err))
+		return "failed to read event history"
+	}
+	changes := buildChangeHistories(history, a.robotUsernames(ctx))
+	periodDesc := "the last " + prettyTimeDelta(period)
+
+	subject := args[0]
+	for _, ch := range changes {
+		if ch.Project == subject {
+			stats := computeReviewStats(changes, start, now, func(ch *changeHistory) bool { return ch.Project == subject })
+			return fmt.Sprintf("Review stats for %s over %s:\n%s", a.fmt.FormatCode(subject), periodDesc, a.formatReviewStats(stats, 0))
+		}
+	}
+
+	usernames := []string{subject}
+	if chatID := a.fmt.UnwrapUserLink(subject); chatID != "" {
+		usernames, err = a.persistentDB.GetGerritUsernamesForChatID(ctx, chatID)
+		if err != nil {
+			logger.Error("failed to look up gerrit usernames for chat user", zap.Error(err))
+			return "failed to look up Gerrit account"
+		}
+		if len(usernames) == 0 {
+			return fmt.Sprintf("I don't know the Gerrit account of %s", a.fmt.FormatUserLink(chatID))
+		}
+	}
+	all := computeReviewStats(changes, start, now, func(*changeHistory) bool { return true })
+	var s bytes.Buffer
+	for _, username := range usernames {
+		authored := computeReviewStats(changes, start, now, func(ch *changeHistory) bool { return ch.Owner == username })
+		fmt.Fprintf(&s, "Review stats for %s over %s:\n%s", a.fmt.FormatCode(username), periodDesc, a.formatUserStats(username, all, authored))
+	}
+	return s.String()
+}
+
+// PeriodicWeeklyStats sends the weekly review analytics report to the configured
+// weekly-stats-channel, at the start of each working week.
+func (a *App) PeriodicWeeklyStats(ctx context.Context, getTime func() time.Time) error {
+	timer := time.NewTimer(timeUntilWeeklyStats(getTime()))
+	for {
+		select {
+		case t := <-timer.C:
+			a.SendWeeklyStats(detach(ctx), t)
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return ctx.Err()
+		}
+		timer.Reset(timeUntilWeeklyStats(getTime()))
+	}
+}
+
+func timeUntilWeeklyStats(now time.Time) time.Duration {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), workingDayStartHour, 0, 0, 0, time.UTC)
+	for next.Weekday() != weeklyStatsWeekday || !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// SendWeeklyStats sends a review analytics report covering the week before t to the
+// configured weekly-stats-channel, if any.
+func (a *App) SendWeeklyStats(ctx context.Context, t time.Time) {
+	chanID := a.persistentDB.JustGetConfig(ctx, "weekly-stats-channel", "")
+	if chanID == "" {
+		return
+	}
+	defer metrics.ObserveSince(metrics.ReportDuration.WithLabelValues(a.teamID, "weekly-stats"), time.Now())
+	start := t.Add(-7 * 24 * time.Hour)
+	history, err := a.persistentDB.GetEventHistory(ctx, start, t)
+	if err != nil {
+		a.logger.Error("failed to read event history for weekly stats", zap.Error(err))
+		return
+	}
+	changes := buildChangeHistories(history, a.robotUsernames(ctx))
+
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "Weekly review report for %s to %s\n", start.UTC().Format("Jan 2"), t.UTC().Add(-time.Second).Format("Jan 2"))
+	s.WriteString(a.formatReviewStats(computeReviewStats(changes, start, t, func(*changeHistory) bool { return true }), weeklyStatsTopReviewers))
+
+	var projects []string
+	seen := make(map[string]struct{})
+	for _, ch := range changes {
+		if _, ok := seen[ch.Project]; !ok {
+			seen[ch.Project] = struct{}{}
+			projects = append(projects, ch.Project)
+		}
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		stats := computeReviewStats(changes, start, t, func(ch *changeHistory) bool { return ch.Project == project })
+		if stats.Opened == 0 && stats.Merged == 0 {
+			continue
+		}
+		fmt.Fprintf(&s, "• %s: %d opened, %d merged, time to first review %s, time to merge %s\n",
+			a.fmt.FormatCode(project), stats.Opened, stats.Merged,
+			formatDurationStat(stats.TimeToFirstReview, "change"), formatDurationStat(stats.TimeToMerge, "change"))
+	}
+	if _, err := a.chat.SendChannelNotification(ctx, chanID, strings.TrimSuffix(s.String(), "\n")); err != nil {
+		a.logger.Error("failed to send weekly stats", zap.String("channel-id", chanID), zap.Error(err))
+	}
+}
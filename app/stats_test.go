@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+var statsTestStart = time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+
+func at(hours float64) time.Time {
+	return statsTestStart.Add(time.Duration(hours * float64(time.Hour)))
+}
+
+var statsTestHistory = []HistoryEvent{
+	{EventType: "patchset-created", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "alice", PatchSetNum: 1, EventTime: at(0)},
+	{EventType: "reviewer-added", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "bob", PatchSetNum: 1, EventTime: at(0)},
+	{EventType: "reviewer-added", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "carol", PatchSetNum: 1, EventTime: at(1)},
+	{EventType: "comment-added", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "jenkins", PatchSetNum: 1, EventTime: at(0.5)},
+	{EventType: "comment-added", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "bob", PatchSetNum: 1, EventTime: at(2)},
+	{EventType: "patchset-created", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "alice", PatchSetNum: 2, EventTime: at(3)},
+	{EventType: "comment-added", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "carol", PatchSetNum: 2, Approved: true, EventTime: at(5)},
+	{EventType: "change-merged", ProjectName: "jorts", ChangeNum: 1, Owner: "alice", Actor: "carol", PatchSetNum: 2, EventTime: at(6)},
+
+	{EventType: "patchset-created", ProjectName: "shorts", ChangeNum: 7, Owner: "bob", Actor: "bob", PatchSetNum: 1, EventTime: at(10)},
+	{EventType: "reviewer-added", ProjectName: "shorts", ChangeNum: 7, Owner: "bob", Actor: "carol", PatchSetNum: 1, EventTime: at(10)},
+	{EventType: "comment-added", ProjectName: "shorts", ChangeNum: 7, Owner: "bob", Actor: "bob", PatchSetNum: 1, EventTime: at(11)},
+	{EventType: "comment-added", ProjectName: "shorts", ChangeNum: 7, Owner: "bob", Actor: "carol", PatchSetNum: 1, EventTime: at(34)},
+}
+
+func TestReviewStats(t *testing.T) {
+	changes := buildChangeHistories(statsTestHistory, map[string]struct{}{"jenkins": {}})
+	require.Len(t, changes, 2)
+
+	jorts := changes[0]
+	assert.Equal(t, at(0), jorts.Created)
+	assert.Equal(t, at(2), jorts.FirstReview)
+	assert.Equal(t, at(5), jorts.Approved)
+	assert.Equal(t, at(6), jorts.Merged)
+	assert.Equal(t, 2, jorts.Iterations)
+
+	all := computeReviewStats(changes, at(0), at(48), func(*changeHistory) bool { return true })
+	assert.Equal(t, 2, all.Opened)
+	assert.Equal(t, 1, all.Merged)
+	assert.Equal(t, []time.Duration{2 * time.Hour, 24 * time.Hour}, all.TimeToFirstReview)
+	assert.Equal(t, []time.Duration{5 * time.Hour}, all.TimeToApproval)
+	assert.Equal(t, []time.Duration{6 * time.Hour}, all.TimeToMerge)
+	assert.Equal(t, []int{2}, all.Iterations)
+	assert.Equal(t, map[string]int{"bob": 1, "carol": 2}, all.ReviewRequests)
+	assert.Equal(t, map[string]int{"bob": 1, "carol": 2}, all.ReviewsGiven)
+	assert.ElementsMatch(t, []time.Duration{4 * time.Hour, 24 * time.Hour}, all.ResponseTimes["carol"])
+	assert.Equal(t, 13*time.Hour, medianDuration(all.TimeToFirstReview))
+
+	// only events inside the period count
+	later := computeReviewStats(changes, at(4), at(48), func(ch *changeHistory) bool { return ch.Project == "jorts" })
+	assert.Equal(t, 0, later.Opened)
+	assert.Equal(t, 1, later.Merged)
+	assert.Empty(t, later.TimeToFirstReview)
+	assert.Empty(t, later.ReviewRequests)
+	assert.Equal(t, map[string]int{"carol": 1}, later.ReviewsGiven)
+}
+
+func TestParseStatsPeriod(t *testing.T) {
+	for period, expected := range map[string]time.Duration{
+		"12h": 12 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+	} {
+		got, err := parseStatsPeriod(period)
+		require.NoError(t, err)
+		assert.Equal(t, expected, got, period)
+	}
+	for _, period := range []string{"", "d", "7", "-1d", "3y"} {
+		_, err := parseStatsPeriod(period)
+		assert.Error(t, err, period)
+	}
+}
+
+func TestTimeUntilWeeklyStats(t *testing.T) {
+	// 2026-10-12 is a Monday
+	assert.Equal(t, time.Hour, timeUntilWeeklyStats(time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 7*24*time.Hour, timeUntilWeeklyStats(time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 3*24*time.Hour, timeUntilWeeklyStats(time.Date(2026, 10, 9, 9, 0, 0, 0, time.UTC)))
+}
+
+func TestStatsCommand(t *testing.T) {
+	doPersistentDBTest(t, func(ctx context.Context, db *PersistentDB) {
+		for _, ev := range statsTestHistory {
+			require.NoError(t, db.RecordHistoryEvent(ctx, ev))
+		}
+		require.NoError(t, db.SetConfig(ctx, "jenkins-robot-user", "jenkins"))
+		require.NoError(t, db.AssociateChatIDWithGerritUser(ctx, "carol", "U-CAROL"))
+		a := &App{logger: zaptest.NewLogger(t), fmt: &slack.Formatter{}, persistentDB: db}
+		logger := a.logger
+
+		reply := a.statsCommand(ctx, logger, []string{"jorts", "2d"}, at(48))
+		assert.Equal(t, "Review stats for `jorts` over the last 2 days:\n"+
+			"Changes opened: 1, merged: 1\n"+
+			"Time to first review: median 2 hours (1 change)\n"+
+			"Time to approval: median 5 hours (1 change)\n"+
+			"Time to merge: median 6 hours (1 change)\n"+
+			"Patchsets per merged change: 2.0 on average\n"+
+			"Review load (requests received): bob 1, carol 1\n", reply)
+
+		reply = a.statsCommand(ctx, logger, []string{"<@U-CAROL>", "2d"}, at(48))
+		assert.Equal(t, "Review stats for `carol` over the last 2 days:\n"+
+			"Review requests received: 2\n"+
+			"Changes reviewed: 2\n"+
+			"Time to respond to review requests: median 14 hours (2 requests)\n"+
+			"Own changes opened: 0, merged: 0\n"+
+			"Time to first review on own changes: n/a\n"+
+			"Time to merge own changes: n/a\n", reply)
+
+		assert.Contains(t, a.statsCommand(ctx, logger, []string{"jorts", "forever"}, at(48)), "bad period")
+		assert.Contains(t, a.statsCommand(ctx, logger, nil, at(48)), "usage")
+	})
+}
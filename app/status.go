@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Status describes the condition of a team's App, for operators.
+type Status struct {
+	// GerritConnected indicates whether a Gerrit client is configured and open.
+	GerritConnected bool `json:"gerrit_connected"`
+	// GerritVersion is the version reported by the Gerrit server, if connected.
+	GerritVersion string `json:"gerrit_version,omitempty"`
+	// GerritFailures is the number of consecutive Gerrit API calls which have failed.
+	GerritFailures int `json:"gerrit_consecutive_failures"`
+	// LastEventReceived is when the most recent Gerrit event arrived, if any have.
+	LastEventReceived *time.Time `json:"last_event_received,omitempty"`
+	// LastReportSent is when the most recent team or personal report was sent, if any have been.
+	LastReportSent *time.Time `json:"last_report_sent,omitempty"`
+	// QueuedNotifications is the number of notifications held for delivery in digests.
+	QueuedNotifications int `json:"queued_notifications"`
+	// DryRun indicates whether the team is in dry-run mode.
+	DryRun bool `json:"dry_run"`
+	// DryRunMessages lists the most recent messages recorded instead of sent in dry-run mode.
+	DryRunMessages []DryRunMessage `json:"dry_run_messages,omitempty"`
+}
+
+// statusDryRunMessages is how many recorded dry-run messages are included in a Status.
+const statusDryRunMessages = 20
+
+// noteEventReceived records the arrival of a Gerrit event in the team's HealthState. To save
+// on writes, this is done at most once per healthWriteInterval.
+func (a *App) noteEventReceived(ctx context.Context, t time.Time) {
+	a.statusLock.Lock()
+	if t.Sub(a.lastEventPersisted) < healthWriteInterval {
+		a.statusLock.Unlock()
+		return
+	}
+	a.lastEventPersisted = t
+	a.statusLock.Unlock()
+	if err := a.persistentDB.NoteHealthEventReceived(ctx, t); err != nil {
+		a.logger.Error("failed to record gerrit event arrival", zap.Error(err))
+	}
+}
+
+func (a *App) noteReportSent(t time.Time) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	a.lastReportSent = t
+}
+
+// Status reports the current condition of the App.
+func (a *App) Status(ctx context.Context) (status Status, err error) {
+	if gerritClient := a.getGerritClient(); gerritClient != nil {
+		status.GerritConnected = true
+		status.GerritVersion = gerritClient.ServerVersion()
+	}
+
+	health, err := a.persistentDB.GetHealthState(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.GerritFailures = health.GerritFailures
+	if !health.LastEventReceived.IsZero() {
+		status.LastEventReceived = &health.LastEventReceived
+	}
+
+	a.statusLock.Lock()
+	if !a.lastReportSent.IsZero() {
+		lastReportSent := a.lastReportSent
+		status.LastReportSent = &lastReportSent
+	}
+	a.statusLock.Unlock()
+
+	status.QueuedNotifications, err = a.persistentDB.CountDigestEntries(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.DryRun, _ = dryRunMode(ctx, a.persistentDB)
+	status.DryRunMessages, err = a.persistentDB.GetDryRunMessages(ctx, statusDryRunMessages)
+	return status, err
+}
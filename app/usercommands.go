@@ -0,0 +1,363 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+)
+
+const userCommandsHelp = "`!help` - show this message\n" +
+	"`!prefs [<name> [<value>|default]]` - show or change your notification preferences\n" +
+	"`!mine` - list your open changes and their state\n" +
+	"`!reviews` - send your personal review report now\n" +
+	"`!whois <gerrit-username>|<@chat-user>` - look up who someone is on the other system\n" +
+	"`!link <gerrit-username>` - link your chat account to your Gerrit account\n" +
+	"`!link confirm <code>` - finish linking with the code emailed to your Gerrit account\n" +
+	"`!unlink [<gerrit-username>]` - unlink your chat account from your Gerrit account(s)\n" +
+	"`!status <change-number>|<change-url>` - show the votes, reviewers and build status of a change\n" +
+	"`!stats <project>|<gerrit-username>|<@chat-user> [<period>]` - show review turnaround statistics (period defaults to `7d`)\n"
+
+const adminCommandsHelp = "`!personal-reports` - send personal reports to everyone who is due for one\n" +
+	"`!team-report <reportname>` - send a configured team report now\n" +
+	"`!assoc <gerrit-username> <@chat-user>` - associate a Gerrit user with a chat user\n" +
+	"`!routes ...` - manage channel notification routing rules\n" +
+	"`!identities ...` - import or export Gerrit/chat user associations in bulk\n" +
+	"`!config [<key> [<value>]]` - show or change team configuration\n" +
+	"`!dry-run [<count>]` - show recent messages recorded instead of sent in dry-run mode\n" +
+	"`!replay-events <count> [<speed>]` - replay the most recent captured Gerrit events in dry-run mode\n"
+
+// helpCommand handles the !help chat command. Admin commands are only listed for admins.
+func (a *App) helpCommand(ctx context.Context, userID string) string {
+	if a.isAdminUser(ctx, userID) {
+		return userCommandsHelp + "\nAdmin commands:\n" + adminCommandsHelp
+	}
+	return userCommandsHelp
+}
+
+// botAccessRefusal returns a reply refusing a command which shows Gerrit data to the user, if
+// the command would run as gerrit-http-username (and so could show changes the user can't see
+// in Gerrit) and that access has not been shared with everyone. Otherwise it returns "".
+func (a *App) botAccessRefusal(ctx context.Context, userID string) string {
+	if a.persistentDB.JustGetConfig(ctx, "gerrit-http-username", "") == "" ||
+		a.persistentDB.JustGetConfigBool(ctx, "share-bot-gerrit-access", false) ||
+		a.isAdminUser(ctx, userID) {
+		return ""
+	}
+	return "This command would use my Gerrit account, which can see changes you may not be able to. An admin can allow it with the `share-bot-gerrit-access` config item."
+}
+
+// gerritUsernamesFor returns the Gerrit usernames associated with a chat user, or a reply
+// explaining why there are none.
+func (a *App) gerritUsernamesFor(ctx context.Context, logger *zap.Logger, userID string) ([]string, string) {
+	usernames, err := a.persistentDB.GetGerritUsernamesForChatID(ctx, userID)
+	if err != nil {
+		logger.Error("failed to look up gerrit usernames for chat user", zap.Error(err))
+		return nil, "failed to look up your Gerrit account"
+	}
+	if len(usernames) == 0 {
+		return nil, "I don't know which Gerrit account is yours yet. Link it with `!link <gerrit-username>`."
+	}
+	return usernames, ""
+}
+
+// mineCommand handles the !mine chat command, listing the open changes owned by the user.
+func (a *App) mineCommand(ctx context.Context, logger *zap.Logger, userID string) string {
+	if a.getGerritClient() == nil {
+		return "Gerrit is not configured yet."
+	}
+	usernames, reply := a.gerritUsernamesFor(ctx, logger, userID)
+	if reply != "" {
+		return reply
+	}
+	now := time.Now()
+	var lines []string
+	for _, username := range usernames {
+		changes, err := a.getAllChangesMatching(ctx, fmt.Sprintf("is:open owner:%q", username), &gerrit.QueryChangesOpts{
+			Limit:                    gerritQueryPageSize,
+			DescribeLabels:           true,
+			DescribeDetailedLabels:   true,
+			DescribeDetailedAccounts: true,
+			DescribeSubmittable:      true,
+		})
+		if err != nil {
+			logger.Error("failed to query Gerrit for owned changes", zap.String("gerrit-username", username), zap.Error(err))
+			return "failed to query Gerrit for your changes"
+		}
+		for _, change := range changes {
+			lines = append(lines, fmt.Sprintf("%s\n%s · Updated %s",
+				a.formatChangeInfoLink(&change),
+				a.changeState(&change),
+				prettyDate(now, gerrit.ParseTimestamp(change.Updated))))
+		}
+	}
+	if len(lines) == 0 {
+		return "You have no open changes."
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reviewsCommand handles the !reviews chat command, sending the user their personal review
+// report right away regardless of when they last received one.
+func (a *App) reviewsCommand(ctx context.Context, logger *zap.Logger, userID string) string {
+	if a.getGerritClient() == nil {
+		return "Gerrit is not configured yet."
+	}
+	usernames, reply := a.gerritUsernamesFor(ctx, logger, userID)
+	if reply != "" {
+		return reply
+	}
+	reportItems, err := a.personalReportItems(ctx, usernames, time.Now())
+	if err != nil {
+		logger.Error("failed to query Gerrit for pending reviews", zap.Strings("gerrit-usernames", usernames), zap.Error(err))
+		return "failed to query Gerrit for your pending reviews"
+	}
+	if len(reportItems) == 0 {
+		return "No reviews are waiting on you."
+	}
+	if _, err := a.chat.SendPersonalReport(ctx, userID, "Reviews assigned to you", reportItems); err != nil {
+		logger.Error("failed to send on-demand report", zap.Error(err))
+		return "failed to send your report"
+	}
+	return ""
+}
+
+// whoisCommand handles the !whois chat command. Given a Gerrit username it replies with the
+// associated chat user, and given a chat user it replies with the associated Gerrit usernames.
+func (a *App) whoisCommand(ctx context.Context, logger *zap.Logger, args []string) string {
+	if len(args) != 1 {
+		return "bad !whois usage (`!whois <gerrit-username>` or `!whois <@chat-user>`)"
+	}
+	if chatID := a.fmt.UnwrapUserLink(args[0]); chatID != "" {
+		usernames, err := a.persistentDB.GetGerritUsernamesForChatID(ctx, chatID)
+		if err != nil {
+			logger.Error("failed to look up gerrit usernames for chat user", zap.String("whois-chat-id", chatID), zap.Error(err))
+			return "failed to look up Gerrit account"
+		}
+		if len(usernames) == 0 {
+			return fmt.Sprintf("%s is not associated with any Gerrit account", a.fmt.FormatUserLink(chatID))
+		}
+		for i := range usernames {
+			usernames[i] = a.fmt.FormatCode(usernames[i])
+		}
+		return fmt.Sprintf("%s = %s", a.fmt.FormatUserLink(chatID), strings.Join(usernames, ", "))
+	}
+
+	gerritUsername := args[0]
+	chatID, err := a.persistentDB.LookupChatIDForGerritUser(ctx, gerritUsername)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("failed to look up chat user for gerrit username", zap.String("gerrit-username", gerritUsername), zap.Error(err))
+		return "failed to look up chat user"
+	}
+	if chatID == "" && a.getGerritClient() != nil {
+		// not associated yet; see if the chat system knows about the same email address
+		accounts, _, err := a.getGerritClient().QueryAccountsEx(ctx, fmt.Sprintf("username:%q", gerritUsername), &gerrit.QueryAccountsOpts{DescribeDetails: true})
+		if err != nil {
+			logger.Info("failed to query Gerrit for account", zap.String("gerrit-username", gerritUsername), zap.Error(err))
+		} else if len(accounts) > 0 && accounts[0].Username == gerritUsername {
+			chatID = a.lookupGerritUser(ctx, accountFromAccountInfo(&accounts[0]))
+		}
+	}
+	if chatID == "" {
+		return fmt.Sprintf("%s is not associated with any chat user", a.fmt.FormatCode(gerritUsername))
+	}
+	return fmt.Sprintf("%s = %s", a.fmt.FormatCode(gerritUsername), a.fmt.FormatUserLink(chatID))
+}
+
+var changeNumberInURLRegexp = regexp.MustCompile(`/(?:c/(.+)/\+|c|#/c)/([1-9][0-9]*)(?:[/#?]|$)`)
+
+// parseChangeReference interprets a change number, a Gerrit "project~number" identifier, or a
+// Gerrit change URL (possibly wrapped as a chat link), and returns an identifier suitable for
+// the Gerrit API.
+func (a *App) parseChangeReference(ref string) (string, bool) {
+	if strings.HasPrefix(ref, "<") {
+		ref = a.fmt.UnwrapLink(ref)
+	}
+	if _, err := strconv.ParseUint(ref, 10, 32); err == nil {
+		return ref, true
+	}
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		subMatches := changeNumberInURLRegexp.FindStringSubmatch(ref)
+		if subMatches == nil {
+			return "", false
+		}
+		if subMatches[1] != "" {
+			return subMatches[1] + "~" + subMatches[2], true
+		}
+		return subMatches[2], true
+	}
+	if strings.Contains(ref, "~") {
+		return ref, true
+	}
+	return "", false
+}
+
+// statusCommand handles the !status chat command, describing the votes, reviewers, and build
+// status of a change.
+func (a *App) statusCommand(ctx context.Context, logger *zap.Logger, args []string) string {
+	if len(args) != 1 {
+		return "bad !status usage (`!status <change-number>` or `!status <change-url>`)"
+	}
+	gerritClient := a.getGerritClient()
+	if gerritClient == nil {
+		return "Gerrit is not configured yet."
+	}
+	changeID, ok := a.parseChangeReference(args[0])
+	if !ok {
+		return fmt.Sprintf("%q does not look like a change number or URL", args[0])
+	}
+	change, err := gerritClient.GetChangeEx(ctx, changeID, &gerrit.QueryChangesOpts{
+		DescribeLabels:           true,
+		DescribeDetailedLabels:   true,
+		DescribeCurrentRevision:  true,
+		DescribeDetailedAccounts: true,
+		DescribeMessages:         true,
+		DescribeSubmittable:      true,
+	})
+	if err != nil {
+		logger.Info("failed to look up change", zap.String("change-id", changeID), zap.Error(err))
+		return fmt.Sprintf("could not find change %q", changeID)
+	}
+
+	var s bytes.Buffer
+	s.WriteString(fmt.Sprintf("%s %s\n", a.formatChangeInfoLink(&change), a.fmt.FormatItalic("("+change.Owner.Name+")")))
+	s.WriteString(fmt.Sprintf("Status: %s\n", a.changeState(&change)))
+	var reviewers []string
+	for _, reviewer := range change.Reviewers["REVIEWER"] {
+		if reviewer.Username == change.Owner.Username {
+			continue
+		}
+		reviewers = append(reviewers, accountFromAccountInfo(&reviewer).DisplayName())
+	}
+	if len(reviewers) == 0 {
+		reviewers = append(reviewers, "none")
+	}
+	s.WriteString(fmt.Sprintf("Reviewers: %s\n", strings.Join(reviewers, ", ")))
+	if ccs := change.Reviewers["CC"]; len(ccs) > 0 {
+		names := make([]string, 0, len(ccs))
+		for _, cc := range ccs {
+			names = append(names, accountFromAccountInfo(&cc).DisplayName())
+		}
+		s.WriteString(fmt.Sprintf("CC: %s\n", strings.Join(names, ", ")))
+	}
+	for _, labelLine := range labelVoteLines(&change) {
+		s.WriteString(labelLine)
+		s.WriteString("\n")
+	}
+	s.WriteString(fmt.Sprintf("Build: %s\n", a.latestBuildStatus(ctx, &change)))
+	return s.String()
+}
+
+// changeState gives a short description of where a change stands in the review process.
+func (a *App) changeState(change *gerrit.ChangeInfo) string {
+	switch {
+	case change.Status == "MERGED":
+		return "merged"
+	case change.Status == "ABANDONED":
+		return "abandoned"
+	case change.WorkInProgress:
+		return "work in progress"
+	case change.Submittable:
+		return a.fmt.FormatBold("submittable")
+	}
+	lines := labelVoteLines(change)
+	if len(lines) == 0 {
+		return "awaiting review"
+	}
+	return strings.Join(lines, "; ")
+}
+
+// labelVoteLines describes the nonzero votes on each label of a change, one line per label,
+// ordered by label name.
+func labelVoteLines(change *gerrit.ChangeInfo) []string {
+	labelNames := make([]string, 0, len(change.Labels))
+	for labelName := range change.Labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	lines := make([]string, 0, len(labelNames))
+	for _, labelName := range labelNames {
+		var votes []string
+		for _, vote := range change.Labels[labelName].All {
+			if vote.Value == nil || *vote.Value == 0 {
+				continue
+			}
+			votes = append(votes, fmt.Sprintf("%+d (%s)", *vote.Value, accountFromAccountInfo(&vote.AccountInfo).DisplayName()))
+		}
+		if len(votes) == 0 {
+			votes = append(votes, "no votes")
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", labelName, strings.Join(votes, ", ")))
+	}
+	return lines
+}
+
+// latestBuildStatus describes the most recent build status reported on the current patchset
+// of a change by the configured CI robot users.
+func (a *App) latestBuildStatus(ctx context.Context, change *gerrit.ChangeInfo) string {
+	if len(a.ciRobotUsernames(ctx)) == 0 {
+		return "unknown (no CI robot users configured)"
+	}
+	currentRevisionNum := 0
+	if currentRevision, ok := change.Revisions[change.CurrentRevision]; ok {
+		currentRevisionNum = int(currentRevision.Number)
+	}
+	for i := len(change.Messages) - 1; i >= 0; i-- {
+		message := change.Messages[i]
+		if message.RevisionNumber < currentRevisionNum {
+			break
+		}
+		parser, _ := a.ciRobotParser(ctx, message.Author.Username)
+		if parser == nil {
+			continue
+		}
+		if status := describeBuildComment(parser, message.Message); status != "" {
+			return status
+		}
+	}
+	return "no builds reported for the current patchset"
+}
+
+// describeBuildComment interprets a comment from a CI robot user in the same way as
+// CIRobotCommentAdded, and returns a short description of the build status it reports,
+// or "" if it is not a build status comment.
+func describeBuildComment(parser ciParser, comment string) string {
+	report, ok := parseRobotComment(parser, comment)
+	if !ok {
+		return ""
+	}
+	var description string
+	switch report.Status {
+	case buildStarted:
+		description = "started"
+	case buildSucceeded:
+		description = "succeeded"
+	case buildFailed:
+		description = "failed"
+	case buildAborted:
+		description = "canceled"
+	case buildTypeTriggered:
+		description = report.BuildType + " triggered"
+	case buildTypeStarted:
+		description = report.BuildType + " started"
+	case buildTypeFailed:
+		description = report.BuildType + " failed"
+	case buildTypeSucceeded:
+		description = report.BuildType + " succeeded"
+	}
+	if report.Link != "" {
+		description += " " + report.Link
+	}
+	return description
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+func TestParseChangeReference(t *testing.T) {
+	a := &App{fmt: &slack.Formatter{}}
+	for _, test := range []struct {
+		ref      string
+		expected string
+		ok       bool
+	}{
+		{"1234", "1234", true},
+		{"jorts/testiness~1234", "jorts/testiness~1234", true},
+		{"https://gerrit.jorts.io/c/jorts/testiness/+/1234", "jorts/testiness~1234", true},
+		{"https://gerrit.jorts.io/c/jorts/testiness/+/1234/5", "jorts/testiness~1234", true},
+		{"<https://gerrit.jorts.io/c/jorts/testiness/+/1234>", "jorts/testiness~1234", true},
+		{"https://gerrit.jorts.io/c/1234", "1234", true},
+		{"https://gerrit.jorts.io/#/c/1234/", "1234", true},
+		{"https://gerrit.jorts.io/q/status:open", "", false},
+		{"beans", "", false},
+	} {
+		got, ok := a.parseChangeReference(test.ref)
+		assert.Equalf(t, test.ok, ok, "ref %q", test.ref)
+		assert.Equalf(t, test.expected, got, "ref %q", test.ref)
+	}
+}
+
+func TestDescribeBuildComment(t *testing.T) {
+	assert.Equal(t, "started https://build.jorts.io/job/1",
+		describeBuildComment(builtinCIParsers[ciParserJenkins], "Patch Set 2:\n\nBuild Started https://build.jorts.io/job/1"))
+	assert.Equal(t, "failed https://build.jorts.io/job/1",
+		describeBuildComment(builtinCIParsers[ciParserJenkins], "Patch Set 2: Verified-1\n\nBuild Failed \n\nhttps://build.jorts.io/job/1 : FAILURE"))
+	assert.Equal(t, "succeeded https://build.jorts.io/job/1",
+		describeBuildComment(builtinCIParsers[ciParserJenkins], "Patch Set 2: Verified+1\n\nBuild Successful \n\nhttps://build.jorts.io/job/1 : SUCCESS"))
+	assert.Equal(t, "", describeBuildComment(builtinCIParsers[ciParserJenkins], "Patch Set 2:\n\nlooks good to me"))
+	assert.Equal(t, "", describeBuildComment(builtinCIParsers[ciParserJenkins], "hello"))
+}
+
+func TestValidatePersonalReportHour(t *testing.T) {
+	prefDef := findUserPrefItem(personalReportHourPrefKey)
+	for _, test := range []struct {
+		value    string
+		expected string
+		ok       bool
+	}{
+		{"9", "9", true},
+		{"0x10", "16", true},
+		{"8", "", false},
+		{"17", "", false},
+		{"23", "", false},
+		{"-1", "", false},
+		{"noon", "", false},
+	} {
+		got, err := validateUserPref(prefDef, test.value)
+		assert.Equalf(t, test.ok, err == nil, "value %q", test.value)
+		assert.Equalf(t, test.expected, got, "value %q", test.value)
+	}
+}
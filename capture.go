@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+var captureDir = flag.String("capture-gerrit-events", "", "Directory in which to record the Gerrit events received for each team, in <team-id>.jsonl, so that they can be replayed. If empty, events are not recorded.")
+
+// captureTeamIDRegexp matches the team IDs which can safely be used in capture file names.
+var captureTeamIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// captureFileName returns the name of the file in dir where a team's Gerrit events are
+// captured, or "" if dir is empty.
+func captureFileName(dir, teamID string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if !captureTeamIDRegexp.MatchString(teamID) {
+		return "", errs.New("team ID %q can not be used in a file name", teamID)
+	}
+	return filepath.Join(dir, teamID+".jsonl"), nil
+}
+
+// eventCapture records the Gerrit events received for each team in the team's capture file,
+// from which they can be replayed with `changesetchihuahua events replay` or !replay-events.
+type eventCapture struct {
+	logger *zap.Logger
+	dir    string
+
+	lock    sync.Mutex
+	files   map[string]*os.File
+	writers map[string]*events.CaptureWriter
+}
+
+// newEventCapture creates an eventCapture which keeps capture files in dir. If dir is empty,
+// it returns nil, which captures nothing.
+func newEventCapture(logger *zap.Logger, dir string) *eventCapture {
+	if dir == "" {
+		return nil
+	}
+	return &eventCapture{
+		logger:  logger,
+		dir:     dir,
+		files:   make(map[string]*os.File),
+		writers: make(map[string]*events.CaptureWriter),
+	}
+}
+
+// Capture records an event payload received for a team. Failures are logged, but otherwise
+// ignored, so that they do not affect the handling of the event.
+func (c *eventCapture) Capture(teamID string, payload []byte, receivedAt time.Time) {
+	if c == nil {
+		return
+	}
+	writer, err := c.writer(teamID)
+	if err == nil {
+		err = writer.Write(payload, receivedAt)
+	}
+	if err != nil {
+		c.logger.Error("failed to capture gerrit event", zap.String("team-id", teamID), zap.Error(err))
+	}
+}
+
+func (c *eventCapture) writer(teamID string) (*events.CaptureWriter, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if writer, ok := c.writers[teamID]; ok {
+		return writer, nil
+	}
+	fileName, err := captureFileName(c.dir, teamID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c.files[teamID] = f
+	c.writers[teamID] = events.NewCaptureWriter(f)
+	return c.writers[teamID], nil
+}
+
+// Close closes all of the capture files.
+func (c *eventCapture) Close() (err error) {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for teamID, f := range c.files {
+		err = errs.Combine(err, f.Close())
+		delete(c.files, teamID)
+		delete(c.writers, teamID)
+	}
+	return err
+}
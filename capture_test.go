@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+func TestEventCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "capture")
+	capture := newEventCapture(zaptest.NewLogger(t), dir)
+	receivedAt := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	capture.Capture("T1", []byte(`{"type":"ref-updated","eventCreatedOn":1580355933}`), receivedAt)
+	capture.Capture("T1", []byte(`{"type":"ref-updated","eventCreatedOn":1580355934}`), receivedAt.Add(time.Second))
+	capture.Capture("../T2", []byte(`{"type":"ref-updated"}`), receivedAt)
+	require.NoError(t, capture.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	fileName, err := captureFileName(dir, "T1")
+	require.NoError(t, err)
+	f, err := os.Open(fileName)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, f.Close()) }()
+	var captured []events.CapturedEvent
+	require.NoError(t, events.ReadCapture(f, func(c events.CapturedEvent) error {
+		captured = append(captured, c)
+		return nil
+	}))
+	require.Len(t, captured, 2)
+	require.True(t, receivedAt.Add(time.Second).Equal(captured[1].ReceivedAt))
+
+	// with no directory, nothing is captured
+	noCapture := newEventCapture(zaptest.NewLogger(t), "")
+	noCapture.Capture("T1", []byte(`{}`), receivedAt)
+	require.NoError(t, noCapture.Close())
+}
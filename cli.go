@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/app"
+	"github.com/storj/changesetchihuahua/slack"
+)
+
+// runCommand runs an operator subcommand given on the command line, instead of starting the
+// server.
+func runCommand(ctx context.Context, logger *zap.Logger, args []string) error {
+	switch args[0] {
+	case "identities":
+		return identitiesCommand(ctx, logger, args[1:])
+	case "migrate":
+		return migrateCommand(ctx, logger, args[1:])
+	case "teams":
+		return teamsCommand(ctx, logger, args[1:])
+	case "config":
+		return configCommand(ctx, logger, args[1:])
+	case "report":
+		return reportCommand(ctx, logger, args[1:])
+	case "events":
+		return eventsCommand(ctx, logger, args[1:])
+	case "db":
+		return dbCommand(ctx, logger, args[1:])
+	}
+	return errs.New("unknown command %q", args[0])
+}
+
+// identitiesCommand imports or exports a team's Gerrit-to-chat user associations.
+//
+//	changesetchihuahua identities -team <team-id> [-format csv|ldif] export [<file>]
+//	changesetchihuahua identities -team <team-id> [-format csv|ldif] [-apply] import [<file>]
+//
+// A file name of "-" (the default) means stdin or stdout. Without -apply, an import only
+// prints what would change.
+func identitiesCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	flags := flag.NewFlagSet("identities", flag.ContinueOnError)
+	teamID := flags.String("team", "", "ID of the team whose identities should be imported or exported")
+	format := flags.String("format", app.IdentityFormatCSV, "File format (csv or ldif)")
+	apply := flags.Bool("apply", false, "Apply an import, instead of only showing what would change")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *teamID == "" || flags.NArg() < 1 || flags.NArg() > 2 {
+		return errs.New("usage: identities -team <team-id> [-format csv|ldif] [-apply] import|export [<file>]")
+	}
+	fileName := "-"
+	if flags.NArg() == 2 {
+		fileName = flags.Arg(1)
+	}
+
+	persistentDB, err := registeredTeamDB(ctx, logger, *teamID)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, persistentDB.Close()) }()
+
+	switch flags.Arg(0) {
+	case "export":
+		records, err := app.ExportIdentities(ctx, persistentDB)
+		if err != nil {
+			return err
+		}
+		out, err := createOutput(fileName)
+		if err != nil {
+			return err
+		}
+		return errs.Combine(app.WriteIdentities(out, *format, records), out.Close())
+	case "import":
+		in, err := openInput(fileName)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = in.Close() }()
+		records, err := app.ReadIdentities(in, *format)
+		if err != nil {
+			return err
+		}
+		plan, err := app.PlanIdentityImport(ctx, persistentDB, teamChatIDLookup(ctx, logger, *teamID), records)
+		if err != nil {
+			return err
+		}
+		fmt.Print(plan.String())
+		if !*apply {
+			fmt.Println("Dry run only; pass -apply to make these changes.")
+			return nil
+		}
+		if err := app.ApplyIdentityImport(ctx, persistentDB, plan); err != nil {
+			return err
+		}
+		fmt.Println("Applied. Conflicts were skipped.")
+		return nil
+	}
+	return errs.New("unknown identities subcommand %q", flags.Arg(0))
+}
+
+// teamChatIDLookup returns a function which looks up chat users by email using the team's
+// registered chat credentials, or nil if the team is not registered.
+func teamChatIDLookup(ctx context.Context, logger *zap.Logger, teamID string) func(ctx context.Context, email string) (string, error) {
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		logger.Info("could not open governor db; chat users can not be looked up by email", zap.Error(err))
+		return nil
+	}
+	defer func() { _ = teamDB.Close() }()
+	team, err := teamDB.GetTeam(ctx, teamID)
+	if err != nil {
+		logger.Info("team not registered; chat users can not be looked up by email", zap.String("team-id", teamID), zap.Error(err))
+		return nil
+	}
+	chat, err := slack.NewSlackInterface(logger.Named("chat"), team.SetupData, loadTeamSetupData(logger, teamID), saveTeamSetupData(logger, teamID))
+	if err != nil {
+		logger.Info("could not set up chat connection; chat users can not be looked up by email", zap.Error(err))
+		return nil
+	}
+	return func(ctx context.Context, email string) (string, error) {
+		chatUser, err := chat.LookupUserByEmail(ctx, email)
+		if err != nil {
+			return "", err
+		}
+		return chatUser.ChatID(), nil
+	}
+}
+
+// loadTeamSetupData returns a function which reads a team's current setup data from the
+// governor DB, whose tokens may have been refreshed by the server since the command started.
+func loadTeamSetupData(logger *zap.Logger, teamID string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (_ string, err error) {
+		teamDB, err := openGovernorDB(logger)
+		if err != nil {
+			return "", err
+		}
+		defer func() { err = errs.Combine(err, teamDB.Close()) }()
+		team, err := teamDB.GetTeam(ctx, teamID)
+		if err != nil {
+			return "", err
+		}
+		return team.SetupData, nil
+	}
+}
+
+// saveTeamSetupData returns a function which stores updated setup data for a team in the
+// governor DB, such as when its access token is refreshed.
+func saveTeamSetupData(logger *zap.Logger, teamID string) func(ctx context.Context, setupData string) error {
+	return func(ctx context.Context, setupData string) (err error) {
+		teamDB, err := openGovernorDB(logger)
+		if err != nil {
+			return err
+		}
+		defer func() { err = errs.Combine(err, teamDB.Close()) }()
+		return teamDB.PutTeam(ctx, teamID, setupData, time.Now())
+	}
+}
+
+// registeredTeamApp creates an App for a registered team, connected to its chat system, just
+// as the server would. The caller is responsible for closing the App.
+func registeredTeamApp(ctx context.Context, logger *zap.Logger, teamID string) (_ *app.App, err error) {
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		return nil, errs.New("could not open governor db: %v", err)
+	}
+	defer func() { err = errs.Combine(err, teamDB.Close()) }()
+	team, err := getRegisteredTeam(ctx, teamDB, teamID)
+	if err != nil {
+		return nil, err
+	}
+	return newTeamApp(ctx, logger.With(zap.String("team-id", teamID)), teamDB, teamID, team.SetupData, loadTeamSetupData(logger, teamID), saveTeamSetupData(logger, teamID))
+}
+
+// registeredTeamDB opens the persistent DB of a registered team, with the key the server uses
+// for its secret config items. The caller is responsible for closing it.
+func registeredTeamDB(ctx context.Context, logger *zap.Logger, teamID string) (_ *app.PersistentDB, err error) {
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		return nil, errs.New("could not open governor db: %v", err)
+	}
+	defer func() { err = errs.Combine(err, teamDB.Close()) }()
+	if _, err := getRegisteredTeam(ctx, teamDB, teamID); err != nil {
+		return nil, err
+	}
+	return openTeamDB(logger, teamDB, teamID)
+}
+
+// getRegisteredTeam returns the registration of a team, or errUnknownTeam if it is not
+// registered. Opening the DB of a team which is not registered would create a new, empty one.
+func getRegisteredTeam(ctx context.Context, teamDB *app.GovernorDB, teamID string) (app.TeamRecord, error) {
+	team, err := teamDB.GetTeam(ctx, teamID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return team, errs.New("%w: %s", errUnknownTeam, teamID)
+		}
+		return team, err
+	}
+	return team, nil
+}
+
+// openInput opens the named file for reading, or stdin if the name is "-".
+func openInput(fileName string) (io.ReadCloser, error) {
+	if fileName == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(fileName)
+}
+
+// createOutput creates the named file for writing, or uses stdout if the name is "-".
+func createOutput(fileName string) (io.WriteCloser, error) {
+	if fileName == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(fileName)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// migrateCommand brings the governor DB and the DBs of one or all teams up to date. The
+// server does the same at startup; this allows it to be done ahead of time.
+//
+//	changesetchihuahua migrate [-team <team-id>]
+func migrateCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	teamID := flags.String("team", "", "ID of the team whose DB should be migrated (default all registered teams)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errs.New("usage: migrate [-team <team-id>]")
+	}
+
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		return errs.New("could not open governor db: %v", err)
+	}
+	defer func() { err = errs.Combine(err, teamDB.Close()) }()
+	fmt.Println("governor db is up to date")
+
+	teamIDs := []string{*teamID}
+	if *teamID != "" {
+		if _, err := getRegisteredTeam(ctx, teamDB, *teamID); err != nil {
+			return err
+		}
+	} else {
+		teams, err := teamDB.GetTeams(ctx)
+		if err != nil {
+			return err
+		}
+		teamIDs = teamIDs[:0]
+		for _, team := range teams {
+			teamIDs = append(teamIDs, team.TeamID)
+		}
+	}
+	for _, id := range teamIDs {
+		persistentDB, err := openTeamDB(logger.With(zap.String("team-id", id)), teamDB, id)
+		if err != nil {
+			return errs.New("team %s: %w", id, err)
+		}
+		if err := persistentDB.Close(); err != nil {
+			return errs.New("team %s: %w", id, err)
+		}
+		fmt.Printf("team %s db is up to date\n", id)
+	}
+	return nil
+}
+
+// teamsCommand lists, shows, or removes registered teams.
+//
+//	changesetchihuahua teams list
+//	changesetchihuahua teams show <team-id>
+//	changesetchihuahua teams remove -yes [-server <url>] <team-id>
+//
+// Removing a team deletes its registration and all of its data. If the server is running, its
+// URL should be given with -server (along with -operator-token), so that the server stops the
+// team and removes it; otherwise the team is removed directly from the DB.
+func teamsCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	usage := errs.New("usage: teams list | teams show <team-id> | teams remove -yes [-server <url>] <team-id>")
+	if len(args) < 1 {
+		return usage
+	}
+	flags := flag.NewFlagSet("teams "+args[0], flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "Confirm that a team should be removed, along with all of its data")
+	server := flags.String("server", "", "URL of the running server, through which a team should be removed")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if args[0] == "remove" && *server != "" {
+		if flags.NArg() != 1 || !*yes {
+			return usage
+		}
+		return remoteTeamCommand(ctx, *server, flags.Arg(0), "remove")
+	}
+
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		return errs.New("could not open governor db: %v", err)
+	}
+	defer func() { err = errs.Combine(err, teamDB.Close()) }()
+
+	switch args[0] {
+	case "list":
+		teams, err := teamDB.GetTeams(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "TEAM ID\tNAME\tREGISTERED\tUPDATED")
+		for _, team := range teams {
+			summary, err := slack.SummarizeSetupData(team.SetupData)
+			if err != nil {
+				logger.Info("could not read setup data", zap.String("team-id", team.TeamID), zap.Error(err))
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", team.TeamID, summary.TeamName,
+				team.CreatedAt.Format(time.RFC3339), team.UpdatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "show":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		team, err := getRegisteredTeam(ctx, teamDB, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		summary, err := slack.SummarizeSetupData(team.SetupData)
+		if err != nil {
+			return err
+		}
+		tokenExpiry := "never"
+		if !summary.TokenExpiresAt.IsZero() {
+			tokenExpiry = summary.TokenExpiresAt.Format(time.RFC3339)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintf(w, "Team ID:\t%s\n", team.TeamID)
+		_, _ = fmt.Fprintf(w, "Name:\t%s\n", summary.TeamName)
+		_, _ = fmt.Fprintf(w, "Registered:\t%s\n", team.CreatedAt.Format(time.RFC3339))
+		_, _ = fmt.Fprintf(w, "Updated:\t%s\n", team.UpdatedAt.Format(time.RFC3339))
+		_, _ = fmt.Fprintf(w, "App ID:\t%s\n", summary.AppID)
+		_, _ = fmt.Fprintf(w, "Bot user:\t%s\n", summary.BotUserID)
+		_, _ = fmt.Fprintf(w, "Scopes:\t%s\n", summary.Scope)
+		_, _ = fmt.Fprintf(w, "Token expires:\t%s\n", tokenExpiry)
+		return w.Flush()
+	case "remove":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		if !*yes {
+			return errs.New("removing team %s deletes all of its data; pass -yes to confirm", flags.Arg(0))
+		}
+		if err := deleteTeam(ctx, logger, teamDB, flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("team %s removed\n", flags.Arg(0))
+		return nil
+	}
+	return usage
+}
+
+// remoteTeamCommand asks a running server to carry out an operator command on a team.
+func remoteTeamCommand(ctx context.Context, serverURL, teamID, command string) (err error) {
+	if *operatorToken == "" {
+		return errs.New("-operator-token is needed to send commands to the server")
+	}
+	endpoint, err := url.JoinPath(serverURL, "operator", "teams", teamID, command)
+	if err != nil {
+		return errs.New("invalid server URL %q: %v", serverURL, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*operatorToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, resp.Body.Close()) }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errs.New("server refused %s: %s: %s", command, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("team %s: %s\n", teamID, strings.TrimSpace(string(body)))
+	return nil
+}
+
+// configCommand shows or changes a team's config items, with the same checks as the !config
+// chat command. The team does not need to be running.
+//
+//	changesetchihuahua config get <team-id> [<key>]
+//	changesetchihuahua config set <team-id> <key> <value>
+//
+// Channels and users may be given as plain chat IDs.
+func configCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	usage := errs.New("usage: config get <team-id> [<key>] | config set <team-id> <key> <value>")
+	if len(args) < 2 {
+		return usage
+	}
+	persistentDB, err := registeredTeamDB(ctx, logger, args[1])
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, persistentDB.Close()) }()
+	operator := app.NewOperator(logger.With(zap.String("team-id", args[1])), persistentDB, &slack.Formatter{})
+
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		items, err := operator.ConfigItems(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			fmt.Printf("%s = %q\n", item.Key, item.Value)
+		}
+		return nil
+	case args[0] == "get" && len(args) == 3:
+		value, err := operator.GetConfig(ctx, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	case args[0] == "set" && len(args) == 4:
+		if err := operator.SetConfig(ctx, args[2], args[3]); err != nil {
+			return err
+		}
+		fmt.Printf("%s updated\n", args[2])
+		return nil
+	}
+	return usage
+}
+
+// reportCommand sends one of a team's configured team reports now.
+//
+//	changesetchihuahua report send <team-id> <report-name>
+func reportCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	if len(args) != 3 || args[0] != "send" {
+		return errs.New("usage: report send <team-id> <report-name>")
+	}
+	teamApp, err := registeredTeamApp(ctx, logger, args[1])
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, teamApp.Close()) }()
+
+	channelID, err := teamApp.SendTeamReport(ctx, args[2], time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("report %s sent to channel %s\n", args[2], channelID)
+	return nil
+}
+
+// eventsCommand replays a capture of Gerrit events for a team (see -capture-gerrit-events),
+// as though they had just been received from Gerrit. Files of bare event payloads, one per
+// line, can be replayed too.
+//
+//	changesetchihuahua events replay [-speed <factor>] [-last <n>] [-dry-run] [-dry-run-channel <channel-id>] <team-id> [<file>]
+//
+// A file name of "-" (the default) means stdin. With -dry-run, the resulting messages are
+// recorded, to be seen with !dry-run, instead of being sent.
+func eventsCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	usage := errs.New("usage: events replay [-speed <factor>] [-last <n>] [-dry-run] [-dry-run-channel <channel-id>] <team-id> [<file>]")
+	if len(args) < 1 || args[0] != "replay" {
+		return usage
+	}
+	flags := flag.NewFlagSet("events replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 0, "How many times faster than they were received events should be replayed (0 for no delay between them)")
+	last := flags.Int("last", 0, "Replay only this many of the most recent events (0 for all)")
+	dryRun := flags.Bool("dry-run", false, "Record the resulting messages instead of sending them, whether or not the team is in dry-run mode")
+	dryRunChannel := flags.String("dry-run-channel", "", "With -dry-run, send the resulting messages to this channel instead of to their real recipients")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 || *speed < 0 || (*dryRunChannel != "" && !*dryRun) {
+		return usage
+	}
+	fileName := "-"
+	if flags.NArg() == 2 {
+		fileName = flags.Arg(1)
+	}
+	in, err := openInput(fileName)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	teamApp, err := registeredTeamApp(ctx, logger, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, teamApp.Close()) }()
+
+	count, err := teamApp.ReplayEvents(ctx, in, app.ReplayOptions{
+		Speed:         *speed,
+		DryRun:        *dryRun,
+		DryRunChannel: *dryRunChannel,
+		Last:          *last,
+	})
+	fmt.Printf("replayed %d events\n", count)
+	return err
+}
+
+// dbCommand exports or imports the entire contents of a team's DB. An export can be imported
+// into a DB of any supported type, so this can be used to move a team between DBs.
+//
+//	changesetchihuahua db export <team-id> [<file>]
+//	changesetchihuahua db import [-replace] <team-id> [<file>]
+//
+// A file name of "-" (the default) means stdin or stdout. Without -replace, an import fails
+// if any of its rows conflict with existing data.
+func dbCommand(ctx context.Context, logger *zap.Logger, args []string) (err error) {
+	usage := errs.New("usage: db export <team-id> [<file>] | db import [-replace] <team-id> [<file>]")
+	if len(args) < 1 {
+		return usage
+	}
+	flags := flag.NewFlagSet("db "+args[0], flag.ContinueOnError)
+	replace := flags.Bool("replace", false, "Delete all existing data in the team's DB before importing")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 || (args[0] == "export" && *replace) {
+		return usage
+	}
+	fileName := "-"
+	if flags.NArg() == 2 {
+		fileName = flags.Arg(1)
+	}
+
+	persistentDB, err := registeredTeamDB(ctx, logger, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, persistentDB.Close()) }()
+
+	switch args[0] {
+	case "export":
+		out, err := createOutput(fileName)
+		if err != nil {
+			return err
+		}
+		return errs.Combine(persistentDB.Export(ctx, out), out.Close())
+	case "import":
+		in, err := openInput(fileName)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = in.Close() }()
+		count, err := persistentDB.Import(ctx, in, *replace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %d rows\n", count)
+		return nil
+	}
+	return usage
+}
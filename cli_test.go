@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOperatorCommands(t *testing.T) {
+	ctx := context.Background()
+	logger := zaptest.NewLogger(t)
+	dir := t.TempDir()
+	oldSource := *persistentDBSource
+	*persistentDBSource = "sqlite:" + filepath.Join(dir, "persistent.db")
+	defer func() { *persistentDBSource = oldSource }()
+	t.Setenv(teamKeyEnvVar, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+
+	teamDB, err := openGovernorDB(logger)
+	require.NoError(t, err)
+	require.NoError(t, teamDB.PutTeam(ctx, "T1", `{"access_token":"xoxb-1","team":{"id":"T1","name":"Storj"}}`, time.Now()))
+	require.NoError(t, teamDB.Close())
+
+	require.NoError(t, runCommand(ctx, logger, []string{"migrate"}))
+	require.NoError(t, runCommand(ctx, logger, []string{"teams", "list"}))
+	require.NoError(t, runCommand(ctx, logger, []string{"teams", "show", "T1"}))
+	err = runCommand(ctx, logger, []string{"teams", "show", "T2"})
+	require.True(t, errors.Is(err, errUnknownTeam))
+
+	// commands naming a team which is not registered fail, without creating a DB for it
+	for _, args := range [][]string{
+		{"config", "set", "T2", "global-notify-channel", "C0123456789"},
+		{"config", "get", "T2"},
+		{"db", "export", "T2", filepath.Join(dir, "t2.jsonl")},
+		{"identities", "-team", "T2", "export", filepath.Join(dir, "t2.csv")},
+		{"migrate", "-team", "T2"},
+	} {
+		require.ErrorIs(t, runCommand(ctx, logger, args), errUnknownTeam, "%v", args)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*T2*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	// config and DB contents survive an export and import
+	require.NoError(t, runCommand(ctx, logger, []string{"config", "set", "T1", "global-notify-channel", "C0123456789"}))
+	dumpFile := filepath.Join(dir, "dump.jsonl")
+	require.NoError(t, runCommand(ctx, logger, []string{"db", "export", "T1", dumpFile}))
+	require.NoError(t, runCommand(ctx, logger, []string{"config", "set", "T1", "global-notify-channel", "C9876543210"}))
+	require.Error(t, runCommand(ctx, logger, []string{"db", "import", "T1", dumpFile}))
+	require.NoError(t, runCommand(ctx, logger, []string{"db", "import", "-replace", "T1", dumpFile}))
+	persistentDB, err := registeredTeamDB(ctx, logger, "T1")
+	require.NoError(t, err)
+	require.Equal(t, "C0123456789", persistentDB.JustGetConfig(ctx, "global-notify-channel", ""))
+	require.NoError(t, persistentDB.Close())
+
+	// removal needs confirmation
+	require.Error(t, runCommand(ctx, logger, []string{"teams", "remove", "T1"}))
+	require.NoError(t, runCommand(ctx, logger, []string{"teams", "remove", "-yes", "T1"}))
+	teamDB, err = openGovernorDB(logger)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, teamDB.Close()) }()
+	teams, err := teamDB.GetTeams(ctx)
+	require.NoError(t, err)
+	require.Empty(t, teams)
+}
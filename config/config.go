@@ -0,0 +1,223 @@
+// Package config lets server settings, which are defined as command line flags, also be given
+// in a YAML configuration file or in environment variables, and reloads the settings which can
+// safely change while the server is running.
+//
+// Settings are applied in this order, later ones taking precedence: flag defaults, the
+// configuration file, environment variables, and the command line. In the configuration file,
+// each setting is a top-level key named after its flag:
+//
+//	notify-timeout: 10m
+//	slack-client-id: "13639549360.893676519079"
+//
+// and in the environment, it is named after its flag in upper case, with dashes changed to
+// underscores and EnvPrefix in front (CHIHUAHUA_NOTIFY_TIMEOUT). Secrets can be kept out of
+// both by naming a file which holds the value instead: use the key slack-client-secret-file,
+// or the environment variable CHIHUAHUA_SLACK_CLIENT_SECRET_FILE.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is put in front of the environment variable names for settings.
+const EnvPrefix = "CHIHUAHUA_"
+
+// fileSuffix marks a setting whose value is to be read from the named file.
+const fileSuffix = "-file"
+
+// Loader applies settings from a configuration file and the environment to a set of flags.
+type Loader struct {
+	flags    *flag.FlagSet
+	path     string
+	lookupFn func(string) (string, bool)
+	// fromCommandLine holds the names of the flags given on the command line, which are not
+	// overridden.
+	fromCommandLine map[string]bool
+}
+
+// NewLoader creates a Loader for flags, which must already have been parsed. path is the
+// configuration file to read, or empty if there is none.
+func NewLoader(flags *flag.FlagSet, path string) *Loader {
+	fromCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		fromCommandLine[f.Name] = true
+	})
+	return &Loader{
+		flags:           flags,
+		path:            path,
+		lookupFn:        os.LookupEnv,
+		fromCommandLine: fromCommandLine,
+	}
+}
+
+// Load applies all settings from the configuration file and the environment, except those
+// given on the command line.
+func (l *Loader) Load() error {
+	settings, err := l.settings()
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedNames(settings) {
+		if l.fromCommandLine[name] {
+			continue
+		}
+		if err := l.flags.Set(name, settings[name]); err != nil {
+			return errs.New("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Reload reads the configuration file and the environment again, and applies the settings
+// which can change while the server is running. It returns the names of the settings which
+// were changed, and of those which were changed but can not take effect until a restart.
+func (l *Loader) Reload() (changed, needRestart []string, err error) {
+	settings, err := l.settings()
+	if err != nil {
+		return nil, nil, err
+	}
+	// settings which are no longer given go back to their defaults.
+	l.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := settings[f.Name]; !ok && !l.fromCommandLine[f.Name] {
+			settings[f.Name] = f.DefValue
+		}
+	})
+	for _, name := range sortedNames(settings) {
+		f := l.flags.Lookup(name)
+		if l.fromCommandLine[name] || f.Value.String() == normalize(f, settings[name]) {
+			continue
+		}
+		if !IsReloadable(name) {
+			needRestart = append(needRestart, name)
+			continue
+		}
+		if err := f.Value.Set(settings[name]); err != nil {
+			return changed, needRestart, errs.New("invalid value for %s: %v", name, err)
+		}
+		changed = append(changed, name)
+	}
+	return changed, needRestart, nil
+}
+
+// settings collects the value of every setting given in the configuration file or the
+// environment, with secret files already read.
+func (l *Loader) settings() (map[string]string, error) {
+	settings := make(map[string]string)
+	if l.path != "" {
+		if err := l.readFile(settings); err != nil {
+			return nil, errs.New("reading config file %s: %v", l.path, err)
+		}
+	}
+	var err error
+	l.flags.VisitAll(func(f *flag.Flag) {
+		envName := EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := l.lookupFn(envName); ok {
+			settings[f.Name] = value
+		} else if fileName, ok := l.lookupFn(envName + "_FILE"); ok {
+			value, readErr := readSecretFile(fileName)
+			if readErr != nil {
+				err = errs.Combine(err, errs.New("%s_FILE: %v", envName, readErr))
+				return
+			}
+			settings[f.Name] = value
+		}
+	})
+	return settings, err
+}
+
+// readFile adds the settings from the configuration file to settings.
+func (l *Loader) readFile(settings map[string]string) error {
+	contents, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	var fileSettings map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	if err := decoder.Decode(&fileSettings); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	for key, rawValue := range fileSettings {
+		var value string
+		switch rawValue.(type) {
+		case map[string]interface{}, []interface{}:
+			return errs.New("%s: expected a single value", key)
+		case nil:
+			value = ""
+		default:
+			value = fmt.Sprint(rawValue)
+		}
+		switch {
+		case l.flags.Lookup(key) != nil:
+			settings[key] = value
+		case strings.HasSuffix(key, fileSuffix) && l.flags.Lookup(strings.TrimSuffix(key, fileSuffix)) != nil:
+			secret, err := readSecretFile(value)
+			if err != nil {
+				return errs.New("%s: %v", key, err)
+			}
+			settings[strings.TrimSuffix(key, fileSuffix)] = secret
+		default:
+			return errs.New("unknown setting %q", key)
+		}
+	}
+	return nil
+}
+
+// readSecretFile reads a setting from a file, without any trailing newline.
+func readSecretFile(fileName string) (string, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// normalize returns value as it would be shown by f.Value.String() once set, so that values
+// written differently (such as "1h" and "60m") compare equal. If value is not valid for f, it
+// is returned unchanged.
+func normalize(f *flag.Flag, value string) string {
+	var kind interface{}
+	switch v := f.Value.(type) {
+	case *Duration:
+		kind = time.Duration(0)
+	case *Bool:
+		kind = false
+	case flag.Getter:
+		kind = v.Get()
+	}
+	switch kind.(type) {
+	case time.Duration:
+		if d, err := time.ParseDuration(value); err == nil {
+			return d.String()
+		}
+	case bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case int:
+		if i, err := strconv.Atoi(value); err == nil {
+			return strconv.Itoa(i)
+		}
+	}
+	return value
+}
+
+func sortedNames(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
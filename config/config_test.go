@@ -0,0 +1,104 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFlags() (flags *flag.FlagSet, timeout *Duration, verbose *Bool, listen, secret *string) {
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	timeout = &Duration{}
+	timeout.value.Store(int64(time.Minute))
+	flags.Var(timeout, "notify-timeout", "")
+	verbose = &Bool{}
+	flags.Var(verbose, "log-events", "")
+	reloadableLock.Lock()
+	reloadable["notify-timeout"] = true
+	reloadable["log-events"] = true
+	reloadableLock.Unlock()
+	listen = flags.String("http-listen", ":80", "")
+	secret = flags.String("client-secret", "", "")
+	return flags, timeout, verbose, listen, secret
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("hunter2\n"), 0o600))
+	configFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+notify-timeout: 5m
+log-events: true
+http-listen: ":8080"
+client-secret-file: `+secretFile+`
+`), 0o644))
+
+	flags, timeout, verbose, listen, secret := newTestFlags()
+	require.NoError(t, flags.Parse([]string{"-http-listen", ":9090"}))
+	loader := NewLoader(flags, configFile)
+	env := map[string]string{"CHIHUAHUA_NOTIFY_TIMEOUT": "7m"}
+	loader.lookupFn = func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	require.NoError(t, loader.Load())
+
+	assert.Equal(t, 7*time.Minute, timeout.Get()) // environment beats the file
+	assert.True(t, verbose.Get())
+	assert.Equal(t, ":9090", *listen) // command line beats both
+	assert.Equal(t, "hunter2", *secret)
+
+	// secrets can come from files named in the environment too
+	require.NoError(t, os.WriteFile(secretFile, []byte("correct horse"), 0o600))
+	env["CHIHUAHUA_CLIENT_SECRET_FILE"] = secretFile
+	require.NoError(t, os.WriteFile(configFile, nil, 0o644))
+	require.NoError(t, loader.Load())
+	assert.Equal(t, "correct horse", *secret)
+
+	// unknown settings are an error, not silently ignored
+	require.NoError(t, os.WriteFile(configFile, []byte("notify-timeuot: 5m\n"), 0o644))
+	require.Error(t, loader.Load())
+}
+
+func TestReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("notify-timeout: 5m\nclient-secret: a\n"), 0o644))
+
+	flags, timeout, verbose, _, secret := newTestFlags()
+	require.NoError(t, flags.Parse(nil))
+	loader := NewLoader(flags, configFile)
+	loader.lookupFn = func(string) (string, bool) { return "", false }
+	require.NoError(t, loader.Load())
+	assert.Equal(t, 5*time.Minute, timeout.Get())
+
+	// nothing changed; the same duration written differently is not a change
+	require.NoError(t, os.WriteFile(configFile, []byte("notify-timeout: 300s\nclient-secret: a\n"), 0o644))
+	changed, needRestart, err := loader.Reload()
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Empty(t, needRestart)
+
+	// reloadable settings change; others wait for a restart
+	require.NoError(t, os.WriteFile(configFile, []byte("notify-timeout: 10m\nlog-events: true\nclient-secret: b\n"), 0o644))
+	changed, needRestart, err = loader.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log-events", "notify-timeout"}, changed)
+	assert.Equal(t, []string{"client-secret"}, needRestart)
+	assert.Equal(t, 10*time.Minute, timeout.Get())
+	assert.True(t, verbose.Get())
+	assert.Equal(t, "a", *secret)
+
+	// settings removed from the file go back to their defaults
+	require.NoError(t, os.WriteFile(configFile, []byte("client-secret: a\n"), 0o644))
+	changed, _, err = loader.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log-events", "notify-timeout"}, changed)
+	assert.Equal(t, time.Minute, timeout.Get())
+	assert.False(t, verbose.Get())
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	reloadableLock sync.Mutex
+	// reloadable holds the names of the flags which may be changed while the server is
+	// running.
+	reloadable = make(map[string]bool)
+)
+
+// ReloadableVar defines a flag on the command line which may be changed by Reload while the
+// server is running. value must be safe to Set while other goroutines are using it.
+func ReloadableVar(value flag.Value, name, usage string) {
+	flag.Var(value, name, usage+" (reloadable)")
+	reloadableLock.Lock()
+	reloadable[name] = true
+	reloadableLock.Unlock()
+}
+
+// IsReloadable reports whether the named flag may be changed while the server is running.
+func IsReloadable(name string) bool {
+	reloadableLock.Lock()
+	defer reloadableLock.Unlock()
+	return reloadable[name]
+}
+
+// Duration is a time.Duration setting which is safe to change while it is in use.
+type Duration struct {
+	value atomic.Int64
+}
+
+// DurationFlag defines a reloadable time.Duration flag with the given name, default value and
+// usage string.
+func DurationFlag(name string, value time.Duration, usage string) *Duration {
+	d := &Duration{}
+	d.value.Store(int64(value))
+	ReloadableVar(d, name, usage)
+	return d
+}
+
+// Get returns the current value.
+func (d *Duration) Get() time.Duration {
+	return time.Duration(d.value.Load())
+}
+
+// Set implements flag.Value.
+func (d *Duration) Set(s string) error {
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.value.Store(int64(value))
+	return nil
+}
+
+// String implements flag.Value.
+func (d *Duration) String() string {
+	return d.Get().String()
+}
+
+// Bool is a bool setting which is safe to change while it is in use.
+type Bool struct {
+	value atomic.Bool
+}
+
+// BoolFlag defines a reloadable bool flag with the given name, default value and usage
+// string.
+func BoolFlag(name string, value bool, usage string) *Bool {
+	b := &Bool{}
+	b.value.Store(value)
+	ReloadableVar(b, name, usage)
+	return b
+}
+
+// Get returns the current value.
+func (b *Bool) Get() bool {
+	return b.value.Load()
+}
+
+// Set implements flag.Value.
+func (b *Bool) Set(s string) error {
+	value, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value.Store(value)
+	return nil
+}
+
+// String implements flag.Value.
+func (b *Bool) String() string {
+	return strconv.FormatBool(b.Get())
+}
+
+// IsBoolFlag lets the flag be given on the command line without a value.
+func (b *Bool) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/app"
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/gerrit/gerrittest"
+	"github.com/storj/changesetchihuahua/metrics"
+	"github.com/storj/changesetchihuahua/slack"
+	"github.com/storj/changesetchihuahua/slack/slacktest"
+)
+
+const e2eTimeout = 10 * time.Second
+
+// e2eHarness runs a whole Governor behind the web UI handler, talking to fake Gerrit and
+// Slack servers.
+type e2eHarness struct {
+	t        *testing.T
+	gerrit   *gerrittest.Server
+	slack    *slacktest.Server
+	web      *httptest.Server
+	governor *Governor
+}
+
+func newE2EHarness(t *testing.T) *e2eHarness {
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := zaptest.NewLogger(t)
+	h := &e2eHarness{
+		t:      t,
+		gerrit: gerrittest.NewServer(),
+		slack:  slacktest.NewServer(),
+	}
+	t.Cleanup(h.gerrit.Close)
+	t.Cleanup(h.slack.Close)
+
+	dbSource := "sqlite:" + filepath.Join(t.TempDir(), "persistent.db")
+	setFlag(t, persistentDBSource, dbSource)
+	setFlag(t, slack.APIURL, h.slack.URL)
+	setFlag(t, slack.SigningSecret, "signing-secret")
+	setFlag(t, operatorToken, "operator-token")
+	// handle events one at a time, in order, so that tests can send events which depend on
+	// earlier ones having been handled
+	setFlag(t, eventWorkers, 1)
+
+	sealer, err := app.NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	teamDB, err := app.NewGovernorDB(logger, dbSource, sealer)
+	require.NoError(t, err)
+	h.governor, err = NewGovernor(ctx, logger, teamDB)
+	require.NoError(t, err)
+
+	webURL, err := url.Parse("https://chihuahua.example.com/")
+	require.NoError(t, err)
+	state := newUIWebState(logger, h.governor, webURL, newEventCapture(logger, ""))
+	h.web = httptest.NewServer(newUIWebHandler(logger, state, true))
+
+	t.Cleanup(func() {
+		h.web.Close()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), e2eTimeout)
+		defer shutdownCancel()
+		assert.NoError(t, h.governor.Shutdown(shutdownCtx))
+		cancel()
+		assert.NoError(t, teamDB.Close())
+	})
+	return h
+}
+
+// setFlag changes the value of a flag for the length of the test.
+func setFlag[T any](t *testing.T, flagValue *T, value T) {
+	oldValue := *flagValue
+	*flagValue = value
+	t.Cleanup(func() { *flagValue = oldValue })
+}
+
+// do sends a request to the web UI and returns the response status and body.
+func (h *e2eHarness) do(method, path string, header http.Header, body []byte) (int, string) {
+	req, err := http.NewRequest(method, h.web.URL+path, bytes.NewReader(body))
+	require.NoError(h.t, err)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(h.t, err)
+	defer func() { _ = resp.Body.Close() }()
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(h.t, err)
+	return resp.StatusCode, string(respBody)
+}
+
+// slackEvent sends a signed Events API request to the web UI.
+func (h *e2eHarness) slackEvent(body []byte) (int, string) {
+	return h.do(http.MethodPost, "/slack/events", slacktest.SignatureHeaders(*slack.SigningSecret, body, time.Now()), body)
+}
+
+// gerritEvent sends a Gerrit event to the web UI, as the webhooks plugin would.
+func (h *e2eHarness) gerritEvent(body []byte, err error) {
+	require.NoError(h.t, err)
+	status, _ := h.do(http.MethodPost, "/gerrit/"+h.slack.TeamID(), nil, body)
+	require.Equal(h.t, http.StatusOK, status)
+}
+
+// command sends a DM from the given user to the bot and waits for the reply.
+func (h *e2eHarness) command(userID, text string) string {
+	before := h.sentMessages()
+	status, _ := h.slackEvent(slacktest.MessageEvent(h.slack.TeamID(), userID, slacktest.DMChannel(userID), text))
+	require.Equal(h.t, http.StatusOK, status)
+	reply, ok := h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel(userID) }, before)
+	require.True(h.t, ok, "no reply to %q", text)
+	return reply.Text
+}
+
+// sentMessages returns the set of messages sent so far, to be passed to waitForMessage.
+func (h *e2eHarness) sentMessages() map[slacktest.Message]bool {
+	sent := make(map[slacktest.Message]bool)
+	for _, message := range h.slack.Messages() {
+		sent[message] = true
+	}
+	return sent
+}
+
+// waitForMessage waits for a message matching the given function, other than those which had
+// already been sent.
+func (h *e2eHarness) waitForMessage(match func(slacktest.Message) bool, alreadySent map[slacktest.Message]bool) (slacktest.Message, bool) {
+	return h.slack.WaitForMessage(e2eTimeout, func(m slacktest.Message) bool {
+		return !alreadySent[m] && match(m)
+	})
+}
+
+func (h *e2eHarness) teamStatuses() []TeamStatus {
+	status, body := h.do(http.MethodGet, "/status", http.Header{"Authorization": {"Bearer operator-token"}}, nil)
+	require.Equal(h.t, http.StatusOK, status)
+	var statusResp struct {
+		Teams []TeamStatus `json:"teams"`
+	}
+	require.NoError(h.t, json.Unmarshal([]byte(body), &statusResp))
+	return statusResp.Teams
+}
+
+func TestEndToEnd(t *testing.T) {
+	h := newE2EHarness(t)
+	h.slack.AddUser(slacktest.User{ID: "U1", Name: "admin", RealName: "Ada Admin", Email: "ada@example.com"})
+	h.slack.AddUser(slacktest.User{ID: "U2", Name: "owner", RealName: "Oscar Owner", Email: "oscar@example.com"})
+	h.slack.AddUser(slacktest.User{ID: "U3", Name: "reviewer", RealName: "Rita Reviewer", Email: "rita@example.com"})
+	h.slack.AddChannel("C1", "reviews")
+	ada := h.gerrit.AddAccount(gerrit.AccountInfo{Username: "ada", Name: "Ada Admin", Email: "ada@example.com"})
+	oscar := h.gerrit.AddAccount(gerrit.AccountInfo{Username: "oscar", Name: "Oscar Owner", Email: "oscar@example.com"})
+	rita := h.gerrit.AddAccount(gerrit.AccountInfo{Username: "rita", Name: "Rita Reviewer", Email: "rita@example.com"})
+	jenkins := h.gerrit.AddAccount(gerrit.AccountInfo{Username: "jenkins", Name: "Jenkins"})
+
+	status, body := h.do(http.MethodGet, "/healthz", nil, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok\n", body)
+	status, _ = h.do(http.MethodGet, "/status", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// Slack checks the events URL before the app is installed anywhere
+	status, body = h.slackEvent(slacktest.URLVerificationEvent("challenge-1"))
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "challenge-1", body)
+	// and wrongly signed events are refused
+	challenge := slacktest.URLVerificationEvent("challenge-2")
+	status, _ = h.do(http.MethodPost, "/slack/events", slacktest.SignatureHeaders("wrong-secret", challenge, time.Now()), challenge)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// install the app through the OAuth flow
+	h.slack.AddOAuthCode("code-1", "U1")
+	status, body = h.do(http.MethodGet, "/slack/oauth?code=bad-code", nil, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Failed to acquire OAuth token")
+	status, body = h.do(http.MethodGet, "/slack/oauth?code=code-1", nil, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Success!")
+	require.Eventually(t, func() bool {
+		statuses := h.teamStatuses()
+		return len(statuses) == 1 && statuses[0].Running
+	}, e2eTimeout, 10*time.Millisecond)
+	status, _ = h.do(http.MethodGet, "/readyz", nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	// the installing user is the team admin, and can configure the team by DM
+	assert.Equal(t, "I don't understand that command.", h.command("U1", "!woof"))
+	assert.Equal(t, "Ok", h.command("U1", "!config gerrit-address <"+h.gerrit.URL+">"))
+	assert.Equal(t, "Ok", h.command("U1", "!config global-notify-channel <#C1|reviews>"))
+	assert.Equal(t, "Ok", h.command("U1", "!config jenkins-robot-user jenkins"))
+	assert.Contains(t, h.command("U1", "!config jenkins-robot-user"), `"jenkins"`)
+
+	// a new change with a reviewer is announced to the reviewer and the channel
+	change := h.gerrit.AddChange(gerrit.ChangeInfo{
+		Project: "storj/chihuahua",
+		Subject: "make the dog bark louder",
+		Owner:   oscar,
+		Reviewers: map[string][]gerrit.AccountInfo{
+			"REVIEWER": {rita},
+			"CC":       {ada},
+		},
+	})
+	patchSet, err := h.gerrit.AddPatchSet(change.Number, "REWORK", oscar)
+	require.NoError(t, err)
+	before := h.sentMessages()
+	h.gerritEvent(h.gerrit.PatchSetCreatedEvent(change.Number, patchSet))
+	toReviewer, ok := h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel("U3") }, before)
+	require.True(t, ok)
+	assert.Contains(t, toReviewer.Text, "with you as a reviewer")
+	assert.Contains(t, toReviewer.Text, h.gerrit.ChangeURL(change.Project, change.Number))
+	toCC, ok := h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel("U1") }, before)
+	require.True(t, ok)
+	assert.Contains(t, toCC.Text, "with you CC'd")
+	toChannel, ok := h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == "C1" }, before)
+	require.True(t, ok)
+	assert.Contains(t, toChannel.Text, "Oscar Owner pushed a new changeset")
+
+	// build results from the robot user are shown on the announcements, and the owner is told
+	before = h.sentMessages()
+	h.gerritEvent(h.gerrit.CommentAddedEvent(change.Number, patchSet, jenkins, "Build Successful \n\nhttps://ci.example.com/job/1/ : SUCCESS"))
+	toOwner, ok := h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel("U2") }, before)
+	require.True(t, ok)
+	assert.Contains(t, toOwner.Text, "succeeded")
+	for _, announcement := range []slacktest.Message{toReviewer, toCC, toChannel} {
+		assert.True(t, h.slack.WaitForReaction(e2eTimeout, announcement.Channel, announcement.Timestamp, "white_check_mark"))
+	}
+
+	// comments from people are passed on to the change owner
+	before = h.sentMessages()
+	h.gerritEvent(h.gerrit.CommentAddedEvent(change.Number, patchSet, rita, "Code-Review+2\n\nlooks good to me"))
+	toOwner, ok = h.waitForMessage(func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel("U2") }, before)
+	require.True(t, ok)
+	assert.Contains(t, toOwner.Text, "looks good to me")
+
+	// events for unknown teams and undecodable events are dealt with
+	status, _ = h.do(http.MethodPost, "/gerrit/TNOPE", nil, []byte(`{"type":"dropped-output"}`))
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = h.do(http.MethodPost, "/gerrit/"+h.slack.TeamID(), nil, []byte(`{"type":`))
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	// and those for unknown teams are counted without adding a label for each team named
+	unknownFailures := testutil.ToFloat64(metrics.EventDecodeFailures.WithLabelValues(metrics.UnknownTeam))
+	status, _ = h.do(http.MethodPost, "/gerrit/TNOPE", nil, []byte(`{"type":`))
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, unknownFailures+1, testutil.ToFloat64(metrics.EventDecodeFailures.WithLabelValues(metrics.UnknownTeam)))
+	assert.False(t, metrics.EventDecodeFailures.DeleteLabelValues("TNOPE"))
+
+	// operators can pause and resume the team
+	status, _ = h.do(http.MethodPost, "/operator/teams/"+h.slack.TeamID()+"/pause", http.Header{"Authorization": {"Bearer operator-token"}}, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.False(t, h.teamStatuses()[0].Running)
+	status, _ = h.do(http.MethodPost, "/operator/teams/"+h.slack.TeamID()+"/resume", http.Header{"Authorization": {"Bearer operator-token"}}, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Eventually(t, func() bool { return h.teamStatuses()[0].Running }, e2eTimeout, 10*time.Millisecond)
+
+	// uninstalling the app removes the team
+	status, _ = h.slackEvent(slacktest.AppUninstalledEvent(h.slack.TeamID()))
+	require.Equal(t, http.StatusOK, status)
+	require.Eventually(t, func() bool { return len(h.teamStatuses()) == 0 }, e2eTimeout, 10*time.Millisecond)
+	require.False(t, strings.Contains(strings.Join(h.gerrit.Requests(), "\n"), "POST "), "no changes should have been made in Gerrit")
+}
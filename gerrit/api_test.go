@@ -0,0 +1,168 @@
+package gerrit_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/gerrit/gerrittest"
+)
+
+func TestClientQueries(t *testing.T) {
+	ctx := context.Background()
+	server := gerrittest.NewServer()
+	defer server.Close()
+
+	jane := server.AddAccount(gerrit.AccountInfo{Name: "Jane Doe", Username: "jane", Email: "jane@example.com"})
+	joe := server.AddAccount(gerrit.AccountInfo{Name: "Joe Bloggs", Username: "joe", Email: "joe@example.com"})
+	for i := 0; i < 3; i++ {
+		server.AddChange(gerrit.ChangeInfo{Project: "storj/storj", Subject: "change", Owner: jane})
+	}
+	merged := server.AddChange(gerrit.ChangeInfo{Project: "storj/uplink", Subject: "merged change", Owner: joe, Status: "MERGED"})
+
+	client, err := gerrit.OpenClient(ctx, zaptest.NewLogger(t), server.URL)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, client.Close()) }()
+	assert.Equal(t, gerrittest.DefaultVersion, client.ServerVersion())
+
+	changes, more, err := client.QueryChangesEx(ctx, []string{"is:open owner:jane"}, &gerrit.QueryChangesOpts{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.True(t, more)
+	changes, more, err = client.QueryChangesEx(ctx, []string{"is:open owner:jane"}, &gerrit.QueryChangesOpts{Limit: 2, StartAt: 2})
+	require.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.False(t, more)
+
+	changes, _, err = client.QueryChangesEx(ctx, []string{"-is:open"}, &gerrit.QueryChangesOpts{})
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, merged.Number, changes[0].Number)
+	assert.Equal(t, "joe", changes[0].Owner.Username)
+
+	_, _, err = client.QueryChangesEx(ctx, []string{"label:Code-Review=+2"}, &gerrit.QueryChangesOpts{})
+	require.Error(t, err)
+	server.SetQueryResults("label:Code-Review=+2", merged.Number)
+	changes, _, err = client.QueryChangesEx(ctx, []string{"label:Code-Review=+2"}, &gerrit.QueryChangesOpts{})
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	accounts, _, err := client.QueryAccountsEx(ctx, "username:joe", &gerrit.QueryAccountsOpts{DescribeDetails: true})
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, joe, accounts[0])
+
+	assert.Equal(t, server.URL+"c/storj%2Fuplink/+/4", client.URLForChange(&merged))
+}
+
+func TestClientChangeDetails(t *testing.T) {
+	ctx := context.Background()
+	server := gerrittest.NewServer()
+	defer server.Close()
+
+	jane := server.AddAccount(gerrit.AccountInfo{Name: "Jane Doe", Username: "jane"})
+	joe := server.AddAccount(gerrit.AccountInfo{Name: "Joe Bloggs", Username: "joe"})
+	change := server.AddChange(gerrit.ChangeInfo{
+		Project:   "storj/storj",
+		Subject:   "fix everything",
+		Owner:     jane,
+		Reviewers: map[string][]gerrit.AccountInfo{"REVIEWER": {joe}},
+	})
+	_, err := server.AddPatchSet(change.Number, "REWORK", jane)
+	require.NoError(t, err)
+	_, err = server.AddPatchSet(change.Number, "TRIVIAL_REBASE", jane)
+	require.NoError(t, err)
+	server.AddComments(change.Number, 2, "main.go", gerrit.CommentInfo{Author: joe, Line: 5, Message: "nit"})
+	server.SetFiles(change.Number, 2, map[string]gerrit.FileInfo{"main.go": {LinesInserted: 3}})
+
+	client, err := gerrit.OpenClient(ctx, zaptest.NewLogger(t), server.URL)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, client.Close()) }()
+	changeID := change.Project + "~2"
+
+	got, err := client.GetChangeEx(ctx, "storj/storj~1", &gerrit.QueryChangesOpts{DescribeCurrentRevision: true})
+	require.NoError(t, err)
+	assert.Equal(t, "fix everything", got.Subject)
+	require.Len(t, got.Revisions, 1)
+	assert.Equal(t, gerrit.PatchSetNumber(2), got.Revisions[got.CurrentRevision].Number)
+
+	patchSetInfo, err := client.GetPatchSetInfo(ctx, change.ChangeID, "1")
+	require.NoError(t, err)
+	require.Len(t, patchSetInfo.Revisions, 1)
+	for _, revision := range patchSetInfo.Revisions {
+		assert.Equal(t, "REWORK", revision.Kind)
+	}
+	assert.Len(t, patchSetInfo.Reviewers["REVIEWER"], 1)
+
+	reviewers, err := client.GetChangeReviewers(ctx, change.ID)
+	require.NoError(t, err)
+	require.Len(t, reviewers, 1)
+	assert.Equal(t, "joe", reviewers[0].Username)
+
+	comments, err := client.ListRevisionComments(ctx, change.ChangeID, "current")
+	require.NoError(t, err)
+	require.Len(t, comments["main.go"], 1)
+	assert.Equal(t, "nit", comments["main.go"][0].Message)
+	assert.Equal(t, 2, comments["main.go"][0].PatchSet)
+
+	files, err := client.ListRevisionFiles(ctx, change.ChangeID, "2")
+	require.NoError(t, err)
+	assert.Equal(t, 3, files["main.go"].LinesInserted)
+
+	_, err = client.GetChangeEx(ctx, changeID, nil)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "404"), err.Error())
+}
+
+func TestClientAddReviewer(t *testing.T) {
+	ctx := context.Background()
+	server := gerrittest.NewServer()
+	defer server.Close()
+	server.SetCredentials("chihuahua", "secret")
+
+	jane := server.AddAccount(gerrit.AccountInfo{Username: "jane"})
+	server.AddAccount(gerrit.AccountInfo{Username: "joe"})
+	server.AddAccount(gerrit.AccountInfo{Username: "chihuahua"})
+	change := server.AddChange(gerrit.ChangeInfo{Project: "storj/storj", Owner: jane})
+
+	// without credentials, changes can't be made
+	anonClient, err := gerrit.OpenClient(ctx, zaptest.NewLogger(t), server.URL)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, anonClient.Close()) }()
+	require.Error(t, anonClient.AddReviewer(ctx, change.ID, "joe"))
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	serverURL.User = url.UserPassword("chihuahua", "wrong")
+	_, err = gerrit.OpenClient(ctx, zaptest.NewLogger(t), serverURL.String())
+	require.Error(t, err)
+
+	serverURL.User = url.UserPassword("chihuahua", "secret")
+	client, err := gerrit.OpenClient(ctx, zaptest.NewLogger(t), serverURL.String())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, client.Close()) }()
+	require.NoError(t, client.AddReviewer(ctx, change.ChangeID, "joe"))
+	require.Error(t, client.AddReviewer(ctx, change.ID, "nobody"))
+
+	updated, ok := server.Change(change.Number)
+	require.True(t, ok)
+	require.Len(t, updated.Reviewers["REVIEWER"], 1)
+	assert.Equal(t, "joe", updated.Reviewers["REVIEWER"][0].Username)
+	require.Len(t, updated.ReviewerUpdates, 1)
+	assert.Equal(t, "chihuahua", updated.ReviewerUpdates[0].UpdatedBy.Username)
+	assert.Contains(t, server.Requests(), "POST /a/changes/"+change.ChangeID+"/reviewers")
+
+	server.SetFailure(http.StatusServiceUnavailable)
+	_, err = client.GetChangeReviewers(ctx, change.ID)
+	require.Error(t, err)
+	server.SetFailure(0)
+	_, err = client.GetChangeReviewers(ctx, change.ID)
+	require.NoError(t, err)
+}
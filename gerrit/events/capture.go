@@ -0,0 +1,77 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// CapturedEvent is one line of an event capture: a Gerrit event payload exactly as it was
+// received, and when.
+type CapturedEvent struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// Decode decodes the captured event payload.
+func (c *CapturedEvent) Decode() (GerritEvent, error) {
+	return DecodeGerritEvent(c.Event)
+}
+
+// CaptureWriter writes Gerrit events to an event capture, in JSON lines format. It is safe for
+// concurrent use.
+type CaptureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewCaptureWriter creates a CaptureWriter which writes to w.
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{w: w}
+}
+
+// Write adds an event payload received at the given time to the capture.
+func (cw *CaptureWriter) Write(payload []byte, receivedAt time.Time) error {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, payload); err != nil {
+		return EventDecodingError.Wrap(err)
+	}
+	line, err := json.Marshal(CapturedEvent{ReceivedAt: receivedAt.UTC(), Event: compacted.Bytes()})
+	if err != nil {
+		return err
+	}
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	_, err = cw.w.Write(append(line, '\n'))
+	return err
+}
+
+// ReadCapture reads an event capture, calling fn for each event in turn. Lines holding a bare
+// Gerrit event payload, as logged by -log-gerrit-events, are accepted too; they have no
+// ReceivedAt time.
+func ReadCapture(r io.Reader, fn func(captured CapturedEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxEventPayloadSize+1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var captured CapturedEvent
+		if err := json.Unmarshal(line, &captured); err != nil {
+			return errs.New("line %d: %w", lineNum, err)
+		}
+		if captured.Event == nil {
+			captured.Event = append(json.RawMessage(nil), line...)
+		}
+		if err := fn(captured); err != nil {
+			return errs.New("line %d: %w", lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
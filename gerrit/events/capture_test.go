@@ -0,0 +1,46 @@
+package events
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	receivedAt := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var capture bytes.Buffer
+	writer := NewCaptureWriter(&capture)
+	// payloads may span lines as received, but are captured on one line each
+	require.NoError(t, writer.Write([]byte(strings.Replace(testJSON1, ",", ",\n", -1)), receivedAt))
+	require.NoError(t, writer.Write([]byte(testJSON2), receivedAt.Add(time.Second)))
+	require.Error(t, writer.Write([]byte("not json"), receivedAt))
+	require.Equal(t, 2, strings.Count(capture.String(), "\n"))
+
+	// a bare payload is accepted as well
+	capture.WriteString("\n" + testJSON1 + "\n")
+
+	var got []CapturedEvent
+	require.NoError(t, ReadCapture(&capture, func(captured CapturedEvent) error {
+		got = append(got, captured)
+		return nil
+	}))
+	require.Len(t, got, 3)
+	require.True(t, receivedAt.Equal(got[0].ReceivedAt))
+	require.True(t, receivedAt.Add(time.Second).Equal(got[1].ReceivedAt))
+	require.True(t, got[2].ReceivedAt.IsZero())
+
+	ev, err := got[0].Decode()
+	require.NoError(t, err)
+	require.IsType(t, &RefUpdatedEvent{}, ev)
+	ev, err = got[1].Decode()
+	require.NoError(t, err)
+	require.IsType(t, &CommentAddedEvent{}, ev)
+	ev, err = got[2].Decode()
+	require.NoError(t, err)
+	require.IsType(t, &RefUpdatedEvent{}, ev)
+
+	require.Error(t, ReadCapture(strings.NewReader("{\n"), func(CapturedEvent) error { return nil }))
+}
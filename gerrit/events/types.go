@@ -23,6 +23,8 @@ type Change struct {
 	Branch string
 	// Topic is the name specified by the uploader for this change series.
 	Topic string
+	// Hashtags is the list of hashtags set on this change.
+	Hashtags []string
 	// ID gives the Gerrit Change-ID.
 	ID string
 	// Number is the (deprecated) change number.
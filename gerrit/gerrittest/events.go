@@ -0,0 +1,109 @@
+package gerrittest
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/errs"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+// PatchSetCreatedEvent returns the JSON body of the patchset-created event Gerrit would send
+// for the given patchset of a change, as the change currently stands.
+func (s *Server) PatchSetCreatedEvent(changeNumber, patchSet int) ([]byte, error) {
+	change, ps, err := s.eventChange(changeNumber, patchSet)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&events.PatchSetCreatedEvent{
+		Base:     eventBase("patchset-created"),
+		Change:   change,
+		PatchSet: ps,
+		Uploader: ps.Uploader,
+	})
+}
+
+// CommentAddedEvent returns the JSON body of the comment-added event Gerrit would send when
+// the given account comments on a patchset of a change. Gerrit puts a "Patch Set N:" line in
+// front of the comment text, so that is done here too.
+func (s *Server) CommentAddedEvent(changeNumber, patchSet int, author gerrit.AccountInfo, comment string) ([]byte, error) {
+	change, ps, err := s.eventChange(changeNumber, patchSet)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&events.CommentAddedEvent{
+		Base:     eventBase("comment-added"),
+		Change:   change,
+		PatchSet: ps,
+		Author:   eventAccount(author),
+		Comment:  "Patch Set " + strconv.Itoa(patchSet) + ":\n\n" + comment,
+	})
+}
+
+// ChangeURL returns the URL at which the Gerrit web UI would show the given change.
+func (s *Server) ChangeURL(project string, changeNumber int) string {
+	return s.URL + "c/" + project + "/+/" + strconv.Itoa(changeNumber)
+}
+
+func (s *Server) eventChange(changeNumber, patchSet int) (events.Change, events.PatchSet, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	change := s.changeByNumber(changeNumber)
+	if change == nil {
+		return events.Change{}, events.PatchSet{}, errs.New("no change %d", changeNumber)
+	}
+	var ps events.PatchSet
+	for revision, info := range change.Revisions {
+		if int(info.Number) == patchSet {
+			ps = events.PatchSet{
+				Number:    patchSet,
+				Revision:  revision,
+				Ref:       info.Ref,
+				Uploader:  eventAccount(info.Uploader),
+				Author:    eventAccount(info.Uploader),
+				CreatedOn: parseTime(info.Created).Unix(),
+				Kind:      info.Kind,
+			}
+		}
+	}
+	if ps.Number == 0 {
+		return events.Change{}, events.PatchSet{}, errs.New("no patchset %d on change %d", patchSet, changeNumber)
+	}
+	return events.Change{
+		Project:         change.Project,
+		Branch:          change.Branch,
+		Topic:           change.Topic,
+		Hashtags:        change.Hashtags,
+		ID:              change.ChangeID,
+		Number:          change.Number,
+		Subject:         change.Subject,
+		Owner:           eventAccount(change.Owner),
+		URL:             s.ChangeURL(change.Project, change.Number),
+		CreatedOn:       parseTime(change.Created).Unix(),
+		LastUpdated:     parseTime(change.Updated).Unix(),
+		Open:            change.Status == "NEW",
+		Status:          change.Status,
+		Private:         change.IsPrivate,
+		WIP:             change.WorkInProgress,
+		CurrentPatchSet: ps,
+	}, ps, nil
+}
+
+func eventBase(eventType string) events.Base {
+	return events.Base{Type: eventType, EventCreatedOn: time.Now().Unix()}
+}
+
+func eventAccount(account gerrit.AccountInfo) events.Account {
+	return events.Account{Name: account.Name, Email: account.Email, Username: account.Username}
+}
+
+func parseTime(timestamp string) time.Time {
+	t, err := time.Parse(gerrit.TimeLayout, timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,129 @@
+package gerrittest
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+)
+
+// queryTerm is one operator from a query, like "owner:jane" or "-is:wip".
+type queryTerm struct {
+	negated  bool
+	operator string
+	value    string
+}
+
+// queryTerms is a parsed query. All terms must match.
+type queryTerms []queryTerm
+
+// parseQuery splits a query into its terms. Only the simplest form of the Gerrit query
+// language is understood: operators separated by spaces, optionally negated with "-".
+func parseQuery(query string) (queryTerms, error) {
+	var terms queryTerms
+	for _, field := range strings.Fields(query) {
+		var term queryTerm
+		if strings.HasPrefix(field, "-") {
+			term.negated = true
+			field = field[1:]
+		}
+		operator, value, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, errs.New("gerrittest does not understand query term %q", field)
+		}
+		term.operator = operator
+		term.value = strings.Trim(value, `"{}`)
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// matchChange determines whether a change matches all terms. It is an error for a term to
+// use an operator the fake does not understand.
+func (terms queryTerms) matchChange(change *gerrit.ChangeInfo) (bool, error) {
+	for _, term := range terms {
+		matches, err := changeTermMatches(term, change)
+		if err != nil {
+			return false, err
+		}
+		if matches == term.negated {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func changeTermMatches(term queryTerm, change *gerrit.ChangeInfo) (bool, error) {
+	switch term.operator {
+	case "is", "status":
+		switch term.value {
+		case "open", "new", "pending":
+			return change.Status == "NEW", nil
+		case "closed":
+			return change.Status == "MERGED" || change.Status == "ABANDONED", nil
+		case "merged":
+			return change.Status == "MERGED", nil
+		case "abandoned":
+			return change.Status == "ABANDONED", nil
+		case "wip":
+			return change.WorkInProgress, nil
+		case "private":
+			return change.IsPrivate, nil
+		}
+		return false, errs.New("gerrittest does not understand query term %s:%s", term.operator, term.value)
+	case "owner":
+		return accountMatches(&change.Owner, term.value), nil
+	case "reviewer", "cc":
+		state := strings.ToUpper(term.operator)
+		for _, account := range change.Reviewers[state] {
+			if accountMatches(&account, term.value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "project":
+		return change.Project == term.value, nil
+	case "branch":
+		return change.Branch == term.value, nil
+	case "topic":
+		return change.Topic == term.value, nil
+	case "change":
+		return strconv.Itoa(change.Number) == term.value || change.ChangeID == term.value, nil
+	}
+	return false, errs.New("gerrittest does not understand query operator %q", term.operator)
+}
+
+// matchAccount determines whether an account matches all terms. It is an error for a term
+// to use an operator the fake does not understand.
+func (terms queryTerms) matchAccount(account *gerrit.AccountInfo) (bool, error) {
+	for _, term := range terms {
+		var matches bool
+		switch term.operator {
+		case "is":
+			if term.value != "active" {
+				return false, errs.New("gerrittest does not understand account query term is:%s", term.value)
+			}
+			matches = true
+		case "username":
+			matches = account.Username == term.value
+		case "email":
+			matches = account.Email == term.value
+		case "name":
+			matches = strings.Contains(strings.ToLower(account.Name), strings.ToLower(term.value))
+		default:
+			return false, errs.New("gerrittest does not understand account query operator %q", term.operator)
+		}
+		if matches == term.negated {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// accountMatches determines whether ident (a username, email, or account ID) identifies an
+// account.
+func accountMatches(account *gerrit.AccountInfo, ident string) bool {
+	return ident != "" && (account.Username == ident || account.Email == ident || strconv.Itoa(account.AccountID) == ident)
+}
@@ -0,0 +1,597 @@
+// Package gerrittest provides an in-process fake Gerrit server, for testing code which talks
+// to the Gerrit REST API. It serves the endpoints used by gerrit.Client from state which
+// tests set up (and inspect) through the Server methods.
+package gerrittest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+
+	"github.com/storj/changesetchihuahua/gerrit"
+)
+
+// DefaultVersion is the server version reported by a new Server.
+const DefaultVersion = "3.4.1"
+
+// gerritMagic is the prefix Gerrit puts on all JSON responses, to defeat XSSI.
+const gerritMagic = ")]}'\n"
+
+// Server is a fake Gerrit server. Its state can be changed at any time, including while
+// requests are being served.
+type Server struct {
+	// URL is the base URL of the server, suitable for passing to gerrit.OpenClient.
+	URL string
+
+	httpServer *httptest.Server
+
+	lock sync.Mutex
+	// version is what /config/server/version reports.
+	version string
+	// username and password, when set, are required for requests to the authenticated
+	// endpoints under "/a/".
+	username string
+	password string
+	accounts []gerrit.AccountInfo
+	changes  []gerrit.ChangeInfo
+	// comments and files are keyed by change number, then patchset number, then file path.
+	comments map[int]map[int]map[string][]gerrit.CommentInfo
+	files    map[int]map[int]map[string]gerrit.FileInfo
+	// queryResults holds canned results (as change numbers) for change queries which are too
+	// complicated for the fake to evaluate.
+	queryResults map[string][]int
+	// failStatus, when nonzero, is the status code returned for all API requests.
+	failStatus int
+	requests   []string
+}
+
+// NewServer starts a new fake Gerrit server with no accounts or changes. It should be closed
+// with Close when no longer needed.
+func NewServer() *Server {
+	s := &Server{
+		version:      DefaultVersion,
+		comments:     make(map[int]map[int]map[string][]gerrit.CommentInfo),
+		files:        make(map[int]map[int]map[string]gerrit.FileInfo),
+		queryResults: make(map[string][]int),
+	}
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL + "/"
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// SetVersion sets the version which the server reports.
+func (s *Server) SetVersion(version string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version = version
+}
+
+// SetCredentials sets the HTTP credentials which must be given for requests to the
+// authenticated endpoints. Until this is called, any credentials are accepted.
+func (s *Server) SetCredentials(username, password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.username = username
+	s.password = password
+}
+
+// SetFailure makes the server answer every API request with the given HTTP status code, as if
+// it were broken. A status code of 0 makes it work normally again.
+func (s *Server) SetFailure(statusCode int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failStatus = statusCode
+}
+
+// Requests returns the requests served so far, as "METHOD /path" strings.
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// AddAccount adds a user account. If the account has no AccountID, one is assigned.
+func (s *Server) AddAccount(account gerrit.AccountInfo) gerrit.AccountInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if account.AccountID == 0 {
+		account.AccountID = 1000000 + len(s.accounts)
+	}
+	s.accounts = append(s.accounts, account)
+	return account
+}
+
+// AddChange adds a change, replacing any existing change with the same number. Missing
+// identifiers, status, and timestamps are filled in, and the completed ChangeInfo is returned.
+func (s *Server) AddChange(change gerrit.ChangeInfo) gerrit.ChangeInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if change.Number == 0 {
+		change.Number = len(s.changes) + 1
+	}
+	if change.Branch == "" {
+		change.Branch = "master"
+	}
+	if change.ChangeID == "" {
+		change.ChangeID = "I" + fakeSHA1(change.Project, strconv.Itoa(change.Number))
+	}
+	if change.ID == "" {
+		change.ID = url.PathEscape(change.Project) + "~" + change.Branch + "~" + change.ChangeID
+	}
+	if change.Status == "" {
+		change.Status = "NEW"
+	}
+	now := time.Now().UTC().Format(gerrit.TimeLayout)
+	if change.Created == "" {
+		change.Created = now
+	}
+	if change.Updated == "" {
+		change.Updated = change.Created
+	}
+	for i := range s.changes {
+		if s.changes[i].Number == change.Number {
+			s.changes[i] = change
+			return change
+		}
+	}
+	s.changes = append(s.changes, change)
+	return change
+}
+
+// AddPatchSet adds a new patchset, of the given kind (such as "REWORK" or "TRIVIAL_REBASE"),
+// to an existing change and makes it current. It returns the new patchset number.
+func (s *Server) AddPatchSet(changeNumber int, kind string, uploader gerrit.AccountInfo) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	change := s.changeByNumber(changeNumber)
+	if change == nil {
+		return 0, errs.New("no change %d", changeNumber)
+	}
+	patchSetNumber := len(change.Revisions) + 1
+	revision := fakeSHA1(change.ChangeID, strconv.Itoa(patchSetNumber))
+	if change.Revisions == nil {
+		change.Revisions = make(map[string]gerrit.RevisionInfo)
+	}
+	change.Revisions[revision] = gerrit.RevisionInfo{
+		Kind:     kind,
+		Number:   gerrit.PatchSetNumber(patchSetNumber),
+		Created:  time.Now().UTC().Format(gerrit.TimeLayout),
+		Uploader: uploader,
+		Ref:      fmt.Sprintf("refs/changes/%02d/%d/%d", changeNumber%100, changeNumber, patchSetNumber),
+	}
+	change.CurrentRevision = revision
+	return patchSetNumber, nil
+}
+
+// Change returns the change with the given number, as it currently stands.
+func (s *Server) Change(number int) (gerrit.ChangeInfo, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	change := s.changeByNumber(number)
+	if change == nil {
+		return gerrit.ChangeInfo{}, false
+	}
+	return *change, true
+}
+
+// AddComments adds inline comments on a file in the given patchset of a change. Comments
+// without an ID are assigned one.
+func (s *Server) AddComments(changeNumber, patchSet int, path string, comments ...gerrit.CommentInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.comments[changeNumber] == nil {
+		s.comments[changeNumber] = make(map[int]map[string][]gerrit.CommentInfo)
+	}
+	if s.comments[changeNumber][patchSet] == nil {
+		s.comments[changeNumber][patchSet] = make(map[string][]gerrit.CommentInfo)
+	}
+	for _, comment := range comments {
+		if comment.ID == "" {
+			comment.ID = fakeSHA1(strconv.Itoa(changeNumber), strconv.Itoa(patchSet), path, strconv.Itoa(len(s.comments[changeNumber][patchSet][path])))[:16]
+		}
+		comment.PatchSet = patchSet
+		s.comments[changeNumber][patchSet][path] = append(s.comments[changeNumber][patchSet][path], comment)
+	}
+}
+
+// SetFiles sets the files modified in the given patchset of a change.
+func (s *Server) SetFiles(changeNumber, patchSet int, files map[string]gerrit.FileInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.files[changeNumber] == nil {
+		s.files[changeNumber] = make(map[int]map[string]gerrit.FileInfo)
+	}
+	s.files[changeNumber][patchSet] = files
+}
+
+// SetQueryResults makes change queries for exactly the given query string return the given
+// changes, in order. Queries without canned results are evaluated by the fake, which only
+// understands a few simple operators.
+func (s *Server) SetQueryResults(query string, changeNumbers ...int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queryResults[query] = changeNumbers
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.EscapedPath())
+
+	path := r.URL.EscapedPath()
+	// authUser is the user making the request, if it was made through the authenticated
+	// endpoints.
+	authUser := ""
+	if rest, ok := strings.CutPrefix(path, "/a/"); ok {
+		username, password, hasAuth := r.BasicAuth()
+		if !hasAuth || (s.username != "" && (username != s.username || password != s.password)) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path = "/" + rest
+		authUser = username
+	} else if r.Method != http.MethodGet {
+		// Gerrit only allows changes through the authenticated endpoints
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if s.failStatus != 0 {
+		http.Error(w, http.StatusText(s.failStatus), s.failStatus)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range parts {
+		if unescaped, err := url.PathUnescape(parts[i]); err == nil {
+			parts[i] = unescaped
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && path == "/config/server/version":
+		s.writeJSON(w, s.version)
+	case r.Method == http.MethodGet && path == "/changes/":
+		s.queryChanges(w, r)
+	case r.Method == http.MethodGet && path == "/accounts/":
+		s.queryAccounts(w, r)
+	case parts[0] == "changes" && len(parts) >= 2:
+		s.serveChange(w, r, authUser, parts[1], parts[2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveChange serves requests under /changes/<changeID>/.
+func (s *Server) serveChange(w http.ResponseWriter, r *http.Request, authUser, changeID string, rest []string) {
+	change := s.findChange(changeID)
+	if change == nil {
+		http.Error(w, "Not found: "+changeID, http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && len(rest) == 0:
+		s.writeJSON(w, s.describeChange(change, r.URL.Query()["o"]))
+	case r.Method == http.MethodGet && len(rest) == 1 && rest[0] == "reviewers":
+		s.writeJSON(w, reviewersOf(change))
+	case r.Method == http.MethodGet && len(rest) == 1 && rest[0] == "messages":
+		s.writeJSON(w, change.Messages)
+	case r.Method == http.MethodPost && len(rest) == 1 && rest[0] == "reviewers":
+		s.addReviewer(w, r, authUser, change)
+	case r.Method == http.MethodGet && len(rest) == 3 && rest[0] == "revisions":
+		revisionID, patchSet, ok := resolveRevision(change, rest[1])
+		if !ok {
+			http.Error(w, "Not found: "+rest[1], http.StatusNotFound)
+			return
+		}
+		switch rest[2] {
+		case "review":
+			described := *change
+			described.Revisions = map[string]gerrit.RevisionInfo{revisionID: change.Revisions[revisionID]}
+			described.CurrentRevision = revisionID
+			s.writeJSON(w, described)
+		case "comments":
+			comments := s.comments[change.Number][patchSet]
+			if comments == nil {
+				comments = map[string][]gerrit.CommentInfo{}
+			}
+			s.writeJSON(w, comments)
+		case "files":
+			files := s.files[change.Number][patchSet]
+			if files == nil {
+				files = map[string]gerrit.FileInfo{}
+			}
+			s.writeJSON(w, files)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// addReviewer adds the reviewer named in the request body to a change, recording the
+// authenticated user as the one who did it.
+func (s *Server) addReviewer(w http.ResponseWriter, r *http.Request, authUser string, change *gerrit.ChangeInfo) {
+	var input struct {
+		Reviewer string `json:"reviewer"`
+		State    string `json:"state"`
+	}
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &input)
+	}
+	if err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reviewer := s.findAccount(input.Reviewer)
+	if reviewer == nil {
+		s.writeJSON(w, map[string]string{
+			"input": input.Reviewer,
+			"error": input.Reviewer + " does not identify a registered user or group",
+		})
+		return
+	}
+	state := input.State
+	if state == "" {
+		state = "REVIEWER"
+	}
+	if change.Reviewers == nil {
+		change.Reviewers = make(map[string][]gerrit.AccountInfo)
+	}
+	for _, existing := range change.Reviewers[state] {
+		if existing.AccountID == reviewer.AccountID {
+			s.writeJSON(w, map[string]string{"input": input.Reviewer})
+			return
+		}
+	}
+	change.Reviewers[state] = append(change.Reviewers[state], *reviewer)
+	updatedBy := gerrit.AccountInfo{Username: authUser}
+	if account := s.findAccount(updatedBy.Username); account != nil {
+		updatedBy = *account
+	}
+	change.ReviewerUpdates = append(change.ReviewerUpdates, gerrit.ReviewerUpdateInfo{
+		Updated:   time.Now().UTC().Format(gerrit.TimeLayout),
+		UpdatedBy: updatedBy,
+		Reviewer:  reviewer,
+		State:     state,
+	})
+	s.writeJSON(w, map[string]interface{}{
+		"input":     input.Reviewer,
+		"reviewers": []gerrit.AccountInfo{*reviewer},
+	})
+}
+
+// queryChanges serves change queries. Only the first query given is answered.
+func (s *Server) queryChanges(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := values.Get("q")
+	var matches []*gerrit.ChangeInfo
+	if numbers, ok := s.queryResults[query]; ok {
+		for _, number := range numbers {
+			if change := s.changeByNumber(number); change != nil {
+				matches = append(matches, change)
+			}
+		}
+	} else {
+		terms, err := parseQuery(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i := range s.changes {
+			ok, err := terms.matchChange(&s.changes[i])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if ok {
+				matches = append(matches, &s.changes[i])
+			}
+		}
+		// like Gerrit, return the most recently updated changes first
+		sort.SliceStable(matches, func(i, j int) bool { return matches[i].Updated > matches[j].Updated })
+	}
+	page, more := paginate(len(matches), values)
+	results := make([]gerrit.ChangeInfo, 0, len(page))
+	for _, i := range page {
+		results = append(results, s.describeChange(matches[i], values["o"]))
+	}
+	if more {
+		results[len(results)-1].MoreChanges = true
+	}
+	s.writeJSON(w, results)
+}
+
+// queryAccounts serves account queries.
+func (s *Server) queryAccounts(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	terms, err := parseQuery(values.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var matches []gerrit.AccountInfo
+	for _, account := range s.accounts {
+		ok, err := terms.matchAccount(&account)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok {
+			matches = append(matches, account)
+		}
+	}
+	page, more := paginate(len(matches), values)
+	results := make([]gerrit.AccountInfo, 0, len(page))
+	for _, i := range page {
+		results = append(results, matches[i])
+	}
+	if more {
+		results[len(results)-1].MoreAccounts = true
+	}
+	s.writeJSON(w, results)
+}
+
+// describeChange returns a copy of a change, without the details which were not requested.
+func (s *Server) describeChange(change *gerrit.ChangeInfo, options []string) gerrit.ChangeInfo {
+	described := *change
+	has := func(option string) bool {
+		for _, o := range options {
+			if o == option {
+				return true
+			}
+		}
+		return false
+	}
+	if !has("ALL_REVISIONS") {
+		if has("CURRENT_REVISION") && change.CurrentRevision != "" {
+			described.Revisions = map[string]gerrit.RevisionInfo{change.CurrentRevision: change.Revisions[change.CurrentRevision]}
+		} else {
+			described.Revisions = nil
+		}
+	}
+	if !has("MESSAGES") {
+		described.Messages = nil
+	}
+	if !has("LABELS") && !has("DETAILED_LABELS") {
+		described.Labels = nil
+	}
+	if !has("DETAILED_LABELS") {
+		described.Reviewers = nil
+	}
+	if !has("REVIEWER_UPDATES") {
+		described.ReviewerUpdates = nil
+	}
+	return described
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(gerritMagic))
+	_, _ = w.Write(body)
+}
+
+func (s *Server) changeByNumber(number int) *gerrit.ChangeInfo {
+	for i := range s.changes {
+		if s.changes[i].Number == number {
+			return &s.changes[i]
+		}
+	}
+	return nil
+}
+
+// findChange looks up a change by any of the identifiers Gerrit accepts: the change number,
+// "project~number", the Change-Id, or "project~branch~Change-Id".
+func (s *Server) findChange(changeID string) *gerrit.ChangeInfo {
+	if number, err := strconv.Atoi(changeID); err == nil {
+		return s.changeByNumber(number)
+	}
+	for i := range s.changes {
+		change := &s.changes[i]
+		switch changeID {
+		case change.ID, change.ChangeID,
+			change.Project + "~" + strconv.Itoa(change.Number),
+			change.Project + "~" + change.Branch + "~" + change.ChangeID:
+			return change
+		}
+	}
+	return nil
+}
+
+// findAccount looks up an account by username, email, or account ID.
+func (s *Server) findAccount(ident string) *gerrit.AccountInfo {
+	for i := range s.accounts {
+		account := &s.accounts[i]
+		if ident != "" && (account.Username == ident || account.Email == ident || strconv.Itoa(account.AccountID) == ident) {
+			return account
+		}
+	}
+	return nil
+}
+
+// reviewersOf lists the reviewers and CCs of a change, with their current votes.
+func reviewersOf(change *gerrit.ChangeInfo) []gerrit.ReviewerInfo {
+	var reviewers []gerrit.ReviewerInfo
+	for _, state := range []string{"REVIEWER", "CC"} {
+		for _, account := range change.Reviewers[state] {
+			approvals := map[string]string{}
+			for labelName, label := range change.Labels {
+				for _, approval := range label.All {
+					if approval.AccountID == account.AccountID && approval.Value != nil {
+						approvals[labelName] = fmt.Sprintf("%+d", *approval.Value)
+					}
+				}
+			}
+			reviewers = append(reviewers, gerrit.ReviewerInfo{AccountInfo: account, Approvals: approvals})
+		}
+	}
+	if reviewers == nil {
+		reviewers = []gerrit.ReviewerInfo{}
+	}
+	return reviewers
+}
+
+// resolveRevision finds the revision of a change named by a revision ID, which may be
+// "current", a patchset number, or a commit SHA-1. It returns the commit SHA-1 and patchset
+// number.
+func resolveRevision(change *gerrit.ChangeInfo, revisionID string) (string, int, bool) {
+	if revisionID == "current" {
+		revisionID = change.CurrentRevision
+	}
+	if revision, ok := change.Revisions[revisionID]; ok {
+		return revisionID, int(revision.Number), true
+	}
+	if number, err := strconv.Atoi(revisionID); err == nil {
+		for sha, revision := range change.Revisions {
+			if int(revision.Number) == number {
+				return sha, number, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// paginate applies the "n" (limit) and "S" (start) query parameters to a list of n results,
+// returning the indexes to include and whether there are more results after those.
+func paginate(n int, values url.Values) (indexes []int, more bool) {
+	start, _ := strconv.Atoi(values.Get("S"))
+	limit, _ := strconv.Atoi(values.Get("n"))
+	end := n
+	if limit > 0 && start+limit < n {
+		end = start + limit
+		more = true
+	}
+	for i := start; i < end; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes, more
+}
+
+func fakeSHA1(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -3,27 +3,58 @@ package main
 import (
 	"bufio"
 	"context"
+	"database/sql"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/zeebo/errs"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/storj/changesetchihuahua/app"
+	"github.com/storj/changesetchihuahua/config"
 	"github.com/storj/changesetchihuahua/gerrit"
 	"github.com/storj/changesetchihuahua/gerrit/events"
+	"github.com/storj/changesetchihuahua/metrics"
 	"github.com/storj/changesetchihuahua/slack"
 )
 
-var notificationTimeout = flag.Duration("notify-timeout", time.Minute*30, "Maximum amount of time to spend trying to deliver a notification")
+var (
+	// errUnknownTeam is returned when an operation names a team which is not registered.
+	errUnknownTeam = errors.New("no such team")
+	// errTeamPaused is returned when an event can not be queued because an operator has
+	// paused its team.
+	errTeamPaused = errors.New("team is paused")
+	// errTeamUnavailable is returned when an event can not be queued because its team is
+	// starting up, or has failed and is waiting to be restarted.
+	errTeamUnavailable = errors.New("team is not available")
+	// errEventQueueFull is returned when an event can not be queued because its team's event
+	// queue is full.
+	errEventQueueFull = errors.New("event queue is full")
+)
+
+// teamKeyEnvVar is the environment variable which may hold the key for encrypting team
+// records, if -team-key-file is not given.
+const teamKeyEnvVar = "CHIHUAHUA_TEAM_KEY"
+
+var (
+	teamKeyFile           = flag.String("team-key-file", "", "File holding the base64-encoded 32-byte key used to encrypt team records (including chat tokens) and secret team config items in the persistent DB. If not given, the key is read from the "+teamKeyEnvVar+" environment variable.")
+	notificationTimeout   = config.DurationFlag("notify-timeout", time.Minute*30, "Maximum amount of time to spend trying to deliver a notification")
+	teamRestartMinBackoff = config.DurationFlag("team-restart-min-backoff", time.Second*10, "How long to wait before restarting a team which failed")
+	teamRestartMaxBackoff = config.DurationFlag("team-restart-max-backoff", time.Minute*30, "Longest time to wait before restarting a team which keeps failing")
+	eventWorkers          = flag.Int("event-workers", 4, "Number of Gerrit events to handle at once for each team")
+	eventQueueSize        = flag.Int("event-queue-size", 1000, "Number of Gerrit events which may wait to be handled for each team. When a team's queue is full, further events are refused with 503 Service Unavailable so that Gerrit retries them.")
+)
 
 // Governor controls the Changeset Chihuahua functionality at a top level. It knows about
 // all registered teams.
@@ -33,50 +64,157 @@ type Governor struct {
 
 	teamsLock sync.Mutex
 	teams     map[string]*Team
-
-	teamFileLock sync.Mutex
-	teamFile     string
+	// removals tracks teams being removed in the background after being uninstalled.
+	removals sync.WaitGroup
+
+	teamDB *app.GovernorDB
+	// leader decides whether this instance runs scheduled work, when several share the DB.
+	leader *leaderElector
+	// collector reports the teams' status as metrics, until the Governor is shut down.
+	collector prometheus.Collector
 }
 
 // Team is a Slack team that is registered with Changeset Chihuahua.
 type Team struct {
-	id        string
-	logger    *zap.Logger
-	canceler  context.CancelFunc
-	teamApp   *app.App
-	setupData string
-	runError  error
+	id     string
+	logger *zap.Logger
+	// teamDB is where updated setup data (such as a refreshed access token) is saved. It may
+	// be nil, in which case updates are only kept in memory.
+	teamDB *app.GovernorDB
+	// leader determines when this instance should run the team's scheduled work. If nil,
+	// scheduled work always runs.
+	leader *leaderElector
+
+	// statusLock protects everything below.
+	statusLock sync.Mutex
+	setupData  string
+	state      teamState
+	teamApp    *app.App
+	runError   error
+	restarts   int
+	// canceler stops the team's supervisor, which closes done on exit. Both are nil when the
+	// supervisor is not running.
+	canceler context.CancelFunc
+	done     chan struct{}
+
+	// eventQueue holds Gerrit events waiting for the team's event workers. It is nil when the
+	// team is not running.
+	eventQueue chan events.GerritEvent
+
+	// workers tracks goroutines handling events for the team's App. Work is only added while
+	// teamApp is set (under statusLock), and the App is not closed until it is all done.
+	workers sync.WaitGroup
 }
 
+// teamState describes what a Team's supervisor is doing.
+type teamState string
+
+const (
+	teamStarting = teamState("starting")
+	teamRunning  = teamState("running")
+	teamFailed   = teamState("failed")
+	teamPaused   = teamState("paused")
+	teamStopped  = teamState("stopped")
+)
+
 type vanillaGerritConnector struct{}
 
 func (v vanillaGerritConnector) OpenGerrit(ctx context.Context, logger *zap.Logger, address string) (gerrit.Client, error) {
 	return gerrit.OpenClient(ctx, logger, address)
 }
 
-// NewGovernor creates a new Governor.
-func NewGovernor(ctx context.Context, logger *zap.Logger, teamFile string) (*Governor, error) {
-	teamData, err := readTeamFile(teamFile)
+// NewGovernor creates a new Governor, and starts all teams registered in the governor DB.
+func NewGovernor(ctx context.Context, logger *zap.Logger, teamDB *app.GovernorDB) (*Governor, error) {
+	teams, err := teamDB.GetTeams(ctx)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-		teamData = make(map[string]string)
+		return nil, err
 	}
 	g := &Governor{
 		topContext: ctx,
 		logger:     logger,
 		teams:      make(map[string]*Team),
-		teamFile:   teamFile,
+		teamDB:     teamDB,
+		leader:     newLeaderElector(logger.Named("leader"), teamDB, *instanceID, *leaderLease),
+	}
+	g.leader.Start(ctx)
+	g.collector = governorCollector{governor: g}
+	metrics.MustRegister(g.collector)
+	logger.Info("changeset-chihuahua governor starting up", zap.String("version", Version), zap.Int("num-teams", len(teams)))
+
+	for _, team := range teams {
+		if err := g.StartTeam(team.TeamID, team.SetupData); err != nil {
+			logger.Error("failed to start team", zap.String("team-id", team.TeamID), zap.Error(err))
+		}
+	}
+	return g, nil
+}
+
+// openGovernorDB opens the governor DB, using the team record encryption key from
+// -team-key-file or the environment.
+func openGovernorDB(logger *zap.Logger) (*app.GovernorDB, error) {
+	key, err := loadTeamKey()
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := app.NewSealer(key)
+	if err != nil {
+		return nil, err
 	}
-	logger.Info("changeset-chihuahua governor starting up", zap.String("version", Version), zap.Int("num-teams", len(teamData)))
+	return app.NewGovernorDB(logger.Named("governor-db"), *persistentDBSource, sealer)
+}
 
+// loadTeamKey reads the key used to encrypt team records. It is expected to be 32 random
+// bytes, base64-encoded, in the file named by -team-key-file or else in the teamKeyEnvVar
+// environment variable.
+func loadTeamKey() ([]byte, error) {
+	encoded := os.Getenv(teamKeyEnvVar)
+	if *teamKeyFile != "" {
+		contents, err := os.ReadFile(*teamKeyFile)
+		if err != nil {
+			return nil, errs.New("could not read team key file: %v", err)
+		}
+		encoded = string(contents)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, errs.New("no key for encrypting team records: give -team-key-file or set %s (generate one with `head -c32 /dev/urandom | base64`)", teamKeyEnvVar)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errs.New("team key is not valid base64: %v", err)
+	}
+	return key, nil
+}
+
+// migrateTeamFile copies team definitions from a legacy team file into the governor DB, for
+// any teams not already there, and then renames the file so that this happens only once.
+func migrateTeamFile(ctx context.Context, logger *zap.Logger, teamDB *app.GovernorDB, fileName string) error {
+	teamData, err := readTeamFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
 	for teamID, setupData := range teamData {
-		if err := g.StartTeam(teamID, setupData); err != nil {
-			logger.Error("failed to start team", zap.String("team-id", teamID), zap.Error(err))
+		_, err := teamDB.GetTeam(ctx, teamID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := teamDB.PutTeam(ctx, teamID, setupData, time.Now()); err != nil {
+			return errs.New("could not migrate team %s: %v", teamID, err)
 		}
 	}
-	return g, nil
+	migratedName := fileName + ".migrated"
+	if err := os.Rename(fileName, migratedName); err != nil {
+		return err
+	}
+	logger.Warn("migrated teams from team file into the governor DB. the old file still holds plaintext tokens, and should be deleted",
+		zap.String("old-team-file", migratedName), zap.Int("num-teams", len(teamData)))
+	return nil
 }
 
 func readTeamFile(fileName string) (teamData map[string]string, err error) {
@@ -105,37 +243,45 @@ func readTeamFile(fileName string) (teamData map[string]string, err error) {
 	return teamData, nil
 }
 
-// NewTeam is called when a new Slack team is registered with Changeset Chihuahua. It adds the
-// team definition so that we will still have it after a restart, then creates a new Team
-// instance and calls Run on it.
+// NewTeam is called when a Slack team installs Changeset Chihuahua. It stores the team's
+// record so that we will still have it after a restart, then creates a new Team instance and
+// starts it. If the team was already registered (that is, it has reinstalled the app), its
+// record is updated and it is restarted with the new setup data.
 func (g *Governor) NewTeam(teamID string, setupData string) error {
-	g.teamsLock.Lock()
-	defer g.teamsLock.Unlock()
-
-	if _, ok := g.teams[teamID]; ok {
-		return errs.New("team %s is already active", teamID)
-	}
-	if strings.ContainsAny(teamID, " \n") {
+	if teamID == "" || strings.ContainsAny(teamID, " \n/") {
 		return errs.New("invalid team ID")
 	}
-	if strings.Contains(setupData, "\n") {
-		return errs.New("invalid setup data")
+	if err := g.teamDB.PutTeam(g.topContext, teamID, setupData, time.Now()); err != nil {
+		return errs.New("could not store team record: %v", err)
 	}
-	if err := g.appendTeamDefinition(teamID, setupData); err != nil {
-		return errs.New("could not add team definition: %v", err)
+
+	g.teamsLock.Lock()
+	team, ok := g.teams[teamID]
+	if !ok {
+		team = &Team{
+			id:        teamID,
+			setupData: setupData,
+			logger:    g.logger.Named(teamID),
+			teamDB:    g.teamDB,
+			leader:    g.leader,
+		}
+		g.teams[teamID] = team
 	}
-	team := &Team{
-		id:        teamID,
-		setupData: setupData,
-		logger:    g.logger.Named(teamID),
+	g.teamsLock.Unlock()
+
+	if ok {
+		g.logger.Info("team reinstalled; restarting", zap.String("team-id", teamID))
+		team.Stop(teamStarting)
+		team.statusLock.Lock()
+		team.setupData = setupData
+		team.statusLock.Unlock()
 	}
-	g.teams[teamID] = team
-	go team.Run(g.topContext)
+	team.Start(g.topContext)
 	return nil
 }
 
 // StartTeam is called at program start for already-registered teams. It creates the
-// appropriate Team instance and calls Run on it.
+// appropriate Team instance and starts it.
 func (g *Governor) StartTeam(teamID, setupData string) error {
 	g.teamsLock.Lock()
 	defer g.teamsLock.Unlock()
@@ -147,74 +293,495 @@ func (g *Governor) StartTeam(teamID, setupData string) error {
 		id:        teamID,
 		setupData: setupData,
 		logger:    g.logger.Named(teamID),
+		teamDB:    g.teamDB,
+		leader:    g.leader,
 	}
 	g.teams[teamID] = team
-	go team.Run(g.topContext)
+	team.Start(g.topContext)
 	return nil
 }
 
-// Run takes care of all per-team functionality. It creates a Slack client for the team,
-// manages the database for team config and events, and arranges for periodic Gerrit
-// reports.
-func (t *Team) Run(ctx context.Context) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	defer func() {
-		if t.runError != nil {
-			t.logger.Error("Failed to run", zap.Error(t.runError))
-		}
-	}()
-
-	slackClient, err := slack.NewSlackInterface(t.logger.Named("chat"), t.setupData)
+// PauseTeam stops a team until it is resumed. Events for a paused team are dropped.
+func (g *Governor) PauseTeam(teamID string) error {
+	team, err := g.getTeam(teamID)
 	if err != nil {
-		t.runError = errs.New("could not initialize slack connection: %v", err)
-		return
+		return err
 	}
-	teamDBSource, err := addSearchPath(*persistentDBSource, "team-"+t.id)
+	team.Stop(teamPaused)
+	return nil
+}
+
+// ResumeTeam starts a paused team again.
+func (g *Governor) ResumeTeam(teamID string) error {
+	team, err := g.getTeam(teamID)
 	if err != nil {
-		t.runError = errs.New("could not parse %q: %v", *persistentDBSource, err)
-		return
+		return err
 	}
-	persistentDB, err := app.NewPersistentDB(t.logger.Named("db"), teamDBSource)
-	if err != nil {
-		t.runError = errs.New("could not open db: %v", err)
-		return
+	if !team.Start(g.topContext) {
+		return errs.New("team %s is not paused", teamID)
 	}
-	t.teamApp = app.New(ctx, t.logger, slackClient, &slack.Formatter{}, persistentDB, vanillaGerritConnector{})
+	return nil
+}
 
-	var errGroup errgroup.Group
-	errGroup.Go(func() error {
-		return t.teamApp.PeriodicTeamReports(ctx, time.Now)
-	})
-	errGroup.Go(func() error {
-		return t.teamApp.PeriodicPersonalReports(ctx, time.Now)
-	})
-	err = errGroup.Wait()
-	t.logger.Info("Team errgroup exited", zap.String("team-id", t.id), zap.Error(err))
-	err = t.Close()
+// RestartTeam stops a team, if it is running, and starts it again right away.
+func (g *Governor) RestartTeam(teamID string) error {
+	team, err := g.getTeam(teamID)
 	if err != nil {
-		t.logger.Error("failed to close team", zap.Error(err))
+		return err
 	}
+	team.Stop(teamStarting)
+	team.Start(g.topContext)
+	return nil
 }
 
-// GerritEventReceived is called when an event is received from Gerrit. The Governor determines
-// the appropriate Team and passes the event on to it.
-func (g *Governor) GerritEventReceived(teamID string, event events.GerritEvent) {
+// RemoveTeam stops a team and permanently deletes it: its registration in the governor DB,
+// and its database.
+func (g *Governor) RemoveTeam(ctx context.Context, teamID string) error {
 	g.teamsLock.Lock()
 	team, ok := g.teams[teamID]
+	delete(g.teams, teamID)
 	g.teamsLock.Unlock()
 	if !ok {
-		g.logger.Info("received event for unknown team", zap.String("team-id", teamID))
-		return
+		return errs.New("%w: %s", errUnknownTeam, teamID)
+	}
+	team.Stop(teamPaused)
+	return deleteTeam(ctx, g.logger, g.teamDB, teamID)
+}
+
+// deleteTeam deletes a team's registration and its database. The team must not be running.
+func deleteTeam(ctx context.Context, logger *zap.Logger, teamDB *app.GovernorDB, teamID string) error {
+	logger.Info("removing team", zap.String("team-id", teamID))
+	err := teamDB.DeleteTeam(ctx, teamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
 	}
+	return errs.Combine(err, dropTeamDB(ctx, *persistentDBSource, teamID))
+}
 
+// Shutdown stops all teams, and waits for any uninstalled teams to finish being removed.
+// Reports which are being sent and events which have been accepted are allowed to finish, and
+// each team's App is closed. Then the scheduler lease is released, so that another instance can
+// take over scheduled work. Shutdown returns early if ctx is done first.
+func (g *Governor) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, team := range g.teamList() {
+		wg.Add(1)
+		go func(team *Team) {
+			defer wg.Done()
+			team.Stop(teamStopped)
+		}(team)
+	}
+	done := make(chan struct{})
 	go func() {
-		ctx, cancel := context.WithTimeout(g.topContext, *notificationTimeout)
-		defer cancel()
+		wg.Wait()
+		g.removals.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		g.logger.Info("all teams stopped")
+	case <-ctx.Done():
+		return errs.New("gave up waiting for teams to stop: %w", ctx.Err())
+	}
+	if g.leader != nil {
+		g.leader.Stop()
+	}
+	if g.collector != nil {
+		metrics.Unregister(g.collector)
+	}
+	return nil
+}
+
+func (g *Governor) getTeam(teamID string) (*Team, error) {
+	g.teamsLock.Lock()
+	defer g.teamsLock.Unlock()
+	team, ok := g.teams[teamID]
+	if !ok {
+		return nil, errs.New("%w: %s", errUnknownTeam, teamID)
+	}
+	return team, nil
+}
 
-		team.teamApp.GerritEvent(ctx, event)
+// Start starts the team's supervisor, which runs the team and restarts it with increasing
+// delays if it fails. It returns false if the supervisor was already running.
+func (t *Team) Start(ctx context.Context) bool {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if t.canceler != nil {
+		return false
+	}
+	ctx, t.canceler = context.WithCancel(ctx)
+	t.done = make(chan struct{})
+	t.state = teamStarting
+	go t.supervise(ctx, t.done)
+	return true
+}
+
+// Stop stops the team's supervisor, if it is running, and waits for the team to shut down.
+// The team is left in the given state.
+func (t *Team) Stop(state teamState) {
+	t.statusLock.Lock()
+	canceler, done := t.canceler, t.done
+	t.canceler, t.done = nil, nil
+	t.state = state
+	t.statusLock.Unlock()
+
+	if canceler != nil {
+		canceler()
+		<-done
+	}
+}
+
+// supervise runs the team until ctx is canceled, restarting it after failures. The delay
+// before each restart doubles from team-restart-min-backoff up to team-restart-max-backoff,
+// and goes back to the minimum once the team has stayed up for longer than the maximum.
+func (t *Team) supervise(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	backoff := teamRestartMinBackoff.Get()
+	for {
+		started := time.Now()
+		err := t.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > teamRestartMaxBackoff.Get() {
+			backoff = teamRestartMinBackoff.Get()
+		}
+		t.logger.Error("team failed; will restart", zap.Error(err), zap.Duration("backoff", backoff))
+		t.statusLock.Lock()
+		t.state = teamFailed
+		t.runError = err
+		t.statusLock.Unlock()
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		if backoff > teamRestartMaxBackoff.Get() {
+			backoff = teamRestartMaxBackoff.Get()
+		}
+		t.statusLock.Lock()
+		t.restarts++
+		t.state = teamStarting
+		t.statusLock.Unlock()
+	}
+}
+
+// loadSetupData returns the team's stored setup data, which may have been updated by another
+// instance serving the team.
+func (t *Team) loadSetupData(ctx context.Context) (string, error) {
+	if t.teamDB == nil {
+		t.statusLock.Lock()
+		defer t.statusLock.Unlock()
+		return t.setupData, nil
+	}
+	team, err := t.teamDB.GetTeam(ctx, t.id)
+	if err != nil {
+		return "", err
+	}
+	t.statusLock.Lock()
+	t.setupData = team.SetupData
+	t.statusLock.Unlock()
+	return team.SetupData, nil
+}
+
+// saveSetupData stores updated setup data for the team, so that it is used when the team is
+// restarted.
+func (t *Team) saveSetupData(ctx context.Context, setupData string) error {
+	t.statusLock.Lock()
+	t.setupData = setupData
+	t.statusLock.Unlock()
+	if t.teamDB == nil {
+		return nil
+	}
+	return t.teamDB.PutTeam(ctx, t.id, setupData, time.Now())
+}
+
+// Run takes care of all per-team functionality. It creates a Slack client for the team,
+// manages the database for team config and events, and arranges for periodic Gerrit
+// reports. It returns when ctx is canceled, or when the team can not be started.
+func (t *Team) Run(ctx context.Context) error {
+	t.statusLock.Lock()
+	setupData := t.setupData
+	t.statusLock.Unlock()
+
+	teamApp, err := newTeamApp(ctx, t.logger, t.teamDB, t.id, setupData, t.loadSetupData, t.saveSetupData)
+	if err != nil {
+		return err
+	}
+	if fileName, err := captureFileName(*captureDir, t.id); err != nil {
+		t.logger.Info("gerrit events will not be captured", zap.Error(err))
+	} else {
+		teamApp.SetEventCaptureFile(fileName)
+	}
+	t.statusLock.Lock()
+	t.teamApp = teamApp
+	t.eventQueue = make(chan events.GerritEvent, *eventQueueSize)
+	for i := 0; i < *eventWorkers; i++ {
+		t.workers.Add(1)
+		go func(queue <-chan events.GerritEvent) {
+			defer t.workers.Done()
+			t.handleEvents(ctx, teamApp, queue)
+		}(t.eventQueue)
+	}
+	t.runError = nil
+	t.state = teamRunning
+	t.statusLock.Unlock()
+
+	// config changes made through other instances are picked up whether or not this one is
+	// the leader
+	syncCtx, stopSync := context.WithCancel(ctx)
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		_ = teamApp.PeriodicConfigSync(syncCtx)
+	}()
+
+	err = t.runScheduledWork(ctx, teamApp)
+	t.logger.Info("Team errgroup exited", zap.String("team-id", t.id), zap.Error(err))
+	stopSync()
+
+	t.statusLock.Lock()
+	t.teamApp = nil
+	close(t.eventQueue)
+	t.eventQueue = nil
+	t.statusLock.Unlock()
+	t.workers.Wait()
+	if err := teamApp.Close(); err != nil {
+		t.logger.Error("failed to close team", zap.Error(err))
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// openTeamDB opens (and migrates, if necessary) the persistent DB of the given team. Secret
+// config items are sealed with the same key as the team records in teamDB.
+func openTeamDB(logger *zap.Logger, teamDB *app.GovernorDB, teamID string) (*app.PersistentDB, error) {
+	teamDBSource, err := addSearchPath(*persistentDBSource, "team-"+teamID)
+	if err != nil {
+		return nil, errs.New("could not parse %q: %v", *persistentDBSource, err)
+	}
+	persistentDB, err := app.NewPersistentDB(logger.Named("db"), teamDBSource, teamDB.Sealer())
+	if err != nil {
+		return nil, errs.New("could not open db: %v", err)
+	}
+	return persistentDB, nil
+}
+
+// newTeamApp connects to the team's chat system and opens its persistent DB, and creates an
+// App for the team using them. The caller is responsible for closing the App.
+func newTeamApp(ctx context.Context, logger *zap.Logger, teamDB *app.GovernorDB, teamID, setupData string, loadSetupData func(ctx context.Context) (string, error), saveSetupData func(ctx context.Context, setupData string) error) (*app.App, error) {
+	slackClient, err := slack.NewSlackInterface(logger.Named("chat"), setupData, loadSetupData, saveSetupData)
+	if err != nil {
+		return nil, errs.New("could not initialize slack connection: %v", err)
+	}
+	persistentDB, err := openTeamDB(logger, teamDB, teamID)
+	if err != nil {
+		return nil, err
+	}
+	return app.New(ctx, logger, teamID, slackClient, &slack.Formatter{}, persistentDB, vanillaGerritConnector{}), nil
+}
+
+// runScheduledWork runs the team's periodic reports, digests, reminders and health checks
+// while this instance is the leader, until ctx is canceled.
+func (t *Team) runScheduledWork(ctx context.Context, teamApp *app.App) error {
+	for {
+		leaderCtx, release, err := t.leader.Leadership(ctx)
+		if err != nil {
+			return err
+		}
+		var errGroup errgroup.Group
+		errGroup.Go(func() error {
+			return teamApp.PeriodicTeamReports(leaderCtx, time.Now)
+		})
+		errGroup.Go(func() error {
+			return teamApp.PeriodicPersonalReports(leaderCtx, time.Now)
+		})
+		errGroup.Go(func() error {
+			return teamApp.PeriodicDigests(leaderCtx, time.Now)
+		})
+		errGroup.Go(func() error {
+			return teamApp.PeriodicSLAReminders(leaderCtx, time.Now)
+		})
+		errGroup.Go(func() error {
+			return teamApp.PeriodicWeeklyStats(leaderCtx, time.Now)
+		})
+		errGroup.Go(func() error {
+			return teamApp.PeriodicHealthChecks(leaderCtx, time.Now)
+		})
+		err = errGroup.Wait()
+		release()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		// leadership was lost; wait to get it back
+	}
+}
+
+// RunError returns the error which caused the team to fail most recently, if it has not
+// been successfully restarted since.
+func (t *Team) RunError() error {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	return t.runError
+}
+
+// handleEvents passes Gerrit events from queue to the team's App until the queue is closed.
+// Events which have been queued are seen through, even if the team is being stopped.
+func (t *Team) handleEvents(ctx context.Context, teamApp *app.App, queue <-chan events.GerritEvent) {
+	for event := range queue {
+		eventCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notificationTimeout.Get())
+		teamApp.GerritEvent(eventCtx, event)
+		cancel()
+	}
+}
+
+// queueEvent adds a Gerrit event to the team's event queue. It returns errTeamPaused if the
+// team has been paused, errTeamUnavailable if it is not running for any other reason, or
+// errEventQueueFull if there is no room.
+func (t *Team) queueEvent(event events.GerritEvent) error {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if t.eventQueue == nil {
+		if t.state == teamPaused {
+			return errTeamPaused
+		}
+		return errTeamUnavailable
+	}
+	select {
+	case t.eventQueue <- event:
+		return nil
+	default:
+		return errEventQueueFull
+	}
+}
+
+// queueDepth returns the number of events waiting in the team's event queue.
+func (t *Team) queueDepth() int {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	return len(t.eventQueue)
+}
+
+// startWork runs f in a new goroutine with the team's App, unless the team is not running.
+// The App will not be closed until f returns. It returns false if the team is not running.
+func (t *Team) startWork(f func(teamApp *app.App)) bool {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	if t.teamApp == nil {
+		return false
+	}
+	teamApp := t.teamApp
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		f(teamApp)
 	}()
+	return true
+}
+
+// App returns the team's App, or nil if the team is not running.
+func (t *Team) App() *app.App {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	return t.teamApp
+}
+
+// TeamStatus describes the condition of a registered team, for operators.
+type TeamStatus struct {
+	ID       string    `json:"id"`
+	State    teamState `json:"state"`
+	Running  bool      `json:"running"`
+	RunError string    `json:"run_error,omitempty"`
+	Restarts int       `json:"restarts"`
+	*app.Status
+}
+
+// Ready determines whether all registered teams have finished starting up for the first
+// time, successfully or not.
+func (g *Governor) Ready() bool {
+	for _, team := range g.teamList() {
+		team.statusLock.Lock()
+		starting := team.state == teamStarting && team.restarts == 0
+		team.statusLock.Unlock()
+		if starting {
+			return false
+		}
+	}
+	return true
+}
+
+// TeamStatuses reports the condition of every registered team, sorted by team ID.
+func (g *Governor) TeamStatuses(ctx context.Context) []TeamStatus {
+	teams := g.teamList()
+	statuses := make([]TeamStatus, 0, len(teams))
+	for _, team := range teams {
+		team.statusLock.Lock()
+		status := TeamStatus{ID: team.id, State: team.state, Restarts: team.restarts}
+		if team.runError != nil {
+			status.RunError = team.runError.Error()
+		}
+		teamApp := team.teamApp
+		team.statusLock.Unlock()
+
+		if teamApp != nil {
+			status.Running = true
+			appStatus, err := teamApp.Status(ctx)
+			if err != nil {
+				g.logger.Error("failed to get team status", zap.String("team-id", team.id), zap.Error(err))
+			}
+			status.Status = &appStatus
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// teamList returns all registered teams.
+func (g *Governor) teamList() []*Team {
+	g.teamsLock.Lock()
+	defer g.teamsLock.Unlock()
+	teams := make([]*Team, 0, len(g.teams))
+	for _, team := range g.teams {
+		teams = append(teams, team)
+	}
+	return teams
+}
+
+// GerritEventReceived is called when an event is received from Gerrit. The Governor determines
+// the appropriate Team and queues the event for it. Events for unknown or paused teams are
+// dropped. If the team is starting or waiting to be restarted, the event is refused with
+// errTeamUnavailable, and if its event queue is full, with errEventQueueFull, so that Gerrit
+// can try again later.
+func (g *Governor) GerritEventReceived(teamID string, event events.GerritEvent) error {
+	team, err := g.getTeam(teamID)
+	if err != nil {
+		g.logger.Info("received event for unknown team", zap.String("team-id", teamID))
+		return nil
+	}
+	metrics.EventsReceived.WithLabelValues(teamID, event.GetType()).Inc()
+	err = team.queueEvent(event)
+	switch {
+	case errors.Is(err, errTeamPaused):
+		g.logger.Info("dropping event for paused team", zap.String("team-id", teamID), zap.String("event-type", event.GetType()))
+		return nil
+	case err != nil:
+		g.logger.Warn("refusing event", zap.String("team-id", teamID), zap.String("event-type", event.GetType()), zap.Error(err))
+		metrics.EventsRejected.WithLabelValues(teamID).Inc()
+		return err
+	}
+	return nil
 }
 
 // VerifyAndHandleChatEvent is called when an HTTP request is received which purports to be
@@ -224,54 +791,66 @@ func (g *Governor) VerifyAndHandleChatEvent(header http.Header, messageBody []by
 	if err != nil {
 		return nil, err
 	}
-	g.teamsLock.Lock()
-	team, ok := g.teams[teamID]
-	g.teamsLock.Unlock()
-	if !ok {
+	team, err := g.getTeam(teamID)
+	if err != nil {
 		g.logger.Info("received chat event for unknown team", zap.String("team-id", teamID), zap.Any("event", event))
 		responseBytes = slack.HandleNoTeamEvent(g.topContext, event)
 		return responseBytes, nil
 	}
-
-	go func() {
-		err := team.teamApp.ChatEvent(g.topContext, event)
+	started := team.startWork(func(teamApp *app.App) {
+		err := teamApp.ChatEvent(context.WithoutCancel(g.topContext), event)
 		if errors.Is(err, slack.ErrStopTeam) {
 			g.logger.Info("uninstalled from team", zap.String("team-id", teamID))
-			g.teamsLock.Lock()
-			delete(g.teams, teamID)
-			g.teamsLock.Unlock()
-
-			if err := team.teamApp.Close(); err != nil {
-				g.logger.Info("failed to close team", zap.String("team-id", teamID), zap.Error(err))
-			}
+			// removing the team waits for this worker to finish, so it can't be done here.
+			g.removals.Add(1)
+			go func() {
+				defer g.removals.Done()
+				if err := g.RemoveTeam(g.topContext, teamID); err != nil {
+					g.logger.Error("failed to remove uninstalled team", zap.String("team-id", teamID), zap.Error(err))
+				}
+			}()
 		} else if err != nil {
 			g.logger.Error("Unexpected error from teamApp.ChatEvent", zap.Error(err))
 		}
-	}()
+	})
+	if !started {
+		g.logger.Info("dropping chat event for team which is not running", zap.String("team-id", teamID))
+	}
 	return nil, nil
 }
 
-func (g *Governor) appendTeamDefinition(teamID, setupData string) (err error) {
-	g.teamFileLock.Lock()
-	defer g.teamFileLock.Unlock()
-
-	f, err := os.OpenFile(g.teamFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+// dropTeamDB permanently deletes a team's database: its schema, for postgres, or its file,
+// for sqlite.
+func dropTeamDB(ctx context.Context, dbURL, teamID string) (err error) {
+	schemaName := "team-" + teamID
+	u, err := url.Parse(dbURL)
 	if err != nil {
 		return err
 	}
-	defer func() { err = errs.Combine(err, f.Close()) }()
-
-	dataLine := teamID + " " + setupData + "\n"
-	if _, err := f.Write([]byte(dataLine)); err != nil {
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		db, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return err
+		}
+		defer func() { err = errs.Combine(err, db.Close()) }()
+		_, err = db.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+pq.QuoteIdentifier(schemaName)+" CASCADE")
 		return err
+	case "sqlite", "sqlite3":
+		teamDBSource, err := addSearchPath(dbURL, schemaName)
+		if err != nil {
+			return err
+		}
+		teamURL, err := url.Parse(teamDBSource)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(teamURL.Opaque); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
 	}
-	return nil
-}
-
-// Close shuts down functionality for a Team.
-func (t *Team) Close() error {
-	t.canceler()
-	return t.teamApp.Close()
+	return errs.New("unrecognized db scheme %q", u.Scheme)
 }
 
 func addSearchPath(dbURL, schemaName string) (string, error) {
@@ -296,3 +875,35 @@ func addSearchPath(dbURL, schemaName string) (string, error) {
 	}
 	return u.String(), nil
 }
+
+var (
+	activeTeamsDesc  = prometheus.NewDesc("chihuahua_active_teams", "Number of teams known to the governor.", nil, nil)
+	teamRunErrorDesc = prometheus.NewDesc("chihuahua_team_run_error", "Whether the team stopped running due to an error (1) or not (0).", []string{"team"}, nil)
+	eventQueueDesc   = prometheus.NewDesc("chihuahua_event_queue_depth", "Number of Gerrit events waiting to be handled.", []string{"team"}, nil)
+)
+
+// governorCollector is a prometheus.Collector reporting the status of the Governor's teams.
+type governorCollector struct {
+	governor *Governor
+}
+
+// Describe implements prometheus.Collector.
+func (gc governorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeTeamsDesc
+	ch <- teamRunErrorDesc
+	ch <- eventQueueDesc
+}
+
+// Collect implements prometheus.Collector.
+func (gc governorCollector) Collect(ch chan<- prometheus.Metric) {
+	teams := gc.governor.teamList()
+	ch <- prometheus.MustNewConstMetric(activeTeamsDesc, prometheus.GaugeValue, float64(len(teams)))
+	for _, team := range teams {
+		var failed float64
+		if team.RunError() != nil {
+			failed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(teamRunErrorDesc, prometheus.GaugeValue, failed, team.id)
+		ch <- prometheus.MustNewConstMetric(eventQueueDesc, prometheus.GaugeValue, float64(team.queueDepth()), team.id)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/app"
+	"github.com/storj/changesetchihuahua/gerrit/events"
+)
+
+func TestMigrateTeamFile(t *testing.T) {
+	ctx := context.Background()
+	logger := zaptest.NewLogger(t)
+	dir := t.TempDir()
+	sealer, err := app.NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	teamDB, err := app.NewGovernorDB(logger, "sqlite:"+filepath.Join(dir, "persistent.db"), sealer)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, teamDB.Close()) }()
+
+	// a team already in the db is left alone
+	require.NoError(t, teamDB.PutTeam(ctx, "T2", `{"new":true}`, time.Now()))
+
+	teamFile := filepath.Join(dir, "teams.dat")
+	require.NoError(t, os.WriteFile(teamFile, []byte("# comment\nT1 {\"a\":1}\nT2 {\"old\":true}\n"), 0o644))
+	require.NoError(t, migrateTeamFile(ctx, logger, teamDB, teamFile))
+
+	teams, err := teamDB.GetTeams(ctx)
+	require.NoError(t, err)
+	require.Len(t, teams, 2)
+	require.Equal(t, "T1", teams[0].TeamID)
+	require.Equal(t, `{"a":1}`, teams[0].SetupData)
+	require.Equal(t, `{"new":true}`, teams[1].SetupData)
+
+	_, err = os.Stat(teamFile)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(teamFile + ".migrated")
+	require.NoError(t, err)
+
+	// with the file gone, there is nothing more to do
+	require.NoError(t, migrateTeamFile(ctx, logger, teamDB, teamFile))
+}
+
+func TestDropTeamDBSqlite(t *testing.T) {
+	dbURL := "sqlite:" + filepath.Join(t.TempDir(), "persistent.db")
+	teamDBSource, err := addSearchPath(dbURL, "team-T1")
+	require.NoError(t, err)
+	teamDBFile := teamDBSource[len("sqlite:"):]
+	require.NoError(t, os.WriteFile(teamDBFile, nil, 0o644))
+
+	require.NoError(t, dropTeamDB(context.Background(), dbURL, "T1"))
+	_, err = os.Stat(teamDBFile)
+	require.True(t, os.IsNotExist(err))
+
+	// and a second time, with nothing left to remove
+	require.NoError(t, dropTeamDB(context.Background(), dbURL, "T1"))
+}
+
+func TestTeamWorkersDrain(t *testing.T) {
+	team := &Team{id: "T1", logger: zaptest.NewLogger(t), teamApp: &app.App{}}
+
+	release := make(chan struct{})
+	require.True(t, team.startWork(func(*app.App) { <-release }))
+
+	// once the team stops accepting work, waiting for its workers blocks until they finish
+	team.statusLock.Lock()
+	team.teamApp = nil
+	team.statusLock.Unlock()
+	require.False(t, team.startWork(func(*app.App) { t.Error("work started on stopped team") }))
+
+	drained := make(chan struct{})
+	go func() {
+		team.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("workers drained while work was in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-drained
+}
+
+func TestGovernorShutdownDeadline(t *testing.T) {
+	g := &Governor{logger: zaptest.NewLogger(t), teams: make(map[string]*Team)}
+	require.NoError(t, g.Shutdown(context.Background()))
+
+	// a team whose supervisor never finishes holds up shutdown only until the deadline
+	stuck := &Team{id: "T1", logger: zaptest.NewLogger(t), canceler: func() {}, done: make(chan struct{})}
+	g.teams["T1"] = stuck
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, g.Shutdown(ctx), context.DeadlineExceeded)
+
+	stuck.statusLock.Lock()
+	require.Equal(t, teamStopped, stuck.state)
+	stuck.statusLock.Unlock()
+}
+
+func TestGerritEventQueue(t *testing.T) {
+	team := &Team{id: "T1", logger: zaptest.NewLogger(t)}
+	g := &Governor{logger: zaptest.NewLogger(t), teams: map[string]*Team{"T1": team}}
+
+	// events for teams which are unknown or paused are dropped, not refused
+	require.NoError(t, g.GerritEventReceived("T2", &events.RefUpdatedEvent{}))
+	team.statusLock.Lock()
+	team.state = teamPaused
+	team.statusLock.Unlock()
+	require.NoError(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}))
+
+	// but events for teams which are starting or waiting to restart are refused, to be
+	// retried
+	for _, state := range []teamState{teamStarting, teamFailed} {
+		team.statusLock.Lock()
+		team.state = state
+		team.statusLock.Unlock()
+		require.ErrorIs(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}), errTeamUnavailable)
+	}
+
+	team.statusLock.Lock()
+	team.state = teamRunning
+	team.eventQueue = make(chan events.GerritEvent, 2)
+	team.statusLock.Unlock()
+	require.NoError(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}))
+	require.NoError(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}))
+	require.Equal(t, 2, team.queueDepth())
+	require.ErrorIs(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}), errEventQueueFull)
+
+	<-team.eventQueue
+	require.NoError(t, g.GerritEventReceived("T1", &events.RefUpdatedEvent{}))
+}
+
+func TestLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	logger := zaptest.NewLogger(t)
+	sealer, err := app.NewSealer(make([]byte, 32))
+	require.NoError(t, err)
+	teamDB, err := app.NewGovernorDB(logger, "sqlite:"+filepath.Join(t.TempDir(), "persistent.db"), sealer)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, teamDB.Close()) }()
+
+	first := newLeaderElector(logger.Named("first"), teamDB, "first", 300*time.Millisecond)
+	second := newLeaderElector(logger.Named("second"), teamDB, "second", 300*time.Millisecond)
+	first.Start(ctx)
+	leaderCtx, release, err := first.Leadership(ctx)
+	require.NoError(t, err)
+	defer release()
+
+	// only one instance can be the leader
+	second.Start(ctx)
+	defer second.Stop()
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	_, _, err = second.Leadership(waitCtx)
+	cancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// when the leader stops, it releases the lease, and the other takes over
+	first.Stop()
+	select {
+	case <-leaderCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership context not canceled after stopping")
+	}
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	secondCtx, secondRelease, err := second.Leadership(waitCtx)
+	require.NoError(t, err)
+	defer secondRelease()
+	require.NoError(t, secondCtx.Err())
+
+	// a nil elector is always the leader
+	nilCtx, nilRelease, err := (*leaderElector)(nil).Leadership(ctx)
+	require.NoError(t, err)
+	nilRelease()
+	require.Error(t, nilCtx.Err())
+}
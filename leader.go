@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/storj/changesetchihuahua/app"
+)
+
+// schedulerLease is the name of the lease held by the instance which runs scheduled work
+// (reports, digests, reminders and health checks) for all teams.
+const schedulerLease = "scheduler"
+
+var (
+	instanceID  = flag.String("instance-id", defaultInstanceID(), "Name of this instance, unique among instances sharing a persistent DB")
+	leaderLease = flag.Duration("leader-lease", time.Second*30, "How long the instance running scheduled work holds its lease without renewing it. If that instance goes away, another takes over within this time.")
+)
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// leaderElector arranges, through a lease in the governor DB, for exactly one of the
+// instances sharing the DB to be the leader at a time. Only the leader runs scheduled work;
+// any instance can handle events.
+type leaderElector struct {
+	logger   *zap.Logger
+	teamDB   *app.GovernorDB
+	holder   string
+	lease    time.Duration
+	canceler context.CancelFunc
+	done     chan struct{}
+
+	// lock protects everything below.
+	lock sync.Mutex
+	// leaderCtx is canceled when leadership is lost. It is nil when this is not the leader.
+	leaderCtx    context.Context
+	cancelLeader context.CancelFunc
+	// gained is closed (and replaced) whenever leadership is gained.
+	gained chan struct{}
+}
+
+func newLeaderElector(logger *zap.Logger, teamDB *app.GovernorDB, holder string, lease time.Duration) *leaderElector {
+	return &leaderElector{
+		logger: logger,
+		teamDB: teamDB,
+		holder: holder,
+		lease:  lease,
+		gained: make(chan struct{}),
+	}
+}
+
+// Start starts trying to become the leader, and renewing the lease while leader, until Stop
+// is called.
+func (le *leaderElector) Start(ctx context.Context) {
+	ctx, le.canceler = context.WithCancel(ctx)
+	le.done = make(chan struct{})
+	go le.run(ctx)
+}
+
+// Stop gives up leadership, releasing the lease so that another instance can take over
+// straight away.
+func (le *leaderElector) Stop() {
+	if le.canceler == nil {
+		return
+	}
+	le.canceler()
+	<-le.done
+	le.canceler = nil
+}
+
+func (le *leaderElector) run(ctx context.Context) {
+	defer close(le.done)
+
+	// renew well before the lease runs out, so that one slow renewal doesn't lose it
+	ticker := time.NewTicker(le.lease / 3)
+	defer ticker.Stop()
+	for {
+		acquired, err := le.teamDB.AcquireLease(ctx, schedulerLease, le.holder, time.Now(), le.lease)
+		if err != nil && ctx.Err() == nil {
+			le.logger.Error("could not acquire or renew lease", zap.Error(err))
+		}
+		le.setLeader(acquired && err == nil)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			le.setLeader(false)
+			releaseCtx, cancel := context.WithTimeout(context.Background(), le.lease)
+			if err := le.teamDB.ReleaseLease(releaseCtx, schedulerLease, le.holder); err != nil {
+				le.logger.Error("could not release lease", zap.Error(err))
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+func (le *leaderElector) setLeader(isLeader bool) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	switch {
+	case isLeader && le.leaderCtx == nil:
+		le.logger.Info("became leader; running scheduled work", zap.String("instance-id", le.holder))
+		le.leaderCtx, le.cancelLeader = context.WithCancel(context.Background())
+		close(le.gained)
+		le.gained = make(chan struct{})
+	case !isLeader && le.leaderCtx != nil:
+		le.logger.Info("no longer leader; stopping scheduled work", zap.String("instance-id", le.holder))
+		le.cancelLeader()
+		le.leaderCtx, le.cancelLeader = nil, nil
+	}
+}
+
+// Leadership waits until this instance is the leader, or ctx is done. It returns a context
+// which is canceled when leadership is lost or ctx is done, along with its cancel function.
+// A nil leaderElector is always the leader.
+func (le *leaderElector) Leadership(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	if le == nil {
+		leaderCtx, cancel := context.WithCancel(ctx)
+		return leaderCtx, cancel, nil
+	}
+	for {
+		le.lock.Lock()
+		currentLeaderCtx, gained := le.leaderCtx, le.gained
+		le.lock.Unlock()
+
+		if currentLeaderCtx != nil {
+			leaderCtx, cancel := context.WithCancel(ctx)
+			stop := context.AfterFunc(currentLeaderCtx, cancel)
+			return leaderCtx, func() {
+				stop()
+				cancel()
+			}, nil
+		}
+		select {
+		case <-gained:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/thepaul/autocert"
 	"github.com/zeebo/errs"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/storj/changesetchihuahua/config"
 )
 
 const (
@@ -20,27 +25,86 @@ const (
 )
 
 var (
+	configFile         = flag.String("config", "", "YAML file of settings, named like these flags. Settings can also be given in environment variables, like "+config.EnvPrefix+"NOTIFY_TIMEOUT. Command line flags take precedence over both. Send SIGHUP to reload the settings marked reloadable.")
 	httpListenAddr     = flag.String("http-listen", ":80", "Address to listen on for HTTP requests to web UI and incoming Gerrit events. If empty, don't listen for HTTP.")
 	httpsListenAddr    = flag.String("https-listen", ":443", "Address to listen on for HTTPS requests to web UI and incoming Gerrit events. If empty, don't listen for HTTPS.")
 	persistentDBSource = flag.String("persistent-db", "sqlite:./persistent.db", "Data source for persistent DB (supported types: sqlite, postgres)")
-	teamFile           = flag.String("team-file", "teams.dat", "Where to store information about registered teams")
+	teamFile           = flag.String("team-file", "teams.dat", "Legacy file of registered teams. If it exists at startup, its teams are moved into the persistent DB and it is renamed.")
 	externalURL        = flag.String("external-url", "https://localhost.localdomain/", "The URL by which external hosts (including Slack servers) can contact this server")
 	operatorEmail      = flag.String("operator-email", "", "Contact email address to be submitted to ACME server (e.g. Let's Encrypt) to be put in issued SSL certificates")
 	certRenewBefore    = flag.Duration("cert-renew-before", time.Hour*24*30, "How early certificates should be renewed before they expire")
 	certCacheDir       = flag.String("cert-cache-dir", "./ssl-cert-cache/", "A directory on the local filesystem which will be used for storing SSL certificate information. If it does not exist, the directory will be created with 0700 permissions.")
+	shutdownTimeout    = config.DurationFlag("shutdown-timeout", time.Second*30, "On SIGINT or SIGTERM, how long to wait for in-flight HTTP requests to finish, and then how long to wait for in-flight reports and events")
 )
 
+// logLevel is the minimum level of log messages to emit.
+var logLevel = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+func init() {
+	config.ReloadableVar(logLevelValue{logLevel}, "log-level", "Minimum level of log messages to emit (debug, info, warn or error)")
+}
+
+// logLevelValue lets a zap.AtomicLevel be given as a flag.
+type logLevelValue struct {
+	zap.AtomicLevel
+}
+
+// String implements flag.Value.
+func (v logLevelValue) String() string {
+	if v.AtomicLevel == (zap.AtomicLevel{}) {
+		// the flag package checks the zero value to decide whether to show the default
+		return ""
+	}
+	return v.AtomicLevel.String()
+}
+
+// Set implements flag.Value.
+func (v logLevelValue) Set(s string) error {
+	return v.UnmarshalText([]byte(s))
+}
+
 func main() {
 	flag.Parse()
+	configLoader := config.NewLoader(flag.CommandLine, *configFile)
+	if err := configLoader.Load(); err != nil {
+		log.Fatalf("Can't load configuration: %v", err)
+	}
 
-	logger, err := zap.NewDevelopment()
+	logConfig := zap.NewDevelopmentConfig()
+	logConfig.Level = logLevel
+	logger, err := logConfig.Build()
 	if err != nil {
 		log.Fatalf("Can't initialize zap logger: %v", err)
 	}
-	defer func() { panic(logger.Sync()) }()
-	errg, ctx := errgroup.WithContext(context.Background())
+	if flag.NArg() > 0 {
+		if err := runCommand(context.Background(), logger, flag.Args()); err != nil {
+			_ = logger.Sync()
+			log.Fatal(err)
+		}
+		_ = logger.Sync()
+		return
+	}
+
+	// teams are not stopped by a signal directly; they are shut down once the web servers have
+	// drained, so that requests which are still being handled can reach them.
+	governorCtx, cancelGovernor := context.WithCancel(context.Background())
+	defer cancelGovernor()
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	errg, ctx := errgroup.WithContext(signalCtx)
+	errg.Go(func() error {
+		reloadOnHangup(ctx, logger, configLoader)
+		return nil
+	})
 
-	governor, err := NewGovernor(ctx, logger, *teamFile)
+	teamDB, err := openGovernorDB(logger)
+	if err != nil {
+		logger.Fatal("could not open governor db", zap.Error(err))
+	}
+	if err := migrateTeamFile(ctx, logger, teamDB, *teamFile); err != nil {
+		logger.Fatal("could not migrate team file", zap.String("team-file", *teamFile), zap.Error(err))
+	}
+	governor, err := NewGovernor(governorCtx, logger, teamDB)
 	if err != nil {
 		logger.Fatal("could not set up governor", zap.Error(err))
 	}
@@ -55,7 +119,8 @@ func main() {
 	if parsedURL.Port() != "" {
 		logger.Fatal("invalid external-url: port may not be specified. ACME challenges won't work if external hosts can't contact this server on port 443.")
 	}
-	webState := newUIWebState(logger.Named("web-state"), governor, parsedURL)
+	capture := newEventCapture(logger.Named("capture"), *captureDir)
+	webState := newUIWebState(logger.Named("web-state"), governor, parsedURL, capture)
 
 	if *httpListenAddr != "" {
 		webHandler := newUIWebHandler(logger.Named("web-handler"), webState, false)
@@ -87,7 +152,46 @@ func main() {
 		})
 	}
 
-	if err := errg.Wait(); err != nil {
-		logger.Fatal("exiting", zap.Error(err))
+	serveErr := errg.Wait()
+	if serveErr != nil {
+		logger.Error("web server failed", zap.Error(serveErr))
+	}
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout.Get())
+	defer cancel()
+	if err := governor.Shutdown(shutdownCtx); err != nil {
+		logger.Error("teams did not shut down cleanly", zap.Error(err))
+	}
+	if err := teamDB.Close(); err != nil {
+		logger.Error("could not close governor db", zap.Error(err))
+	}
+	if err := capture.Close(); err != nil {
+		logger.Error("could not close event capture files", zap.Error(err))
+	}
+	_ = logger.Sync()
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// reloadOnHangup reloads the configuration whenever SIGHUP is received, until ctx is done.
+func reloadOnHangup(ctx context.Context, logger *zap.Logger, configLoader *config.Loader) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-hangups:
+		case <-ctx.Done():
+			return
+		}
+		changed, needRestart, err := configLoader.Reload()
+		if err != nil {
+			logger.Error("could not reload configuration", zap.Error(err))
+		}
+		logger.Info("reloaded configuration", zap.Strings("changed", changed))
+		if len(needRestart) > 0 {
+			logger.Warn("changed settings will only take effect after a restart", zap.Strings("settings", needRestart))
+		}
 	}
 }
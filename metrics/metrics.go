@@ -0,0 +1,169 @@
+// Package metrics holds the Prometheus metrics collected by Changeset Chihuahua.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chihuahua"
+
+// UnknownTeam is the team label used for requests naming a team which is not registered, so
+// that such requests can't add labels without limit.
+const UnknownTeam = "unknown"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// EventsReceived counts Gerrit events received, by team and event type.
+	EventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gerrit_events_received_total",
+		Help:      "Gerrit events received, by event type.",
+	}, []string{"team", "type"})
+
+	// EventDecodeFailures counts Gerrit event payloads which could not be decoded, by team.
+	// Payloads sent for teams which are not registered are counted under UnknownTeam.
+	EventDecodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gerrit_event_decode_failures_total",
+		Help:      "Gerrit event payloads which could not be decoded.",
+	}, []string{"team"})
+
+	// EventsRejected counts Gerrit events which were refused because the team's event queue
+	// was full, by team.
+	EventsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_rejected_total",
+		Help:      "Gerrit events refused because the event queue was full.",
+	}, []string{"team"})
+
+	// NotificationsSent counts chat notifications delivered, by team and notification kind.
+	NotificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Chat notifications sent, by notification kind.",
+	}, []string{"team", "kind"})
+
+	// NotificationsFailed counts chat notifications which could not be delivered, by team and
+	// notification kind.
+	NotificationsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Chat notifications which could not be sent, by notification kind.",
+	}, []string{"team", "kind"})
+
+	// GerritRequestDuration observes the latency of Gerrit API calls, by team and endpoint.
+	GerritRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gerrit_request_duration_seconds",
+		Help:      "Latency of Gerrit API calls, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"team", "endpoint"})
+
+	// GerritRequestErrors counts failed Gerrit API calls, by team and endpoint.
+	GerritRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gerrit_request_errors_total",
+		Help:      "Gerrit API calls which returned an error, by endpoint.",
+	}, []string{"team", "endpoint"})
+
+	// SlackRequestDuration observes the latency of Slack API calls, by team and API method.
+	SlackRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "slack_request_duration_seconds",
+		Help:      "Latency of Slack API calls, by API method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"team", "method"})
+
+	// SlackRateLimited counts Slack API calls which were refused due to rate limiting, by team
+	// and API method.
+	SlackRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slack_rate_limited_total",
+		Help:      "Slack API calls refused due to rate limiting, by API method.",
+	}, []string{"team", "method"})
+
+	// ReportDuration observes how long it takes to build and send reports, by team and report
+	// type.
+	ReportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "report_duration_seconds",
+		Help:      "Time taken to build and send reports, by report type.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"team", "report"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		EventsReceived,
+		EventDecodeFailures,
+		EventsRejected,
+		NotificationsSent,
+		NotificationsFailed,
+		GerritRequestDuration,
+		GerritRequestErrors,
+		SlackRequestDuration,
+		SlackRateLimited,
+		ReportDuration,
+	)
+}
+
+// MustRegister adds collectors to the registry served by Handler, panicking on failure.
+func MustRegister(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Unregister removes a collector added with MustRegister.
+func Unregister(c prometheus.Collector) {
+	registry.Unregister(c)
+}
+
+// Handler returns an http.Handler serving all registered metrics in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveSince records the time elapsed since start in the given histogram. It is meant to be
+// deferred.
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// slackTransport is an http.RoundTripper which records metrics about Slack API calls.
+type slackTransport struct {
+	teamID     string
+	underlying http.RoundTripper
+}
+
+// NewSlackTransport wraps an http.RoundTripper so that the latency of Slack API calls made
+// through it, and any rate limiting responses, are recorded for the given team.
+func NewSlackTransport(teamID string, underlying http.RoundTripper) http.RoundTripper {
+	return &slackTransport{teamID: teamID, underlying: underlying}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (st *slackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := slackAPIMethod(req.URL.Path)
+	start := time.Now()
+	resp, err := st.underlying.RoundTrip(req)
+	SlackRequestDuration.WithLabelValues(st.teamID, method).Observe(time.Since(start).Seconds())
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		SlackRateLimited.WithLabelValues(st.teamID, method).Inc()
+	}
+	return resp, err
+}
+
+// slackAPIMethod extracts the API method name (e.g. "chat.postMessage") from the path of a
+// Slack Web API request.
+func slackAPIMethod(urlPath string) string {
+	return urlPath[strings.LastIndex(urlPath, "/")+1:]
+}
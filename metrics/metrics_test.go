@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlackTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/chat.postMessage") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewSlackTransport("T1", http.DefaultTransport)}
+	for _, method := range []string{"chat.postMessage", "chat.postMessage", "users.info"} {
+		resp, err := client.Post(server.URL+"/api/"+method, "application/x-www-form-urlencoded", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(SlackRateLimited.WithLabelValues("T1", "chat.postMessage")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(SlackRateLimited.WithLabelValues("T1", "users.info")))
+	assert.Equal(t, 2, testutil.CollectAndCount(SlackRequestDuration))
+
+	// the handler exposes everything registered
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `chihuahua_slack_rate_limited_total{method="chat.postMessage",team="T1"} 2`)
+}
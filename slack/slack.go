@@ -20,6 +20,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/storj/changesetchihuahua/messages"
+	"github.com/storj/changesetchihuahua/metrics"
 )
 
 var (
@@ -29,6 +30,8 @@ var (
 	ClientSecret = flag.String("slack-client-secret", "", "Client secret issued to this app by Slack")
 	// SigningSecret is the signing secret issued to this app by Slack.
 	SigningSecret = flag.String("slack-signing-secret", "", "Signing secret issued to this app by Slack")
+	// APIURL is the base URL of the Slack Web API.
+	APIURL = flag.String("slack-api-url", slack.APIURL, "Base URL of the Slack Web API (only useful for testing)")
 	// debugSlackLib indicates whether to log debug information from the Slack client library.
 	debugSlackLib = flag.Bool("debug-slack-lib", false, "Log debug information from Slack client library")
 )
@@ -104,15 +107,25 @@ type EventedChatSystem interface {
 	HandleEvent(ctx context.Context, event ChatEvent) error
 }
 
-// NewSlackInterface creates an EventedChatSystem instance for a Slack server.
-func NewSlackInterface(logger *zap.Logger, setupData string) (EventedChatSystem, error) {
-	var oauthData slack.OAuthV2Response
-	if err := json.Unmarshal([]byte(setupData), &oauthData); err != nil {
+// NewSlackInterface creates an EventedChatSystem instance for a Slack server. If the team's
+// access token expires, it is refreshed as needed, and saveSetupData (if not nil) is called
+// with the updated setup data so that it can be stored. Before refreshing, loadSetupData (if
+// not nil) is used to check whether another instance has already done so.
+func NewSlackInterface(logger *zap.Logger, setupDataJSON string, loadSetupData func(ctx context.Context) (string, error), saveSetupData func(ctx context.Context, setupData string) error) (EventedChatSystem, error) {
+	var data setupData
+	if err := json.Unmarshal([]byte(setupDataJSON), &data); err != nil {
 		return nil, err
 	}
+	oauthData := data.OAuthV2Response
 
 	slackLogger := logWrapper{logger}
-	slackOptions := []slack.Option{slack.OptionLog(slackLogger)}
+	tokens := newTokenSource(logger, data, loadSetupData, saveSetupData)
+	transport := &tokenTransport{tokens: tokens, underlying: metrics.NewSlackTransport(oauthData.Team.ID, http.DefaultTransport)}
+	slackOptions := []slack.Option{
+		slack.OptionLog(slackLogger),
+		slack.OptionHTTPClient(&http.Client{Transport: transport}),
+		slack.OptionAPIURL(*APIURL),
+	}
 	if *debugSlackLib {
 		slackOptions = append(slackOptions, slack.OptionDebug(true))
 	}
@@ -179,14 +192,16 @@ func (s *slackInterface) handleMessage(ctx context.Context, eventData *slackeven
 	}
 	// TODO: handle messages in threads, with SubType="message_replied"; replies should go in thread
 
-	s.logger.Debug("received message", zap.Any("message", *eventData))
+	// the text is not logged, since it may hold a secret being given to the bot
+	logger := s.logger.With(zap.String("user", eventData.User), zap.String("channel", eventData.Channel))
+	logger.Debug("received message")
 
 	if s.incomingMessageCallback != nil {
 		reply := s.incomingMessageCallback(eventData.User, eventData.Channel, strings.HasPrefix(eventData.Channel, "D"), eventData.Text)
 		if reply != "" {
 			_, err := s.PostMessage(ctx, eventData.Channel, reply)
 			if err != nil {
-				s.logger.Debug("failed to send response to message", zap.Error(err), zap.String("response", reply), zap.Any("message", *eventData))
+				logger.Debug("failed to send response to message", zap.Error(err), zap.String("response", reply))
 			}
 		}
 	}
@@ -400,12 +415,24 @@ func (s *slackInterface) removeReactions(ctx context.Context, ref slack.ItemRef,
 	return errg.Err()
 }
 
-// GetOAuthV2Token issues a call to Slack to get a OAuth V2 token.
+// GetOAuthV2Token issues a call to Slack to get a OAuth V2 token. The response can be turned
+// into team setup data with NewSetupData.
 func GetOAuthV2Token(ctx context.Context, clientID, clientSecret, code, redirectURI string) (resp *slack.OAuthV2Response, err error) {
-	return slack.GetOAuthV2ResponseContext(ctx, http.DefaultClient, clientID, clientSecret, code, redirectURI)
+	values := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}
+	resp = &slack.OAuthV2Response{}
+	if err := postForm(ctx, *APIURL+"oauth.v2.access", values, resp); err != nil {
+		return nil, err
+	}
+	return resp, resp.Err()
 }
 
-// postForm is very similar to slack.postForm(); reimplemented for the sake of getOAuthToken().
+// postForm is very similar to slack.postForm(); reimplemented so that the Web API URL can be
+// changed for OAuth calls too.
 func postForm(ctx context.Context, endpoint string, values url.Values, intf interface{}) error {
 	reqBody := strings.NewReader(values.Encode())
 	req, err := http.NewRequest("POST", endpoint, reqBody)
@@ -0,0 +1,160 @@
+package slack
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/storj/changesetchihuahua/slack/slacktest"
+)
+
+// useFakeSlack points the Slack client code at a new fake server, for the length of the test.
+func useFakeSlack(t *testing.T) *slacktest.Server {
+	server := slacktest.NewServer()
+	oldURL, oldSecret := *APIURL, *SigningSecret
+	*APIURL, *SigningSecret = server.URL, "signing-secret"
+	t.Cleanup(func() {
+		*APIURL, *SigningSecret = oldURL, oldSecret
+		server.Close()
+	})
+	return server
+}
+
+func TestSlackInterface(t *testing.T) {
+	ctx := context.Background()
+	server := useFakeSlack(t)
+	server.AddUser(slacktest.User{ID: "U1", Name: "jane", RealName: "Jane Doe", Email: "jane@example.com", TZOffset: 3600})
+	server.AddUser(slacktest.User{ID: "U2", Name: "joe", RealName: "Joe Bloggs", Email: "joe@example.com", Presence: "away"})
+	server.AddChannel("C1", "general")
+	server.AddChannel("C2", "reviews")
+	server.AddOAuthCode("code-1", "U1")
+
+	_, err := GetOAuthV2Token(ctx, "client", "secret", "bad-code", "https://example.com/slack/oauth")
+	require.Error(t, err)
+	resp, err := GetOAuthV2Token(ctx, "client", "secret", "code-1", "https://example.com/slack/oauth")
+	require.NoError(t, err)
+	assert.Equal(t, slacktest.DefaultTeamID, resp.Team.ID)
+	setupData, err := NewSetupData(resp, time.Now())
+	require.NoError(t, err)
+
+	chat, err := NewSlackInterface(zaptest.NewLogger(t), setupData, nil, nil)
+	require.NoError(t, err)
+	installer, err := chat.GetInstallingUser(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "U1", installer)
+
+	user, err := chat.LookupUserByEmail(ctx, "joe@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "U2", user.ChatID())
+	assert.Equal(t, "Joe Bloggs", user.RealName())
+	assert.False(t, user.IsOnline())
+	user, err = chat.GetUserInfoByID(ctx, "U1")
+	require.NoError(t, err)
+	assert.True(t, user.IsOnline())
+	_, offset := time.Now().In(user.Timezone()).Zone()
+	assert.Equal(t, 3600, offset)
+	_, err = chat.LookupUserByEmail(ctx, "nobody@example.com")
+	require.Error(t, err)
+
+	chanID, err := chat.LookupChannelByName(ctx, "#reviews")
+	require.NoError(t, err)
+	assert.Equal(t, "C2", chanID)
+	_, err = chat.LookupChannelByName(ctx, "#random")
+	require.Error(t, err)
+
+	handle, err := chat.SendNotification(ctx, "U2", "hello")
+	require.NoError(t, err)
+	_, err = chat.SendChannelReport(ctx, "C1", "Report", []string{"one", "two"})
+	require.NoError(t, err)
+	messages := server.Messages()
+	require.Len(t, messages, 3)
+	assert.Equal(t, slacktest.Message{Channel: slacktest.DMChannel("U2"), Timestamp: messages[0].Timestamp, Text: "hello"}, messages[0])
+	assert.Equal(t, "*Report*", messages[1].Text)
+	assert.Equal(t, messages[1].Timestamp, messages[2].ThreadTimestamp)
+	assert.Equal(t, "one\n\ntwo", messages[2].Text)
+
+	// the handle survives being stored and loaded again
+	handleJSON, err := handle.MarshalJSON()
+	require.NoError(t, err)
+	handle, err = chat.UnmarshalMessageHandle(string(handleJSON))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), handle.SentTime(), time.Minute)
+
+	require.NoError(t, chat.InformBuildTypeStarted(ctx, handle, "unit", "https://ci/1"))
+	assert.Equal(t, []string{"build_unit_started"}, server.Reactions(messages[0].Channel, messages[0].Timestamp))
+	require.NoError(t, chat.InformBuildTypeFailure(ctx, handle, "unit", "https://ci/1"))
+	assert.Equal(t, []string{"build_unit_failed"}, server.Reactions(messages[0].Channel, messages[0].Timestamp))
+	require.NoError(t, chat.InformBuildTypeSuccess(ctx, handle, "unit", "https://ci/2"))
+	assert.Equal(t, []string{"build_unit_succeeded"}, server.Reactions(messages[0].Channel, messages[0].Timestamp))
+	require.NoError(t, chat.InformBuildStarted(ctx, handle, "https://ci/3"))
+	require.NoError(t, chat.InformBuildSuccess(ctx, handle, "https://ci/3"))
+	assert.Equal(t, []string{"build_unit_succeeded", "white_check_mark"}, server.Reactions(messages[0].Channel, messages[0].Timestamp))
+	failure, ok := server.WaitForMessage(0, func(m slacktest.Message) bool { return m.Text == "Build failure: https://ci/1" })
+	require.True(t, ok)
+	assert.Equal(t, messages[0].Timestamp, failure.ThreadTimestamp)
+
+	server.FailMethod("chat.postMessage", "rate_limited")
+	_, err = chat.SendChannelNotification(ctx, "C1", "nope")
+	require.Error(t, err)
+	server.FailMethod("chat.postMessage", "")
+	_, err = chat.SendChannelNotification(ctx, "C1", "yep")
+	require.NoError(t, err)
+}
+
+func TestSlackEvents(t *testing.T) {
+	ctx := context.Background()
+	server := useFakeSlack(t)
+	server.AddUser(slacktest.User{ID: "U1"})
+
+	chat, err := NewSlackInterface(zaptest.NewLogger(t), mustSetupData(t, server, "U1"), nil, nil)
+	require.NoError(t, err)
+	chat.SetIncomingMessageCallback(func(userID, chanID string, isDM bool, text string) string {
+		if !isDM {
+			return ""
+		}
+		return strings.ToUpper(text)
+	})
+
+	body := slacktest.MessageEvent(server.TeamID(), "U1", slacktest.DMChannel("U1"), "woof")
+	req, err := slacktest.NewEventRequest("https://example.com/slack/events", *SigningSecret, body)
+	require.NoError(t, err)
+	event, teamID, err := VerifyEventMessage(req.Header, body)
+	require.NoError(t, err)
+	assert.Equal(t, server.TeamID(), teamID)
+	require.NoError(t, chat.HandleEvent(ctx, event))
+	reply, ok := server.WaitForMessage(time.Second, func(m slacktest.Message) bool { return m.Channel == slacktest.DMChannel("U1") })
+	require.True(t, ok)
+	assert.Equal(t, "WOOF", reply.Text)
+
+	// a request signed with the wrong secret is refused
+	req, err = slacktest.NewEventRequest("https://example.com/slack/events", "wrong-secret", body)
+	require.NoError(t, err)
+	_, _, err = VerifyEventMessage(req.Header, body)
+	require.True(t, errors.Is(err, ErrVerifyFailed))
+
+	body = slacktest.URLVerificationEvent("challenge-1")
+	req, err = slacktest.NewEventRequest("https://example.com/slack/events", *SigningSecret, body)
+	require.NoError(t, err)
+	event, _, err = VerifyEventMessage(req.Header, body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("challenge-1"), HandleNoTeamEvent(ctx, event))
+
+	body = slacktest.AppUninstalledEvent(server.TeamID())
+	req, err = slacktest.NewEventRequest("https://example.com/slack/events", *SigningSecret, body)
+	require.NoError(t, err)
+	event, _, err = VerifyEventMessage(req.Header, body)
+	require.NoError(t, err)
+	require.ErrorIs(t, chat.HandleEvent(ctx, event), ErrStopTeam)
+}
+
+func mustSetupData(t *testing.T, server *slacktest.Server, installingUserID string) string {
+	setupData, err := NewSetupData(server.OAuthResponse(installingUserID), time.Now())
+	require.NoError(t, err)
+	return setupData
+}
@@ -0,0 +1,97 @@
+package slacktest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MessageEvent returns the body of an Events API request telling of a message posted by a
+// user in a channel (or a DM channel, as given by DMChannel).
+func MessageEvent(teamID, userID, channelID, text string) []byte {
+	return callbackEvent(teamID, map[string]interface{}{
+		"type":         "message",
+		"user":         userID,
+		"channel":      channelID,
+		"channel_type": channelType(channelID),
+		"text":         text,
+		"ts":           strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64),
+	})
+}
+
+// AppUninstalledEvent returns the body of an Events API request telling that the app has
+// been uninstalled from a team.
+func AppUninstalledEvent(teamID string) []byte {
+	return callbackEvent(teamID, map[string]interface{}{
+		"type": "app_uninstalled",
+	})
+}
+
+// URLVerificationEvent returns the body of the Events API request Slack sends to check that
+// an events URL belongs to the app.
+func URLVerificationEvent(challenge string) []byte {
+	return mustMarshal(map[string]interface{}{
+		"type":      "url_verification",
+		"token":     "verification-token",
+		"challenge": challenge,
+	})
+}
+
+// NewEventRequest creates an Events API request for the given URL, signed with the signing
+// secret as Slack would sign it.
+func NewEventRequest(eventsURL, signingSecret string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, eventsURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, values := range SignatureHeaders(signingSecret, body, time.Now()) {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+// SignatureHeaders returns the headers with which Slack would sign a request with the given
+// body, sent at the given time.
+func SignatureHeaders(signingSecret string, body []byte, now time.Time) http.Header {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	_, _ = mac.Write([]byte("v0:" + timestamp + ":"))
+	_, _ = mac.Write(body)
+	header := make(http.Header)
+	header.Set("X-Slack-Request-Timestamp", timestamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func callbackEvent(teamID string, event map[string]interface{}) []byte {
+	return mustMarshal(map[string]interface{}{
+		"token":      "verification-token",
+		"team_id":    teamID,
+		"api_app_id": "ATEST",
+		"type":       "event_callback",
+		"event_id":   "Ev" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		"event_time": time.Now().Unix(),
+		"event":      event,
+	})
+}
+
+func channelType(channelID string) string {
+	if len(channelID) > 0 && channelID[0] == 'D' {
+		return "im"
+	}
+	return "channel"
+}
+
+func mustMarshal(v interface{}) []byte {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
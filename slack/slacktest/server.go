@@ -0,0 +1,451 @@
+// Package slacktest provides an in-process fake Slack server, for testing code which talks to
+// the Slack Web API, along with helpers for building signed Events API requests. The fake
+// serves the Web API methods used by Changeset Chihuahua from state which tests set up, and
+// records the messages and reactions sent to it so that tests can inspect them.
+package slacktest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// DefaultTeamID is the ID of the team served by a new Server.
+	DefaultTeamID = "T0TEST"
+	// DefaultTeamName is the name of the team served by a new Server.
+	DefaultTeamName = "Test Team"
+	// BotUserID is the user ID of the app's bot user.
+	BotUserID = "UBOT"
+	// AccessToken is the access token issued to the app. Web API calls with any other token
+	// are refused.
+	AccessToken = "xoxb-slacktest"
+)
+
+// User is a Slack user known to the fake server.
+type User struct {
+	ID       string
+	Name     string
+	RealName string
+	Email    string
+	// TZOffset is the user's offset from UTC, in seconds.
+	TZOffset int
+	// Presence is "active" or "away".
+	Presence string
+}
+
+// Message is a message posted through the fake server.
+type Message struct {
+	Channel   string
+	Timestamp string
+	// ThreadTimestamp is the timestamp of the message this one was posted in reply to, if any.
+	ThreadTimestamp string
+	Text            string
+}
+
+// Server is a fake Slack Web API server. Its state can be changed at any time, including
+// while requests are being served.
+type Server struct {
+	// URL is the base URL of the Web API, suitable for use as the slack-api-url setting.
+	URL string
+
+	httpServer *httptest.Server
+
+	lock     sync.Mutex
+	teamID   string
+	teamName string
+	users    map[string]*User
+	// channels maps IDs of channels the bot is a member of to their names.
+	channels map[string]string
+	// oauthCodes maps unused OAuth codes to the users who will have installed the app.
+	oauthCodes map[string]string
+	// failures maps Web API method names to the error they should fail with.
+	failures  map[string]string
+	messages  []Message
+	reactions map[string]map[string]bool
+	lastTS    int64
+	// changed is closed, and replaced, whenever messages or reactions change.
+	changed chan struct{}
+}
+
+// NewServer starts a new fake Slack server with no users or channels. It should be closed
+// with Close when no longer needed.
+func NewServer() *Server {
+	s := &Server{
+		teamID:     DefaultTeamID,
+		teamName:   DefaultTeamName,
+		users:      make(map[string]*User),
+		channels:   make(map[string]string),
+		oauthCodes: make(map[string]string),
+		failures:   make(map[string]string),
+		reactions:  make(map[string]map[string]bool),
+		lastTS:     time.Now().UnixNano() / 1000,
+		changed:    make(chan struct{}),
+	}
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL + "/api/"
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// TeamID returns the ID of the team served.
+func (s *Server) TeamID() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.teamID
+}
+
+// SetTeam changes the ID and name of the team served.
+func (s *Server) SetTeam(teamID, teamName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.teamID = teamID
+	s.teamName = teamName
+}
+
+// AddUser adds a user, replacing any existing user with the same ID. Users are "active"
+// unless given another presence.
+func (s *Server) AddUser(user User) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if user.Presence == "" {
+		user.Presence = "active"
+	}
+	s.users[user.ID] = &user
+}
+
+// SetPresence changes the presence ("active" or "away") of a user.
+func (s *Server) SetPresence(userID, presence string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if user, ok := s.users[userID]; ok {
+		user.Presence = presence
+	}
+}
+
+// AddChannel adds a channel which the bot is a member of.
+func (s *Server) AddChannel(channelID, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.channels[channelID] = name
+}
+
+// AddOAuthCode arranges for the given code to be accepted once by oauth.v2.access, as if
+// installingUserID had just installed the app.
+func (s *Server) AddOAuthCode(code, installingUserID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.oauthCodes[code] = installingUserID
+}
+
+// OAuthResponse returns the OAuth V2 response the server gives when installingUserID
+// installs the app.
+func (s *Server) OAuthResponse(installingUserID string) *slack.OAuthV2Response {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.oauthResponse(installingUserID)
+}
+
+// FailMethod makes calls to a Web API method (like "chat.postMessage") fail with the given
+// Slack error code. An empty error code makes the method work normally again.
+func (s *Server) FailMethod(method, slackError string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if slackError == "" {
+		delete(s.failures, method)
+	} else {
+		s.failures[method] = slackError
+	}
+}
+
+// DMChannel returns the ID of the direct message channel with a user.
+func DMChannel(userID string) string {
+	return "D" + userID
+}
+
+// Messages returns all messages posted so far.
+func (s *Server) Messages() []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Reactions returns the names of the reactions currently on a message, sorted.
+func (s *Server) Reactions(channel, timestamp string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var names []string
+	for name := range s.reactions[channel+"/"+timestamp] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WaitForMessage waits until a message matching the given function has been posted, and
+// returns it. It returns false if there is no such message before the timeout.
+func (s *Server) WaitForMessage(timeout time.Duration, match func(Message) bool) (Message, bool) {
+	var found Message
+	ok := s.waitFor(timeout, func() bool {
+		for _, message := range s.messages {
+			if match(message) {
+				found = message
+				return true
+			}
+		}
+		return false
+	})
+	return found, ok
+}
+
+// WaitForReaction waits until the named reaction is on a message. It returns false if that
+// does not happen before the timeout.
+func (s *Server) WaitForReaction(timeout time.Duration, channel, timestamp, name string) bool {
+	return s.waitFor(timeout, func() bool {
+		return s.reactions[channel+"/"+timestamp][name]
+	})
+}
+
+// waitFor waits until cond, which is called with s.lock held, returns true.
+func (s *Server) waitFor(timeout time.Duration, cond func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		done := cond()
+		changed := s.changed
+		s.lock.Unlock()
+		if done {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// noteChange wakes up waiters. s.lock must be held.
+func (s *Server) noteChange() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	method, ok := strings.CutPrefix(r.URL.Path, "/api/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if slackError, ok := s.failures[method]; ok {
+		writeError(w, slackError)
+		return
+	}
+	if method == "oauth.v2.access" {
+		s.oauthAccess(w, r)
+		return
+	}
+	if requestToken(r) != AccessToken {
+		writeError(w, "invalid_auth")
+		return
+	}
+
+	switch method {
+	case "auth.test":
+		writeOK(w, map[string]interface{}{"team_id": s.teamID, "team": s.teamName, "user_id": BotUserID})
+	case "chat.postMessage":
+		s.postMessage(w, r)
+	case "conversations.open":
+		userID := strings.Split(r.Form.Get("users"), ",")[0]
+		if _, ok := s.users[userID]; !ok {
+			writeError(w, "user_not_found")
+			return
+		}
+		writeOK(w, map[string]interface{}{"channel": map[string]interface{}{"id": DMChannel(userID)}})
+	case "users.conversations":
+		s.listChannels(w)
+	case "users.info":
+		user, ok := s.users[r.Form.Get("user")]
+		if !ok {
+			writeError(w, "user_not_found")
+			return
+		}
+		writeOK(w, map[string]interface{}{"user": slackUser(user)})
+	case "users.lookupByEmail":
+		for _, user := range s.users {
+			if strings.EqualFold(user.Email, r.Form.Get("email")) {
+				writeOK(w, map[string]interface{}{"user": slackUser(user)})
+				return
+			}
+		}
+		writeError(w, "users_not_found")
+	case "users.getPresence":
+		user, ok := s.users[r.Form.Get("user")]
+		if !ok {
+			writeError(w, "user_not_found")
+			return
+		}
+		writeOK(w, map[string]interface{}{"presence": user.Presence, "online": user.Presence == "active"})
+	case "reactions.add", "reactions.remove":
+		s.changeReaction(w, r, method == "reactions.add")
+	default:
+		writeError(w, "unknown_method")
+	}
+}
+
+// oauthAccess serves oauth.v2.access, exchanging a code added with AddOAuthCode for an
+// access token.
+func (s *Server) oauthAccess(w http.ResponseWriter, r *http.Request) {
+	installingUserID, ok := s.oauthCodes[r.Form.Get("code")]
+	if !ok {
+		writeError(w, "invalid_code")
+		return
+	}
+	delete(s.oauthCodes, r.Form.Get("code"))
+	writeJSON(w, s.oauthResponse(installingUserID))
+}
+
+// oauthResponse returns the OAuth V2 response for an installation. s.lock must be held.
+func (s *Server) oauthResponse(installingUserID string) *slack.OAuthV2Response {
+	return &slack.OAuthV2Response{
+		AccessToken: AccessToken,
+		TokenType:   "bot",
+		Scope:       "chat:write,im:write,reactions:write,users:read,users:read.email",
+		BotUserID:   BotUserID,
+		AppID:       "ATEST",
+		Team:        slack.OAuthV2ResponseTeam{ID: s.teamID, Name: s.teamName},
+		AuthedUser:  slack.OAuthV2ResponseAuthedUser{ID: installingUserID},
+		SlackResponse: slack.SlackResponse{
+			Ok: true,
+		},
+	}
+}
+
+func (s *Server) postMessage(w http.ResponseWriter, r *http.Request) {
+	channel := r.Form.Get("channel")
+	if _, ok := s.channels[channel]; !ok && !strings.HasPrefix(channel, "D") {
+		writeError(w, "channel_not_found")
+		return
+	}
+	// timestamps must be unique within a channel; these are unique everywhere
+	s.lastTS++
+	timestamp := strconv.FormatInt(s.lastTS/1000000, 10) + "." + strconv.FormatInt(s.lastTS%1000000+1000000, 10)[1:]
+	s.messages = append(s.messages, Message{
+		Channel:         channel,
+		Timestamp:       timestamp,
+		ThreadTimestamp: r.Form.Get("thread_ts"),
+		Text:            r.Form.Get("text"),
+	})
+	s.noteChange()
+	writeOK(w, map[string]interface{}{"channel": channel, "ts": timestamp})
+}
+
+func (s *Server) listChannels(w http.ResponseWriter) {
+	var channels []map[string]interface{}
+	for id, name := range s.channels {
+		channels = append(channels, map[string]interface{}{"id": id, "name": name, "name_normalized": name, "is_channel": true})
+	}
+	writeOK(w, map[string]interface{}{
+		"channels":          channels,
+		"response_metadata": map[string]string{"next_cursor": ""},
+	})
+}
+
+func (s *Server) changeReaction(w http.ResponseWriter, r *http.Request, add bool) {
+	key := r.Form.Get("channel") + "/" + r.Form.Get("timestamp")
+	name := r.Form.Get("name")
+	found := false
+	for _, message := range s.messages {
+		if message.Channel+"/"+message.Timestamp == key {
+			found = true
+		}
+	}
+	if !found {
+		writeError(w, "message_not_found")
+		return
+	}
+	if add {
+		if s.reactions[key][name] {
+			writeError(w, "already_reacted")
+			return
+		}
+		if s.reactions[key] == nil {
+			s.reactions[key] = make(map[string]bool)
+		}
+		s.reactions[key][name] = true
+	} else {
+		if !s.reactions[key][name] {
+			writeError(w, "no_reaction")
+			return
+		}
+		delete(s.reactions[key], name)
+	}
+	s.noteChange()
+	writeOK(w, nil)
+}
+
+// slackUser describes a user as the Web API does.
+func slackUser(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        user.ID,
+		"name":      user.Name,
+		"real_name": user.RealName,
+		"tz_offset": user.TZOffset,
+		"profile": map[string]interface{}{
+			"real_name": user.RealName,
+			"email":     user.Email,
+		},
+	}
+}
+
+// requestToken finds the access token given with a Web API request, which may be in the
+// Authorization header or in the form values.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.Form.Get("token")
+}
+
+func writeOK(w http.ResponseWriter, fields map[string]interface{}) {
+	response := map[string]interface{}{"ok": true}
+	for key, value := range fields {
+		response[key] = value
+	}
+	writeJSON(w, response)
+}
+
+func writeError(w http.ResponseWriter, slackError string) {
+	writeJSON(w, slack.SlackResponse{Ok: false, Error: slackError})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
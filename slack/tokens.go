@@ -0,0 +1,348 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+)
+
+// tokenRefreshMargin is how long before an expiring access token runs out that it is
+// refreshed.
+const tokenRefreshMargin = 5 * time.Minute
+
+// setupData is the team setup data stored by the Governor: the OAuth V2 response Slack gave
+// when the team installed the app, with the access token and refresh token replaced as they
+// are rotated.
+type setupData struct {
+	slack.OAuthV2Response
+	// ExpiresAt is the Unix time at which AccessToken expires, or 0 if it does not expire.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// NewSetupData serializes an OAuth V2 response received at time now as team setup data,
+// suitable for passing to NewSlackInterface.
+func NewSetupData(resp *slack.OAuthV2Response, now time.Time) (string, error) {
+	data := setupData{OAuthV2Response: *resp}
+	if resp.ExpiresIn > 0 {
+		data.ExpiresAt = now.Add(time.Duration(resp.ExpiresIn) * time.Second).Unix()
+	}
+	jsonBlob, err := json.Marshal(data)
+	return string(jsonBlob), err
+}
+
+// tokenSource keeps track of a team's access token. When the workspace has token rotation
+// enabled, Slack issues access tokens which expire along with a refresh token, and
+// tokenSource exchanges the refresh token for a new access token as needed.
+type tokenSource struct {
+	logger       *zap.Logger
+	clientID     string
+	clientSecret string
+	refreshURL   string
+	getTime      func() time.Time
+	// loadSetupData (if not nil) returns the team's stored setup data, which may hold tokens
+	// refreshed by another instance serving the same team.
+	loadSetupData func(ctx context.Context) (string, error)
+	// saveSetupData is called (if not nil) with the updated setup data after each refresh.
+	saveSetupData func(ctx context.Context, setupData string) error
+
+	// lock protects data, and is held while refreshing so that only one refresh happens at
+	// a time.
+	lock sync.Mutex
+	data setupData
+}
+
+func newTokenSource(logger *zap.Logger, data setupData, loadSetupData func(ctx context.Context) (string, error), saveSetupData func(ctx context.Context, setupData string) error) *tokenSource {
+	if data.ExpiresAt == 0 && data.ExpiresIn > 0 {
+		// setup data from before expiry was tracked; we can't know when this token was
+		// issued, so refresh it before its first use.
+		data.ExpiresAt = time.Now().Unix()
+	}
+	return &tokenSource{
+		logger:        logger,
+		clientID:      *ClientID,
+		clientSecret:  *ClientSecret,
+		refreshURL:    *APIURL + "oauth.v2.access",
+		getTime:       time.Now,
+		loadSetupData: loadSetupData,
+		saveSetupData: saveSetupData,
+		data:          data,
+	}
+}
+
+// rotates reports whether the token can be refreshed.
+func (ts *tokenSource) rotates() bool {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.data.RefreshToken != ""
+}
+
+// Token returns the current access token, first refreshing it if it will expire soon.
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.data.RefreshToken == "" || ts.data.ExpiresAt == 0 {
+		return ts.data.AccessToken, nil
+	}
+	expiresAt := time.Unix(ts.data.ExpiresAt, 0)
+	now := ts.getTime()
+	if now.Add(tokenRefreshMargin).Before(expiresAt) {
+		return ts.data.AccessToken, nil
+	}
+	if err := ts.refreshLocked(ctx); err != nil {
+		if now.Before(expiresAt) {
+			// there is still a little time left; try again on the next call.
+			ts.logger.Warn("could not refresh slack token before expiry", zap.Time("expires-at", expiresAt), zap.Error(err))
+			return ts.data.AccessToken, nil
+		}
+		return "", err
+	}
+	return ts.data.AccessToken, nil
+}
+
+// Refresh is called when Slack has rejected expiredToken as expired. It returns a new access
+// token, refreshing it unless that has already been done by another caller.
+func (ts *tokenSource) Refresh(ctx context.Context, expiredToken string) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.data.AccessToken != expiredToken {
+		return ts.data.AccessToken, nil
+	}
+	if ts.data.RefreshToken == "" {
+		return "", errs.New("slack token has expired, and there is no refresh token")
+	}
+	if err := ts.refreshLocked(ctx); err != nil {
+		return "", err
+	}
+	return ts.data.AccessToken, nil
+}
+
+// refreshLocked gets a new access token, and saves the updated setup data. ts.lock must be
+// held.
+//
+// Every instance serving the team refreshes the same token, and once one of them has done
+// so, the refresh token the others hold is no good. So the stored setup data is checked
+// first, in case the token has already been refreshed elsewhere, and again if the refresh
+// fails, in case that happened in the meantime.
+func (ts *tokenSource) refreshLocked(ctx context.Context) error {
+	changed, fresh := ts.reloadLocked(ctx)
+	if fresh {
+		return nil
+	}
+	err := ts.exchangeLocked(ctx)
+	if err == nil {
+		return nil
+	}
+	if changed, fresh = ts.reloadLocked(ctx); fresh {
+		return nil
+	}
+	if !changed {
+		return err
+	}
+	return ts.exchangeLocked(ctx)
+}
+
+// reloadLocked replaces the tokens held by ts with those in the stored setup data, if they
+// differ. It reports whether they did, and whether the stored access token is good for long
+// enough that it need not be refreshed. ts.lock must be held.
+func (ts *tokenSource) reloadLocked(ctx context.Context) (changed, fresh bool) {
+	if ts.loadSetupData == nil {
+		return false, false
+	}
+	setupDataJSON, err := ts.loadSetupData(ctx)
+	if err != nil {
+		ts.logger.Warn("could not load stored slack token", zap.Error(err))
+		return false, false
+	}
+	var stored setupData
+	if err := json.Unmarshal([]byte(setupDataJSON), &stored); err != nil {
+		ts.logger.Warn("could not parse stored setup data", zap.Error(err))
+		return false, false
+	}
+	if stored.AccessToken == ts.data.AccessToken && stored.RefreshToken == ts.data.RefreshToken {
+		return false, false
+	}
+	ts.data = stored
+	fresh = stored.ExpiresAt != 0 && ts.getTime().Add(tokenRefreshMargin).Before(time.Unix(stored.ExpiresAt, 0))
+	ts.logger.Info("using slack token refreshed by another instance", zap.Int64("expires-at", stored.ExpiresAt), zap.Bool("fresh", fresh))
+	return true, fresh
+}
+
+// exchangeLocked exchanges the refresh token for a new access token through oauth.v2.access,
+// and saves the updated setup data. ts.lock must be held.
+func (ts *tokenSource) exchangeLocked(ctx context.Context) error {
+	values := url.Values{
+		"client_id":     {ts.clientID},
+		"client_secret": {ts.clientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {ts.data.RefreshToken},
+	}
+	var resp slack.OAuthV2Response
+	if err := postForm(ctx, ts.refreshURL, values, &resp); err != nil {
+		return errs.New("could not refresh slack token: %v", err)
+	}
+	if !resp.Ok {
+		return errs.New("could not refresh slack token: %s", resp.Error)
+	}
+	if resp.AccessToken == "" {
+		return errs.New("could not refresh slack token: no access token in response")
+	}
+
+	ts.data.AccessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		ts.data.RefreshToken = resp.RefreshToken
+	}
+	ts.data.ExpiresIn = resp.ExpiresIn
+	ts.data.ExpiresAt = 0
+	if resp.ExpiresIn > 0 {
+		ts.data.ExpiresAt = ts.getTime().Add(time.Duration(resp.ExpiresIn) * time.Second).Unix()
+	}
+	ts.logger.Info("refreshed slack token", zap.Int64("expires-at", ts.data.ExpiresAt))
+
+	if ts.saveSetupData != nil {
+		jsonBlob, err := json.Marshal(ts.data)
+		if err != nil {
+			return err
+		}
+		// the new token is good either way, so don't fail the call over this. but if the
+		// refresh token was rotated too, the stored one will no longer work after a restart.
+		if err := ts.saveSetupData(ctx, string(jsonBlob)); err != nil {
+			ts.logger.Error("could not save refreshed slack token", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// tokenTransport is an http.RoundTripper which sends Slack API requests with the current
+// access token from a tokenSource, whatever token the slack client was created with. When
+// Slack answers that the token has expired, the token is refreshed and the request retried.
+type tokenTransport struct {
+	tokens     *tokenSource
+	underlying http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (tt *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !tt.tokens.rotates() {
+		return tt.underlying.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := tt.tokens.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tt.underlying.RoundTrip(withToken(req, body, token))
+	if err != nil {
+		return nil, err
+	}
+	expired, err := isTokenExpiredResponse(resp)
+	if err != nil || !expired {
+		return resp, err
+	}
+	_ = resp.Body.Close()
+
+	tt.tokens.logger.Info("slack token expired; refreshing and retrying", zap.String("url", req.URL.Path))
+	token, err = tt.tokens.Refresh(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	return tt.underlying.RoundTrip(withToken(req, body, token))
+}
+
+// withToken returns a copy of req, with the given body, in which the access token (whether
+// given in the Authorization header, the query string, or a form body) is replaced by token.
+func withToken(req *http.Request, body []byte, token string) *http.Request {
+	newReq := req.Clone(req.Context())
+	if newReq.Header.Get("Authorization") != "" {
+		newReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	if query := newReq.URL.Query(); query.Has("token") {
+		query.Set("token", token)
+		newReq.URL.RawQuery = query.Encode()
+	}
+	if body == nil {
+		return newReq
+	}
+	if mediaType, _, _ := mime.ParseMediaType(newReq.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		if values, err := url.ParseQuery(string(body)); err == nil && values.Has("token") {
+			values.Set("token", token)
+			body = []byte(values.Encode())
+		}
+	}
+	newReq.Body = io.NopCloser(bytes.NewReader(body))
+	newReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	newReq.ContentLength = int64(len(body))
+	return newReq
+}
+
+// isTokenExpiredResponse checks whether resp is Slack's token_expired error. The response
+// body is buffered so that it can still be read by the caller.
+func isTokenExpiredResponse(resp *http.Response) (bool, error) {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return false, nil
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	var slackResp slack.SlackResponse
+	if err := json.Unmarshal(respBody, &slackResp); err != nil {
+		return false, nil
+	}
+	return !slackResp.Ok && slackResp.Error == "token_expired", nil
+}
+
+// SetupSummary describes a team's setup data without its secrets, for showing to operators.
+type SetupSummary struct {
+	TeamID    string
+	TeamName  string
+	AppID     string
+	BotUserID string
+	Scope     string
+	// TokenExpiresAt is when the current access token expires, or the zero time if it does
+	// not expire.
+	TokenExpiresAt time.Time
+}
+
+// SummarizeSetupData returns a SetupSummary of the given team setup data.
+func SummarizeSetupData(setupDataJSON string) (SetupSummary, error) {
+	var data setupData
+	if err := json.Unmarshal([]byte(setupDataJSON), &data); err != nil {
+		return SetupSummary{}, errs.New("invalid setup data: %w", err)
+	}
+	summary := SetupSummary{
+		TeamID:    data.Team.ID,
+		TeamName:  data.Team.Name,
+		AppID:     data.AppID,
+		BotUserID: data.BotUserID,
+		Scope:     data.Scope,
+	}
+	if data.ExpiresAt != 0 {
+		summary.TokenExpiresAt = time.Unix(data.ExpiresAt, 0)
+	}
+	return summary, nil
+}
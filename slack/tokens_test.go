@@ -0,0 +1,218 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeTokenServer acts as both the Slack Web API (auth.test only) and the OAuth token
+// endpoint, accepting only the most recently issued access token. The refresh token is
+// "refresh-1", unless rotateRefresh is set, in which case a new one is issued each time.
+type fakeTokenServer struct {
+	lock          sync.Mutex
+	validToken    string
+	validRefresh  string
+	rotateRefresh bool
+	refreshes     int
+	authTests     int
+	nextTokenID   int
+}
+
+func (f *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	switch r.URL.Path {
+	case "/oauth.v2.access":
+		if f.validRefresh == "" {
+			f.validRefresh = "refresh-1"
+		}
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != f.validRefresh {
+			_ = json.NewEncoder(w).Encode(slack.SlackResponse{Ok: false, Error: "invalid_refresh_token"})
+			return
+		}
+		f.refreshes++
+		f.nextTokenID++
+		f.validToken = "xoxe.xoxb-" + string(rune('a'+f.nextTokenID))
+		if f.rotateRefresh {
+			f.validRefresh = "refresh-" + strconv.Itoa(f.nextTokenID+1)
+		}
+		_ = json.NewEncoder(w).Encode(slack.OAuthV2Response{
+			AccessToken:   f.validToken,
+			RefreshToken:  f.validRefresh,
+			ExpiresIn:     43200,
+			SlackResponse: slack.SlackResponse{Ok: true},
+		})
+	case "/auth.test":
+		f.authTests++
+		if r.FormValue("token") != f.validToken {
+			_ = json.NewEncoder(w).Encode(slack.SlackResponse{Ok: false, Error: "token_expired"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "team": "T1"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeTokenServer{validToken: "xoxe.xoxb-a"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var saved []string
+	data := setupData{
+		OAuthV2Response: slack.OAuthV2Response{
+			AccessToken:  "xoxe.xoxb-a",
+			RefreshToken: "refresh-1",
+			ExpiresIn:    43200,
+			Team:         slack.OAuthV2ResponseTeam{ID: "T1"},
+		},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	tokens := newTokenSource(zaptest.NewLogger(t), data, nil, func(ctx context.Context, setupData string) error {
+		saved = append(saved, setupData)
+		return nil
+	})
+	tokens.refreshURL = server.URL + "/oauth.v2.access"
+	tokens.getTime = func() time.Time { return now }
+	api := slack.New("xoxe.xoxb-a",
+		slack.OptionAPIURL(server.URL+"/"),
+		slack.OptionHTTPClient(&http.Client{Transport: &tokenTransport{tokens: tokens, underlying: http.DefaultTransport}}))
+
+	// the token is still good, so it is used as is
+	resp, err := api.AuthTestContext(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "T1", resp.Team)
+	assert.Equal(t, 0, fake.refreshes)
+	assert.Empty(t, saved)
+
+	// the token is about to expire, so it is refreshed before the call
+	now = now.Add(time.Hour - time.Minute)
+	_, err = api.AuthTestContext(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.refreshes)
+	assert.Equal(t, 2, fake.authTests)
+	require.Len(t, saved, 1)
+	var savedData setupData
+	require.NoError(t, json.Unmarshal([]byte(saved[0]), &savedData))
+	assert.Equal(t, "xoxe.xoxb-b", savedData.AccessToken)
+	assert.Equal(t, "refresh-1", savedData.RefreshToken)
+	assert.Equal(t, "T1", savedData.Team.ID)
+	assert.Equal(t, now.Add(12*time.Hour).Unix(), savedData.ExpiresAt)
+
+	// Slack revokes the token early; it is refreshed and the call retried
+	fake.lock.Lock()
+	fake.validToken = "revoked"
+	fake.lock.Unlock()
+	resp, err = api.AuthTestContext(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "T1", resp.Team)
+	assert.Equal(t, 2, fake.refreshes)
+	assert.Equal(t, 4, fake.authTests)
+	require.Len(t, saved, 2)
+}
+
+func TestTokenRotationAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeTokenServer{validToken: "xoxe.xoxb-a", rotateRefresh: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	stale := setupData{
+		OAuthV2Response: slack.OAuthV2Response{AccessToken: "xoxe.xoxb-a", RefreshToken: "refresh-1", ExpiresIn: 43200},
+		ExpiresAt:       now.Add(time.Hour).Unix(),
+	}
+	staleJSON, err := json.Marshal(stale)
+	require.NoError(t, err)
+	stored := string(staleJSON)
+	var loadErr error
+	newInstance := func() *tokenSource {
+		tokens := newTokenSource(zaptest.NewLogger(t), stale,
+			func(ctx context.Context) (string, error) {
+				if loadErr != nil {
+					defer func() { loadErr = nil }()
+					return "", loadErr
+				}
+				return stored, nil
+			},
+			func(ctx context.Context, setupData string) error {
+				stored = setupData
+				return nil
+			})
+		tokens.refreshURL = server.URL + "/oauth.v2.access"
+		tokens.getTime = func() time.Time { return now }
+		return tokens
+	}
+	instanceA, instanceB, instanceC := newInstance(), newInstance(), newInstance()
+	now = now.Add(time.Hour - time.Minute)
+
+	// the first instance to need a new token refreshes it
+	token, err := instanceA.Token(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "xoxe.xoxb-b", token)
+	assert.Equal(t, 1, fake.refreshes)
+
+	// the others find it in the stored setup data, instead of using up the refresh token
+	token, err = instanceB.Token(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "xoxe.xoxb-b", token)
+	assert.Equal(t, 1, fake.refreshes)
+
+	// even if the stored setup data can't be read at first, a failed refresh sends the
+	// instance back to it
+	loadErr = errs.New("db is down")
+	token, err = instanceC.Token(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "xoxe.xoxb-b", token)
+	assert.Equal(t, 1, fake.refreshes)
+
+	// and when the token is rejected, the new refresh token is used
+	now = now.Add(12 * time.Hour)
+	token, err = instanceB.Refresh(ctx, "xoxe.xoxb-b")
+	require.NoError(t, err)
+	assert.Equal(t, "xoxe.xoxb-c", token)
+	token, err = instanceA.Refresh(ctx, "xoxe.xoxb-b")
+	require.NoError(t, err)
+	assert.Equal(t, "xoxe.xoxb-c", token)
+	assert.Equal(t, 2, fake.refreshes)
+}
+
+func TestNewSetupData(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	setupJSON, err := NewSetupData(&slack.OAuthV2Response{AccessToken: "xoxe.xoxb-a", RefreshToken: "r", ExpiresIn: 60}, now)
+	require.NoError(t, err)
+	var data setupData
+	require.NoError(t, json.Unmarshal([]byte(setupJSON), &data))
+	assert.Equal(t, "xoxe.xoxb-a", data.AccessToken)
+	assert.Equal(t, now.Add(time.Minute).Unix(), data.ExpiresAt)
+
+	setupJSON, err = NewSetupData(&slack.OAuthV2Response{AccessToken: "xoxb-a"}, now)
+	require.NoError(t, err)
+	data = setupData{}
+	require.NoError(t, json.Unmarshal([]byte(setupJSON), &data))
+	assert.Zero(t, data.ExpiresAt)
+
+	resp := &slack.OAuthV2Response{AccessToken: "xoxe.xoxb-a", RefreshToken: "r", ExpiresIn: 60, BotUserID: "U1"}
+	resp.Team.ID, resp.Team.Name = "T1", "Storj"
+	setupJSON, err = NewSetupData(resp, now)
+	require.NoError(t, err)
+	summary, err := SummarizeSetupData(setupJSON)
+	require.NoError(t, err)
+	assert.Equal(t, SetupSummary{TeamID: "T1", TeamName: "Storj", BotUserID: "U1", TokenExpiresAt: time.Unix(now.Add(time.Minute).Unix(), 0)}, summary)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,21 +14,26 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/storj/changesetchihuahua/config"
 	"github.com/storj/changesetchihuahua/gerrit/events"
+	"github.com/storj/changesetchihuahua/metrics"
 	"github.com/storj/changesetchihuahua/slack"
 )
 
 var (
-	logGerritEvents = flag.Bool("log-gerrit-events", false, "If given, log all Gerrit events received")
+	logGerritEvents = config.BoolFlag("log-gerrit-events", false, "If given, log all Gerrit events received")
+	operatorToken   = flag.String("operator-token", "", "Bearer token required to access operator endpoints such as /status. If empty, operator endpoints are disabled.")
 )
 
 type uiWebState struct {
 	logger      *zap.Logger
 	governor    *Governor
 	externalURL *url.URL
+	capture     *eventCapture
 }
 
 type uiWebServer struct {
@@ -35,11 +41,12 @@ type uiWebServer struct {
 	handler http.Handler
 }
 
-func newUIWebState(logger *zap.Logger, governor *Governor, externalURL *url.URL) *uiWebState {
+func newUIWebState(logger *zap.Logger, governor *Governor, externalURL *url.URL, capture *eventCapture) *uiWebState {
 	return &uiWebState{
 		logger:      logger,
 		governor:    governor,
 		externalURL: externalURL,
+		capture:     capture,
 	}
 }
 
@@ -106,13 +113,13 @@ func (ws *uiWebState) maybeOAuthRedirect(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	ws.logger.Info("OAuth flow success", zap.Any("response", resp))
-	jsonBlob, err := json.Marshal(resp)
+	setupData, err := slack.NewSetupData(resp, time.Now())
 	if err != nil {
 		ws.logger.Error("failed to marshal OAuth token data?!", zap.Error(err))
 		_, _ = w.Write([]byte("Failed to record OAuth token data."))
 		return
 	}
-	if err := ws.governor.NewTeam(resp.Team.ID, string(jsonBlob)); err != nil {
+	if err := ws.governor.NewTeam(resp.Team.ID, setupData); err != nil {
 		ws.logger.Error("failed to create new team record", zap.Error(err))
 		_, _ = w.Write([]byte("Failed to record new team."))
 		return
@@ -133,24 +140,149 @@ func (ws *uiWebState) gerritEvent(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if *logGerritEvents {
+	if logGerritEvents.Get() {
 		ws.logger.Debug("Gerrit event received", zap.ByteString("body", body))
 	}
 
+	// the team ID comes from the unauthenticated URL, so only registered teams get their own
+	// metric labels
+	_, err = ws.governor.getTeam(teamID)
+	knownTeam := err == nil
+	teamLabel := teamID
+	if !knownTeam {
+		teamLabel = metrics.UnknownTeam
+	}
+
 	event, err := events.DecodeGerritEvent(body)
 	if err != nil {
 		ws.logger.Error("decoding payload", zap.Error(err), zap.ByteString("data", body))
+		metrics.EventDecodeFailures.WithLabelValues(teamLabel).Inc()
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 	ws.logger.Debug("received gerrit event", zap.String("origin", r.RemoteAddr), zap.String("event-type", event.GetType()))
-	ws.governor.GerritEventReceived(teamID, event)
+	if err := ws.governor.GerritEventReceived(teamID, event); err != nil {
+		// tell Gerrit to try again later
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if knownTeam {
+		ws.capture.Capture(teamID, body, time.Now())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Healthz reports that the server is up and able to handle requests.
+func (ws *uiWebState) Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether all registered teams have finished starting up.
+func (ws *uiWebState) Readyz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !ws.governor.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("teams still starting\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Status reports the condition of every registered team as JSON. It requires the configured
+// operator token.
+func (ws *uiWebState) Status(w http.ResponseWriter, r *http.Request) {
+	if !isOperatorRequest(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	responseBytes, err := json.Marshal(struct {
+		Version string       `json:"version"`
+		Teams   []TeamStatus `json:"teams"`
+	}{
+		Version: Version,
+		Teams:   ws.governor.TeamStatuses(r.Context()),
+	})
+	if err != nil {
+		ws.logger.Error("failed to marshal status", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(responseBytes)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseBytes)
+}
+
+// TeamControl carries out an operator command on a team. Requests look like
+// "POST /operator/teams/<team-id>/<command>", where the command is pause, resume, restart,
+// or remove. It requires the configured operator token.
+func (ws *uiWebState) TeamControl(w http.ResponseWriter, r *http.Request) {
+	if !isOperatorRequest(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/operator/teams/"), "/")
+	if len(pathParts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	teamID, command := pathParts[0], pathParts[1]
+
+	var err error
+	switch command {
+	case "pause":
+		err = ws.governor.PauseTeam(teamID)
+	case "resume":
+		err = ws.governor.ResumeTeam(teamID)
+	case "restart":
+		err = ws.governor.RestartTeam(teamID)
+	case "remove":
+		err = ws.governor.RemoveTeam(r.Context(), teamID)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := ws.logger.With(zap.String("team-id", teamID), zap.String("command", command))
+	if err != nil {
+		logger.Info("operator command failed", zap.Error(err))
+		if errors.Is(err, errUnknownTeam) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+		_, _ = w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	logger.Info("operator command succeeded")
 	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// isOperatorRequest determines whether the request carries the configured operator token.
+func isOperatorRequest(r *http.Request) bool {
+	if *operatorToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(*operatorToken)) == 1
 }
 
 func newUIWebHandler(logger *zap.Logger, state *uiWebState, isSecure bool) http.Handler {
 	mux := NewLoggingMux(logger)
 	mux.HandleFunc("/gerrit/", state.gerritEvent)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", state.Healthz)
+	mux.HandleFunc("/readyz", state.Readyz)
+	mux.HandleFunc("/status", state.Status)
+	mux.HandleFunc("/operator/teams/", state.TeamControl)
 	if isSecure {
 		mux.HandleFunc("/slack/", state.maybeOAuthRedirect)
 		mux.HandleFunc("/slack/setup", state.Setup)
@@ -166,11 +298,21 @@ func newUIWebServer(state *uiWebState, handler http.Handler) *uiWebServer {
 	}
 }
 
+// Serve serves HTTP requests on listener until ctx is canceled. It then stops accepting
+// connections and waits up to shutdown-timeout for in-flight requests to finish.
 func (server *uiWebServer) Serve(ctx context.Context, listener net.Listener) error {
 	server.state.logger.Info("Listening for connections", zap.String("bind-address", listener.Addr().String()))
+	httpServer := &http.Server{Handler: server.handler}
+	shutdownDone := make(chan error, 1)
 	go func() {
 		<-ctx.Done()
-		_ = listener.Close()
+		server.state.logger.Info("draining connections", zap.String("bind-address", listener.Addr().String()))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout.Get())
+		defer cancel()
+		shutdownDone <- httpServer.Shutdown(shutdownCtx)
 	}()
-	return http.Serve(listener, server.handler)
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdownDone
 }